@@ -0,0 +1,229 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLogger logs every request with the authenticated user, the action
+// performed and its target, and records mutating requests in the audit log.
+type accessLogger struct {
+	h  http.Handler
+	ws *webServer
+	// out is where the access log is written. When nil, log.Printf is used.
+	out io.Writer
+	// quiet disables the access log but not the audit log.
+	quiet bool
+}
+
+// auditEntry is a mutating action recorded in the audit log.
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	Remote string    `json:"remote"`
+	Action string    `json:"action"`
+	Target string    `json:"target,omitempty"`
+	Status int       `json:"status"`
+	// Detail is extra information, e.g. the full RCON command.
+	Detail string `json:"detail,omitempty"`
+}
+
+// actionOf returns the action and its target for the request. For example
+// POST /rpc/start/ark-island.service is action "start" on target
+// "ark-island.service".
+func actionOf(r *http.Request) (string, string) {
+	p := strings.Trim(r.URL.Path, "/")
+	parts := strings.SplitN(p, "/", 3)
+	switch {
+	case len(parts) >= 2 && parts[0] == "rpc":
+		if len(parts) == 3 {
+			return parts[1], parts[2]
+		}
+		return parts[1], ""
+	case len(parts) >= 3 && parts[0] == "api":
+		rest := strings.SplitN(parts[2], "/", 3)
+		if len(rest) == 3 {
+			// /api/v1/<kind>/<target>/<action>
+			return rest[0] + "." + rest[2], rest[1]
+		}
+		if len(rest) == 2 {
+			return rest[0], rest[1]
+		}
+		return rest[0], ""
+	}
+	return "", ""
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	length int
+}
+
+func (s *statusWriter) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusWriter) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.length += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection, e.g.
+// to extend the write deadline.
+func (s *statusWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Flush is needed for streaming responses.
+func (s *statusWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack is needed for websocket.
+func (s *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("hijack not supported")
+	}
+	s.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (a *accessLogger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	// The user is only known after authentication; requireAuth stores it in
+	// this holder.
+	holder := &userHolder{}
+	a.h.ServeHTTP(sw, r.WithContext(withUserHolder(r.Context(), holder)))
+	user := "-"
+	if holder.user != nil {
+		user = holder.user.Name
+	}
+	action, target := actionOf(r)
+	d := roundDuration(time.Since(start))
+	remote := a.ws.remoteAddr(r.RemoteAddr)
+	uri := r.RequestURI
+	// Don't leak the trigger tokens and action links in the logs.
+	if strings.HasPrefix(r.URL.Path, "/link/") {
+		uri = "/link/redacted"
+	} else if r.URL.Query().Has("token") {
+		uri = r.URL.Path + "?token=redacted"
+	}
+	line := fmt.Sprintf("%s %s %3d %6db %-4s %8s %s", remote, user, sw.status, sw.length, r.Method, d, uri)
+	if action != "" {
+		line += fmt.Sprintf(" action=%s target=%s", action, target)
+	}
+	if a.out != nil {
+		fmt.Fprintf(a.out, "%s %s\n", start.Format(time.RFC3339), line)
+	} else if !a.quiet {
+		log.Print(line)
+	}
+	if r.Method != "GET" && r.Method != "HEAD" && action != "" {
+		a.ws.audit(auditEntry{Time: start, User: user, Remote: remote, Action: action, Target: target, Status: sw.status, Detail: holder.detail})
+	}
+}
+
+// audit records an entry in the audit log and queues it for audit_syslog.
+func (s *webServer) audit(e auditEntry) {
+	if s.config().AuditSyslog != nil && s.auditQ != nil {
+		select {
+		case s.auditQ <- e:
+		default:
+			log.Printf("audit: audit_syslog is too slow, dropped %s %s", e.User, e.Action)
+		}
+	}
+	if s.db == nil {
+		return
+	}
+	if err := s.db.appendTime(bucketAudit, e.Time, e); err != nil {
+		log.Printf("audit: %v", err)
+	}
+}
+
+// roundDuration returns time rounded to 4 digits.
+func roundDuration(d time.Duration) time.Duration {
+	for m := time.Duration(1); ; m *= 10 {
+		if d < 10000*m {
+			return (d + m/2) / m * m
+		}
+	}
+}
+
+// rotatingFile is an io.Writer appending to a file that is rotated when it
+// grows over maxSize, keeping keep old files as path.1, path.2, etc.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, keep int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, keep: keep}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = fi.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxSize > 0 && r.size+int64(len(b)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	for i := r.keep - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if r.keep > 0 {
+		_ = os.Rename(r.path, r.path+".1")
+	} else {
+		_ = os.Remove(r.path)
+	}
+	return r.open()
+}
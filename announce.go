@@ -0,0 +1,339 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	textTemplate "text/template"
+	"time"
+)
+
+// announcement is a recurring in-game broadcast composed in the web UI.
+type announcement struct {
+	Name string `json:"name"`
+	// Message is a text/template executed with announceData, e.g.
+	// "Restart in {{until .NextRestart}}".
+	Message string `json:"message"`
+	// Every is the interval between the broadcasts, e.g. "2h"; unused when At
+	// is set.
+	Every string `json:"every,omitempty"`
+	// At is the time of a daily broadcast in the configured time zone, as
+	// "HH:MM".
+	At string `json:"at,omitempty"`
+	// Days are the weekdays, e.g. "Sat", the announcement is sent. Every day
+	// when empty.
+	Days []string `json:"days,omitempty"`
+	// Servers are the servers receiving it, all the running ones when empty.
+	Servers []string `json:"servers,omitempty"`
+	// Event is the .Event variable, e.g. "Double XP weekend".
+	Event   string    `json:"event,omitempty"`
+	Enabled bool      `json:"enabled"`
+	Author  string    `json:"author,omitempty"`
+	Last    time.Time `json:"last,omitempty"`
+}
+
+// announceMinEvery bounds how often an announcement may spam the chat.
+const announceMinEvery = 5 * time.Minute
+
+var weekdays = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+// announceData are the variables of the announcements.
+type announceData struct {
+	// Server is the session name.
+	Server string
+	Map    string
+	Event  string
+	// NextRestart is when the server goes down for its next restart, zero
+	// when none is planned.
+	NextRestart time.Time
+	// DaysSinceWipe is 0 when the server's last_wipe isn't set.
+	DaysSinceWipe int
+	Players       int
+	Now           time.Time
+}
+
+var announceFuncs = textTemplate.FuncMap{
+	// until returns the time left before t, e.g. "2h15m".
+	"until": func(t time.Time) string {
+		if t.IsZero() {
+			return "unknown"
+		}
+		d := time.Until(t).Round(time.Minute)
+		return strings.TrimSuffix(max(d, 0).String(), "0s")
+	},
+}
+
+// validate checks the announcement and returns its parsed message.
+func (a *announcement) validate(c *config) (*textTemplate.Template, error) {
+	if !reServerName.MatchString(a.Name) {
+		return nil, errors.New("name: use lowercase letters, digits, - and _")
+	}
+	t, err := textTemplate.New("").Funcs(announceFuncs).Option("missingkey=error").Parse(a.Message)
+	if err != nil {
+		return nil, fmt.Errorf("message: %w", err)
+	}
+	if strings.TrimSpace(a.Message) == "" {
+		return nil, errors.New("message is required")
+	}
+	if a.At != "" {
+		if err := validClock(a.At); err != nil {
+			return nil, fmt.Errorf("at: %w", err)
+		}
+	} else if d, err := time.ParseDuration(a.Every); err != nil || d < announceMinEvery {
+		return nil, fmt.Errorf("every: expected a duration of at least %s, e.g. 2h, or a daily time", announceMinEvery)
+	}
+	for _, d := range a.Days {
+		if !slices.Contains(weekdays, d) {
+			return nil, fmt.Errorf("days: unknown day %q", d)
+		}
+	}
+	if _, err := c.selectServers(a.Servers); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// due returns true if the announcement must be sent at now, in the
+// configured time zone. The loop runs every minute.
+func (a *announcement) due(now time.Time) bool {
+	if !a.Enabled || (len(a.Days) != 0 && !slices.Contains(a.Days, weekdays[now.Weekday()])) {
+		return false
+	}
+	if a.At != "" {
+		// Like the rolling restarts, a time skipped by DST is sent right
+		// after and a repeated one only once.
+		return now.Format("15:04") >= a.At && a.Last.In(now.Location()).Format("2006-01-02") != now.Format("2006-01-02")
+	}
+	d, err := time.ParseDuration(a.Every)
+	return err == nil && now.Sub(a.Last) >= d-30*time.Second
+}
+
+// announcements returns the announcements sorted by name.
+func (s *store) announcements() ([]announcement, error) {
+	out := []announcement{}
+	err := s.scanPrefix(bucketAnnouncements, nil, func(k, v []byte) {
+		a := announcement{}
+		if json.Unmarshal(v, &a) == nil {
+			out = append(out, a)
+		}
+	})
+	return out, err
+}
+
+// announceVars returns the variables of the announcement for the server.
+func (s *webServer) announceVars(ctx context.Context, a *announcement, v *serverConfig) announceData {
+	c := s.config()
+	d := announceData{Server: v.SessionName, Map: c.mapInfo(v.Map).Name, Event: a.Event, Now: time.Now().In(c.location())}
+	if d.Server == "" {
+		d.Server = v.Name
+	}
+	if t, err := time.ParseInLocation("2006-01-02", v.LastWipe, c.location()); err == nil {
+		d.DaysSinceWipe = int(time.Since(t) / (24 * time.Hour))
+	}
+	if p, ok := s.nextRestarts(ctx)[v.unitName()]; ok {
+		d.NextRestart = p.At
+	}
+	s.mu.Lock()
+	for _, u := range s.lastStates {
+		if u.Name == v.unitName() && u.HasPlayers {
+			d.Players = len(u.Players)
+		}
+	}
+	s.mu.Unlock()
+	return d
+}
+
+// announceTargets returns the running servers receiving the announcement.
+func (s *webServer) announceTargets(a *announcement) []*serverConfig {
+	c := s.config()
+	l, err := c.selectServers(a.Servers)
+	if err != nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []*serverConfig
+	for _, v := range l {
+		for _, u := range s.lastStates {
+			if u.Name == v.unitName() && u.Running && v.gameInfo().RCON {
+				out = append(out, v)
+			}
+		}
+	}
+	return out
+}
+
+// sendAnnouncement broadcasts the announcement on its running servers.
+func (s *webServer) sendAnnouncement(ctx context.Context, a *announcement) error {
+	t, err := a.validate(s.config())
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, v := range s.announceTargets(a) {
+		b := strings.Builder{}
+		if err := t.Execute(&b, s.announceVars(ctx, a, v)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", v.Name, err))
+			continue
+		}
+		p, err := s.rconPoller(s.config(), v)
+		if err == nil {
+			_, err = p.Execute(ctx, "Broadcast "+b.String())
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", v.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// announce sends the due announcements every minute.
+func (s *webServer) announce(ctx context.Context) {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		l, err := s.db.announcements()
+		if err != nil {
+			log.Printf("announce: %v", err)
+			continue
+		}
+		now := time.Now().In(s.config().location())
+		for i := range l {
+			a := &l[i]
+			if !a.due(now) {
+				continue
+			}
+			a.Last = now
+			if err := s.db.put(bucketAnnouncements, []byte(a.Name), a); err != nil {
+				log.Printf("announce: %s: %v", a.Name, err)
+				continue
+			}
+			ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			if err := s.sendAnnouncement(ctx, a); err != nil {
+				log.Printf("announce: %s: %v", a.Name, err)
+			}
+			cancel()
+		}
+	}
+}
+
+var announcementsTmpl = template.Must(template.New("announcements.html.tmpl").Funcs(template.FuncMap{"has": slices.Contains[[]string]}).ParseFS(rsc, "rsc/announcements.html.tmpl"))
+
+// announcementRow is an announcement on the announcements page.
+type announcementRow struct {
+	announcement
+	// Preview is the message rendered for the first target server.
+	Preview string
+}
+
+// serveAnnouncements lists the announcements at /announcements/. The changes
+// are POSTed to /rpc/announcements to be recorded in the audit log.
+func (s *webServer) serveAnnouncements(w http.ResponseWriter, r *http.Request) {
+	c := s.config()
+	w.Header().Add("Content-Type", "text/html")
+	data := map[string]any{"Servers": c.Servers, "Weekdays": weekdays}
+	if r.Method == "POST" && r.URL.Path == "/rpc/announcements" {
+		a, res, err := s.editAnnouncement(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			data["Err"] = err.Error()
+		}
+		// Keep the form filled on errors and previews.
+		data["Form"] = a
+		data["Result"] = res
+	}
+	l, err := s.db.announcements()
+	if err != nil {
+		data["Err"] = err.Error()
+	}
+	loc := c.displayLocation(userFrom(r.Context()))
+	rows := make([]announcementRow, 0, len(l))
+	for i := range l {
+		l[i].Last = l[i].Last.In(loc)
+		rows = append(rows, announcementRow{announcement: l[i], Preview: s.preview(r.Context(), &l[i])})
+	}
+	data["Announcements"] = rows
+	_ = announcementsTmpl.Execute(w, data)
+}
+
+// preview renders the announcement for its first server.
+func (s *webServer) preview(ctx context.Context, a *announcement) string {
+	c := s.config()
+	t, err := a.validate(c)
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	l, _ := c.selectServers(a.Servers)
+	if len(l) == 0 {
+		return ""
+	}
+	b := strings.Builder{}
+	if err := t.Execute(&b, s.announceVars(ctx, a, l[0])); err != nil {
+		return "error: " + err.Error()
+	}
+	return l[0].Name + ": " + b.String()
+}
+
+// editAnnouncement saves, previews, sends or removes an announcement. Only
+// admins can.
+func (s *webServer) editAnnouncement(r *http.Request) (*announcement, string, error) {
+	u := userFrom(r.Context())
+	if err := r.ParseForm(); err != nil {
+		return nil, "", err
+	}
+	a := &announcement{
+		Name:    strings.TrimSpace(r.FormValue("name")),
+		Message: strings.TrimSpace(r.FormValue("message")),
+		Every:   strings.TrimSpace(r.FormValue("every")),
+		At:      strings.TrimSpace(r.FormValue("at")),
+		Days:    r.Form["days"],
+		Servers: r.Form["servers"],
+		Event:   strings.TrimSpace(r.FormValue("event")),
+		Enabled: r.FormValue("enabled") != "",
+		Author:  u.Name,
+	}
+	op := r.FormValue("op")
+	setAuditDetail(r.Context(), op+" "+a.Name)
+	if op == "preview" {
+		return a, s.preview(r.Context(), a), nil
+	}
+	if !u.hasRole(roleAdmin) {
+		return a, "", errors.New("only admins can edit the announcements")
+	}
+	switch op {
+	case "remove":
+		return nil, "", s.db.del(bucketAnnouncements, []byte(a.Name))
+	case "send":
+		var cur announcement
+		if ok, err := s.db.get(bucketAnnouncements, []byte(a.Name), &cur); err != nil || !ok {
+			return nil, "", fmt.Errorf("unknown announcement %q", a.Name)
+		}
+		if err := s.sendAnnouncement(r.Context(), &cur); err != nil {
+			return nil, "", err
+		}
+		return nil, "sent " + cur.Name, nil
+	}
+	if _, err := a.validate(s.config()); err != nil {
+		return a, "", err
+	}
+	var old announcement
+	if ok, _ := s.db.get(bucketAnnouncements, []byte(a.Name), &old); ok {
+		a.Last = old.Last
+	}
+	return nil, "saved " + a.Name, s.db.put(bucketAnnouncements, []byte(a.Name), a)
+}
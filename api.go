@@ -0,0 +1,234 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// apiServer is the JSON representation of a server. Keep in sync with
+// client.Server.
+type apiServer struct {
+	Name        string      `json:"name"`
+	Unit        string      `json:"unit"`
+	Map         string      `json:"map,omitempty"`
+	ActiveState string      `json:"active_state"`
+	Running     bool        `json:"running"`
+	CPU         float64     `json:"cpu_s"`
+	Memory      float64     `json:"memory_mib"`
+	Connect     connectInfo `json:"connect"`
+	Listing     string      `json:"listing,omitempty"`
+	Players     []player    `json:"players,omitempty"`
+	Lock        string      `json:"lock,omitempty"`
+}
+
+// apiActionResult is the result of an action on a server.
+type apiActionResult struct {
+	Result string `json:"result"`
+}
+
+func replyJSON(w http.ResponseWriter, v any) {
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("json: %v", err)
+	}
+}
+
+func newAPIServer(v *unitStatus) apiServer {
+	return apiServer{
+		Name:        v.DisplayName,
+		Unit:        v.Name,
+		Map:         v.Map.Name,
+		ActiveState: v.ActiveState,
+		Running:     v.Running,
+		CPU:         v.CPU,
+		Memory:      v.Memory,
+		Connect:     v.Connect,
+		Listing:     v.Listing,
+		Players:     v.Players,
+		Lock:        v.Lock,
+	}
+}
+
+// apiRoutes returns the API route table.
+func (s *webServer) apiRoutes() *apiRouter {
+	unit := apiParam{Name: "unit", In: "path", Type: "string", Desc: "systemd unit, e.g. ark-island.service"}
+	a := &apiRouter{}
+	a.routes = []apiRoute{
+		{
+			Method:  "GET",
+			Path:    "/ping",
+			Summary: "Measures the latency to ark-serman",
+			Handler: func(w http.ResponseWriter, r *http.Request, _ map[string]string) { servePing(w, r) },
+		},
+		{
+			Method:   "GET",
+			Path:     "/servers",
+			Summary:  "Lists the servers",
+			Response: []apiServer{},
+			Handler:  s.apiServers,
+		},
+		{
+			Method:   "GET",
+			Path:     "/servers/{unit}",
+			Summary:  "Returns one server",
+			Params:   []apiParam{unit},
+			Response: apiServer{},
+			Handler:  s.apiServer,
+		},
+		{
+			Method:  "POST",
+			Path:    "/servers/{unit}/{action}",
+			Summary: "Runs an action on a server",
+			Params: []apiParam{
+				unit,
+				{Name: "action", In: "path", Type: "string", Enum: []string{"start", "stop", "restart", "backup"}},
+			},
+			Response: apiActionResult{},
+			Handler:  s.apiServerAction,
+		},
+		{
+			Method:   "GET",
+			Path:     "/events",
+			Summary:  "Lists the recent events, newest first",
+			Params:   []apiParam{{Name: "unit", In: "query", Type: "string", Desc: "only the events of this unit"}},
+			Response: []event{},
+			Handler: func(w http.ResponseWriter, r *http.Request, p map[string]string) {
+				l := events.list(p["unit"], userFrom(r.Context()).hasRole(roleAdmin))
+				if l == nil {
+					l = []event{}
+				}
+				replyJSON(w, l)
+			},
+		},
+		{
+			Method:   "GET",
+			Path:     "/countdown",
+			Summary:  "Lists the time left before the next restart of each server",
+			Response: []restartCountdown{},
+			Handler:  s.apiCountdown,
+		},
+		{
+			Method:  "GET",
+			Path:    "/blueprints",
+			Summary: "Searches the item and creature blueprints",
+			Params: []apiParam{
+				{Name: "q", In: "query", Type: "string", Desc: "substring of the name or path"},
+				{Name: "kind", In: "query", Type: "string", Enum: []string{"item", "dino"}},
+			},
+			Response: []blueprint{},
+			Handler: func(w http.ResponseWriter, r *http.Request, p map[string]string) {
+				replyJSON(w, s.config().searchBlueprints(p["q"], p["kind"]))
+			},
+		},
+		{
+			Method:   "GET",
+			Path:     "/bookmarks",
+			Summary:  "Exports the map bookmarks",
+			Params:   []apiParam{{Name: "map", In: "query", Type: "string", Desc: "only the bookmarks of this map ID, e.g. TheIsland"}},
+			Response: []bookmark{},
+			Handler: func(w http.ResponseWriter, r *http.Request, p map[string]string) {
+				l, err := s.db.bookmarks(p["map"])
+				if err != nil {
+					replyError(w, err.Error())
+					return
+				}
+				replyJSON(w, l)
+			},
+		},
+		{
+			Method:   "GET",
+			Path:     "/watchlist",
+			Summary:  "Lists the flagged players",
+			Response: []watchEntry{},
+			Handler: func(w http.ResponseWriter, r *http.Request, p map[string]string) {
+				l, err := s.db.watchlist()
+				if err != nil {
+					replyError(w, err.Error())
+					return
+				}
+				replyJSON(w, l)
+			},
+		},
+		{
+			Method:  "POST",
+			Path:    "/triggers/{name}",
+			Summary: "Runs a predefined action; authenticated by the trigger's token instead of a user",
+			Params: []apiParam{
+				{Name: "name", In: "path", Type: "string"},
+				{Name: "token", In: "query", Type: "string", Desc: "token, when it can't be sent as Authorization: Bearer"},
+			},
+			Response: apiActionResult{},
+			Handler:  s.apiTrigger,
+		},
+		{
+			Method:  "GET",
+			Path:    "/attach",
+			Summary: "Opens the websocket of the CLI's -attach; the JSON messages run the status and rcon requests",
+			Handler: s.apiAttach,
+		},
+		{
+			Method:   "GET",
+			Path:     "/openapi.json",
+			Summary:  "Returns this document",
+			Response: map[string]any{},
+			Handler: func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+				replyJSON(w, a.openAPI())
+			},
+		},
+	}
+	return a
+}
+
+// apiServers serves GET /api/v1/servers.
+func (s *webServer) apiServers(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	u, err := s.states(r.Context())
+	if err != nil {
+		replyError(w, err.Error())
+		return
+	}
+	out := make([]apiServer, 0, len(u))
+	for i := range u {
+		out = append(out, newAPIServer(&u[i]))
+	}
+	replyJSON(w, out)
+}
+
+// apiServer serves GET /api/v1/servers/{unit}.
+func (s *webServer) apiServer(w http.ResponseWriter, r *http.Request, p map[string]string) {
+	u, err := s.states(r.Context())
+	if err != nil {
+		replyError(w, err.Error())
+		return
+	}
+	for i := range u {
+		if u[i].Name == p["unit"] {
+			replyJSON(w, newAPIServer(&u[i]))
+			return
+		}
+	}
+	http.Error(w, "unknown server", http.StatusNotFound)
+}
+
+// apiServerAction serves POST /api/v1/servers/{unit}/{action}.
+func (s *webServer) apiServerAction(w http.ResponseWriter, r *http.Request, p map[string]string) {
+	if !isServerUnit(p["unit"]) {
+		http.Error(w, "unknown server", http.StatusNotFound)
+		return
+	}
+	extendWriteDeadline(w, bulkTimeout+10*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), bulkTimeout)
+	defer cancel()
+	res, err := s.doAction(ctx, p["action"], p["unit"])
+	if err != nil {
+		replyActionError(w, err)
+		return
+	}
+	replyJSON(w, apiActionResult{Result: res})
+}
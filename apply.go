@@ -0,0 +1,595 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/maruel/subcommands"
+
+	"github.com/maruel/ark-serman/internal/systemdctl"
+)
+
+// iniSetting is a value ark-serman maintains in one of the server INI files,
+// which are shared by all the servers of the installation.
+type iniSetting struct {
+	// File is "GameUserSettings.ini" or "Game.ini".
+	File    string `json:"file"`
+	Section string `json:"section"`
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+}
+
+// change is a difference between the configuration and the host, and how to
+// reconcile it.
+type change struct {
+	// Kind is "server", "unit", "ini", "setting" or "mod".
+	Kind string `json:"kind"`
+	// Op is "install", "create" or "update".
+	Op string `json:"op"`
+	// Target is the unit name, the INI file name, "<file> [<section>] <key>"
+	// or the mod ID.
+	Target string `json:"target"`
+	// From is the state observed on the host when planning; empty when
+	// missing.
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	// Setting is set for "setting" changes.
+	Setting *iniSetting `json:"setting,omitempty"`
+	// Game is the game installed by "server" changes; Ark when empty.
+	Game string `json:"game,omitempty"`
+}
+
+func (c *change) String() string {
+	switch {
+	case c.Kind == "setting" && c.Op == "update":
+		return fmt.Sprintf("change %s from %q to %q", c.Target, c.From, c.To)
+	case c.Kind == "setting":
+		return fmt.Sprintf("set %s to %q", c.Target, c.To)
+	default:
+		return c.Op + " " + c.Kind + " " + c.Target
+	}
+}
+
+// steamcmd runs steamcmd on the Ark installation directory.
+func steamcmd(ctx context.Context, c *config, args ...string) error {
+	return steamcmdIn(ctx, c, c.installDir(), args...)
+}
+
+// installGame installs or updates the game's dedicated server, on the
+// configured branch if any.
+func installGame(ctx context.Context, c *config, g *game) error {
+	b, err := c.branchArgs()
+	if err != nil {
+		return err
+	}
+	return steamcmdIn(ctx, c, c.gameDir(g), append(append([]string{"+app_update", g.AppID}, b...), "validate")...)
+}
+
+// planChanges returns what must change on the host to match the
+// configuration: the dedicated server installations, the systemd units, the
+// Game.ini snippets, the INI settings and the mods.
+func planChanges(c *config) ([]change, error) {
+	var out []change
+	l := c.usedGames()
+	if len(l) == 0 {
+		l = games[:1]
+	}
+	for _, g := range l {
+		if _, err := os.Stat(filepath.Join(c.gameDir(g), g.Binary)); errors.Is(err, fs.ErrNotExist) {
+			ch := change{Kind: "server", Op: "install", Target: c.gameDir(g)}
+			if g.ID != "ark" {
+				ch.Game = g.ID
+			}
+			out = append(out, ch)
+		}
+	}
+	d, err := userUnitDir()
+	if err != nil {
+		return nil, err
+	}
+	for i := range c.Servers {
+		s := &c.Servers[i]
+		b, err := generateUnit(c, s)
+		if err != nil {
+			return nil, err
+		}
+		old, err := os.ReadFile(filepath.Join(d, s.unitName()))
+		if errors.Is(err, fs.ErrNotExist) {
+			out = append(out, change{Kind: "unit", Op: "create", Target: s.unitName(), To: string(b)})
+		} else if err != nil {
+			return nil, err
+		} else if !bytes.Equal(old, b) {
+			out = append(out, change{Kind: "unit", Op: "update", Target: s.unitName(), From: string(old), To: string(b)})
+		}
+		p := s.resourcesDropIn()
+		b = generateResources(s)
+		old, err = os.ReadFile(filepath.Join(d, p))
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			if b != nil {
+				out = append(out, change{Kind: "unit", Op: "create", Target: p, To: string(b)})
+			}
+		case err != nil:
+			return nil, err
+		case b == nil:
+			out = append(out, change{Kind: "unit", Op: "delete", Target: p, From: string(old)})
+		case !bytes.Equal(old, b):
+			out = append(out, change{Kind: "unit", Op: "update", Target: p, From: string(old), To: string(b)})
+		}
+	}
+	// Composed before the settings are applied on top.
+	ch, err := planSnippets(c)
+	if err != nil {
+		return nil, err
+	}
+	if ch != nil {
+		out = append(out, *ch)
+	}
+	for _, v := range c.Settings {
+		cur, err := iniValue(filepath.Join(configDir(c), v.File), v.Section, v.Key)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if cur == v.Value {
+			continue
+		}
+		v := v
+		ch := change{Kind: "setting", Op: "update", Target: v.File + " [" + v.Section + "] " + v.Key, From: cur, To: v.Value, Setting: &v}
+		if cur == "" {
+			ch.Op = "create"
+		}
+		out = append(out, ch)
+	}
+	for _, m := range c.modIDs() {
+		if _, err := os.Stat(modDir(c, m)); errors.Is(err, fs.ErrNotExist) {
+			out = append(out, change{Kind: "mod", Op: "install", Target: m})
+		}
+	}
+	return out, nil
+}
+
+func modDir(c *config, id string) string {
+	return filepath.Join(c.installDir(), "ShooterGame", "Content", "Mods", id)
+}
+
+// observe returns the current state of the change's target on the host, to
+// compare with From.
+func observe(c *config, ch *change) (string, error) {
+	p := ""
+	switch ch.Kind {
+	case "server", "mod":
+		if ch.Kind == "mod" {
+			p = modDir(c, ch.Target)
+		} else if g := gameByID(ch.Game); g != nil {
+			p = filepath.Join(c.gameDir(g), g.Binary)
+		} else {
+			return "", fmt.Errorf("unknown game %q", ch.Game)
+		}
+		if _, err := os.Stat(p); err == nil {
+			return "installed", nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		return "", nil
+	case "unit":
+		d, err := userUnitDir()
+		if err != nil {
+			return "", err
+		}
+		b, err := os.ReadFile(filepath.Join(d, ch.Target))
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		}
+		return string(b), err
+	case "ini":
+		b, err := os.ReadFile(filepath.Join(configDir(c), ch.Target))
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		}
+		return string(b), err
+	case "setting":
+		if ch.Setting == nil {
+			return "", errors.New("missing setting")
+		}
+		v, err := iniValue(filepath.Join(configDir(c), ch.Setting.File), ch.Setting.Section, ch.Setting.Key)
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		}
+		return v, err
+	}
+	return "", fmt.Errorf("unknown change %s", ch.Kind)
+}
+
+// plan is a reviewed list of changes, applied exactly as planned.
+type plan struct {
+	Created time.Time `json:"created"`
+	Changes []change  `json:"changes"`
+}
+
+func newPlan(c *config) (*plan, error) {
+	l, err := planChanges(c)
+	if err != nil {
+		return nil, err
+	}
+	return &plan{Created: time.Now().UTC().Truncate(time.Second), Changes: l}, nil
+}
+
+// digest identifies the changes, so the plan applied is the one reviewed.
+func (p *plan) digest() string {
+	b, _ := json.Marshal(p.Changes)
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:8])
+}
+
+// print writes the changes for review. The passwords are redacted.
+func (p *plan) print(w io.Writer, c *config) {
+	for _, ch := range p.Changes {
+		fmt.Fprintln(w, ch.String())
+		if (ch.Kind == "unit" || ch.Kind == "ini") && ch.Op == "update" {
+			for _, l := range unitDiff(redact(ch.From), redact(ch.To)) {
+				fmt.Fprintln(w, "    "+l)
+			}
+		}
+	}
+}
+
+// passwordArg matches the passwords in the server command line.
+var passwordArg = regexp.MustCompile(`(Password=)[^?\s]*`)
+
+// redact hides the passwords in a unit file.
+func redact(s string) string {
+	return passwordArg.ReplaceAllString(s, "${1}<redacted>")
+}
+
+// apply checks that the host didn't change since planning and applies the
+// changes, then reloads systemd if units changed.
+func (p *plan) apply(ctx context.Context, c *config, logf func(string, ...any)) error {
+	all, _ := c.selectServers(nil)
+	release, err := lockServers(ctx, c, "apply", all...)
+	if err != nil {
+		return err
+	}
+	defer release()
+	for i := range p.Changes {
+		ch := &p.Changes[i]
+		cur, err := observe(c, ch)
+		if err != nil {
+			return fmt.Errorf("%s: %w", ch, err)
+		}
+		if cur != ch.From {
+			return fmt.Errorf("the plan is stale, %s changed since; plan again", ch.Target)
+		}
+	}
+	for i := range p.Changes {
+		if p.Changes[i].Kind == "mod" {
+			if err := checkUpdate(ctx, c, logf); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	units := false
+	for i := range p.Changes {
+		ch := &p.Changes[i]
+		if err := applyChange(ctx, c, ch); err != nil {
+			return fmt.Errorf("%s: %w", ch, err)
+		}
+		logf("Done: %s", ch)
+		units = units || ch.Kind == "unit"
+	}
+	if !units {
+		return nil
+	}
+	conn, err := systemdctl.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.ReloadContext(ctx)
+}
+
+// applyChange makes the change on the host.
+func applyChange(ctx context.Context, c *config, ch *change) error {
+	switch ch.Kind {
+	case "server":
+		g := gameByID(ch.Game)
+		if g == nil {
+			return fmt.Errorf("unknown game %q", ch.Game)
+		}
+		return installGame(ctx, c, g)
+	case "unit":
+		d, err := userUnitDir()
+		if err != nil {
+			return err
+		}
+		p := filepath.Join(d, ch.Target)
+		if ch.Op == "delete" {
+			return os.Remove(p)
+		}
+		// The drop-ins are in a sub-directory.
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			return err
+		}
+		// Contains the admin password.
+		return os.WriteFile(p, []byte(ch.To), 0o600)
+	case "ini":
+		return writeIni(filepath.Join(configDir(c), ch.Target), strings.Split(strings.TrimRight(ch.To, "\n"), "\n"))
+	case "setting":
+		v := ch.Setting
+		return setIniValue(filepath.Join(configDir(c), v.File), v.Section, v.Key, v.Value)
+	case "mod":
+		if c.ModCache {
+			return downloadMods(ctx, c, ch.Target)
+		}
+		// The server extracts the downloaded mods at startup with
+		// -automanagedmods.
+		return steamcmd(ctx, c, "+workshop_download_item", "346110", ch.Target)
+	}
+	return fmt.Errorf("unknown change %s", ch.Kind)
+}
+
+// setIniValue sets key in the section of the INI file, keeping the rest of
+// the file as is. The file and the section are created as needed.
+func setIniValue(p, section, key, value string) error {
+	b, err := os.ReadFile(p)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	lines := strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+	if len(b) == 0 {
+		lines = nil
+	}
+	cur, end := "", -1
+	for i, l := range lines {
+		t := strings.TrimSpace(l)
+		if strings.HasPrefix(t, "[") && strings.HasSuffix(t, "]") {
+			cur = t[1 : len(t)-1]
+			continue
+		}
+		if cur != section {
+			continue
+		}
+		if k, _, ok := strings.Cut(t, "="); ok && strings.EqualFold(k, key) {
+			lines[i] = key + "=" + value
+			return writeIni(p, lines)
+		}
+		if t != "" {
+			end = i
+		}
+	}
+	if end < 0 {
+		for i, l := range lines {
+			if strings.TrimSpace(l) == "["+section+"]" {
+				end = i
+			}
+		}
+	}
+	if end < 0 {
+		if len(lines) != 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, "["+section+"]", key+"="+value)
+	} else {
+		lines = append(lines[:end+1], append([]string{key + "=" + value}, lines[end+1:]...)...)
+	}
+	return writeIni(p, lines)
+}
+
+func writeIni(p string, lines []string) error {
+	content := strings.Join(lines, "\n") + "\n"
+	if err := validateIni(filepath.Base(p), content); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(p, []byte(content), 0o644)
+}
+
+// unitDiff returns the lines removed and added between two unit files.
+func unitDiff(from, to string) []string {
+	a := strings.Split(from, "\n")
+	b := strings.Split(to, "\n")
+	in := func(l []string, s string) bool {
+		for _, v := range l {
+			if v == s {
+				return true
+			}
+		}
+		return false
+	}
+	var out []string
+	for _, l := range a {
+		if !in(b, l) {
+			out = append(out, "- "+l)
+		}
+	}
+	for _, l := range b {
+		if !in(a, l) {
+			out = append(out, "+ "+l)
+		}
+	}
+	return out
+}
+
+var planTmpl = template.Must(template.ParseFS(rsc, "rsc/plan.html.tmpl"))
+
+// servePlan serves the review screen of the changes apply would make at
+// /plan/. Only admins can see it since the units contain the RCON port.
+func (s *webServer) servePlan(w http.ResponseWriter, r *http.Request) {
+	if !userFrom(r.Context()).hasRole(roleAdmin) {
+		http.Error(w, "only admins can review the changes", http.StatusForbidden)
+		return
+	}
+	c := s.config()
+	data := map[string]any{"Applying": s.applying.Load()}
+	p, err := newPlan(c)
+	if err != nil {
+		data["Err"] = err.Error()
+	} else {
+		type item struct {
+			Change string
+			Diff   []string
+		}
+		var items []item
+		for _, ch := range p.Changes {
+			it := item{Change: ch.String()}
+			if ch.Kind == "unit" || ch.Kind == "ini" {
+				it.Diff = unitDiff(redact(ch.From), redact(ch.To))
+			}
+			items = append(items, it)
+		}
+		data["Changes"] = items
+		data["Digest"] = p.digest()
+	}
+	w.Header().Add("Content-Type", "text/html")
+	_ = planTmpl.Execute(w, data)
+}
+
+// rpcApply applies the plan reviewed at /plan/. The plan is computed again
+// and rejected if it doesn't match the digest of the reviewed one.
+func (s *webServer) rpcApply(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if !userFrom(r.Context()).hasRole(roleAdmin) {
+		http.Error(w, "only admins can apply changes", http.StatusForbidden)
+		return
+	}
+	digest := r.FormValue("digest")
+	setAuditDetail(r.Context(), "plan "+digest)
+	c := s.config()
+	p, err := newPlan(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if p.digest() != digest {
+		http.Error(w, "the changes differ from the ones reviewed, review again", http.StatusConflict)
+		return
+	}
+	for i := range c.Servers {
+		if h := serverLock(c, &c.Servers[i]); h != nil {
+			replyActionError(w, &busyError{Server: c.Servers[i].Name, Holder: h})
+			return
+		}
+	}
+	if !s.applying.CompareAndSwap(false, true) {
+		http.Error(w, "already applying changes", http.StatusConflict)
+		return
+	}
+	ctx := withLockOwner(s.ctx, userFrom(r.Context()).Name, false)
+	go func() {
+		defer s.applying.Store(false)
+		if err := p.apply(ctx, c, log.Printf); err != nil {
+			log.Printf("apply: %v", err)
+		}
+	}()
+	http.Redirect(w, r, "/plan/", http.StatusFound)
+}
+
+var cmdApply = &subcommands.Command{
+	UsageLine: "apply <options>",
+	ShortDesc: "Reconciles the host with the configuration file",
+	LongDesc:  "Reconciles the host with the configuration file: installs the dedicated server if missing, creates or corrects the systemd units, sets the INI settings listed in `settings` and downloads the missing mods.\n\nThe plan of changes is listed first and applied after confirmation. Save it for review with `-n -o plan.json` and apply exactly that plan later with `-plan plan.json`; it is rejected if the host changed in the meantime. Running servers must be restarted to use their new unit.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &applyRun{}
+		c.args.flags()
+		c.Flags.BoolVar(&c.dryRun, "n", false, "only list the changes")
+		c.Flags.BoolVar(&c.yes, "y", false, "don't ask for confirmation")
+		c.Flags.StringVar(&c.out, "o", "", "save the plan as JSON to this file")
+		c.Flags.StringVar(&c.planPath, "plan", "", "apply the plan saved with -o instead of planning")
+		c.Flags.BoolVar(&c.wait, "wait", false, "wait for the servers busy with another operation instead of failing")
+		return c
+	},
+}
+
+type applyRun struct {
+	args
+	dryRun   bool
+	yes      bool
+	out      string
+	planPath string
+	wait     bool
+}
+
+func (r *applyRun) Run(a subcommands.Application, args []string, env subcommands.Env) int {
+	if len(args) != 0 {
+		fmt.Fprintf(os.Stderr, "%s: Unsupported arguments.\n", a.GetName())
+		return 1
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	c, err := loadConfig(r.configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	defer c.startTracing()()
+	p := &plan{}
+	if r.planPath != "" {
+		var b []byte
+		if b, err = os.ReadFile(r.planPath); err == nil {
+			err = json.Unmarshal(b, p)
+		}
+	} else {
+		p, err = newPlan(c)
+	}
+	if err == nil && r.out != "" {
+		var b []byte
+		if b, err = json.MarshalIndent(p, "", "  "); err == nil {
+			// Contains the units, thus the admin password.
+			err = os.WriteFile(r.out, append(b, '\n'), 0o600)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	if len(p.Changes) == 0 {
+		fmt.Println("Up to date.")
+		return 0
+	}
+	p.print(os.Stdout, c)
+	if r.dryRun {
+		return 0
+	}
+	if !r.yes {
+		fmt.Print("Apply these changes? [y/N] ")
+		l, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(strings.ToLower(l)) != "y" {
+			return 1
+		}
+	}
+	logf := log.Printf
+	if r.quiet {
+		logf = func(string, ...any) {}
+	}
+	if err := p.apply(withCLIOwner(ctx, r.wait), c, logf); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
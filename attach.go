@@ -0,0 +1,294 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/gorcon/rcon"
+	"github.com/maruel/subcommands"
+
+	"github.com/maruel/ark-serman/internal/websocket"
+)
+
+// The CLI attaches to a running `ark-serman web` with -attach: the commands
+// are sent over a websocket at /api/v1/attach instead of opening their own
+// D-Bus and RCON connections, so an unprivileged user, or a remote admin, goes
+// through the daemon's authentication, RCON policy and audit log.
+
+// attachIdle closes an attached connection without requests.
+const attachIdle = 10 * time.Minute
+
+// attachRequest is a request of an attached CLI.
+type attachRequest struct {
+	ID int `json:"id"`
+	// Op is "status" or "rcon".
+	Op string `json:"op"`
+	// Server is the server's name or unit, for rcon.
+	Server string `json:"server,omitempty"`
+	Cmd    string `json:"cmd,omitempty"`
+}
+
+// attachResponse is the reply to the attachRequest of the same ID.
+type attachResponse struct {
+	ID      int         `json:"id"`
+	Servers []apiServer `json:"servers,omitempty"`
+	Resp    string      `json:"resp,omitempty"`
+	Err     string      `json:"err,omitempty"`
+}
+
+// apiAttach serves the websocket of `ark-serman rcon` and `status` with
+// -attach at GET /api/v1/attach.
+func (s *webServer) apiAttach(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	u := userFrom(r.Context())
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	log.Printf("attach: %s attached from %s", u.Name, s.remoteAddr(r.RemoteAddr))
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(attachIdle))
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var req attachRequest
+		resp := attachResponse{}
+		if err := json.Unmarshal(msg, &req); err != nil {
+			resp.Err = err.Error()
+		} else {
+			resp = s.attachDo(r, u, &req)
+		}
+		b, _ := json.Marshal(resp)
+		if conn.WriteMessage(websocket.Text, b) != nil {
+			return
+		}
+	}
+}
+
+// attachDo runs an attached CLI's request with the same checks as the web
+// console.
+func (s *webServer) attachDo(r *http.Request, u *userConfig, req *attachRequest) attachResponse {
+	out := attachResponse{ID: req.ID}
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+	switch req.Op {
+	case "status":
+		l, err := s.states(ctx)
+		if err != nil {
+			out.Err = err.Error()
+			break
+		}
+		for i := range l {
+			out.Servers = append(out.Servers, newAPIServer(&l[i]))
+		}
+	case "rcon":
+		c := s.config()
+		v := c.server(req.Server)
+		if v == nil {
+			v = c.serverByUnit(req.Server)
+		}
+		if v == nil {
+			out.Err = "unknown server"
+			break
+		}
+		status := http.StatusOK
+		cmd := strings.TrimSpace(req.Cmd)
+		if s.readOnly || u.readOnly || !u.hasRole(roleOperator) {
+			status, out.Err = http.StatusForbidden, "permission denied"
+		} else if err := c.rconAllowed(u.Role, cmd); err != nil {
+			status, out.Err = http.StatusForbidden, err.Error()
+		} else if err := s.db.recordRCON(u.Name, cmd); err != nil {
+			status, out.Err = http.StatusInternalServerError, err.Error()
+		} else if p, err := s.rconPoller(c, v); err != nil {
+			status, out.Err = http.StatusInternalServerError, err.Error()
+		} else if out.Resp, err = p.Execute(ctx, cmd); err != nil {
+			status, out.Err = http.StatusInternalServerError, err.Error()
+		}
+		s.audit(auditEntry{Time: time.Now(), User: u.Name, Remote: s.remoteAddr(r.RemoteAddr), Action: "rcon", Target: v.unitName(), Status: status, Detail: cmd})
+	default:
+		out.Err = fmt.Sprintf("unknown op %q", req.Op)
+	}
+	return out
+}
+
+// attachClient is an attached connection of the CLI.
+type attachClient struct {
+	conn *websocket.Conn
+	id   int
+}
+
+// attachFlags are the flags of the commands that can attach to the daemon.
+type attachFlags struct {
+	attach string
+	token  string
+}
+
+func (a *attachFlags) flags(r *subcommands.CommandRunBase) {
+	r.Flags.StringVar(&a.attach, "attach", "", "send the commands via a running `ark-serman web`, e.g. http://localhost:8070; a user:password@ in the URL is sent as basic authentication")
+	r.Flags.StringVar(&a.token, "token", os.Getenv("ARK_SERMAN_TOKEN"), "API token for -attach, see `ark-serman token`; defaults to $ARK_SERMAN_TOKEN")
+}
+
+// dial attaches to the daemon.
+func (a *attachFlags) dial(ctx context.Context) (*attachClient, error) {
+	u, err := url.Parse(a.attach)
+	if err != nil {
+		return nil, err
+	}
+	h := http.Header{}
+	if a.token != "" {
+		h.Set("Authorization", "Bearer "+a.token)
+	} else if u.User != nil {
+		p, _ := u.User.Password()
+		h.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+p)))
+	}
+	u.User = nil
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v1/attach"
+	dctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	conn, err := websocket.Dial(dctx, u.String(), h)
+	if err != nil {
+		return nil, fmt.Errorf("attaching to %s: %w", u.Host, err)
+	}
+	return &attachClient{conn: conn}, nil
+}
+
+// call sends the request and waits for its response.
+func (a *attachClient) call(req attachRequest) (*attachResponse, error) {
+	a.id++
+	req.ID = a.id
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.conn.WriteMessage(websocket.Text, b); err != nil {
+		return nil, err
+	}
+	_ = a.conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	_, msg, err := a.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	out := &attachResponse{}
+	if err := json.Unmarshal(msg, out); err != nil {
+		return nil, err
+	}
+	if out.ID != req.ID {
+		return nil, fmt.Errorf("unexpected response %d to request %d", out.ID, req.ID)
+	}
+	if out.Err != "" {
+		return out, errors.New(out.Err)
+	}
+	return out, nil
+}
+
+func (a *attachClient) close() {
+	a.conn.Close()
+}
+
+//
+
+var cmdStatus = &subcommands.Command{
+	UsageLine: "status <options>",
+	ShortDesc: "Prints the servers' status",
+	LongDesc:  "Prints the servers' state, memory and players.\n\nWith -attach, the status is the one of a running `ark-serman web`, e.g. `status -attach http://localhost:8070` with $ARK_SERMAN_TOKEN set to a read token.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &statusRun{}
+		c.args.flags()
+		c.attachFlags.flags(&c.CommandRunBase)
+		return c
+	},
+}
+
+type statusRun struct {
+	args
+	attachFlags
+}
+
+func (s *statusRun) Run(a subcommands.Application, args []string, env subcommands.Env) int {
+	if len(args) != 0 {
+		fmt.Fprintf(os.Stderr, "%s: Unsupported arguments.\n", a.GetName())
+		return 1
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	var l []apiServer
+	var err error
+	if s.attach != "" {
+		l, err = s.remote(ctx)
+	} else {
+		l, err = s.local(ctx)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	for _, v := range l {
+		names := make([]string, len(v.Players))
+		for i, p := range v.Players {
+			names[i] = p.Name
+		}
+		fmt.Printf("%-16s %-12s %8.1f MiB %2d players %s\n", v.Name, v.ActiveState, v.Memory, len(v.Players), strings.Join(names, ", "))
+		if v.Lock != "" {
+			fmt.Printf("  %s\n", v.Lock)
+		}
+	}
+	return 0
+}
+
+func (s *statusRun) remote(ctx context.Context) ([]apiServer, error) {
+	c, err := s.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+	resp, err := c.call(attachRequest{Op: "status"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Servers, nil
+}
+
+// local queries systemd and the servers directly.
+func (s *statusRun) local(ctx context.Context) ([]apiServer, error) {
+	c, err := loadConfig(s.configPath)
+	if err != nil {
+		return nil, err
+	}
+	u, err := getUnitStates(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]apiServer, len(u))
+	for i := range u {
+		if v := c.serverByUnit(u[i].Name); v != nil {
+			if h := serverLock(c, v); h != nil {
+				u[i].Lock = h.String()
+			}
+			if u[i].Running {
+				if conn, err := rcon.Dial(v.localAddr(v.RCONPort), c.AdminPassword, rcon.SetDialTimeout(5*time.Second), rcon.SetDeadline(10*time.Second)); err == nil {
+					if resp, err := conn.Execute(v.gameInfo().ListPlayers); err == nil {
+						u[i].Players = v.gameInfo().parsePlayers(resp)
+					}
+					conn.Close()
+				}
+			}
+		}
+		out[i] = newAPIServer(&u[i])
+	}
+	return out, nil
+}
@@ -0,0 +1,176 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// auditSyslog forwards the audit log off the host.
+type auditSyslog struct {
+	// Network is "journald" for the local journal, with the entry as journal
+	// fields, or "udp", "tcp", "unix" or "unixgram" for a syslog server
+	// receiving RFC 5424 messages with the entry as structured data.
+	Network string `json:"network"`
+	// Address is the syslog server, e.g. "siem.example.com:514" or
+	// "/dev/log". Unused with journald.
+	Address string `json:"address,omitempty"`
+	// Tag is the syslog identifier. Defaults to "ark-serman".
+	Tag string `json:"tag,omitempty"`
+}
+
+func (a *auditSyslog) validate() error {
+	switch a.Network {
+	case "journald":
+	case "udp", "tcp", "unix", "unixgram":
+		if a.Address == "" {
+			return fmt.Errorf("audit_syslog: address is required with %s", a.Network)
+		}
+	default:
+		return fmt.Errorf("audit_syslog: invalid network %q", a.Network)
+	}
+	return nil
+}
+
+func (a *auditSyslog) tag() string {
+	if a.Tag == "" {
+		return "ark-serman"
+	}
+	return a.Tag
+}
+
+// journalSocket is where systemd-journald receives the native protocol.
+const journalSocket = "/run/systemd/journal/socket"
+
+// auditSDID is the RFC 5424 structured data ID of the entries. 32473 is the
+// private enterprise number reserved for documentation.
+const auditSDID = "audit@32473"
+
+// auditFields returns the entry as key-value pairs, in a stable order.
+func auditFields(e *auditEntry) [][2]string {
+	out := [][2]string{{"user", e.User}, {"remote", e.Remote}, {"action", e.Action}}
+	if e.Target != "" {
+		out = append(out, [2]string{"target", e.Target})
+	}
+	out = append(out, [2]string{"status", strconv.Itoa(e.Status)})
+	if e.Detail != "" {
+		out = append(out, [2]string{"detail", e.Detail})
+	}
+	return out
+}
+
+// auditMessage is the human readable line of the entry.
+func auditMessage(e *auditEntry) string {
+	msg := e.User + " " + e.Action
+	if e.Target != "" {
+		msg += " " + e.Target
+	}
+	return msg + ": " + strconv.Itoa(e.Status)
+}
+
+// journalEntry encodes the entry in the journal native protocol. The values
+// holding a newline use the binary form.
+func journalEntry(tag string, e *auditEntry) []byte {
+	b := bytes.Buffer{}
+	add := func(k, v string) {
+		if !strings.Contains(v, "\n") {
+			b.WriteString(k + "=" + v + "\n")
+			return
+		}
+		b.WriteString(k + "\n")
+		_ = binary.Write(&b, binary.LittleEndian, uint64(len(v)))
+		b.WriteString(v + "\n")
+	}
+	add("MESSAGE", auditMessage(e))
+	// LOG_AUTHPRIV, LOG_NOTICE.
+	add("PRIORITY", "5")
+	add("SYSLOG_FACILITY", "10")
+	add("SYSLOG_IDENTIFIER", tag)
+	for _, f := range auditFields(e) {
+		add("AUDIT_"+strings.ToUpper(f[0]), f[1])
+	}
+	return b.Bytes()
+}
+
+// syslogEntry encodes the entry as an RFC 5424 message.
+func syslogEntry(tag, hostname string, e *auditEntry) string {
+	sd := bytes.Buffer{}
+	sd.WriteString("[" + auditSDID)
+	for _, f := range auditFields(e) {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`, "\n", " ").Replace(f[1])
+		sd.WriteString(" " + f[0] + `="` + v + `"`)
+	}
+	sd.WriteString("]")
+	// <85> is LOG_AUTHPRIV|LOG_NOTICE.
+	return fmt.Sprintf("<85>1 %s %s %s %d audit %s %s", e.Time.UTC().Format(time.RFC3339Nano), hostname, tag, os.Getpid(), sd.String(), auditMessage(e))
+}
+
+// forwardAudit sends the audit entries queued by audit to audit_syslog. The
+// connection is redialed on the next entry after an error.
+func (s *webServer) forwardAudit(ctx context.Context) {
+	hostname, _ := os.Hostname()
+	var conn net.Conn
+	var cur auditSyslog
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for {
+		var e auditEntry
+		select {
+		case <-ctx.Done():
+			return
+		case e = <-s.auditQ:
+		}
+		cfg := s.config().AuditSyslog
+		if cfg == nil {
+			continue
+		}
+		if conn != nil && cur != *cfg {
+			conn.Close()
+			conn = nil
+		}
+		if conn == nil {
+			var err error
+			network, addr := cfg.Network, cfg.Address
+			if network == "journald" {
+				network, addr = "unixgram", journalSocket
+			}
+			d := net.Dialer{Timeout: 10 * time.Second}
+			if conn, err = d.DialContext(ctx, network, addr); err != nil {
+				log.Printf("audit: %s: %v", cfg.Network, err)
+				conn = nil
+				continue
+			}
+			cur = *cfg
+		}
+		var msg []byte
+		if cfg.Network == "journald" {
+			msg = journalEntry(cfg.tag(), &e)
+		} else {
+			msg = []byte(syslogEntry(cfg.tag(), hostname, &e))
+			if cfg.Network == "tcp" || cfg.Network == "unix" {
+				// Non-transparent framing per RFC 6587.
+				msg = append(msg, '\n')
+			}
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write(msg); err != nil {
+			log.Printf("audit: %s: %v", cfg.Network, err)
+			conn.Close()
+			conn = nil
+		}
+	}
+}
@@ -0,0 +1,383 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles, from the least to the most privileged.
+const (
+	// roleViewer can only look.
+	roleViewer = "viewer"
+	// roleOperator can start, stop and restart servers and send RCON commands.
+	roleOperator = "operator"
+	// roleAdmin can do everything.
+	roleAdmin = "admin"
+)
+
+// roleLevel returns the privilege level of the role, 0 if unknown.
+func roleLevel(r string) int {
+	switch r {
+	case roleViewer:
+		return 1
+	case roleOperator:
+		return 2
+	case roleAdmin:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// userConfig is a web user.
+type userConfig struct {
+	Name string `json:"name"`
+	// PasswordHash is a bcrypt hash. Use `ark-serman user` to set it.
+	PasswordHash string `json:"password_hash,omitempty"`
+	Role         string `json:"role"`
+	// TailscaleLogin is the tailnet login name, e.g. user@example.com, which
+	// authenticates as this user without password with ark-serman web
+	// -tailscale.
+	TailscaleLogin string `json:"tailscale_login,omitempty"`
+	// Timezone is the IANA time zone the web UI shows the times in for this
+	// user, e.g. "America/New_York". Defaults to the configuration's.
+	Timezone string `json:"timezone,omitempty"`
+	// TOTPSecret is the base32 TOTP secret once the user enrolled 2FA at
+	// /2fa/.
+	TOTPSecret string `json:"totp_secret,omitempty"`
+	// RecoveryCodes are the SHA-256 of the unused recovery codes.
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+
+	// readOnly is set for the read scoped API tokens.
+	readOnly bool
+}
+
+// hasRole returns true if the user has at least the role r.
+func (u *userConfig) hasRole(r string) bool {
+	return u != nil && roleLevel(u.Role) >= roleLevel(r)
+}
+
+// anonymous is the user when no user is configured, to keep the historical
+// behavior of an unauthenticated web server.
+var anonymous = &userConfig{Name: "-", Role: roleAdmin}
+
+// sessionDuration is how long a login lasts.
+const sessionDuration = 7 * 24 * time.Hour
+
+// sessionCookie is the name of the cookie holding the signed session.
+const sessionCookie = "ark-serman"
+
+// loadSessionKey loads or creates the key used to sign session cookies.
+func loadSessionKey(dir string) ([]byte, error) {
+	p := filepath.Join(dir, "session.key")
+	b, err := os.ReadFile(p)
+	if err == nil && len(b) == 32 {
+		return b, nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	b = make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return b, os.WriteFile(p, b, 0o600)
+}
+
+// sign returns the HMAC of msg.
+func (s *webServer) sign(msg string) string {
+	m := hmac.New(sha256.New, s.sessionKey)
+	m.Write([]byte(msg))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// newSession returns a cookie value for the user.
+func (s *webServer) newSession(user string) string {
+	msg := base64.RawURLEncoding.EncodeToString([]byte(user)) + "." + strconv.FormatInt(time.Now().Add(sessionDuration).Unix(), 10)
+	return msg + "." + s.sign(msg)
+}
+
+// checkSession returns the user name in a valid cookie value.
+func (s *webServer) checkSession(v string) string {
+	i := strings.LastIndexByte(v, '.')
+	if i == -1 {
+		return ""
+	}
+	msg := v[:i]
+	if !hmac.Equal([]byte(v[i+1:]), []byte(s.sign(msg))) {
+		return ""
+	}
+	parts := strings.SplitN(msg, ".", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return ""
+	}
+	u, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ""
+	}
+	return string(u)
+}
+
+// user returns the configured user by name, or nil.
+func (c *config) user(name string) *userConfig {
+	for i := range c.Users {
+		if c.Users[i].Name == name {
+			return &c.Users[i]
+		}
+	}
+	return nil
+}
+
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("ark-serman"), bcrypt.DefaultCost)
+
+// checkPassword returns the user if the password matches.
+func (c *config) checkPassword(name, pwd string) *userConfig {
+	u := c.user(name)
+	if u == nil {
+		// Spend the same time to not leak which users exist.
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(pwd))
+		return nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(pwd)) != nil {
+		return nil
+	}
+	return u
+}
+
+// authenticate returns the user making the request, or nil.
+func (s *webServer) authenticate(r *http.Request) *userConfig {
+	c := s.config()
+	if s.tailscale != nil {
+		login, err := s.tailscale.whois(r.Context(), r.RemoteAddr)
+		if err != nil {
+			// Not from the tailnet.
+			return nil
+		}
+		if u := c.tailscaleUser(login); u != nil {
+			return u
+		}
+	}
+	if u := c.tokenUser(r); u != nil {
+		return u
+	}
+	if len(c.Users) == 0 {
+		return anonymous
+	}
+	// The triggers' tokens are verified by apiTrigger.
+	if triggerToken(r) != "" && !strings.HasPrefix(r.URL.Path, "/api/v1/triggers/") {
+		s.authFailed(r, "", "token")
+	}
+	if name, pwd, ok := r.BasicAuth(); ok {
+		u := c.checkPassword(name, pwd)
+		if u == nil {
+			s.authFailed(r, name, "basic")
+			return nil
+		}
+		s.authFail.reset(s.authKeys(r, name)...)
+		if u.TOTPSecret != "" {
+			// The second factor can only be entered on the login page.
+			return nil
+		}
+		return u
+	}
+	if ck, err := r.Cookie(sessionCookie); err == nil {
+		if name := s.checkSession(ck.Value); name != "" {
+			return c.user(name)
+		}
+	}
+	return nil
+}
+
+type ctxKey int
+
+const (
+	userKey ctxKey = iota
+	holderKey
+	lockKey
+)
+
+// userHolder lets the outer handlers, e.g. the access log, know what the inner
+// handlers learned about the request.
+type userHolder struct {
+	user   *userConfig
+	detail string
+}
+
+func withUserHolder(ctx context.Context, h *userHolder) context.Context {
+	return context.WithValue(ctx, holderKey, h)
+}
+
+// setAuditDetail records extra information about the action, e.g. the full
+// RCON command, in the audit log.
+func setAuditDetail(ctx context.Context, d string) {
+	if h, _ := ctx.Value(holderKey).(*userHolder); h != nil {
+		h.detail = d
+	}
+}
+
+// setAuditUser records the actor of a request authenticated by other means
+// than a user, e.g. a trigger token.
+func setAuditUser(ctx context.Context, u *userConfig) {
+	if h, _ := ctx.Value(holderKey).(*userHolder); h != nil {
+		h.user = u
+	}
+}
+
+// userFrom returns the authenticated user of the request.
+func userFrom(ctx context.Context) *userConfig {
+	u, _ := ctx.Value(userKey).(*userConfig)
+	return u
+}
+
+// publicPath returns true for the paths served without authentication.
+func publicPath(p string) bool {
+	return p == "/login" || p == "/favicon.ico" || p == "/feed.atom" ||
+		strings.HasPrefix(p, "/static/") || strings.HasPrefix(p, "/feed/") ||
+		strings.HasPrefix(p, "/api/v1/triggers/") || strings.HasPrefix(p, "/link/") ||
+		strings.HasPrefix(p, "/vote/") || strings.HasPrefix(p, "/join/") ||
+		strings.HasPrefix(p, "/badge/") || strings.HasPrefix(p, "/population/") ||
+		strings.HasPrefix(p, "/countdown/")
+}
+
+// requireAuth rejects unauthenticated requests and mutating requests from
+// viewers.
+func (s *webServer) requireAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Rejected before anything else, including the public pages, e.g. the
+		// restart votes.
+		if s.readOnly && !readOnlyPath(r) {
+			http.Error(w, "the web server is read-only", http.StatusForbidden)
+			return
+		}
+		if name, _, ok := r.BasicAuth(); (ok || triggerToken(r) != "") && len(s.config().Users) != 0 && s.lockedOut(w, r, name) {
+			return
+		}
+		u := s.authenticate(r)
+		if u == nil {
+			if publicPath(r.URL.Path) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			if r.Method == "GET" && !strings.HasPrefix(r.URL.Path, "/api/") {
+				http.Redirect(w, r, "/login", http.StatusFound)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="ark-serman"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		if h, _ := r.Context().Value(holderKey).(*userHolder); h != nil {
+			h.user = u
+		}
+		if u.readOnly && !readOnlyPath(r) {
+			http.Error(w, "the token is read-only", http.StatusForbidden)
+			return
+		}
+		if s.config().needsEnrollment(u) && !twoFactorPath(r.URL.Path) {
+			if r.Method == "GET" && !strings.HasPrefix(r.URL.Path, "/api/") {
+				http.Redirect(w, r, "/2fa/", http.StatusFound)
+				return
+			}
+			http.Error(w, "enroll two-factor authentication at /2fa/ first", http.StatusForbidden)
+			return
+		}
+		if r.Method != "GET" && r.Method != "HEAD" && !u.hasRole(roleOperator) && !publicPath(r.URL.Path) && r.URL.Path != "/logout" && r.URL.Path != "/rpc/timezone" && r.URL.Path != "/rpc/2fa" {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, u)))
+	})
+}
+
+var loginTmpl = template.Must(template.ParseFS(rsc, "rsc/login.html.tmpl"))
+
+// serveLogin serves the login form and sets the session cookie.
+func (s *webServer) serveLogin(w http.ResponseWriter, r *http.Request) {
+	msg := ""
+	status := http.StatusUnauthorized
+	if r.Method == "POST" && !s.authFail.lockedUntil(time.Now(), s.authKeys(r, r.FormValue("user"))...).IsZero() {
+		msg = "Too many failed logins, try again later."
+		status = http.StatusTooManyRequests
+	} else if r.Method == "POST" {
+		name := r.FormValue("user")
+		u := s.config().checkPassword(name, r.FormValue("password"))
+		method := "form"
+		if u != nil && u.TOTPSecret != "" && !s.checkSecondFactor(u, r.FormValue("code")) {
+			u, method = nil, "totp"
+		}
+		if u != nil {
+			s.authFail.reset(s.authKeys(r, name)...)
+			http.SetCookie(w, &http.Cookie{
+				Name:     sessionCookie,
+				Value:    s.newSession(u.Name),
+				Path:     "/",
+				MaxAge:   int(sessionDuration / time.Second),
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		s.authFailed(r, name, method)
+		msg = "Invalid user, password or code."
+	}
+	w.Header().Add("Content-Type", "text/html")
+	if msg != "" {
+		w.WriteHeader(status)
+	}
+	_ = loginTmpl.Execute(w, map[string]any{"Message": msg})
+}
+
+func serveLogout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
+
+// rpcTimezone sets the time zone the user sees the times in. Viewers can set
+// their own.
+func (s *webServer) rpcTimezone(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	tz := strings.TrimSpace(r.FormValue("timezone"))
+	if _, err := time.LoadLocation(tz); err != nil {
+		http.Error(w, "unknown time zone", http.StatusBadRequest)
+		return
+	}
+	setAuditDetail(r.Context(), tz)
+	err := s.editUser(userFrom(r.Context()).Name, func(u *userConfig) error {
+		u.Timezone = tz
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
@@ -0,0 +1,169 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// authLockout is the brute force protection of the web UI and the API.
+type authLockout struct {
+	// MaxFailures is the number of failed authentications from an IP or for a
+	// user within Window after which they are locked out. Defaults to 5;
+	// disabled when negative.
+	MaxFailures int `json:"max_failures,omitempty"`
+	// Window defaults to 10 minutes.
+	Window duration `json:"window,omitempty"`
+	// Duration is how long the lockout lasts. Defaults to 15 minutes.
+	Duration duration `json:"duration,omitempty"`
+}
+
+// lockoutPolicy returns AuthLockout with the default values filled in.
+func (c *config) lockoutPolicy() authLockout {
+	p := authLockout{}
+	if c.AuthLockout != nil {
+		p = *c.AuthLockout
+	}
+	if p.MaxFailures == 0 {
+		p.MaxFailures = 5
+	}
+	if p.Window <= 0 {
+		p.Window = duration(10 * time.Minute)
+	}
+	if p.Duration <= 0 {
+		p.Duration = duration(15 * time.Minute)
+	}
+	return p
+}
+
+// authFailures tracks the failed authentications per "ip:<ip>" and
+// "user:<name>". It is kept in memory; a restart of ark-serman lifts the
+// lockouts.
+type authFailures struct {
+	mu    sync.Mutex
+	fails map[string][]time.Time
+	until map[string]time.Time
+}
+
+// lockedUntil returns the end of the lockout of any of the keys, or zero.
+func (a *authFailures) lockedUntil(now time.Time, keys ...string) time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var out time.Time
+	for _, k := range keys {
+		if t := a.until[k]; t.After(now) && t.After(out) {
+			out = t
+		}
+	}
+	return out
+}
+
+// add records a failure and returns the keys newly locked out.
+func (a *authFailures) add(now time.Time, p authLockout, keys ...string) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.fails == nil {
+		a.fails = map[string][]time.Time{}
+		a.until = map[string]time.Time{}
+	}
+	// Forget the old failures so a password spraying doesn't grow the maps
+	// forever.
+	if len(a.fails) > 10000 {
+		for k, l := range a.fails {
+			if now.Sub(l[len(l)-1]) > time.Duration(p.Window) {
+				delete(a.fails, k)
+			}
+		}
+		for k, t := range a.until {
+			if t.Before(now) {
+				delete(a.until, k)
+			}
+		}
+	}
+	var locked []string
+	for _, k := range keys {
+		l := a.fails[k]
+		i := 0
+		for i < len(l) && now.Sub(l[i]) > time.Duration(p.Window) {
+			i++
+		}
+		l = append(l[i:], now)
+		a.fails[k] = l
+		if p.MaxFailures > 0 && len(l) >= p.MaxFailures {
+			a.until[k] = now.Add(time.Duration(p.Duration))
+			delete(a.fails, k)
+			locked = append(locked, k)
+		}
+	}
+	return locked
+}
+
+// reset forgets the failures of the keys after a successful authentication.
+func (a *authFailures) reset(keys ...string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, k := range keys {
+		delete(a.fails, k)
+	}
+}
+
+// clientIP returns the IP of the client, not anonymized since fail2ban
+// needs it.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// authKeys returns the lockout keys of the request. The user is only tracked
+// when it exists.
+func (s *webServer) authKeys(r *http.Request, name string) []string {
+	keys := []string{"ip:" + clientIP(r)}
+	if s.config().user(name) != nil {
+		keys = append(keys, "user:"+name)
+	}
+	return keys
+}
+
+// logAuth writes a line of the auth log, to -auth-log or the standard log.
+func (s *webServer) logAuth(format string, a ...any) {
+	line := fmt.Sprintf(format, a...)
+	if s.authLog == nil {
+		log.Print(line)
+		return
+	}
+	_, _ = fmt.Fprintf(s.authLog, "%s ark-serman: %s\n", time.Now().Format(time.RFC3339), line)
+}
+
+// authFailed logs the failed authentication in the format documented for
+// fail2ban and locks out the IP or the user after too many failures. The IP
+// comes first since the user name is attacker controlled; it is quoted.
+func (s *webServer) authFailed(r *http.Request, name, method string) {
+	s.logAuth("auth failure: ip=%s user=%q method=%s path=%q", clientIP(r), name, method, r.URL.Path)
+	now := time.Now()
+	p := s.config().lockoutPolicy()
+	for _, k := range s.authFail.add(now, p, s.authKeys(r, name)...) {
+		s.logAuth("auth lockout: ip=%s user=%q key=%s until=%s", clientIP(r), name, k, now.Add(time.Duration(p.Duration)).Format(time.RFC3339))
+	}
+}
+
+// lockedOut replies 429 and returns true if the IP or the user is locked out.
+func (s *webServer) lockedOut(w http.ResponseWriter, r *http.Request, name string) bool {
+	until := s.authFail.lockedUntil(time.Now(), s.authKeys(r, name)...)
+	if until.IsZero() {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until)/time.Second)+1))
+	http.Error(w, "too many authentication failures, try again later", http.StatusTooManyRequests)
+	return true
+}
@@ -0,0 +1,131 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maruel/ark-serman/internal/rconpool"
+)
+
+func TestAuthFailures(t *testing.T) {
+	p := authLockout{MaxFailures: 3, Window: duration(time.Minute), Duration: duration(10 * time.Minute)}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	sec := func(n int) time.Time { return now.Add(time.Duration(n) * time.Second) }
+	a := authFailures{}
+	data := []struct {
+		at     time.Time
+		keys   []string
+		locked []string
+	}{
+		{sec(0), []string{"ip:a", "user:bob"}, nil},
+		{sec(10), []string{"ip:a"}, nil},
+		// ip:a reaches 3 failures; user:bob only 2.
+		{sec(20), []string{"ip:a", "user:bob"}, []string{"ip:a"}},
+		// The first failure of user:bob is out of the window.
+		{sec(65), []string{"ip:b", "user:bob"}, nil},
+		{sec(70), []string{"ip:b", "user:bob"}, []string{"user:bob"}},
+	}
+	for i, l := range data {
+		if got := a.add(l.at, p, l.keys...); strings.Join(got, ",") != strings.Join(l.locked, ",") {
+			t.Errorf("#%d: got %q, want %q", i, got, l.locked)
+		}
+	}
+	if got := a.lockedUntil(sec(30), "ip:a"); !got.Equal(sec(20).Add(10 * time.Minute)) {
+		t.Errorf("ip:a locked until %s", got)
+	}
+	if got := a.lockedUntil(sec(30), "ip:b", "user:alice"); !got.IsZero() {
+		t.Errorf("ip:b locked until %s", got)
+	}
+	if got := a.lockedUntil(sec(20+600), "ip:a"); !got.IsZero() {
+		t.Errorf("ip:a still locked at the end: %s", got)
+	}
+	// A success forgets the failures, not the lockout.
+	a.reset("ip:b", "user:bob")
+	if got := a.add(sec(80), p, "ip:b"); len(got) != 0 {
+		t.Errorf("ip:b: got %q", got)
+	}
+	if a.lockedUntil(sec(80), "user:bob").IsZero() {
+		t.Error("user:bob unlocked")
+	}
+	// Disabled.
+	b := authFailures{}
+	for i := 0; i < 10; i++ {
+		if got := b.add(now, authLockout{MaxFailures: -1, Window: p.Window, Duration: p.Duration}, "ip:a"); len(got) != 0 {
+			t.Fatalf("got %q", got)
+		}
+	}
+}
+
+func TestTokenLockout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hash := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+	c := &config{
+		Users:    []userConfig{{Name: "admin", TailscaleLogin: "admin@example.com", Role: roleAdmin}},
+		Tokens:   []apiToken{{Name: "kiosk", TokenHash: hash("r3ad")}},
+		Triggers: []triggerConfig{{Name: "deploy", Action: "restart", TokenHash: hash("tr1gger")}},
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	data := []struct {
+		name  string
+		path  string
+		h     http.Handler
+		bad   string
+		good  string
+		fails int
+	}{
+		{"token", "/api/v1/servers", ok, "Bearer nope", "Bearer r3ad", http.StatusUnauthorized},
+		{"query", "/api/v1/servers?token=nope", ok, "", "Bearer r3ad", http.StatusUnauthorized},
+		{"trigger", "/api/v1/triggers/deploy", nil, "Bearer nope", "Bearer r3ad", http.StatusForbidden},
+	}
+	for _, l := range data {
+		t.Run(l.name, func(t *testing.T) {
+			var log bytes.Buffer
+			s := &webServer{ctx: ctx, ports: newPortMapper(), publicIP: &publicIP{}, rcon: rconpool.New(ctx), authLog: &log}
+			s.setConfig(c)
+			h := l.h
+			if h == nil {
+				h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					s.apiTrigger(w, r, map[string]string{"name": "deploy"})
+				})
+			}
+			h = s.requireAuth(h)
+			do := func(auth string) int {
+				r := httptest.NewRequest("POST", l.path, nil)
+				r.RemoteAddr = "203.0.113.7:1234"
+				if auth != "" {
+					r.Header.Set("Authorization", auth)
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				return w.Code
+			}
+			for i := 0; i < 5; i++ {
+				if got := do(l.bad); got != l.fails {
+					t.Fatalf("#%d: got %d, want %d", i, got, l.fails)
+				}
+			}
+			if !strings.Contains(log.String(), "auth failure: ip=203.0.113.7 ") || !strings.Contains(log.String(), "auth lockout: ip=203.0.113.7 ") {
+				t.Fatalf("log:\n%s", log.String())
+			}
+			// Locked out, even with a valid token.
+			if got := do(l.good); got != http.StatusTooManyRequests {
+				t.Fatalf("got %d", got)
+			}
+		})
+	}
+}
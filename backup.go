@@ -0,0 +1,484 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/maruel/subcommands"
+)
+
+// savedDir returns the ShooterGame/Saved directory.
+func savedDir(c *config) string {
+	return filepath.Join(c.installDir(), "ShooterGame", "Saved")
+}
+
+// saveDir returns the directory holding the server's saves, e.g. the .ark and
+// profile files.
+func (s *serverConfig) saveDir(c *config) string {
+	g := s.gameInfo()
+	return g.saveDir(s, c.gameDir(g))
+}
+
+// configDir returns the directory holding Game.ini and GameUserSettings.ini.
+func configDir(c *config) string {
+	return filepath.Join(savedDir(c), "Config", "LinuxServer")
+}
+
+// backupDir returns the directory holding the server's backups.
+func backupDir(c *config, s *serverConfig) string {
+	return filepath.Join(c.dataDir(), "backups", s.Name)
+}
+
+// backupInfo describes a backup.
+type backupInfo struct {
+	// ID identifies the backup for the backend, e.g. the archive path or the
+	// snapshot name.
+	ID   string
+	Time time.Time
+	// Size is 0 when unknown.
+	Size int64
+}
+
+// backupBackend stores, lists, restores and deletes backups.
+type backupBackend interface {
+	// create backs up the server. The caller should SaveWorld first if the
+	// server is running.
+	create(c *config, s *serverConfig) (backupInfo, error)
+	// list returns the server's backups, newest first.
+	list(c *config, s *serverConfig) ([]backupInfo, error)
+	// restore replaces the server's saves with the backup. The server must be
+	// stopped.
+	restore(c *config, s *serverConfig, id string) error
+	remove(c *config, s *serverConfig, id string) error
+}
+
+// backend returns the configured backup backend.
+func (c *config) backend() backupBackend {
+	switch c.BackupBackend {
+	case "zfs":
+		return zfsBackend{}
+	case "btrfs":
+		return btrfsBackend{}
+	case "incremental":
+		return incrementalBackend{}
+	default:
+		return tarBackend{}
+	}
+}
+
+// rotateBackups deletes the oldest backups over backup_keep.
+func rotateBackups(c *config, s *serverConfig) error {
+	if c.BackupKeep <= 0 {
+		return nil
+	}
+	b := c.backend()
+	l, err := b.list(c, s)
+	if err != nil {
+		return err
+	}
+	for i := c.BackupKeep; i < len(l); i++ {
+		if err := b.remove(c, s, l[i].ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tarBackend stores .tar.gz archives of the save and configuration
+// directories in the data directory.
+type tarBackend struct{}
+
+func (tarBackend) list(c *config, s *serverConfig) ([]backupInfo, error) {
+	return listArchives(backupDir(c, s))
+}
+
+// listArchives returns the archives in d, newest first.
+func listArchives(d string) ([]backupInfo, error) {
+	entries, err := os.ReadDir(d)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []backupInfo
+	for _, e := range entries {
+		if e.IsDir() || !(strings.HasSuffix(e.Name(), ".tar.gz") || strings.HasSuffix(e.Name(), ".tar.gz.enc")) {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		out = append(out, backupInfo{ID: filepath.Join(d, e.Name()), Time: fi.ModTime(), Size: fi.Size()})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Time.After(out[j].Time) })
+	return out, nil
+}
+
+func (tarBackend) create(c *config, s *serverConfig) (backupInfo, error) {
+	p := filepath.Join(backupDir(c, s), s.Name+"-"+time.Now().Format("20060102-150405"))
+	return writeArchive(c, p, savedDir(c), s.saveDir(c), configDir(c))
+}
+
+// writeArchive writes the dirs, with names relative to root, to the archive
+// p.tar.gz, or p.tar.gz.enc when backup_key_file is set.
+func writeArchive(c *config, p, root string, dirs ...string) (backupInfo, error) {
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return backupInfo{}, err
+	}
+	var key []byte
+	if c.BackupKeyFile != "" {
+		var err error
+		if key, err = loadKey(c.BackupKeyFile); err != nil {
+			return backupInfo{}, err
+		}
+	}
+	now := time.Now()
+	p += ".tar.gz"
+	if key != nil {
+		p += ".enc"
+	}
+	f, err := os.OpenFile(p+".tmp", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return backupInfo{}, err
+	}
+	var w io.WriteCloser = nopCloser{f}
+	if key != nil {
+		if w, err = newEncWriter(f, key); err != nil {
+			f.Close()
+			os.Remove(p + ".tmp")
+			return backupInfo{}, err
+		}
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, d := range dirs {
+		if err = addTree(tw, root, d); err != nil {
+			break
+		}
+	}
+	if err2 := tw.Close(); err == nil {
+		err = err2
+	}
+	if err2 := gz.Close(); err == nil {
+		err = err2
+	}
+	if err2 := w.Close(); err == nil {
+		err = err2
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(p+".tmp", p)
+	}
+	if err != nil {
+		os.Remove(p + ".tmp")
+		return backupInfo{}, err
+	}
+	b := backupInfo{ID: p, Time: now}
+	if fi, err := os.Stat(p); err == nil {
+		b.Size = fi.Size()
+	}
+	return b, nil
+}
+
+// extractArchive extracts the archive written by writeArchive in root.
+func extractArchive(c *config, p, root string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(p, ".enc") {
+		if c.BackupKeyFile == "" {
+			return errors.New("the backup is encrypted and backup_key_file is not configured")
+		}
+		key, err := loadKey(c.BackupKeyFile)
+		if err != nil {
+			return err
+		}
+		if r, err = newDecReader(f, key); err != nil {
+			return err
+		}
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	return extractTree(tar.NewReader(gz), root)
+}
+
+func (t tarBackend) restore(c *config, s *serverConfig, id string) error {
+	if filepath.Dir(id) != backupDir(c, s) {
+		return fmt.Errorf("%s is not a backup of %s", id, s.Name)
+	}
+	// Keep the current saves aside until the extraction succeeded.
+	dst := s.saveDir(c)
+	old := dst + ".restore-" + time.Now().Format("20060102-150405")
+	if err := os.Rename(dst, old); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := extractArchive(c, id, savedDir(c)); err != nil {
+		os.RemoveAll(dst)
+		if err2 := os.Rename(old, dst); err2 != nil && !errors.Is(err2, fs.ErrNotExist) {
+			return fmt.Errorf("%w; the previous saves are in %s", err, old)
+		}
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+func (tarBackend) remove(c *config, s *serverConfig, id string) error {
+	if filepath.Dir(id) != backupDir(c, s) {
+		return fmt.Errorf("%s is not a backup of %s", id, s.Name)
+	}
+	return os.Remove(id)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// extractTree extracts the archive created by addTree in root.
+func extractTree(tr *tar.Reader, root string) error {
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(h.Name)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("invalid path %q in archive", h.Name)
+		}
+		p := filepath.Join(root, name)
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(p, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fs.FileMode(h.Mode).Perm()|0o600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if err2 := f.Close(); err == nil {
+				err = err2
+			}
+			if err != nil {
+				return err
+			}
+			_ = os.Chtimes(p, h.ModTime, h.ModTime)
+		}
+	}
+}
+
+// addTree adds the files under dir to the archive, with names relative to
+// root. A missing dir is ignored.
+func addTree(tw *tar.Writer, root, dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == dir && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() && !d.IsDir() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		h, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		h.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.CopyN(tw, f, h.Size)
+		return err
+	})
+}
+
+// backup saves the world if the server is running and creates a backup.
+func (s *webServer) backup(ctx context.Context, v *serverConfig) (string, error) {
+	c := s.config()
+	release, err := lockServers(ctx, c, "backup", v)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	if p, err := s.rconPoller(c, v); err == nil {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		// Best effort; the server may be stopped.
+		_, _ = p.Execute(ctx, v.gameInfo().SaveWorld)
+		cancel()
+	}
+	b, err := c.backend().create(c, v)
+	if err != nil {
+		return "", err
+	}
+	if err := rotateBackups(c, v); err != nil {
+		log.Printf("backup %s: rotate: %v", v.Name, err)
+	}
+	bus.publish(event{Unit: v.unitName(), Kind: evBackupDone, Msg: "Backed up " + v.Name + " to " + filepath.Base(b.ID)})
+	return b.ID, nil
+}
+
+var cmdBackup = &subcommands.Command{
+	UsageLine: "backup <options> <create|list|restore> <servers...>",
+	ShortDesc: "Backs up the servers' saves and configuration",
+	LongDesc:  "Backs up the servers' saves and configuration into the data directory, or as filesystem snapshots with backup_backend zfs or btrfs.\n\nWith no server specified, all the servers are processed. Stop the server or run SaveWorld via rcon first for a consistent backup.\n\nrestore takes one server and one backup ID as printed by list. The server must be stopped. The backups work without the daemon; when D-Bus is unavailable, or with -offline, a server is considered running when its game port is in use.\n\nWith -cluster, the cluster's transfer data (uploaded characters, dinos and items) is processed instead; it is shared by the cluster members and not part of their saves.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &backupRun{}
+		c.args.flags()
+		c.Flags.StringVar(&c.cluster, "cluster", "", "cluster ID to back up the transfer data of")
+		c.Flags.BoolVar(&c.wait, "wait", false, "wait for the servers busy with another operation instead of failing")
+		c.Flags.BoolVar(&c.offline, "offline", false, "don't use D-Bus, e.g. when the systemd user session hangs")
+		return c
+	},
+}
+
+type backupRun struct {
+	args
+	cluster string
+	wait    bool
+	offline bool
+}
+
+func (b *backupRun) Run(a subcommands.Application, args []string, env subcommands.Env) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "%s: Expected one of create, list or restore.\n", a.GetName())
+		return 1
+	}
+	c, err := loadConfig(b.configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	ctx := withOffline(withCLIOwner(context.Background(), b.wait), b.offline)
+	if b.cluster != "" {
+		if err := clusterCmd(ctx, c, b.cluster, args); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+			return 1
+		}
+		return 0
+	}
+	if args[0] == "restore" {
+		if err := restoreCmd(ctx, c, args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+			return 1
+		}
+		return 0
+	}
+	servers, err := c.selectServers(args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	for _, s := range servers {
+		switch args[0] {
+		case "create":
+			err = backupLocked(ctx, c, s)
+		case "list":
+			var l []backupInfo
+			l, err = c.backend().list(c, s)
+			for _, v := range l {
+				fmt.Printf("%s: %s %s %d MiB\n", s.Name, v.Time.Format(time.RFC3339), v.ID, v.Size>>20)
+			}
+		default:
+			err = fmt.Errorf("unknown command %q", args[0])
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// backupLocked creates a backup of the server while holding its lock.
+func backupLocked(ctx context.Context, c *config, s *serverConfig) error {
+	release, err := lockServers(ctx, c, "backup", s)
+	if err != nil {
+		return err
+	}
+	defer release()
+	i, err := c.backend().create(c, s)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %s\n", s.Name, i.ID)
+	return rotateBackups(c, s)
+}
+
+// restoreCmd restores one server from a backup after confirming it is
+// stopped.
+func restoreCmd(ctx context.Context, c *config, args []string) error {
+	if len(args) != 2 {
+		return errors.New("restore expects a server and a backup ID")
+	}
+	s := c.server(args[0])
+	if s == nil {
+		return fmt.Errorf("unknown server %q", args[0])
+	}
+	// Held until the restore completes so the server can't be started
+	// meanwhile.
+	release, err := lockServers(ctx, c, "restore", s)
+	if err != nil {
+		return err
+	}
+	defer release()
+	active, err := serverActive(ctx, s)
+	if err != nil {
+		return err
+	}
+	if active {
+		return fmt.Errorf("%s is running; stop it first", s.Name)
+	}
+	if err := preflight(c, s); err != nil {
+		return err
+	}
+	return c.backend().restore(c, s, args[1])
+}
@@ -0,0 +1,71 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// badgeSVG returns a badge in the style of shields.io: the label on gray and
+// the status on the color.
+func badgeSVG(label, status, color string) string {
+	// Verdana 11px averages about 7px per character.
+	lw, sw := 10+7*len([]rune(label)), 10+7*len([]rune(status))
+	label, status = html.EscapeString(label), html.EscapeString(status)
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[3]s: %[4]s">
+<title>%[3]s: %[4]s</title>
+<rect width="%[2]d" height="20" fill="#555"/>
+<rect x="%[2]d" width="%[6]d" height="20" fill="%[5]s"/>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="%[7]d" y="14">%[3]s</text>
+<text x="%[8]d" y="14">%[4]s</text>
+</g>
+</svg>
+`, lw+sw, lw, label, status, color, sw, lw/2, lw+sw/2)
+}
+
+// serveBadge serves a public status badge of the server at
+// /badge/<unit>.svg, to embed in the community forums. It reflects the last
+// state seen by the unit watcher.
+func (s *webServer) serveBadge(w http.ResponseWriter, r *http.Request) {
+	unit, ok := strings.CutSuffix(path.Base(r.URL.Path), ".svg")
+	c := s.config()
+	v := c.serverByUnit(unit)
+	if !ok || v == nil {
+		http.NotFound(w, r)
+		return
+	}
+	label := v.SessionName
+	if label == "" {
+		label = v.Name
+	}
+	status, color := "offline", "#e05d44"
+	s.mu.Lock()
+	for i := range s.lastStates {
+		if u := &s.lastStates[i]; u.Name == unit && u.Running {
+			status, color = "online", "#4c1"
+			if u.Stalled {
+				status, color = "stalled", "#dfb317"
+			} else if u.HasPlayers {
+				n := strconv.Itoa(len(u.Players))
+				if v.MaxPlayers != 0 {
+					n += "/" + strconv.Itoa(v.MaxPlayers)
+				}
+				status += ", " + n + " players"
+			}
+		}
+	}
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "image/svg+xml")
+	// The watcher refreshes the state every watchInterval; let the forums'
+	// image proxies cache a bit.
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	_, _ = w.Write([]byte(badgeSVG(label, status, color)))
+}
@@ -0,0 +1,161 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// blueprint is an item or creature class the console commands refer to.
+type blueprint struct {
+	Name string `json:"name"`
+	// Kind is "item" or "dino".
+	Kind string `json:"kind"`
+	// Path is the asset path without the class suffix, e.g.
+	// /Game/PrimalEarth/Dinos/Rex/Rex_Character_BP.
+	Path string `json:"path"`
+}
+
+// ref returns the quoted blueprint reference expected by the commands, e.g.
+// "Blueprint'/Game/PrimalEarth/Dinos/Rex/Rex_Character_BP.Rex_Character_BP'".
+func (b *blueprint) ref() string {
+	return fmt.Sprintf("\"Blueprint'%s.%s'\"", b.Path, path.Base(b.Path))
+}
+
+const (
+	bpResources   = "/Game/PrimalEarth/CoreBlueprints/Resources/"
+	bpConsumables = "/Game/PrimalEarth/CoreBlueprints/Items/Consumables/"
+	bpWeapons     = "/Game/PrimalEarth/CoreBlueprints/Weapons/"
+	bpSaddles     = "/Game/PrimalEarth/CoreBlueprints/Items/Armor/Saddles/"
+	bpDinos       = "/Game/PrimalEarth/Dinos/"
+)
+
+// builtinBlueprints are the commonly spawned items and creatures of the base
+// game.
+var builtinBlueprints = []blueprint{
+	{Name: "Black Pearl", Kind: "item", Path: bpResources + "PrimalItemResource_BlackPearl"},
+	{Name: "Cementing Paste", Kind: "item", Path: bpResources + "PrimalItemResource_ChitinPaste"},
+	{Name: "Crystal", Kind: "item", Path: bpResources + "PrimalItemResource_Crystal"},
+	{Name: "Element", Kind: "item", Path: bpResources + "PrimalItemResource_Element"},
+	{Name: "Fiber", Kind: "item", Path: bpResources + "PrimalItemResource_Fibers"},
+	{Name: "Flint", Kind: "item", Path: bpResources + "PrimalItemResource_Flint"},
+	{Name: "Gunpowder", Kind: "item", Path: bpResources + "PrimalItemResource_Gunpowder"},
+	{Name: "Hide", Kind: "item", Path: bpResources + "PrimalItemResource_Hide"},
+	{Name: "Metal", Kind: "item", Path: bpResources + "PrimalItemResource_Metal"},
+	{Name: "Metal Ingot", Kind: "item", Path: bpResources + "PrimalItemResource_MetalIngot"},
+	{Name: "Obsidian", Kind: "item", Path: bpResources + "PrimalItemResource_Obsidian"},
+	{Name: "Oil", Kind: "item", Path: bpResources + "PrimalItemResource_Oil"},
+	{Name: "Polymer", Kind: "item", Path: bpResources + "PrimalItemResource_Polymer"},
+	{Name: "Silica Pearls", Kind: "item", Path: bpResources + "PrimalItemResource_Silicon"},
+	{Name: "Sparkpowder", Kind: "item", Path: bpResources + "PrimalItemResource_Sparkpowder"},
+	{Name: "Stone", Kind: "item", Path: bpResources + "PrimalItemResource_Stone"},
+	{Name: "Thatch", Kind: "item", Path: bpResources + "PrimalItemResource_Thatch"},
+	{Name: "Wood", Kind: "item", Path: bpResources + "PrimalItemResource_Wood"},
+	{Name: "Cooked Meat", Kind: "item", Path: bpConsumables + "PrimalItemConsumable_CookedMeat"},
+	{Name: "Narcotic", Kind: "item", Path: bpConsumables + "PrimalItemConsumable_Narcotic"},
+	{Name: "Stimulant", Kind: "item", Path: bpConsumables + "PrimalItemConsumable_Stimulant"},
+	{Name: "Assault Rifle", Kind: "item", Path: bpWeapons + "PrimalItem_WeaponRifle"},
+	{Name: "Bow", Kind: "item", Path: bpWeapons + "PrimalItem_WeaponBow"},
+	{Name: "Compound Bow", Kind: "item", Path: bpWeapons + "PrimalItem_WeaponCompoundBow"},
+	{Name: "Crossbow", Kind: "item", Path: bpWeapons + "PrimalItem_WeaponCrossbow"},
+	{Name: "Fabricated Sniper Rifle", Kind: "item", Path: bpWeapons + "PrimalItem_WeaponMachinedSniper"},
+	{Name: "Longneck Rifle", Kind: "item", Path: bpWeapons + "PrimalItem_WeaponOneShotRifle"},
+	{Name: "Metal Hatchet", Kind: "item", Path: bpWeapons + "PrimalItem_WeaponMetalHatchet"},
+	{Name: "Metal Pick", Kind: "item", Path: bpWeapons + "PrimalItem_WeaponMetalPick"},
+	{Name: "Pike", Kind: "item", Path: bpWeapons + "PrimalItem_WeaponPike"},
+	{Name: "Spyglass", Kind: "item", Path: bpWeapons + "PrimalItem_WeaponSpyglass"},
+	{Name: "Stone Hatchet", Kind: "item", Path: bpWeapons + "PrimalItem_WeaponStoneHatchet"},
+	{Name: "Stone Pick", Kind: "item", Path: bpWeapons + "PrimalItem_WeaponStonePick"},
+	{Name: "Advanced Rifle Bullet", Kind: "item", Path: bpWeapons + "PrimalItemAmmo_AdvancedRifleBullet"},
+	{Name: "Simple Bullet", Kind: "item", Path: bpWeapons + "PrimalItemAmmo_SimpleBullet"},
+	{Name: "Stone Arrow", Kind: "item", Path: bpWeapons + "PrimalItemAmmo_ArrowStone"},
+	{Name: "Tranquilizer Arrow", Kind: "item", Path: bpWeapons + "PrimalItemAmmo_ArrowTranq"},
+	{Name: "Rex Saddle", Kind: "item", Path: bpSaddles + "PrimalItemArmor_RexSaddle"},
+	{Name: "Ankylosaurus", Kind: "dino", Path: bpDinos + "Ankylo/Ankylo_Character_BP"},
+	{Name: "Argentavis", Kind: "dino", Path: bpDinos + "Argentavis/Argent_Character_BP"},
+	{Name: "Brontosaurus", Kind: "dino", Path: bpDinos + "Sauropod/Sauropod_Character_BP"},
+	{Name: "Carnotaurus", Kind: "dino", Path: bpDinos + "Carno/Carno_Character_BP"},
+	{Name: "Direwolf", Kind: "dino", Path: bpDinos + "Direwolf/Direwolf_Character_BP"},
+	{Name: "Dodo", Kind: "dino", Path: bpDinos + "Dodo/Dodo_Character_BP"},
+	{Name: "Doedicurus", Kind: "dino", Path: bpDinos + "Doedicurus/Doed_Character_BP"},
+	{Name: "Giganotosaurus", Kind: "dino", Path: bpDinos + "Giganotosaurus/Gigant_Character_BP"},
+	{Name: "Mammoth", Kind: "dino", Path: bpDinos + "Mammoth/Mammoth_Character_BP"},
+	{Name: "Megalodon", Kind: "dino", Path: bpDinos + "Megalodon/Megalodon_Character_BP"},
+	{Name: "Mosasaurus", Kind: "dino", Path: bpDinos + "Mosasaurus/Mosa_Character_BP"},
+	{Name: "Parasaur", Kind: "dino", Path: bpDinos + "Para/Para_Character_BP"},
+	{Name: "Pteranodon", Kind: "dino", Path: bpDinos + "Ptero/Ptero_Character_BP"},
+	{Name: "Quetzal", Kind: "dino", Path: bpDinos + "Quetzalcoatlus/Quetz_Character_BP"},
+	{Name: "Raptor", Kind: "dino", Path: bpDinos + "Raptor/Raptor_Character_BP"},
+	{Name: "Rex", Kind: "dino", Path: bpDinos + "Rex/Rex_Character_BP"},
+	{Name: "Sabertooth", Kind: "dino", Path: bpDinos + "Saber/Saber_Character_BP"},
+	{Name: "Stegosaurus", Kind: "dino", Path: bpDinos + "Stego/Stego_Character_BP"},
+	{Name: "Triceratops", Kind: "dino", Path: bpDinos + "Trike/Trike_Character_BP"},
+}
+
+// blueprints returns the blueprint database: the builtin blueprints extended
+// or overridden by name by the ones in the configuration file, e.g. for mods,
+// sorted by name.
+func (c *config) blueprints() []blueprint {
+	m := map[string]blueprint{}
+	for _, v := range builtinBlueprints {
+		m[v.Name] = v
+	}
+	for _, v := range c.Blueprints {
+		m[v.Name] = v
+	}
+	out := make([]blueprint, 0, len(m))
+	for _, v := range m {
+		out = append(out, v)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// searchBlueprints returns the blueprints of the kind, all if empty, whose
+// name or path contains q, case insensitively.
+func (c *config) searchBlueprints(q, kind string) []blueprint {
+	q = strings.ToLower(q)
+	out := []blueprint{}
+	for _, v := range c.blueprints() {
+		if kind != "" && v.Kind != kind {
+			continue
+		}
+		if strings.Contains(strings.ToLower(v.Name), q) || strings.Contains(strings.ToLower(v.Path), q) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// blueprintByName returns the blueprint by exact name, or nil.
+func (c *config) blueprintByName(name string) *blueprint {
+	for _, v := range c.blueprints() {
+		if v.Name == name {
+			return &v
+		}
+	}
+	return nil
+}
+
+// giveItemCmd returns the command giving the item to the player, identified
+// by the in-game player ID as returned by GetPlayerIDForSteamID.
+func giveItemCmd(b *blueprint, playerID, qty, quality int, asBlueprint bool) string {
+	bp := 0
+	if asBlueprint {
+		bp = 1
+	}
+	return fmt.Sprintf("GiveItemToPlayer %d %s %d %d %d", playerID, b.ref(), qty, quality, bp)
+}
+
+// spawnDinoCmd returns the command spawning a wild creature at the
+// coordinates.
+func spawnDinoCmd(b *blueprint, x, y, z float64, level int) string {
+	return fmt.Sprintf("SpawnDino %s %g %g %g %d", b.ref(), x, y, z, level)
+}
@@ -0,0 +1,117 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bookmark is a named location on a map.
+type bookmark struct {
+	// Map is the map ID, e.g. TheIsland.
+	Map  string  `json:"map"`
+	Name string  `json:"name"`
+	X    float64 `json:"x"`
+	Y    float64 `json:"y"`
+	Z    float64 `json:"z"`
+	// Notes are free-form, e.g. who owns the base.
+	Notes string `json:"notes,omitempty"`
+	// Author is the admin who last modified the bookmark.
+	Author  string    `json:"author,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+func (b *bookmark) key() []byte {
+	return []byte(b.Map + "/" + b.Name)
+}
+
+// bookmarks returns the bookmarks of the map, or of all the maps if empty,
+// sorted by map and name.
+func (s *store) bookmarks(mapID string) ([]bookmark, error) {
+	out := []bookmark{}
+	err := s.scanPrefix(bucketBookmarks, bookmarkPrefix(mapID), func(k, v []byte) {
+		b := bookmark{}
+		if json.Unmarshal(v, &b) == nil {
+			out = append(out, b)
+		}
+	})
+	return out, err
+}
+
+func bookmarkPrefix(mapID string) []byte {
+	if mapID == "" {
+		return nil
+	}
+	return []byte(mapID + "/")
+}
+
+var bookmarksTmpl = template.Must(template.ParseFS(rsc, "rsc/bookmarks.html.tmpl"))
+
+// mapBookmarks are the bookmarks of one map for the bookmarks page.
+type mapBookmarks struct {
+	Map       mapInfo
+	Bookmarks []bookmark
+}
+
+// serveBookmarks serves the bookmarks shared by the admins at /bookmarks/.
+// The changes are POSTed to /rpc/bookmarks to be recorded in the audit log.
+func (s *webServer) serveBookmarks(w http.ResponseWriter, r *http.Request) {
+	c := s.config()
+	w.Header().Add("Content-Type", "text/html")
+	data := map[string]any{"Maps": c.maps()}
+	if r.Method == "POST" && r.URL.Path == "/rpc/bookmarks" {
+		if err := s.editBookmark(r); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			data["Err"] = err.Error()
+		}
+	}
+	all, err := s.db.bookmarks("")
+	if err != nil {
+		data["Err"] = err.Error()
+	}
+	loc := c.displayLocation(userFrom(r.Context()))
+	var out []mapBookmarks
+	for _, b := range all {
+		b.Updated = b.Updated.In(loc)
+		if len(out) == 0 || out[len(out)-1].Map.ID != b.Map {
+			out = append(out, mapBookmarks{Map: c.mapInfo(b.Map)})
+		}
+		out[len(out)-1].Bookmarks = append(out[len(out)-1].Bookmarks, b)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Map.Name < out[j].Map.Name })
+	data["ByMap"] = out
+	_ = bookmarksTmpl.Execute(w, data)
+}
+
+// editBookmark adds, updates or removes a bookmark. Only admins can.
+func (s *webServer) editBookmark(r *http.Request) error {
+	u := userFrom(r.Context())
+	if !u.hasRole(roleAdmin) {
+		return errors.New("only admins can edit the bookmarks")
+	}
+	b := bookmark{Map: r.FormValue("map"), Name: strings.TrimSpace(r.FormValue("name"))}
+	setAuditDetail(r.Context(), r.FormValue("op")+" "+string(b.key()))
+	if b.Map == "" || b.Name == "" || strings.Contains(b.Name, "/") {
+		return errors.New("map and name are required; the name can't contain /")
+	}
+	if r.FormValue("op") == "remove" {
+		return s.db.del(bucketBookmarks, b.key())
+	}
+	xyz, err := coords(r)
+	if err != nil {
+		return err
+	}
+	b.X, b.Y, b.Z = xyz[0], xyz[1], xyz[2]
+	b.Notes = strings.TrimSpace(r.FormValue("notes"))
+	b.Author = u.Name
+	b.Updated = time.Now().UTC()
+	return s.db.put(bucketBookmarks, b.key(), b)
+}
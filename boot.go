@@ -0,0 +1,79 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// bootID returns the kernel's random boot ID, which changes on every boot.
+func bootID() string {
+	b, _ := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	return strings.TrimSpace(string(b))
+}
+
+// startOnBoot starts the servers with start_on_boot if the host booted since
+// the last time ark-serman web ran. Restarting ark-serman itself, e.g. to
+// upgrade it, doesn't start servers that were intentionally stopped.
+func (s *webServer) startOnBoot(ctx context.Context) {
+	id := bootID()
+	if id == "" {
+		return
+	}
+	var last string
+	if _, err := s.db.get(bucketMeta, []byte("boot_id"), &last); err != nil {
+		log.Printf("boot: %v", err)
+		return
+	}
+	if last == id {
+		return
+	}
+	if err := s.db.put(bucketMeta, []byte("boot_id"), id); err != nil {
+		log.Printf("boot: %v", err)
+	}
+	var servers []*serverConfig
+	c := s.config()
+	for i := range c.Servers {
+		if c.Servers[i].StartOnBoot {
+			servers = append(servers, &c.Servers[i])
+		}
+	}
+	if len(servers) != 0 {
+		log.Printf("boot: starting %d servers", len(servers))
+		s.startAll(ctx, servers)
+	}
+}
+
+// rpcBoot sets the start_on_boot policy of a server and saves the
+// configuration file.
+func (s *webServer) rpcBoot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.config().serverByUnit(path.Base(r.URL.Path)) == nil {
+		http.Error(w, "unknown server", http.StatusNotFound)
+		return
+	}
+	err := s.editConfig(func(c *config) error {
+		v := c.serverByUnit(path.Base(r.URL.Path))
+		if v == nil {
+			return errors.New("unknown server")
+		}
+		v.StartOnBoot = r.FormValue("enable") == "1"
+		return nil
+	})
+	if err != nil {
+		replyError(w, err.Error())
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
@@ -0,0 +1,252 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// breedingSpecies are the 1x breeding times of a species.
+type breedingSpecies struct {
+	Name       string
+	Maturation time.Duration
+	// Incubation is the egg incubation or the gestation time.
+	Incubation time.Duration
+}
+
+// breedingSpeciesList are the reference species of the calculator; the
+// times of the others can be entered.
+var breedingSpeciesList = []breedingSpecies{
+	{Name: "Raptor", Maturation: 50000 * time.Second, Incubation: 4800 * time.Second},
+	{Name: "Rex", Maturation: 166667 * time.Second, Incubation: 18000 * time.Second},
+	{Name: "Giganotosaurus", Maturation: 500000 * time.Second, Incubation: 172800 * time.Second},
+}
+
+// cuddleInterval is the 1x time between two imprinting cuddles.
+const cuddleInterval = 8 * time.Hour
+
+// cuddleSpread is the fraction of the maturation the cuddles are spread
+// over, so the last one is due before the baby grows up.
+const cuddleSpread = 0.9
+
+// breedingPlan are the multipliers giving the wanted times for a species.
+type breedingPlan struct {
+	BabyMatureSpeedMultiplier    float64
+	EggHatchSpeedMultiplier      float64
+	BabyCuddleIntervalMultiplier float64
+	BabyImprintAmountMultiplier  float64
+}
+
+// planBreeding returns the multipliers maturing the species in maturation and
+// hatching it in incubation, with a full imprint after the number of
+// cuddles. The zero values are left unchanged.
+func planBreeding(sp *breedingSpecies, maturation, incubation time.Duration, cuddles int) breedingPlan {
+	p := breedingPlan{}
+	if maturation > 0 {
+		p.BabyMatureSpeedMultiplier = sp.Maturation.Seconds() / maturation.Seconds()
+		if cuddles > 0 {
+			// Each cuddle imprints interval × amount / maturation.
+			interval := cuddleSpread * maturation.Seconds() / float64(cuddles)
+			p.BabyCuddleIntervalMultiplier = interval / cuddleInterval.Seconds()
+			p.BabyImprintAmountMultiplier = maturation.Seconds() / (float64(cuddles) * interval)
+		}
+	}
+	if incubation > 0 {
+		p.EggHatchSpeedMultiplier = sp.Incubation.Seconds() / incubation.Seconds()
+	}
+	return p
+}
+
+// breedingKeys are the settings of breedingPlan.
+var breedingKeys = []string{"BabyMatureSpeedMultiplier", "EggHatchSpeedMultiplier", "BabyCuddleIntervalMultiplier", "BabyImprintAmountMultiplier"}
+
+// settings returns the Game.ini settings of the non zero multipliers.
+func (p *breedingPlan) settings() []iniSetting {
+	var out []iniSetting
+	for i, f := range []float64{p.BabyMatureSpeedMultiplier, p.EggHatchSpeedMultiplier, p.BabyCuddleIntervalMultiplier, p.BabyImprintAmountMultiplier} {
+		if f != 0 {
+			out = append(out, iniSetting{File: "Game.ini", Section: gameModeSection, Key: breedingKeys[i], Value: strconv.FormatFloat(math.Round(f*10000)/10000, 'f', -1, 64)})
+		}
+	}
+	return out
+}
+
+// breedingTimes are the resulting times of a species.
+type breedingTimes struct {
+	Name       string
+	Maturation time.Duration
+	Incubation time.Duration
+	// Cuddles is the number of cuddles before the baby grows up.
+	Cuddles int
+	// Imprint is the maximum imprint, in percent.
+	Imprint int
+}
+
+// times returns the times of the species with the multipliers; the ones
+// unset are taken as 1.
+func (p *breedingPlan) times(sp *breedingSpecies) breedingTimes {
+	m := func(f float64) float64 {
+		if f == 0 {
+			return 1
+		}
+		return f
+	}
+	mat := sp.Maturation.Seconds() / m(p.BabyMatureSpeedMultiplier)
+	interval := cuddleInterval.Seconds() * m(p.BabyCuddleIntervalMultiplier)
+	out := breedingTimes{
+		Name:       sp.Name,
+		Maturation: time.Duration(mat * float64(time.Second)).Round(time.Minute),
+		Incubation: time.Duration(sp.Incubation.Seconds() / m(p.EggHatchSpeedMultiplier) * float64(time.Second)).Round(time.Minute),
+		Cuddles:    int(mat / interval),
+	}
+	out.Imprint = min(100, int(float64(out.Cuddles)*interval*m(p.BabyImprintAmountMultiplier)/mat*100))
+	return out
+}
+
+// breedingForm is the calculator's input.
+type breedingForm struct {
+	Species    string
+	Maturation string
+	Incubation string
+	Cuddles    string
+	// BaseMaturation and BaseIncubation are the 1x times of a species not in
+	// the list.
+	BaseMaturation string
+	BaseIncubation string
+}
+
+// parse returns the reference species and the wanted times.
+func (f *breedingForm) parse() (*breedingSpecies, time.Duration, time.Duration, int, error) {
+	sp := &breedingSpecies{Name: "custom"}
+	for i := range breedingSpeciesList {
+		if breedingSpeciesList[i].Name == f.Species {
+			sp = &breedingSpeciesList[i]
+		}
+	}
+	dur := func(name, v string) (time.Duration, error) {
+		if v = strings.TrimSpace(v); v == "" {
+			return 0, nil
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return 0, fmt.Errorf("%s: expected a duration like 4h30m, got %q", name, v)
+		}
+		return d, nil
+	}
+	var errs []error
+	var err error
+	if sp.Name == "custom" {
+		c := breedingSpecies{Name: "custom"}
+		if c.Maturation, err = dur("base maturation", f.BaseMaturation); err != nil {
+			errs = append(errs, err)
+		}
+		if c.Incubation, err = dur("base incubation", f.BaseIncubation); err != nil {
+			errs = append(errs, err)
+		}
+		sp = &c
+	}
+	mat, err := dur("maturation", f.Maturation)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	inc, err := dur("incubation", f.Incubation)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	cuddles := 0
+	if v := strings.TrimSpace(f.Cuddles); v != "" {
+		if cuddles, err = strconv.Atoi(v); err != nil || cuddles < 1 {
+			errs = append(errs, fmt.Errorf("cuddles: expected a positive number, got %q", v))
+		}
+	}
+	if (mat != 0 && sp.Maturation == 0) || (inc != 0 && sp.Incubation == 0) {
+		errs = append(errs, errors.New("enter the species' 1x times"))
+	}
+	if cuddles != 0 && mat == 0 {
+		errs = append(errs, errors.New("the cuddles require the maturation time"))
+	}
+	return sp, mat, inc, cuddles, errors.Join(errs...)
+}
+
+var breedingTmpl = template.Must(template.ParseFS(rsc, "rsc/breeding.html.tmpl"))
+
+// serveBreeding serves the breeding calculator at /breeding/. The admins can
+// save the multipliers as settings by POSTing to /rpc/breeding; `apply`
+// writes them to Game.ini.
+func (s *webServer) serveBreeding(w http.ResponseWriter, r *http.Request) {
+	f := breedingForm{
+		Species:        r.FormValue("species"),
+		Maturation:     r.FormValue("maturation"),
+		Incubation:     r.FormValue("incubation"),
+		Cuddles:        r.FormValue("cuddles"),
+		BaseMaturation: r.FormValue("base_maturation"),
+		BaseIncubation: r.FormValue("base_incubation"),
+	}
+	if f.Species == "" {
+		f.Species = breedingSpeciesList[0].Name
+	}
+	data := map[string]any{"Form": f, "Species": breedingSpeciesList, "Admin": userFrom(r.Context()).hasRole(roleAdmin)}
+	w.Header().Add("Content-Type", "text/html")
+	var current []iniSetting
+	for _, v := range s.config().Settings {
+		if strings.EqualFold(v.File, "Game.ini") && slices.ContainsFunc(breedingKeys, func(k string) bool { return strings.EqualFold(k, v.Key) }) {
+			current = append(current, v)
+		}
+	}
+	data["Current"] = current
+	if f.Maturation == "" && f.Incubation == "" {
+		_ = breedingTmpl.Execute(w, data)
+		return
+	}
+	sp, mat, inc, cuddles, err := f.parse()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		data["Err"] = err.Error()
+		_ = breedingTmpl.Execute(w, data)
+		return
+	}
+	p := planBreeding(sp, mat, inc, cuddles)
+	l := p.settings()
+	if strings.HasPrefix(r.URL.Path, "/rpc/") && r.Method == "POST" {
+		setAuditDetail(r.Context(), "save "+sp.Name)
+		if err := s.saveBreeding(r, l); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			data["Err"] = err.Error()
+		} else {
+			data["Result"] = fmt.Sprintf("Saved %d settings; review them in the pending changes and apply them.", len(l))
+			data["Current"] = l
+		}
+	}
+	var times []breedingTimes
+	for i := range breedingSpeciesList {
+		times = append(times, p.times(&breedingSpeciesList[i]))
+	}
+	if sp.Name == "custom" {
+		times = append(times, p.times(sp))
+	}
+	data["Settings"], data["Times"] = l, times
+	_ = breedingTmpl.Execute(w, data)
+}
+
+// saveBreeding sets the multipliers in the configuration's settings.
+func (s *webServer) saveBreeding(r *http.Request, l []iniSetting) error {
+	if !userFrom(r.Context()).hasRole(roleAdmin) {
+		return errors.New("only admins can change the settings")
+	}
+	return s.editConfig(func(c *config) error {
+		for _, v := range l {
+			c.setSetting(v)
+		}
+		return c.validate()
+	})
+}
@@ -0,0 +1,138 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maruel/ark-serman/internal/systemdctl"
+)
+
+// isServerUnit returns true if the unit is an Ark server managed by
+// ark-serman.
+func isServerUnit(unit string) bool {
+	return strings.HasPrefix(unit, "ark-") && strings.HasSuffix(unit, ".service") && unit != "ark-serman.service" && !strings.Contains(unit, "/")
+}
+
+// bulkResult is the outcome of an action on one server.
+type bulkResult struct {
+	Unit   string
+	Result string
+	Err    string
+}
+
+var bulkTmpl = template.Must(template.ParseFS(rsc, "rsc/bulk.html.tmpl"))
+
+// bulkTimeout bounds how long the request waits for the jobs. Jobs still
+// running afterward continue in the background.
+const bulkTimeout = 45 * time.Second
+
+// doAction runs the action on one server.
+func (s *webServer) doAction(ctx context.Context, action, unit string) (string, error) {
+	if action == "start" || action == "stop" || action == "restart" {
+		// backup locks by itself.
+		release, err := s.lockUnit(ctx, action, unit)
+		if err != nil {
+			return "", err
+		}
+		defer release()
+	}
+	switch action {
+	case "start":
+		if err := preflightUnit(s.config(), unit); err != nil {
+			return "", err
+		}
+		s.warnOvercommit(unit)
+		if err := systemdctl.Start(ctx, unit); err != nil {
+			return "", err
+		}
+		if v := s.config().serverByUnit(unit); v != nil {
+			s.ports.add(v)
+		}
+		return "started", nil
+	case "stop":
+		if err := systemdctl.Stop(ctx, unit); err != nil {
+			return "", err
+		}
+		if v := s.config().serverByUnit(unit); v != nil {
+			s.ports.remove(v)
+		}
+		return "stopped", nil
+	case "restart":
+		if err := preflightUnit(s.config(), unit); err != nil {
+			return "", err
+		}
+		if err := s.restartWithStats(ctx, unit); err != nil {
+			return "", err
+		}
+		return "restarted", nil
+	case "backup":
+		v := s.config().serverByUnit(unit)
+		if v == nil {
+			return "", errors.New("not in the configuration file")
+		}
+		f, err := s.backup(ctx, v)
+		if err != nil {
+			return "", err
+		}
+		return "backed up to " + filepath.Base(f), nil
+	default:
+		return "", errors.New("unknown action")
+	}
+}
+
+// rpcBulk runs an action on multiple servers concurrently and reports the
+// result for each.
+func (s *webServer) rpcBulk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	action := r.PostForm.Get("action")
+	units := r.PostForm["unit"]
+	setAuditDetail(r.Context(), action+" "+strings.Join(units, ","))
+	extendWriteDeadline(w, bulkTimeout+10*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), bulkTimeout)
+	defer cancel()
+	out := make([]bulkResult, len(units))
+	var wg sync.WaitGroup
+	for i, u := range units {
+		out[i].Unit = u
+		if !isServerUnit(u) {
+			out[i].Err = "invalid unit"
+			continue
+		}
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			res, err := s.doAction(ctx, action, u)
+			if errors.Is(err, context.DeadlineExceeded) {
+				res = "still in progress"
+			} else if err != nil {
+				out[i].Err = err.Error()
+			}
+			out[i].Result = res
+		}(i, u)
+	}
+	wg.Wait()
+	sort.Slice(out, func(i, j int) bool { return out[i].Unit < out[j].Unit })
+	w.Header().Add("Content-Type", "text/html")
+	if err := bulkTmpl.Execute(w, map[string]any{"Action": action, "Results": out}); err != nil {
+		log.Printf("bulk: %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/maruel/ark-serman/internal/metrics"
+)
+
+var metBusDropped = metrics.NewCounter("ark_serman_bus_dropped_events_total", "Events dropped by the slow bus subscribers.", "kind")
+
+// Event kinds published on the bus.
+const (
+	evStarted         = "started"
+	evStopped         = "stopped"
+	evCrashed         = "crashed"
+	evStalled         = "stalled"
+	evPlayerJoined    = "player_joined"
+	evPlayerLeft      = "player_left"
+	evFirstJoin       = "first_join"
+	evWatchedJoined   = "watched_joined"
+	evRestartVote     = "restart_vote"
+	evBackupDone      = "backup_done"
+	evUpdateAvailable = "update_available"
+	evStats           = "stats"
+	evSlowSave        = "slow_save"
+	evOOMKilled       = "oom_killed"
+	evSwapping        = "swapping"
+	evStepFailed      = "step_failed"
+)
+
+// eventBus is an in-process publish/subscribe bus. Every component interested
+// in what happens to the servers (event log, notifications, automation)
+// subscribes to it instead of being called directly by the producers.
+type eventBus struct {
+	mu   sync.Mutex
+	subs []chan event
+}
+
+var bus eventBus
+
+// publish sends the event to all subscribers. It never blocks; a subscriber
+// that is too slow loses events.
+func (b *eventBus) publish(ev event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+			log.Printf("bus: dropped %s event for %q", ev.Kind, ev.Unit)
+			metBusDropped.Add(1, ev.Kind)
+		}
+	}
+}
+
+// subscribe returns a channel receiving all the events published from now
+// on. Call the returned function to unsubscribe.
+func (b *eventBus) subscribe() (<-chan event, func()) {
+	ch := make(chan event, 64)
+	b.mu.Lock()
+	b.subs = append(b.subs, ch)
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for i, c := range b.subs {
+			if c == ch {
+				b.subs = append(b.subs[:i], b.subs[i+1:]...)
+				close(ch)
+				break
+			}
+		}
+	}
+}
+
+// consume calls f for each event until ctx is canceled.
+func (b *eventBus) consume(ctx context.Context, f func(event)) {
+	ch, unsub := b.subscribe()
+	defer unsub()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-ch:
+			f(ev)
+		}
+	}
+}
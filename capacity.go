@@ -0,0 +1,256 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// footprintWindow is how far back the memory footprints are learned from the
+// performance samples.
+const footprintWindow = 30 * 24 * time.Hour
+
+// footprint is the typical memory usage of a game's map.
+type footprint struct {
+	// Memory is the 95th percentile of the samples, in MB.
+	Memory  float64
+	Samples int
+}
+
+// footprintCache holds the footprints learned from bucketMetrics, keyed by
+// "<game>/<map>". It is refreshed at most every hour.
+type footprintCache struct {
+	mu      sync.Mutex
+	updated time.Time
+	m       map[string]footprint
+}
+
+func footprintKey(v *serverConfig) string {
+	return v.gameInfo().ID + "/" + v.Map
+}
+
+// footprints returns the memory footprints of the maps. The samples are
+// attributed to the map the server currently loads.
+func (s *webServer) footprints() map[string]footprint {
+	f := &s.capacity
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s.db == nil || time.Since(f.updated) < time.Hour {
+		return f.m
+	}
+	c := s.config()
+	samples := map[string][]float64{}
+	from := time.Now().Add(-footprintWindow)
+	err := s.db.last(bucketMetrics, func(k, b []byte) bool {
+		if keyTime(k).Before(from) {
+			return false
+		}
+		sm := metricsSample{}
+		if json.Unmarshal(b, &sm) != nil {
+			return true
+		}
+		for name, p := range sm.Perf {
+			if v := c.server(name); v != nil && p.Memory > 0 {
+				key := footprintKey(v)
+				samples[key] = append(samples[key], p.Memory)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("capacity: %v", err)
+		return f.m
+	}
+	f.m = make(map[string]footprint, len(samples))
+	for k, l := range samples {
+		sort.Float64s(l)
+		f.m[k] = footprint{Memory: l[len(l)*95/100], Samples: len(l)}
+	}
+	f.updated = time.Now()
+	return f.m
+}
+
+// minFootprintSamples is the number of samples, 1 hour of uptime, needed to
+// trust a learned footprint over the game's estimate.
+const minFootprintSamples = 4
+
+// defaultMemory returns the game's estimated memory requirement of the
+// server, in MB. Each mod adds its assets to the server's memory.
+func (v *serverConfig) defaultMemory() int {
+	return v.gameInfo().Memory + 256*len(v.Mods)
+}
+
+// estimateMemory returns the server's expected memory usage in MB and whether
+// it was learned from the history.
+func estimateMemory(v *serverConfig, fp map[string]footprint) (float64, bool) {
+	if f, ok := fp[footprintKey(v)]; ok && f.Samples >= minFootprintSamples {
+		return f.Memory, true
+	}
+	return float64(v.defaultMemory()), false
+}
+
+// readMeminfo returns the fields of /proc/meminfo in MB.
+func readMeminfo() map[string]int {
+	b, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return nil
+	}
+	out := map[string]int{}
+	for _, l := range strings.Split(string(b), "\n") {
+		k, v, ok := strings.Cut(l, ":")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(v), "kB"))); err == nil {
+			out[k] = n / 1024
+		}
+	}
+	return out
+}
+
+// capacityRow is a server's line on the capacity page.
+type capacityRow struct {
+	Server   string
+	Map      string
+	Running  bool
+	Current  float64
+	Estimate float64
+	Learned  bool
+	// Fits is set for a stopped server that can start without overcommitting.
+	Fits bool
+}
+
+// capacityPlan is the host's memory against the servers' footprints, in MB.
+type capacityPlan struct {
+	// Total is the physical RAM plus the swap.
+	Total, RAM, Swap int
+	// Other is the memory used by everything but the running servers.
+	Other float64
+	// Committed is Other plus each running server's estimate or current
+	// usage, whichever is larger; the servers grow to their footprint.
+	Committed float64
+	// AllStarted is Other plus the estimates of all the servers.
+	AllStarted float64
+	// Overcommit is set when AllStarted exceeds Total.
+	Overcommit bool
+	Rows       []capacityRow
+}
+
+// planCapacity returns the capacity plan; it is nil if the host's memory is
+// unknown.
+func (s *webServer) planCapacity() *capacityPlan {
+	mi := readMeminfo()
+	if mi["MemTotal"] == 0 {
+		return nil
+	}
+	c := s.config()
+	fp := s.footprints()
+	s.mu.Lock()
+	states := s.lastStates
+	s.mu.Unlock()
+	cur := map[string]float64{}
+	for i := range states {
+		if v := c.serverByUnit(states[i].Name); v != nil && states[i].Running {
+			cur[v.Name] = states[i].Memory
+		}
+	}
+	p := &capacityPlan{RAM: mi["MemTotal"], Swap: mi["SwapTotal"]}
+	p.Total = p.RAM + p.Swap
+	used := float64(mi["MemTotal"] - mi["MemAvailable"] + mi["SwapTotal"] - mi["SwapFree"])
+	p.Other = used
+	for _, m := range cur {
+		p.Other -= m
+	}
+	p.Other = max(p.Other, 0)
+	p.Committed, p.AllStarted = p.Other, p.Other
+	for i := range c.Servers {
+		v := &c.Servers[i]
+		m, running := cur[v.Name]
+		r := capacityRow{Server: v.Name, Map: c.mapInfo(v.Map).Name, Running: running, Current: m}
+		r.Estimate, r.Learned = estimateMemory(v, fp)
+		if running {
+			p.Committed += max(m, r.Estimate)
+		}
+		p.AllStarted += r.Estimate
+		p.Rows = append(p.Rows, r)
+	}
+	p.Overcommit = p.AllStarted > float64(p.Total)
+	for i := range p.Rows {
+		r := &p.Rows[i]
+		r.Fits = !r.Running && p.Committed+r.Estimate <= float64(p.Total)
+	}
+	return p
+}
+
+// overcommit returns a warning if starting the stopped servers would exceed
+// the physical RAM plus the swap.
+func (p *capacityPlan) overcommit(names ...string) string {
+	need := p.Committed
+	for i := range p.Rows {
+		for _, n := range names {
+			if r := &p.Rows[i]; r.Server == n && !r.Running {
+				need += r.Estimate
+			}
+		}
+	}
+	if need <= float64(p.Total) {
+		return ""
+	}
+	return fmt.Sprintf("starting %s would commit about %.0f MB of the %d MB of RAM and swap", strings.Join(names, ", "), need, p.Total)
+}
+
+// warnOvercommit logs a warning if starting the server would overcommit the
+// host's memory. The start proceeds; the footprint is only an estimate.
+func (s *webServer) warnOvercommit(unit string) {
+	v := s.config().serverByUnit(unit)
+	if v == nil {
+		return
+	}
+	if p := s.planCapacity(); p != nil {
+		if w := p.overcommit(v.Name); w != "" {
+			log.Printf("capacity: warning: %s", w)
+		}
+	}
+}
+
+// capacityWarnings returns whether the host is deep into swap and the stopped
+// servers that can't start without overcommitting its memory, for the web UI.
+func (s *webServer) capacityWarnings() []string {
+	p := s.planCapacity()
+	if p == nil {
+		return nil
+	}
+	var out []string
+	if deep, used := swapState(readMeminfo()); deep {
+		out = append(out, fmt.Sprintf("the host is deep into swap with %d MB swapped; stop a server", used))
+	}
+	for _, r := range p.Rows {
+		if !r.Running && !r.Fits {
+			out = append(out, p.overcommit(r.Server))
+		}
+	}
+	return out
+}
+
+var capacityTmpl = template.Must(template.ParseFS(rsc, "rsc/capacity.html.tmpl"))
+
+// serveCapacity shows the capacity planning page.
+func (s *webServer) serveCapacity(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "text/html")
+	data := map[string]any{"Plan": s.planCapacity(), "Window": int(footprintWindow / (24 * time.Hour))}
+	if err := capacityTmpl.Execute(w, data); err != nil {
+		log.Printf("capacity: %v", err)
+	}
+}
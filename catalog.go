@@ -0,0 +1,157 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+// settingDocs describes the known settings by name, for the settings search.
+// The multipliers are relative to the official rates: above 1 is faster or
+// more, below 1 slower or less, unless noted.
+var settingDocs = map[string]string{
+	// GameUserSettings.ini [ServerSettings].
+	"ActiveMods":                              "Workshop IDs of the mods to load, in load order.",
+	"AdminLogging":                            "Broadcasts the admin commands to the players.",
+	"AllowAnyoneBabyImprintCuddle":            "Lets anyone cuddle a baby, not only the one who imprints it.",
+	"AllowCaveBuildingPvE":                    "Allows building in the caves in PvE.",
+	"AllowFlyerCarryPvE":                      "Lets the flyers carry the wild creatures in PvE.",
+	"AllowThirdPersonPlayer":                  "Allows the third person view.",
+	"AlwaysAllowStructurePickup":              "Lets the structures be picked up at any time, not only shortly after placing them.",
+	"AutoSavePeriodMinutes":                   "How often the world is saved, in minutes.",
+	"DayCycleSpeedScale":                      "Speed of the day and night cycle.",
+	"DayTimeSpeedScale":                       "Speed of the day time.",
+	"DifficultyOffset":                        "Scales the difficulty from 0 to OverrideOfficialDifficulty; the wild levels go up to 30 times the difficulty.",
+	"DinoCharacterFoodDrainMultiplier":        "How fast the creatures get hungry.",
+	"DinoCharacterHealthRecoveryMultiplier":   "How fast the creatures recover health.",
+	"DinoCharacterStaminaDrainMultiplier":     "How fast the creatures use stamina.",
+	"DinoCountMultiplier":                     "Number of wild creatures spawned.",
+	"DinoDamageMultiplier":                    "Damage dealt by the wild creatures.",
+	"DinoResistanceMultiplier":                "Damage taken by the wild creatures; lower is more resistant.",
+	"DisableDinoDecayPvE":                     "Disables the claiming of the abandoned tames in PvE.",
+	"DisableStructureDecayPvE":                "Disables the decay of the abandoned structures in PvE.",
+	"EnablePvPGamma":                          "Allows changing the gamma in PvP.",
+	"ForceAllStructureLocking":                "Locks all the structures by default.",
+	"HarvestAmountMultiplier":                 "Resources gathered per hit.",
+	"HarvestHealthMultiplier":                 "Health of the trees and rocks, i.e. the hits before they are depleted.",
+	"ItemStackSizeMultiplier":                 "Stack sizes of the items.",
+	"KickIdlePlayersPeriod":                   "Seconds before the idle players are kicked.",
+	"MaxTamedDinos":                           "Maximum number of tames on the server.",
+	"MaxTributeDinos":                         "Maximum number of creatures uploaded per player.",
+	"MaxTributeItems":                         "Maximum number of items uploaded per player.",
+	"NightTimeSpeedScale":                     "Speed of the night time.",
+	"NoTributeDownloads":                      "Disables all the downloads from the cluster.",
+	"OverrideOfficialDifficulty":              "Maximum difficulty; the wild levels go up to 30 times it, e.g. 5 for 150.",
+	"OxygenSwimSpeedStatMultiplier":           "Swim speed gained per oxygen point.",
+	"PerPlatformMaxStructuresMultiplier":      "Number of structures on the platform saddles and rafts.",
+	"PlayerCharacterFoodDrainMultiplier":      "How fast the players get hungry.",
+	"PlayerCharacterHealthRecoveryMultiplier": "How fast the players recover health.",
+	"PlayerCharacterStaminaDrainMultiplier":   "How fast the players use stamina.",
+	"PlayerCharacterWaterDrainMultiplier":     "How fast the players get thirsty.",
+	"PlayerDamageMultiplier":                  "Damage dealt by the players.",
+	"PlayerResistanceMultiplier":              "Damage taken by the players; lower is more resistant.",
+	"PreventDownloadDinos":                    "Prevents downloading creatures from the cluster.",
+	"PreventDownloadItems":                    "Prevents downloading items from the cluster.",
+	"PreventDownloadSurvivors":                "Prevents downloading survivors from the cluster.",
+	"PvEStructureDecayPeriodMultiplier":       "Time before the abandoned structures decay in PvE.",
+	"RCONEnabled":                             "Enables the RCON (admin) port.",
+	"RCONPort":                                "RCON (admin) port.",
+	"RCONServerGameLogBuffer":                 "Number of game log lines kept for RCON.",
+	"ResourcesRespawnPeriodMultiplier":        "Time before the resources respawn; lower is faster.",
+	"ServerAdminPassword":                     "Password of the admin commands and of RCON.",
+	"ServerCrosshair":                         "Shows the crosshair.",
+	"ServerForceNoHUD":                        "Hides the HUD.",
+	"ServerHardcore":                          "Hardcore mode: the players restart at level 1 when they die.",
+	"ServerPassword":                          "Password the players need to join.",
+	"ServerPVE":                               "Player versus environment mode: the players can't damage each other.",
+	"ShowMapPlayerLocation":                   "Shows the player's location on the map.",
+	"SpectatorPassword":                       "Password of the spectator mode.",
+	"StructureDamageMultiplier":               "Damage dealt by the structures, e.g. the turrets.",
+	"StructureResistanceMultiplier":           "Damage taken by the structures; lower is more resistant.",
+	"TamingSpeedMultiplier":                   "Taming speed.",
+	"TheMaxStructuresInRange":                 "Maximum number of structures in an area.",
+	"XPMultiplier":                            "Experience gained by the players and the tames.",
+	// GameUserSettings.ini, the other sections.
+	"MultiHome":   "Local IP address the server binds to.",
+	"Port":        "Game port; the raw UDP port is the next one.",
+	"QueryPort":   "Steam query port, used by the server browser.",
+	"SessionName": "Name of the server in the server browser.",
+	"MaxPlayers":  "Maximum number of players connected at once.",
+	"Duration":    "Seconds the message of the day is shown.",
+	"Message":     "Message of the day shown to the players joining.",
+	// Game.ini [/script/shootergame.shootergamemode].
+	"BabyCuddleGracePeriodMultiplier":             "Time after a missed cuddle before the imprint decreases.",
+	"BabyCuddleIntervalMultiplier":                "Time between two cuddles; lower means more cuddles.",
+	"BabyCuddleLoseImprintQualitySpeedMultiplier": "How fast the imprint decreases after a missed cuddle.",
+	"BabyFoodConsumptionSpeedMultiplier":          "How fast the babies eat.",
+	"BabyImprintAmountMultiplier":                 "Imprint gained per cuddle.",
+	"BabyImprintingStatScaleMultiplier":           "Stat bonus of a full imprint.",
+	"BabyMatureSpeedMultiplier":                   "How fast the babies grow up.",
+	"bAllowCustomRecipes":                         "Allows the custom cooking recipes.",
+	"bAllowPlatformSaddleMultiFloors":             "Allows several floors on the platform saddles.",
+	"bAllowUnlimitedRespecs":                      "Allows the Mindwipe Tonic without cooldown.",
+	"bAutoPvETimer":                               "Switches between PvE and PvP on a schedule.",
+	"bAutoUnlockAllEngrams":                       "Unlocks all the engrams.",
+	"bDisableFriendlyFire":                        "Prevents damaging the tribe members and tames in PvP.",
+	"bDisableLootCrates":                          "Disables the supply drops and the loot crates.",
+	"bDisableStructurePlacementCollision":         "Allows placing structures through terrain.",
+	"bIncreasePvPRespawnInterval":                 "Increases the respawn time after repeated deaths in PvP.",
+	"bOnlyAllowSpecifiedEngrams":                  "Hides the engrams not listed in OverrideNamedEngramEntries.",
+	"bPassiveDefensesDamageRiderlessDinos":        "Lets the spike walls damage the creatures without rider.",
+	"bPvEAllowTribeWar":                           "Allows the tribe wars in PvE.",
+	"bPvEAllowTribeWarCancel":                     "Allows canceling the tribe wars in PvE.",
+	"bPvEDisableFriendlyFire":                     "Prevents damaging the tribe members and tames in PvE.",
+	"bShowCreativeMode":                           "Shows the creative mode option to the admins.",
+	"bUseCorpseLocator":                           "Shows a beam above the player's corpse.",
+	"bUseSingleplayerSettings":                    "Uses the single player rates, e.g. faster taming and breeding.",
+	"CraftXPMultiplier":                           "Experience gained by crafting.",
+	"CropGrowthSpeedMultiplier":                   "How fast the crops grow.",
+	"CustomRecipeEffectivenessMultiplier":         "Effectiveness of the custom recipes.",
+	"CustomRecipeSkillMultiplier":                 "Effect of the crafting skill on the custom recipes.",
+	"DinoHarvestingDamageMultiplier":              "Damage of the creatures to the resources.",
+	"EggHatchSpeedMultiplier":                     "How fast the eggs hatch and the gestation ends.",
+	"FuelConsumptionIntervalMultiplier":           "Time between two fuel consumptions; higher uses less fuel.",
+	"GenericXPMultiplier":                         "Experience gained over time.",
+	"GlobalCorpseDecompositionTimeMultiplier":     "Time before the corpses disappear.",
+	"GlobalItemDecompositionTimeMultiplier":       "Time before the dropped items disappear.",
+	"GlobalSpoilingTimeMultiplier":                "Time before the items spoil.",
+	"HairGrowthSpeedMultiplier":                   "How fast the hair grows.",
+	"HarvestXPMultiplier":                         "Experience gained by harvesting.",
+	"KillXPMultiplier":                            "Experience gained by killing.",
+	"LayEggIntervalMultiplier":                    "Time between two eggs; lower lays more.",
+	"MatingIntervalMultiplier":                    "Time before a creature can mate again; lower is faster.",
+	"MatingSpeedMultiplier":                       "How fast the creatures mate.",
+	"MaxNumberOfPlayersInTribe":                   "Maximum number of players in a tribe; 0 for unlimited.",
+	"MaxTribeLogs":                                "Number of tribe log entries kept.",
+	"OverrideMaxExperiencePointsDino":             "Maximum experience of the tames.",
+	"OverrideMaxExperiencePointsPlayer":           "Maximum experience of the players.",
+	"PlayerHarvestingDamageMultiplier":            "Damage of the players to the resources.",
+	"PoopIntervalMultiplier":                      "Time between two poops.",
+	"ResourceNoReplenishRadiusPlayers":            "Distance to the players within which the resources don't respawn.",
+	"ResourceNoReplenishRadiusStructures":         "Distance to the structures within which the resources don't respawn.",
+	"SpecialXPMultiplier":                         "Experience gained by the special events, e.g. exploration notes.",
+	"EngramEntryAutoUnlocks":                      "Engrams unlocked automatically at a level; edit them in Game.ini overrides.",
+	"OverrideNamedEngramEntries":                  "Engram cost, level and visibility; edit them in Game.ini overrides.",
+	"ConfigOverrideItemMaxQuantity":               "Stack size of an item; edit them in Game.ini overrides.",
+	"ConfigOverrideSupplyCrateItems":              "Contents of a supply crate; edit them in Game.ini overrides.",
+}
+
+// launchFlag is a command line flag of the Ark server.
+type launchFlag struct {
+	// Name is the flag, e.g. -NoBattlEye. Value flags are set as -Name=Value.
+	Name  string
+	Value bool
+	Doc   string
+}
+
+// launchFlags are the known flags a server can set in its flags.
+var launchFlags = []launchFlag{
+	{Name: "-NoBattlEye", Doc: "Disables BattlEye, the anti-cheat."},
+	{Name: "-ForceAllowCaveFlyers", Doc: "Allows the flyers in the caves."},
+	{Name: "-UseDynamicConfig", Doc: "Uses the official dynamic configuration, e.g. for the events' rates."},
+	{Name: "-servergamelog", Doc: "Writes the game log, e.g. the admin commands and the tribe logs."},
+	{Name: "-servergamelogincludetribelogs", Doc: "Includes the tribe logs in the game log."},
+	{Name: "-ServerRCONOutputTribeLogs", Doc: "Sends the tribe logs to RCON, e.g. for the chat relays."},
+	{Name: "-exclusivejoin", Doc: "Only lets the players of the whitelist join."},
+	{Name: "-ForceRespawnDinos", Doc: "Destroys the wild creatures at startup so they respawn."},
+	{Name: "-ActiveEvent", Value: true, Doc: "Event to activate, e.g. Summer or WinterWonderland."},
+	{Name: "-culture", Value: true, Doc: "Language of the server messages, e.g. fr."},
+}
@@ -0,0 +1,187 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// Package client is a Go client for the ark-serman web server REST API at
+// /api/v1.
+//
+// The API is described by the OpenAPI document served at
+// /api/v1/openapi.json.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Server is an Ark server managed by ark-serman.
+type Server struct {
+	// Name is the display name.
+	Name string `json:"name"`
+	// Unit is the systemd unit name, e.g. ark-island.service. It identifies
+	// the server in the API.
+	Unit        string  `json:"unit"`
+	Map         string  `json:"map,omitempty"`
+	ActiveState string  `json:"active_state"`
+	Running     bool    `json:"running"`
+	CPU         float64 `json:"cpu_s"`
+	Memory      float64 `json:"memory_mib"`
+	Connect     Connect `json:"connect"`
+	// Listing describes whether the server shows up in the server browser.
+	Listing string   `json:"listing,omitempty"`
+	Players []Player `json:"players,omitempty"`
+	// Lock is the operation in progress on the server, e.g. "update by alice
+	// since 3:04PM".
+	Lock string `json:"lock,omitempty"`
+}
+
+// Connect describes how players connect to a server.
+type Connect struct {
+	// SteamURL is a steam://connect/ URL.
+	SteamURL string `json:"steam_url"`
+	// Console is the command to type in the in-game console.
+	Console string `json:"console"`
+}
+
+// Player is a player connected to a server.
+type Player struct {
+	Name    string `json:"name"`
+	SteamID string `json:"steam_id"`
+	// Watched is set when the player is on the watchlist.
+	Watched bool `json:"watched,omitempty"`
+}
+
+// Event is something that happened to a server.
+type Event struct {
+	Time time.Time `json:"time"`
+	Unit string    `json:"unit,omitempty"`
+	// Kind is e.g. "started", "stopped", "crashed" or "player_joined".
+	Kind   string  `json:"kind"`
+	Msg    string  `json:"msg"`
+	Player *Player `json:"player,omitempty"`
+	// Stats is set for "stats" events.
+	Stats *Stats `json:"stats,omitempty"`
+}
+
+// Stats is a snapshot of a server's metrics taken around a restart. The zero
+// values are unknown.
+type Stats struct {
+	Players int     `json:"players"`
+	Memory  float64 `json:"memory_mib,omitempty"`
+	// SaveSize is the size of the map's save file in bytes.
+	SaveSize int64 `json:"save_size,omitempty"`
+	Day      int   `json:"day,omitempty"`
+}
+
+// Error is a non-successful HTTP response.
+type Error struct {
+	StatusCode int
+	Msg        string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ark-serman: %d: %s", e.StatusCode, e.Msg)
+}
+
+// Client talks to an ark-serman web server.
+type Client struct {
+	// BaseURL is the web server URL, e.g. http://localhost:8070.
+	BaseURL string
+	// User and Password are sent with HTTP basic authentication when User is
+	// set.
+	User     string
+	Password string
+	// HTTP is the client used to send the requests. http.DefaultClient is
+	// used when nil.
+	HTTP *http.Client
+}
+
+// Servers returns all the servers.
+func (c *Client) Servers(ctx context.Context) ([]Server, error) {
+	var out []Server
+	err := c.do(ctx, "GET", "/servers", &out)
+	return out, err
+}
+
+// Server returns one server.
+func (c *Client) Server(ctx context.Context, unit string) (*Server, error) {
+	out := &Server{}
+	if err := c.do(ctx, "GET", "/servers/"+url.PathEscape(unit), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Start starts the server and waits for the job to complete.
+func (c *Client) Start(ctx context.Context, unit string) (string, error) {
+	return c.action(ctx, unit, "start")
+}
+
+// Stop stops the server and waits for the job to complete.
+func (c *Client) Stop(ctx context.Context, unit string) (string, error) {
+	return c.action(ctx, unit, "stop")
+}
+
+// Restart restarts the server and waits for the job to complete.
+func (c *Client) Restart(ctx context.Context, unit string) (string, error) {
+	return c.action(ctx, unit, "restart")
+}
+
+// Backup saves the world and backs up the server.
+func (c *Client) Backup(ctx context.Context, unit string) (string, error) {
+	return c.action(ctx, unit, "backup")
+}
+
+// Events returns the recent events, newest first. If unit is empty, the
+// events of all the servers are returned.
+func (c *Client) Events(ctx context.Context, unit string) ([]Event, error) {
+	p := "/events"
+	if unit != "" {
+		p += "?unit=" + url.QueryEscape(unit)
+	}
+	var out []Event
+	err := c.do(ctx, "GET", p, &out)
+	return out, err
+}
+
+func (c *Client) action(ctx context.Context, unit, action string) (string, error) {
+	var out struct {
+		Result string `json:"result"`
+	}
+	err := c.do(ctx, "POST", "/servers/"+url.PathEscape(unit)+"/"+action, &out)
+	return out.Result, err
+}
+
+func (c *Client) do(ctx context.Context, method, p string, out any) error {
+	if c.BaseURL == "" {
+		return errors.New("ark-serman: BaseURL is required")
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.BaseURL, "/")+"/api/v1"+p, nil)
+	if err != nil {
+		return err
+	}
+	if c.User != "" {
+		req.SetBasicAuth(c.User, c.Password)
+	}
+	h := c.HTTP
+	if h == nil {
+		h = http.DefaultClient
+	}
+	resp, err := h.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &Error{StatusCode: resp.StatusCode, Msg: strings.TrimSpace(string(b))}
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,140 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// clusterRoot returns the directory holding the cluster transfer data, one
+// subdirectory per cluster ID.
+func (c *config) clusterRoot() string {
+	if c.ClusterDir != "" {
+		return c.ClusterDir
+	}
+	return filepath.Join(savedDir(c), "clusters")
+}
+
+// clusterMembers returns the servers in the cluster.
+func (c *config) clusterMembers(id string) []*serverConfig {
+	var out []*serverConfig
+	for i := range c.Servers {
+		if c.Servers[i].ClusterID == id {
+			out = append(out, &c.Servers[i])
+		}
+	}
+	return out
+}
+
+// clusterBackupDir returns the directory holding the cluster's backups.
+func clusterBackupDir(c *config, id string) string {
+	return filepath.Join(c.dataDir(), "cluster-backups", id)
+}
+
+// modifiedSince returns true if a file under dir was modified at or after t.
+func modifiedSince(dir string, t time.Time) bool {
+	found := false
+	_ = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || found {
+			return nil
+		}
+		if fi, err := d.Info(); err == nil && !fi.ModTime().Before(t) {
+			found = true
+		}
+		return nil
+	})
+	return found
+}
+
+// createClusterBackup archives the cluster's uploaded characters, dinos and
+// items.
+//
+// Ark has no way to pause transfers, so a backup during which a player
+// uploaded something is discarded and retried to not archive a partially
+// written file.
+func createClusterBackup(c *config, id string) (backupInfo, error) {
+	if len(c.clusterMembers(id)) == 0 {
+		return backupInfo{}, fmt.Errorf("unknown cluster %q", id)
+	}
+	dir := filepath.Join(c.clusterRoot(), id)
+	for try := 0; ; try++ {
+		// File systems may have a coarse modification time granularity.
+		start := time.Now().Add(-time.Second)
+		p := filepath.Join(clusterBackupDir(c, id), id+"-"+time.Now().Format("20060102-150405"))
+		b, err := writeArchive(c, p, c.clusterRoot(), dir)
+		if err != nil || !modifiedSince(dir, start) {
+			return b, err
+		}
+		os.Remove(b.ID)
+		if try == 4 {
+			return backupInfo{}, errors.New("the cluster data kept changing during the backup; retry later")
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// restoreClusterBackup replaces the cluster data with the backup. All the
+// cluster members must be stopped.
+func restoreClusterBackup(ctx context.Context, c *config, id, backup string) error {
+	if filepath.Dir(backup) != clusterBackupDir(c, id) {
+		return fmt.Errorf("%s is not a backup of cluster %s", backup, id)
+	}
+	for _, s := range c.clusterMembers(id) {
+		active, err := serverActive(ctx, s)
+		if err != nil {
+			return err
+		}
+		if active {
+			return fmt.Errorf("%s is running; stop all the cluster members first", s.Name)
+		}
+	}
+	dst := filepath.Join(c.clusterRoot(), id)
+	old := dst + ".restore-" + time.Now().Format("20060102-150405")
+	if err := os.Rename(dst, old); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := extractArchive(c, backup, c.clusterRoot()); err != nil {
+		os.RemoveAll(dst)
+		if err2 := os.Rename(old, dst); err2 != nil && !errors.Is(err2, fs.ErrNotExist) {
+			return fmt.Errorf("%w; the previous cluster data is in %s", err, old)
+		}
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// clusterCmd runs the backup subcommand on a cluster.
+func clusterCmd(ctx context.Context, c *config, id string, args []string) error {
+	switch args[0] {
+	case "create":
+		if len(args) != 1 {
+			return errors.New("create takes no argument with -cluster")
+		}
+		b, err := createClusterBackup(c, id)
+		if err == nil {
+			fmt.Printf("%s: %s\n", id, b.ID)
+		}
+		return err
+	case "list":
+		l, err := listArchives(clusterBackupDir(c, id))
+		for _, v := range l {
+			fmt.Printf("%s: %s %s %d MiB\n", id, v.Time.Format(time.RFC3339), v.ID, v.Size>>20)
+		}
+		return err
+	case "restore":
+		if len(args) != 2 {
+			return errors.New("restore expects a backup ID with -cluster")
+		}
+		return restoreClusterBackup(ctx, c, id, args[1])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// configPreset is a reference configuration the servers are compared
+// against, e.g. the official rates or the settings the cluster maps should
+// share.
+type configPreset struct {
+	Name string `json:"name"`
+	// Dir holds the preset's INI files, e.g. Game.ini and
+	// GameUserSettings.ini.
+	Dir string `json:"dir,omitempty"`
+	// Args are the launch arguments, e.g. "XPMultiplier=2" for a URL option
+	// or "-NoBattlEye" for a flag.
+	Args []string `json:"args,omitempty"`
+}
+
+// setting is one value of a server's configuration.
+type setting struct {
+	// Source is the INI file name or "launch".
+	Source string
+	// Name is "[Section] Key" for the INI files.
+	Name  string
+	Value string
+}
+
+// settings are the values of a configuration, indexed by the lower case
+// source and name since the engine is case insensitive.
+type settings map[string]setting
+
+func (s settings) add(source, name, value string) {
+	k := strings.ToLower(source + "\x00" + name)
+	if v, ok := s[k]; ok {
+		// The arrays, e.g. ConfigOverrideItemMaxQuantity, repeat the key.
+		v.Value += "\n" + value
+		s[k] = v
+		return
+	}
+	s[k] = setting{Source: source, Name: name, Value: value}
+}
+
+// addIniDir adds the values of the INI files in the directory.
+func (s settings) addIniDir(dir string) error {
+	l, err := filepath.Glob(filepath.Join(dir, "*.ini"))
+	if err != nil {
+		return err
+	}
+	for _, p := range l {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		file, section := filepath.Base(p), ""
+		for _, line := range strings.Split(string(b), "\n") {
+			t := strings.TrimSpace(line)
+			if t == "" || t[0] == ';' || t[0] == '#' {
+				continue
+			}
+			if strings.HasPrefix(t, "[") && strings.HasSuffix(t, "]") {
+				section = t[1 : len(t)-1]
+				continue
+			}
+			if k, v, ok := strings.Cut(t, "="); ok {
+				s.add(file, "["+section+"] "+strings.TrimSpace(k), strings.TrimSpace(v))
+			}
+		}
+	}
+	return nil
+}
+
+// addArgs adds the launch arguments: the "?" separated URL options of the
+// first argument and the flags.
+func (s settings) addArgs(args []string) {
+	for i, a := range args {
+		if i == 0 && !strings.HasPrefix(a, "-") {
+			for j, o := range strings.Split(a, "?") {
+				if o == "" {
+					continue
+				}
+				if k, v, ok := strings.Cut(o, "="); ok {
+					s.add("launch", k, v)
+				} else if j == 0 {
+					s.add("launch", "map", o)
+				} else {
+					s.add("launch", o, "")
+				}
+			}
+			continue
+		}
+		k, v, _ := strings.Cut(a, "=")
+		s.add("launch", k, v)
+	}
+}
+
+// serverSettings returns the server's INI values and launch arguments.
+func serverSettings(c *config, v *serverConfig) (settings, error) {
+	out := settings{}
+	g := v.gameInfo()
+	if g.configDir != nil {
+		if err := out.addIniDir(g.configDir(c.gameDir(g))); err != nil {
+			return nil, err
+		}
+	}
+	out.addArgs(v.gameArgs(c))
+	return out, nil
+}
+
+// presetSettings returns the preset's INI values and launch arguments.
+func presetSettings(p *configPreset) (settings, error) {
+	out := settings{}
+	if p.Dir != "" {
+		if err := out.addIniDir(p.Dir); err != nil {
+			return nil, err
+		}
+	}
+	if len(p.Args) != 0 {
+		// The URL options are given one by one.
+		var opts, flags []string
+		for _, a := range p.Args {
+			if strings.HasPrefix(a, "-") {
+				flags = append(flags, a)
+			} else {
+				opts = append(opts, a)
+			}
+		}
+		out.addArgs(append([]string{"?" + strings.Join(opts, "?")}, flags...))
+	}
+	return out, nil
+}
+
+// perServerArgs are the launch arguments expected to differ between the
+// servers of a cluster.
+var perServerArgs = []string{"map", "sessionname", "port", "queryport", "rconport", "multihome", "-multihome", "altsavedirectoryname"}
+
+// settingDiff is a row of the comparison.
+type settingDiff struct {
+	Source string
+	Name   string
+	A, B   string
+	// Missing is "a" or "b" when the side doesn't set the value.
+	Missing string
+	Differs bool
+	// Expected is set for the values that always differ, e.g. the ports.
+	Expected bool
+	Secret   bool
+}
+
+// diffSettings returns the values of both sides, sorted by source and name.
+// A preset only sets some values; the ones it doesn't set don't differ.
+func diffSettings(a, b settings, presetA, presetB bool) []settingDiff {
+	var out []settingDiff
+	for k, va := range a {
+		d := settingDiff{Source: va.Source, Name: va.Name, A: va.Value}
+		if vb, ok := b[k]; ok {
+			d.B = vb.Value
+			d.Differs = va.Value != vb.Value
+		} else {
+			d.Missing, d.Differs = "b", !presetB
+		}
+		out = append(out, d)
+	}
+	for k, vb := range b {
+		if _, ok := a[k]; !ok {
+			out = append(out, settingDiff{Source: vb.Source, Name: vb.Name, B: vb.Value, Missing: "a", Differs: !presetA})
+		}
+	}
+	for i := range out {
+		if out[i].Source == "launch" && slices.Contains(perServerArgs, strings.ToLower(out[i].Name)) {
+			out[i].Expected = out[i].Differs
+			out[i].Differs = false
+		}
+		// The passwords aren't shown, only whether they differ.
+		if reSecretEnv.MatchString(out[i].Name) {
+			out[i].Secret = true
+			out[i].A, out[i].B = maskSecret(out[i].A), maskSecret(out[i].B)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Source != out[j].Source {
+			// The launch arguments override the INI files; show them first.
+			if out[i].Source == "launch" || out[j].Source == "launch" {
+				return out[i].Source == "launch"
+			}
+			return out[i].Source < out[j].Source
+		}
+		return strings.ToLower(out[i].Name) < strings.ToLower(out[j].Name)
+	})
+	return out
+}
+
+func maskSecret(v string) string {
+	if v == "" {
+		return ""
+	}
+	return "••••••"
+}
+
+// compareSide returns the settings of a server by unit or of a preset, as
+// "preset:<name>".
+func compareSide(c *config, id string) (settings, error) {
+	if name, ok := strings.CutPrefix(id, "preset:"); ok {
+		for i := range c.Presets {
+			if c.Presets[i].Name == name {
+				return presetSettings(&c.Presets[i])
+			}
+		}
+		return nil, errors.New("unknown preset " + name)
+	}
+	v := c.serverByUnit(id)
+	if v == nil {
+		return nil, errors.New("unknown server " + id)
+	}
+	return serverSettings(c, v)
+}
+
+var compareTmpl = template.Must(template.ParseFS(rsc, "rsc/compare.html.tmpl"))
+
+// serveCompare compares the configuration of two servers, or of a server and
+// a preset, at /compare/?a=<unit>&b=<unit or preset:name>. Only admins can
+// since it shows the INI files.
+func (s *webServer) serveCompare(w http.ResponseWriter, r *http.Request) {
+	if !userFrom(r.Context()).hasRole(roleAdmin) {
+		http.Error(w, "only admins can compare the configurations", http.StatusForbidden)
+		return
+	}
+	c := s.config()
+	a, b := r.FormValue("a"), r.FormValue("b")
+	var sides []string
+	for i := range c.Servers {
+		sides = append(sides, c.Servers[i].unitName())
+	}
+	for _, p := range c.Presets {
+		sides = append(sides, "preset:"+p.Name)
+	}
+	data := map[string]any{"Sides": sides, "A": a, "B": b, "All": r.FormValue("all") != ""}
+	w.Header().Add("Content-Type", "text/html")
+	if a != "" && b != "" {
+		sa, err := compareSide(c, a)
+		if err == nil {
+			var sb settings
+			if sb, err = compareSide(c, b); err == nil {
+				rows := diffSettings(sa, sb, strings.HasPrefix(a, "preset:"), strings.HasPrefix(b, "preset:"))
+				n := 0
+				for _, d := range rows {
+					if d.Differs {
+						n++
+					}
+				}
+				data["Rows"], data["Differences"] = rows, n
+			}
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			data["Err"] = err.Error()
+		}
+	}
+	_ = compareTmpl.Execute(w, data)
+}
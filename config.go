@@ -0,0 +1,834 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config is the content of the ark-serman configuration file.
+type config struct {
+	// InstallDir is the Ark Dedicated Server installation directory. Defaults
+	// to steamcmd's default location.
+	InstallDir string `json:"install_dir,omitempty"`
+	// GameDirs are the installation directories of the other games than Ark,
+	// keyed by game, e.g. {"valheim": "/srv/valheim"}. Default to steamcmd's
+	// default location.
+	GameDirs map[string]string `json:"game_dirs,omitempty"`
+	// AdminPassword is the RCON (admin) password shared by all servers.
+	AdminPassword string `json:"admin_password,omitempty"`
+	// ServerPassword is the password players need to join, if any.
+	ServerPassword string `json:"server_password,omitempty"`
+	// DataDir is where the database and backups are stored. Defaults to
+	// ~/.local/share/ark-serman.
+	DataDir string `json:"data_dir,omitempty"`
+	// StartTimeout is how long "start all" waits for a server to report
+	// startup complete (RCON responding) before starting the next one. Defaults
+	// to 10 minutes.
+	StartTimeout duration `json:"start_timeout,omitempty"`
+	// BackupBackend is where backups are stored: "tar" for archives in the
+	// data directory (the default), "incremental" for hard-linked directory
+	// trees in the data directory, "zfs" or "btrfs" for filesystem snapshots
+	// of the save directory.
+	BackupBackend string `json:"backup_backend,omitempty"`
+	// BackupKeyFile is a file holding a 32 bytes key in hex used to encrypt
+	// the backups with AES-256-GCM, since the saves contain the players'
+	// Steam IDs. Only supported by the tar backend.
+	BackupKeyFile string `json:"backup_key_file,omitempty"`
+	// BackupKeep is the number of backups to keep per server. Older ones are
+	// deleted after each backup. All are kept when 0.
+	BackupKeep int `json:"backup_keep,omitempty"`
+	// ClusterDir is the directory holding the cluster transfer data, passed
+	// as -ClusterDirOverride to the clustered servers. Defaults to
+	// ShooterGame/Saved/clusters.
+	ClusterDir string `json:"cluster_dir,omitempty"`
+	// Clusters are the settings shared by the members of each cluster.
+	Clusters []clusterConfig `json:"clusters,omitempty"`
+	// RollingRestart restarts one server per cluster every day to mitigate the
+	// server's memory leaks. Disabled when nil.
+	RollingRestart *rollingRestart `json:"rolling_restart,omitempty"`
+	// StepPolicies are the retries and failure behavior of the automation
+	// steps, by action, e.g. "update", or "default" for all of them.
+	StepPolicies map[string]*stepPolicy `json:"step_policies,omitempty"`
+	// BreakingUpdates are the game updates known to break the mods not
+	// updated since. The game and mod updates warn about these mods.
+	BreakingUpdates []breakingUpdate `json:"breaking_updates,omitempty"`
+	// HoldUpdates is the maintenance flag: when set, the reason the game and
+	// the mods must not be updated, e.g. while waiting for a mod fix.
+	HoldUpdates string `json:"hold_updates,omitempty"`
+	// Scheduler runs the periodic tasks, e.g. the rolling restart: "internal"
+	// (the default) runs them in ark-serman web, "systemd" as systemd timers
+	// installed with `ark-serman schedule install`.
+	Scheduler string `json:"scheduler,omitempty"`
+	// Timezone is the IANA time zone of the schedules and of the times shown
+	// in the web UI, e.g. "Europe/Paris". Defaults to the host's.
+	Timezone string `json:"timezone,omitempty"`
+	// StallAfter is the number of consecutive failed query port probes, 30s
+	// apart, while the RCON port doesn't answer either, after which a running
+	// server is considered stalled. Defaults to 4.
+	StallAfter int `json:"stall_after,omitempty"`
+	// StallRestart kills and restarts stalled servers. Otherwise they are only
+	// reported.
+	StallRestart bool `json:"stall_restart,omitempty"`
+	// SaveMonitor periodically times SaveWorld on the running servers.
+	// Disabled when nil; the saves done before the restarts are still timed.
+	SaveMonitor *saveMonitor `json:"save_monitor,omitempty"`
+	// Servers are the Ark servers to manage, one systemd unit each.
+	Servers []serverConfig `json:"servers"`
+	// PortForwarding requests the game ports from the router when a server
+	// starts: "upnp", "natpmp" or "auto". Disabled when empty.
+	PortForwarding string `json:"port_forwarding,omitempty"`
+	// PublicIP is the host's public IP handed to players. It is detected via
+	// PublicIPCheck when empty.
+	PublicIP string `json:"public_ip,omitempty"`
+	// PublicIPCheck is either a http(s):// URL returning the IP as plain text
+	// or a stun:host:port STUN server. Defaults to https://api.ipify.org.
+	PublicIPCheck string `json:"public_ip_check,omitempty"`
+	// AnonymizeIPs anonymizes the client IPs in the access and audit logs:
+	// "truncate" keeps the /24 (IPv4) or /48 (IPv6) network, "hash" records a
+	// keyed hash. Recorded as is when empty.
+	AnonymizeIPs string `json:"anonymize_ips,omitempty"`
+	// Retention is how long the player history (join and leave events, the
+	// players seen) is kept in the database, e.g. "720h". Kept forever when 0.
+	Retention duration `json:"retention,omitempty"`
+	// AuditRetention is how long the audit log is kept in the database, e.g.
+	// "2160h". Kept forever when 0.
+	AuditRetention duration `json:"audit_retention,omitempty"`
+	// Tokens authenticate the programs and the kiosks instead of users. Use
+	// `ark-serman token` to manage them.
+	Tokens []apiToken `json:"tokens,omitempty"`
+	// TwoFactorRoles are the roles, e.g. ["admin"], whose users must enroll
+	// TOTP two-factor authentication at /2fa/ before using the web UI.
+	TwoFactorRoles []string `json:"two_factor_roles,omitempty"`
+	// WebTerminal enables the host shell at /terminal/ for the admins who
+	// enrolled 2FA, for emergency fixes. The shell runs as the service user.
+	WebTerminal bool `json:"web_terminal,omitempty"`
+	// AuthLockout locks out the IPs and the users after too many failed
+	// authentications. Enabled with the default values when nil.
+	AuthLockout *authLockout `json:"auth_lockout,omitempty"`
+	// AuditSyslog also forwards the audit log to syslog or journald.
+	AuditSyslog *auditSyslog `json:"audit_syslog,omitempty"`
+	// RestartVote lets the players vote for a restart. Disabled when nil.
+	RestartVote *restartVote `json:"restart_vote,omitempty"`
+	// Welcome is sent to the players joining a managed server for the first
+	// time, e.g. with the rules or the Discord invite. It is a text/template
+	// with {{.Name}} and {{.Server}}. Disabled when empty.
+	Welcome string `json:"welcome,omitempty"`
+	// Users are the web users. When empty, the web server doesn't require
+	// authentication.
+	Users []userConfig `json:"users,omitempty"`
+	// Settings are the values `apply` maintains in the INI files.
+	Settings []iniSetting `json:"settings,omitempty"`
+	// Difficulty manages the wild dino levels of the servers. GameUserSettings.ini
+	// is used when nil.
+	Difficulty *difficultyConfig `json:"difficulty,omitempty"`
+	// Presets are reference configurations to compare the servers against at
+	// /compare/.
+	Presets []configPreset `json:"presets,omitempty"`
+	// Maps extends the builtin map registry with custom maps.
+	Maps []mapInfo `json:"maps,omitempty"`
+	// Rescue holds the teleport command templates of the rescue tools.
+	Rescue *rescueCommands `json:"rescue,omitempty"`
+	// Blueprints extends the builtin item and creature blueprints used by the
+	// console's spawn helper, e.g. with the ones of mods.
+	Blueprints []blueprint `json:"blueprints,omitempty"`
+	// Webhooks receive the server events, e.g. started, stopped and crashed,
+	// as JSON.
+	Webhooks []webhookConfig `json:"webhooks,omitempty"`
+	// RCONCommands restricts per role the RCON commands sent from the web
+	// console, e.g. {"operator": {"allow": ["Broadcast", "SaveWorld"]}}. Roles
+	// not listed are unrestricted.
+	RCONCommands map[string]rconRule `json:"rcon_commands,omitempty"`
+	// Triggers are the actions external systems can run with a token.
+	Triggers []triggerConfig `json:"triggers,omitempty"`
+	// Plugins are the subprocesses contributing dashboard panels,
+	// notification channels and scheduled task types.
+	Plugins []pluginConfig `json:"plugins,omitempty"`
+	// Hooks are the scripted reactions to the events.
+	Hooks []hookConfig `json:"hooks,omitempty"`
+	// ModCache downloads the workshop mods once, in a cache in the data
+	// directory, and installs them in the Mods directory shared by the
+	// servers, instead of each server downloading them at startup with
+	// -automanagedmods. The update step then also updates the mods.
+	ModCache bool `json:"mod_cache,omitempty"`
+	// DownloadLimitKbps caps steamcmd's downloads of the game and the mods,
+	// in kilobits per second, so the updates don't saturate the uplink the
+	// players use. Unlimited when 0.
+	DownloadLimitKbps int `json:"download_limit_kbps,omitempty"`
+	// Steam is the Steam account of steamcmd, for the private branches and
+	// the workshop items requiring a login.
+	Steam *steamConfig `json:"steam,omitempty"`
+	// Tracing exports the traces of the web requests, the D-Bus calls, the
+	// RCON commands and the steamcmd runs to an OpenTelemetry collector.
+	Tracing *tracingConfig `json:"tracing,omitempty"`
+}
+
+// rollingRestart is the daily rolling restart policy.
+type rollingRestart struct {
+	// At is the local time of the restart, as "HH:MM".
+	At string `json:"at"`
+	// Warning is how long the players are warned before the restart. Defaults
+	// to 15 minutes.
+	Warning duration `json:"warning,omitempty"`
+	// Countdown are the earlier broadcasts of the time left before the
+	// restart, e.g. ["2h", "1h"]. Defaults to 1 hour and 30 minutes.
+	Countdown []duration `json:"countdown,omitempty"`
+	// Policy overrides step_policies' restart policy for each server.
+	Policy *stepPolicy `json:"policy,omitempty"`
+}
+
+// saveMonitor is the world save duration monitoring policy.
+type saveMonitor struct {
+	// Interval is how often the world is saved. Defaults to 1 hour.
+	Interval duration `json:"interval,omitempty"`
+	// Threshold is the save duration above which a slow_save event is
+	// published. Long saves cause rubber-banding and precede save
+	// corruption. Defaults to 15 seconds.
+	Threshold duration `json:"threshold,omitempty"`
+}
+
+// serverConfig describes one Ark server.
+type serverConfig struct {
+	// Name is the short name of the server. The systemd unit is named
+	// ark-<Name>.service.
+	Name string `json:"name"`
+	// Map is the map to load, e.g. TheIsland. It can be a map not in the stock
+	// list when it is provided by a mod.
+	Map         string `json:"map"`
+	SessionName string `json:"session_name,omitempty"`
+	Port        int    `json:"port"`
+	QueryPort   int    `json:"query_port"`
+	RCONPort    int    `json:"rcon_port"`
+	MaxPlayers  int    `json:"max_players,omitempty"`
+	ClusterID   string `json:"cluster_id,omitempty"`
+	// Mods are workshop IDs loaded via GameModIds.
+	Mods []string `json:"mods,omitempty"`
+	// TotalConversionMod is the workshop ID of a total conversion mod, e.g.
+	// 496735411 for Survival of the Fittest.
+	TotalConversionMod string `json:"total_conversion_mod,omitempty"`
+	// Crossplay enables Epic Games Store players to join via Epic Online
+	// Services.
+	Crossplay bool `json:"crossplay,omitempty"`
+	// EpicOnly restricts the server to Epic players. Requires Crossplay.
+	EpicOnly bool `json:"epic_only,omitempty"`
+	// PublicIPForEpic is the IP advertised to EOS. Defaults to the global
+	// public_ip when set. Required when the host is behind NAT.
+	PublicIPForEpic string `json:"public_ip_for_epic,omitempty"`
+	// MultiHome is the local IPv4 address the server binds to, for hosts with
+	// multiple addresses. The engine doesn't support IPv6. Defaults to all
+	// the addresses.
+	MultiHome string `json:"multihome,omitempty"`
+	// StartOrder orders the servers in "start all"; lower values start first.
+	StartOrder int `json:"start_order,omitempty"`
+	// StartOnBoot starts the server when the host boots. ark-serman web
+	// starts these servers with the same stagger as "start all".
+	StartOnBoot bool `json:"start_on_boot,omitempty"`
+	// SaveDir is the directory under ShooterGame/Saved holding the saves, set
+	// via AltSaveDirectoryName. Defaults to SavedArks.
+	SaveDir string `json:"save_dir,omitempty"`
+	// Options are additional "Key=Value" URL options.
+	Options []string `json:"options,omitempty"`
+	// Flags are additional command line flags, e.g. "-NoBattlEye".
+	Flags []string `json:"flags,omitempty"`
+	// Welcome overrides the global welcome message for this server.
+	Welcome string `json:"welcome,omitempty"`
+	// LastWipe is the date of the last wipe, as YYYY-MM-DD, for the
+	// announcements' DaysSinceWipe.
+	LastWipe string `json:"last_wipe,omitempty"`
+	// CPUAffinity pins the server to these CPUs, e.g. "0-3" or "4,6". Pinning
+	// the maps to distinct cores keeps a busy map from lagging the others.
+	CPUAffinity string `json:"cpu_affinity,omitempty"`
+	// Nice is the scheduling priority, from -20 (highest) to 19. The user
+	// manager can only lower the priority unless RLIMIT_NICE allows it.
+	Nice int `json:"nice,omitempty"`
+	// IOSchedulingClass is "best-effort", "idle" or "realtime"; "realtime"
+	// requires CAP_SYS_ADMIN.
+	IOSchedulingClass string `json:"io_scheduling_class,omitempty"`
+	// MemoryMax is the hard memory limit of the server, e.g. "12G". The
+	// kernel kills the server when it reaches it instead of another process
+	// when the host runs out of memory.
+	MemoryMax string `json:"memory_max,omitempty"`
+	// Game is the game of the server: "ark" (the default), "palworld" or
+	// "valheim". The Ark specific settings, e.g. the mods and the clusters,
+	// are only supported by Ark servers.
+	Game string `json:"game,omitempty"`
+	// Tuning are the presets for big hosts: "hugepages" backs the heap with
+	// transparent huge pages, "numa" binds the server's memory and CPUs to
+	// NUMANode.
+	Tuning []string `json:"tuning,omitempty"`
+	// NUMANode is the NUMA node of the "numa" preset.
+	NUMANode int `json:"numa_node,omitempty"`
+}
+
+// localAddr returns the address to reach the server's port from the host.
+func (s *serverConfig) localAddr(port int) string {
+	h := s.MultiHome
+	if h == "" {
+		h = "127.0.0.1"
+	}
+	return net.JoinHostPort(h, strconv.Itoa(port))
+}
+
+// unitName returns the systemd unit name for this server.
+func (s *serverConfig) unitName() string {
+	return "ark-" + s.Name + ".service"
+}
+
+// duration is a time.Duration encoded as a string like "5m" in JSON.
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// defaultConfigPath returns ~/.config/ark-serman/config.json.
+func defaultConfigPath() string {
+	d, err := os.UserConfigDir()
+	if err != nil {
+		return "config.json"
+	}
+	return filepath.Join(d, "ark-serman", "config.json")
+}
+
+// defaultInstallDir is where update_ark.sh installs the server via steamcmd.
+func defaultInstallDir() string {
+	h, _ := os.UserHomeDir()
+	return filepath.Join(h, ".local", "share", "Steam", "steamapps", "common", "ARK Survival Evolved Dedicated Server")
+}
+
+// loadConfig loads the configuration file. A missing file is an empty
+// configuration.
+func loadConfig(p string) (*config, error) {
+	c := &config{}
+	b, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		c.setDefaults()
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err := d.Decode(c); err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	c.setDefaults()
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	return c, nil
+}
+
+// save writes the configuration file atomically.
+func (c *config) save(p string) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// installDir returns InstallDir or its default value.
+func (c *config) installDir() string {
+	if c.InstallDir == "" {
+		return defaultInstallDir()
+	}
+	return c.InstallDir
+}
+
+// startTimeout returns StartTimeout or its default value.
+func (c *config) startTimeout() time.Duration {
+	if c.StartTimeout <= 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(c.StartTimeout)
+}
+
+// location returns the time zone of the schedules.
+func (c *config) location() *time.Location {
+	if c.Timezone == "" {
+		return time.Local
+	}
+	if l, err := time.LoadLocation(c.Timezone); err == nil {
+		return l
+	}
+	return time.Local
+}
+
+// displayLocation returns the time zone the user sees the times in: the
+// user's own or the schedules'.
+func (c *config) displayLocation(u *userConfig) *time.Location {
+	if u != nil && u.Timezone != "" {
+		if l, err := time.LoadLocation(u.Timezone); err == nil {
+			return l
+		}
+	}
+	return c.location()
+}
+
+// warning returns Warning or its default value.
+func (r *rollingRestart) warning() time.Duration {
+	if r.Warning <= 0 {
+		return 15 * time.Minute
+	}
+	return time.Duration(r.Warning)
+}
+
+// countdown returns Countdown or its default value, longest first. The
+// broadcasts within the warning are sent by the restart itself.
+func (r *rollingRestart) countdown() []time.Duration {
+	l := []time.Duration{time.Hour, 30 * time.Minute}
+	if len(r.Countdown) != 0 {
+		l = l[:0]
+		for _, d := range r.Countdown {
+			l = append(l, time.Duration(d))
+		}
+	}
+	var out []time.Duration
+	for _, d := range l {
+		if d > r.warning() {
+			out = append(out, d)
+		}
+	}
+	slices.Sort(out)
+	slices.Reverse(out)
+	return out
+}
+
+// stallAfter returns StallAfter or its default value.
+func (c *config) stallAfter() int {
+	if c.StallAfter <= 0 {
+		return 4
+	}
+	return c.StallAfter
+}
+
+// saveThreshold returns SaveMonitor.Threshold or its default value.
+func (c *config) saveThreshold() time.Duration {
+	if c.SaveMonitor == nil || c.SaveMonitor.Threshold <= 0 {
+		return 15 * time.Second
+	}
+	return time.Duration(c.SaveMonitor.Threshold)
+}
+
+// dataDir returns DataDir or its default value.
+func (c *config) dataDir() string {
+	if c.DataDir == "" {
+		return defaultDataDir()
+	}
+	return c.DataDir
+}
+
+func (c *config) setDefaults() {
+	for i := range c.Servers {
+		s := &c.Servers[i]
+		if s.SessionName == "" {
+			s.SessionName = s.Name
+		}
+		if g := gameByID(s.Game); g != nil {
+			if s.Map == "" {
+				s.Map = g.DefaultMap
+			}
+			if g.QueryPortOffset != 0 {
+				s.QueryPort = s.Port + g.QueryPortOffset
+			}
+		}
+	}
+}
+
+var reServerName = regexp.MustCompile(`^[a-z0-9][a-z0-9_\-]*$`)
+
+// reMemoryMax matches the systemd MemoryMax= values, e.g. "12G" or "50%".
+var reMemoryMax = regexp.MustCompile(`^(\d+[KMGT]?|\d+%|infinity)$`)
+
+func (c *config) validate() error {
+	switch c.BackupBackend {
+	case "", "tar", "incremental", "zfs", "btrfs":
+	default:
+		return fmt.Errorf("backup_backend: invalid value %q", c.BackupBackend)
+	}
+	if c.BackupKeyFile != "" && c.BackupBackend != "" && c.BackupBackend != "tar" {
+		return fmt.Errorf("backup_key_file: not supported with backup_backend %q", c.BackupBackend)
+	}
+	switch c.AnonymizeIPs {
+	case "", "truncate", "hash":
+	default:
+		return fmt.Errorf("anonymize_ips: invalid value %q", c.AnonymizeIPs)
+	}
+	switch c.PortForwarding {
+	case "", "upnp", "natpmp", "auto":
+	default:
+		return fmt.Errorf("port_forwarding: invalid value %q", c.PortForwarding)
+	}
+	for id := range c.GameDirs {
+		if g := gameByID(id); g == nil || g.ID == "ark" {
+			return fmt.Errorf("game_dirs: invalid game %q; the Ark installation is install_dir", id)
+		}
+	}
+	if c.PublicIP != "" && net.ParseIP(c.PublicIP) == nil {
+		return fmt.Errorf("public_ip: invalid IP %q", c.PublicIP)
+	}
+	for _, b := range c.BreakingUpdates {
+		if _, err := time.Parse("2006-01-02", b.Released); err != nil {
+			return fmt.Errorf("breaking_updates: %s: invalid released %q, expected YYYY-MM-DD", b.Version, b.Released)
+		}
+	}
+	for _, t := range c.Tokens {
+		if t.Scope != "" && t.Scope != "read" && t.Scope != "write" {
+			return fmt.Errorf("tokens: %s: invalid scope %q", t.Name, t.Scope)
+		}
+	}
+	for _, r := range c.TwoFactorRoles {
+		if roleLevel(r) == 0 {
+			return fmt.Errorf("two_factor_roles: invalid role %q", r)
+		}
+	}
+	if c.AuditSyslog != nil {
+		if err := c.AuditSyslog.validate(); err != nil {
+			return err
+		}
+	}
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		return fmt.Errorf("timezone: %w", err)
+	}
+	for _, u := range c.Users {
+		if _, err := time.LoadLocation(u.Timezone); err != nil {
+			return fmt.Errorf("users: %s: timezone: %w", u.Name, err)
+		}
+	}
+	if c.Scheduler != "" && c.Scheduler != "internal" && c.Scheduler != "systemd" {
+		return fmt.Errorf("scheduler: expected internal or systemd, got %q", c.Scheduler)
+	}
+	if c.RollingRestart != nil {
+		if err := validClock(c.RollingRestart.At); err != nil {
+			return fmt.Errorf("rolling_restart: %w", err)
+		}
+	}
+	if err := c.validateStepPolicies(); err != nil {
+		return err
+	}
+	for _, m := range c.Maps {
+		if m.ID == "" || m.Name == "" {
+			return errors.New("maps: id and name are required")
+		}
+		if m.TotalConversion && m.WorkshopID == "" {
+			return fmt.Errorf("map %q: total_conversion requires workshop_id", m.ID)
+		}
+	}
+	for _, v := range c.Settings {
+		if (v.File != "GameUserSettings.ini" && v.File != "Game.ini") || v.Section == "" || v.Key == "" {
+			return fmt.Errorf("settings: %q requires a file GameUserSettings.ini or Game.ini, a section and a key", v.Key)
+		}
+		if t, ok := iniKeyType(v.File, v.Section, v.Key); ok && !t.check(v.Value) {
+			return fmt.Errorf("settings: %s must be %s, got %q", v.Key, t, v.Value)
+		}
+		if c.Difficulty != nil && v.File == "GameUserSettings.ini" && isDifficultyOption(v.Key) {
+			return fmt.Errorf("settings: %s must be set in difficulty", v.Key)
+		}
+	}
+	if c.Difficulty != nil {
+		if err := c.Difficulty.validate(c); err != nil {
+			return err
+		}
+	}
+	presets := map[string]bool{}
+	for _, p := range c.Presets {
+		if p.Name == "" || presets[p.Name] || (p.Dir == "" && len(p.Args) == 0) {
+			return fmt.Errorf("presets: %q requires a unique name and a dir or args", p.Name)
+		}
+		presets[p.Name] = true
+	}
+	for _, b := range c.Blueprints {
+		if b.Name == "" || (b.Kind != "item" && b.Kind != "dino") || !strings.HasPrefix(b.Path, "/Game/") {
+			return fmt.Errorf("blueprints: %q requires a name, a kind item or dino and a /Game/ path", b.Name)
+		}
+	}
+	for _, h := range c.Webhooks {
+		if !strings.HasPrefix(h.URL, "http://") && !strings.HasPrefix(h.URL, "https://") {
+			return fmt.Errorf("webhooks: invalid url %q", h.URL)
+		}
+		for _, k := range h.Events {
+			if !slices.Contains(eventKinds, k) {
+				return fmt.Errorf("webhook %q: unknown event %q", h.URL, k)
+			}
+		}
+	}
+	if c.DownloadLimitKbps < 0 {
+		return errors.New("download_limit_kbps can't be negative")
+	}
+	if c.Steam != nil {
+		if err := c.Steam.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Tracing != nil {
+		if err := c.Tracing.validate(); err != nil {
+			return err
+		}
+	}
+	if c.RestartVote != nil && c.RestartVote.Quorum < 0 {
+		return errors.New("restart_vote: invalid quorum")
+	}
+	if _, err := parseWelcome(c.Welcome); err != nil {
+		return fmt.Errorf("welcome: %w", err)
+	}
+	for role := range c.RCONCommands {
+		if roleLevel(role) == 0 {
+			return fmt.Errorf("rcon_commands: invalid role %q", role)
+		}
+	}
+	triggers := map[string]bool{}
+	for _, t := range c.Triggers {
+		if !reServerName.MatchString(t.Name) || triggers[t.Name] {
+			return fmt.Errorf("triggers: invalid or duplicate name %q", t.Name)
+		}
+		triggers[t.Name] = true
+		switch t.Action {
+		case "start", "stop", "restart", "backup", "start_all":
+		default:
+			return fmt.Errorf("trigger %q: invalid action %q", t.Name, t.Action)
+		}
+		if _, err := c.selectServers(t.Servers); err != nil {
+			return fmt.Errorf("trigger %q: %w", t.Name, err)
+		}
+	}
+	hooks := map[string]bool{}
+	for _, h := range c.Hooks {
+		if !reServerName.MatchString(h.Name) || hooks[h.Name] {
+			return fmt.Errorf("hooks: invalid or duplicate name %q", h.Name)
+		}
+		hooks[h.Name] = true
+		for _, k := range h.Events {
+			if !slices.Contains(eventKinds, k) {
+				return fmt.Errorf("hook %q: unknown event %q", h.Name, k)
+			}
+		}
+		if _, err := parseHook(h.Script); err != nil {
+			return fmt.Errorf("hook %q: %w", h.Name, err)
+		}
+	}
+	plugins := map[string]bool{}
+	for _, p := range c.Plugins {
+		if !reServerName.MatchString(p.Name) || plugins[p.Name] {
+			return fmt.Errorf("plugins: invalid or duplicate name %q", p.Name)
+		}
+		plugins[p.Name] = true
+		if len(p.Command) == 0 || p.Command[0] == "" {
+			return fmt.Errorf("plugin %q: command is required", p.Name)
+		}
+		for _, k := range p.Events {
+			if !slices.Contains(eventKinds, k) {
+				return fmt.Errorf("plugin %q: unknown event %q", p.Name, k)
+			}
+		}
+		tasks := map[string]bool{}
+		for _, t := range p.Tasks {
+			if !reServerName.MatchString(t.Type) || tasks[t.Type] {
+				return fmt.Errorf("plugin %q: invalid or duplicate task type %q", p.Name, t.Type)
+			}
+			tasks[t.Type] = true
+			if err := validClock(t.At); err != nil {
+				return fmt.Errorf("plugin %q: task %q: %w", p.Name, t.Type, err)
+			}
+			if _, err := c.selectServers(t.Servers); err != nil {
+				return fmt.Errorf("plugin %q: task %q: %w", p.Name, t.Type, err)
+			}
+		}
+	}
+	users := map[string]bool{}
+	for _, u := range c.Users {
+		if u.Name == "" || users[u.Name] {
+			return fmt.Errorf("users: invalid or duplicate name %q", u.Name)
+		}
+		users[u.Name] = true
+		if roleLevel(u.Role) == 0 {
+			return fmt.Errorf("user %q: invalid role %q", u.Name, u.Role)
+		}
+		if u.PasswordHash == "" && u.TailscaleLogin == "" {
+			return fmt.Errorf("user %q: password_hash or tailscale_login is required", u.Name)
+		}
+	}
+	names := map[string]bool{}
+	ports := map[int]string{}
+	for i := range c.Servers {
+		s := &c.Servers[i]
+		if !reServerName.MatchString(s.Name) {
+			return fmt.Errorf("server %q: invalid name; use lower case letters, digits, - and _", s.Name)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("server %q: duplicate name", s.Name)
+		}
+		names[s.Name] = true
+		g := gameByID(s.Game)
+		if g == nil {
+			return fmt.Errorf("server %q: unknown game %q", s.Name, s.Game)
+		}
+		if g.ID != "ark" && (len(s.Mods) != 0 || s.TotalConversionMod != "" || s.ClusterID != "" || s.Crossplay || s.MultiHome != "" || len(s.Options) != 0) {
+			return fmt.Errorf("server %q: mods, total_conversion_mod, cluster_id, crossplay, multihome and options are only supported by ark servers", s.Name)
+		}
+		if s.Map == "" {
+			return fmt.Errorf("server %q: map is required", s.Name)
+		}
+		used := []int{s.Port, s.QueryPort}
+		if g.RCON {
+			used = append(used, s.RCONPort)
+		}
+		for _, p := range used {
+			if p <= 0 || p > 65535 {
+				return fmt.Errorf("server %q: port, query_port and rcon_port are required", s.Name)
+			}
+			if o := ports[p]; o != "" {
+				return fmt.Errorf("server %q: port %d already used by %q", s.Name, p, o)
+			}
+			ports[p] = s.Name
+		}
+		if _, err := parseWelcome(s.Welcome); err != nil {
+			return fmt.Errorf("server %q: welcome: %w", s.Name, err)
+		}
+		if s.EpicOnly && !s.Crossplay {
+			return fmt.Errorf("server %q: epic_only requires crossplay", s.Name)
+		}
+		if s.PublicIPForEpic != "" {
+			if !s.Crossplay {
+				return fmt.Errorf("server %q: public_ip_for_epic requires crossplay", s.Name)
+			}
+			if net.ParseIP(s.PublicIPForEpic) == nil {
+				return fmt.Errorf("server %q: public_ip_for_epic: invalid IP %q", s.Name, s.PublicIPForEpic)
+			}
+		}
+		if s.MultiHome != "" {
+			if ip := net.ParseIP(s.MultiHome); ip == nil || ip.To4() == nil {
+				return fmt.Errorf("server %q: multihome must be an IPv4 address; the engine doesn't listen on IPv6", s.Name)
+			}
+		}
+		if _, err := parseCPUs(s.CPUAffinity); err != nil {
+			return fmt.Errorf("server %q: cpu_affinity: %w", s.Name, err)
+		}
+		if s.Nice < -20 || s.Nice > 19 {
+			return fmt.Errorf("server %q: nice must be between -20 and 19", s.Name)
+		}
+		switch s.IOSchedulingClass {
+		case "", "best-effort", "idle", "realtime":
+		default:
+			return fmt.Errorf("server %q: io_scheduling_class: invalid value %q", s.Name, s.IOSchedulingClass)
+		}
+		if s.LastWipe != "" {
+			if _, err := time.Parse("2006-01-02", s.LastWipe); err != nil {
+				return fmt.Errorf("server %q: last_wipe: expected YYYY-MM-DD, got %q", s.Name, s.LastWipe)
+			}
+		}
+		if s.MemoryMax != "" && !reMemoryMax.MatchString(s.MemoryMax) {
+			return fmt.Errorf("server %q: memory_max: invalid value %q, e.g. 12G", s.Name, s.MemoryMax)
+		}
+		for _, t := range s.Tuning {
+			switch t {
+			case "hugepages":
+			case "numa":
+				if s.CPUAffinity != "" {
+					return fmt.Errorf("server %q: the numa preset sets the CPU affinity to the node's CPUs; remove cpu_affinity", s.Name)
+				}
+			default:
+				return fmt.Errorf("server %q: tuning: unknown preset %q", s.Name, t)
+			}
+		}
+		if s.NUMANode < 0 {
+			return fmt.Errorf("server %q: numa_node must be positive", s.Name)
+		}
+		if s.SaveDir != "" && !reServerName.MatchString(strings.ToLower(s.SaveDir)) {
+			return fmt.Errorf("server %q: invalid save_dir %q", s.Name, s.SaveDir)
+		}
+		for _, o := range s.Options {
+			if !strings.Contains(o, "=") || strings.ContainsAny(o, "? ") {
+				return fmt.Errorf("server %q: invalid option %q; use Key=Value", s.Name, o)
+			}
+			if s.ClusterID != "" && isTransferOption(o) {
+				return fmt.Errorf("server %q: option %q must be set in the cluster's transfers", s.Name, o)
+			}
+			if c.Difficulty != nil && isDifficultyOption(o) {
+				return fmt.Errorf("server %q: option %q must be set in difficulty", s.Name, o)
+			}
+		}
+	}
+	clusters := map[string]bool{}
+	for _, v := range c.Clusters {
+		if v.ID == "" || clusters[v.ID] || len(c.clusterMembers(v.ID)) == 0 {
+			return fmt.Errorf("clusters: duplicate or unused id %q", v.ID)
+		}
+		clusters[v.ID] = true
+	}
+	return nil
+}
+
+// server returns the server by name, or nil.
+func (c *config) server(name string) *serverConfig {
+	for i := range c.Servers {
+		if c.Servers[i].Name == name {
+			return &c.Servers[i]
+		}
+	}
+	return nil
+}
+
+// selectServers returns the servers by name. It returns all the servers if
+// names is empty.
+func (c *config) selectServers(names []string) ([]*serverConfig, error) {
+	var out []*serverConfig
+	if len(names) == 0 {
+		for i := range c.Servers {
+			out = append(out, &c.Servers[i])
+		}
+		return out, nil
+	}
+	for _, n := range names {
+		s := c.server(n)
+		if s == nil {
+			return nil, fmt.Errorf("unknown server %q", n)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// serverByUnit returns the server by its systemd unit name, or nil.
+func (c *config) serverByUnit(unit string) *serverConfig {
+	for i := range c.Servers {
+		if c.Servers[i].unitName() == unit {
+			return &c.Servers[i]
+		}
+	}
+	return nil
+}
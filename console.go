@@ -0,0 +1,193 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rconRule restricts the RCON commands a role can send from the web console.
+// Commands are matched on their first word, case insensitively like the
+// engine does.
+type rconRule struct {
+	// Allow lists the only commands permitted. All are permitted when empty.
+	Allow []string `json:"allow,omitempty"`
+	// Deny lists commands rejected even when allowed.
+	Deny []string `json:"deny,omitempty"`
+}
+
+// rconVerb returns the command name, e.g. "Broadcast" for "Broadcast hello".
+func rconVerb(cmd string) string {
+	f := strings.Fields(cmd)
+	if len(f) == 0 {
+		return ""
+	}
+	return f[0]
+}
+
+// rconAllowed returns an error if the role can't send the command.
+func (c *config) rconAllowed(role, cmd string) error {
+	verb := rconVerb(cmd)
+	if verb == "" {
+		return errors.New("empty command")
+	}
+	r, ok := c.RCONCommands[role]
+	if !ok {
+		return nil
+	}
+	has := func(l []string) bool {
+		for _, v := range l {
+			if strings.EqualFold(v, verb) {
+				return true
+			}
+		}
+		return false
+	}
+	if (len(r.Allow) != 0 && !has(r.Allow)) || has(r.Deny) {
+		return fmt.Errorf("%s is not permitted for the %s role", verb, role)
+	}
+	return nil
+}
+
+var consoleTmpl = template.Must(template.ParseFS(rsc, "rsc/console.html.tmpl"))
+
+// serveConsole serves the web RCON console at /console/<unit>; the commands
+// are POSTed to /rpc/rcon/<unit> to be recorded in the audit log with the full
+// command. The policy is enforced here rather than in the UI. The commands
+// sent are kept in the user's history; op=star or op=unstar edits the user's
+// favorites instead of sending cmd.
+func (s *webServer) serveConsole(w http.ResponseWriter, r *http.Request) {
+	unit := path.Base(r.URL.Path)
+	c := s.config()
+	v := c.serverByUnit(unit)
+	if v == nil {
+		http.Error(w, "unknown server", http.StatusNotFound)
+		return
+	}
+	w.Header().Add("Content-Type", "text/html")
+	data := map[string]any{"Unit": unit, "Blueprints": c.blueprints(), "Commands": rconCommands}
+	u := userFrom(r.Context())
+	if op := r.FormValue("op"); r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/rpc/rcon/") && (op == "star" || op == "unstar") {
+		cmd := strings.TrimSpace(r.FormValue("cmd"))
+		setAuditDetail(r.Context(), op+" "+cmd)
+		if cmd == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			data["Err"] = "empty command"
+		} else if err := s.db.starRCON(u.Name, cmd, op == "star"); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			data["Err"] = err.Error()
+		}
+	} else if r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/rpc/rcon/") {
+		cmd := strings.TrimSpace(r.FormValue("cmd"))
+		if name := r.FormValue("bp"); name != "" {
+			var err error
+			if cmd, err = helperCmd(c, r); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				data["Err"] = err.Error()
+				s.consoleHistory(data, u)
+				_ = consoleTmpl.Execute(w, data)
+				return
+			}
+		}
+		setAuditDetail(r.Context(), cmd)
+		data["Cmd"] = cmd
+		if h := rconCommandByName(rconVerb(cmd)); h != nil {
+			data["Help"] = h
+		}
+		if err := c.rconAllowed(u.Role, cmd); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			data["Err"] = err.Error()
+		} else if err := s.db.recordRCON(u.Name, cmd); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			data["Err"] = err.Error()
+		} else if p, err := s.rconPoller(c, v); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			data["Err"] = err.Error()
+		} else {
+			ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+			defer cancel()
+			resp, err := p.Execute(ctx, cmd)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				data["Err"] = err.Error()
+			}
+			data["Resp"] = resp
+		}
+	}
+	s.consoleHistory(data, u)
+	_ = consoleTmpl.Execute(w, data)
+}
+
+// consoleHistory adds the user's favorite and recent commands to the console
+// page.
+func (s *webServer) consoleHistory(data map[string]any, u *userConfig) {
+	h, err := s.db.rconHistory(u.Name)
+	if err != nil {
+		log.Printf("rcon history: %v", err)
+	}
+	starred := make(map[string]bool, len(h.Favorites))
+	for _, f := range h.Favorites {
+		starred[f] = true
+	}
+	data["Favorites"] = h.Favorites
+	data["Recent"] = h.Recent
+	data["Starred"] = starred
+}
+
+// helperCmd builds the GiveItemToPlayer or SpawnDino command from the spawn
+// helper form.
+func helperCmd(c *config, r *http.Request) (string, error) {
+	b := c.blueprintByName(r.FormValue("bp"))
+	if b == nil {
+		return "", fmt.Errorf("unknown blueprint %q", r.FormValue("bp"))
+	}
+	num := func(k string, def int) (int, error) {
+		v := r.FormValue(k)
+		if v == "" {
+			return def, nil
+		}
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("%s: expected an integer", k)
+		}
+		return i, nil
+	}
+	if b.Kind == "dino" {
+		var xyz [3]float64
+		for i, k := range []string{"x", "y", "z"} {
+			var err error
+			if xyz[i], err = strconv.ParseFloat(r.FormValue(k), 64); err != nil {
+				return "", fmt.Errorf("%s: expected a coordinate", k)
+			}
+		}
+		level, err := num("level", 150)
+		if err != nil {
+			return "", err
+		}
+		return spawnDinoCmd(b, xyz[0], xyz[1], xyz[2], level), nil
+	}
+	id, err := num("player", 0)
+	if err != nil || id <= 0 {
+		return "", errors.New("player: the in-game player ID is required")
+	}
+	qty, err := num("qty", 1)
+	if err != nil {
+		return "", err
+	}
+	quality, err := num("quality", 0)
+	if err != nil {
+		return "", err
+	}
+	return giveItemCmd(b, id, qty, quality, r.FormValue("blueprint") != ""), nil
+}
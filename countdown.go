@@ -0,0 +1,159 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// plannedRestart is when a server goes down for a restart.
+type plannedRestart struct {
+	At time.Time
+	// Reason is "rolling_restart", "vote" or "restart" for a graceful restart
+	// in progress.
+	Reason string
+}
+
+// nextRestarts returns the planned restarts per unit. The member of a cluster
+// restarted by the next rolling restart is the one using the most memory
+// right now, so it may change until then.
+func (s *webServer) nextRestarts(ctx context.Context) map[string]plannedRestart {
+	c := s.config()
+	out := map[string]plannedRestart{}
+	if r := c.RollingRestart; r != nil {
+		if l, err := taskStatuses(ctx, c, s.db); err == nil {
+			for _, t := range l {
+				if t.Name != "rolling-restart" || t.Next.IsZero() {
+					continue
+				}
+				s.mu.Lock()
+				servers := rollingCandidates(c, s.lastStates)
+				s.mu.Unlock()
+				for _, v := range servers {
+					// The servers go down once the players were warned.
+					out[v.unitName()] = plannedRestart{At: t.Next.Add(r.warning()), Reason: "rolling_restart"}
+				}
+			}
+		}
+	}
+	for u, at := range s.votes.pendingAt() {
+		out[u] = plannedRestart{At: at, Reason: "vote"}
+	}
+	s.mu.Lock()
+	for u, at := range s.restarting {
+		out[u] = plannedRestart{At: at, Reason: "restart"}
+	}
+	s.mu.Unlock()
+	return out
+}
+
+// countdownRestarts broadcasts the time left before the rolling restart at
+// the rolling_restart's countdown, e.g. 1 hour and 30 minutes before. The
+// restart then warns the players more and more often.
+func (s *webServer) countdownRestarts(ctx context.Context) {
+	// sent is the broadcasts already sent, to send each once.
+	sent := map[string]time.Time{}
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		c := s.config()
+		r := c.RollingRestart
+		if r == nil {
+			continue
+		}
+		now := time.Now()
+		for k, at := range sent {
+			if at.Before(now) {
+				delete(sent, k)
+			}
+		}
+		marks := r.countdown()
+		for unit, p := range s.nextRestarts(ctx) {
+			v := c.serverByUnit(unit)
+			if p.Reason != "rolling_restart" || v == nil {
+				continue
+			}
+			left := p.At.Sub(now)
+			for _, m := range marks {
+				k := unit + " " + p.At.Format(time.RFC3339) + " " + m.String()
+				if left > m || left <= m-time.Minute || !sent[k].IsZero() {
+					continue
+				}
+				sent[k] = p.At
+				s.broadcast(ctx, v, fmt.Sprintf("Server restart in %s.", m))
+			}
+		}
+	}
+}
+
+// restartCountdown is the time left before the restart of a server.
+type restartCountdown struct {
+	Server string `json:"server"`
+	Unit   string `json:"unit"`
+	// RestartAt is omitted when no restart is planned.
+	RestartAt *time.Time `json:"restart_at,omitempty"`
+	Seconds   int        `json:"seconds"`
+	Reason    string     `json:"reason,omitempty"`
+}
+
+// countdown returns the time left before the restart of the server.
+func (s *webServer) countdown(v *serverConfig, planned map[string]plannedRestart) restartCountdown {
+	out := restartCountdown{Server: v.SessionName, Unit: v.unitName()}
+	if out.Server == "" {
+		out.Server = v.Name
+	}
+	if p, ok := planned[out.Unit]; ok {
+		at := p.At.Truncate(time.Second)
+		out.RestartAt = &at
+		out.Seconds = max(int(time.Until(at)/time.Second), 0)
+		out.Reason = p.Reason
+	}
+	return out
+}
+
+// apiCountdown serves GET /api/v1/countdown.
+func (s *webServer) apiCountdown(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	c := s.config()
+	planned := s.nextRestarts(r.Context())
+	out := make([]restartCountdown, 0, len(c.Servers))
+	for i := range c.Servers {
+		out = append(out, s.countdown(&c.Servers[i], planned))
+	}
+	replyJSON(w, out)
+}
+
+var countdownTmpl = template.Must(template.ParseFS(rsc, "rsc/countdown.html.tmpl"))
+
+// serveCountdown serves the countdown to the next restart of the server, as
+// a transparent page at /countdown/<unit> to add as an OBS browser source and
+// as JSON at /countdown/<unit>.json. Both are public so the streamers don't
+// need an account.
+func (s *webServer) serveCountdown(w http.ResponseWriter, r *http.Request) {
+	unit, isJSON := strings.CutSuffix(path.Base(r.URL.Path), ".json")
+	v := s.config().serverByUnit(unit)
+	if v == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if isJSON {
+		w.Header().Set("Cache-Control", "public, max-age=30")
+		replyJSON(w, s.countdown(v, s.nextRestarts(r.Context())))
+		return
+	}
+	w.Header().Add("Content-Type", "text/html")
+	_ = countdownTmpl.Execute(w, map[string]any{"Unit": unit})
+}
@@ -0,0 +1,146 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// crashDir returns the directory holding the crash reports.
+func crashDir(c *config) string {
+	return filepath.Join(c.dataDir(), "crashes")
+}
+
+// crashLogLines is the number of log lines included in a crash report.
+const crashLogLines = 1000
+
+// collectCrash writes a crash report bundle for the server with the journal,
+// the coredump information, the end of ShooterGame.log and the recent crash
+// files written by the engine.
+func collectCrash(ctx context.Context, c *config, v *serverConfig) (string, error) {
+	d := crashDir(c)
+	if err := os.MkdirAll(d, 0o700); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	p := filepath.Join(d, v.Name+"-"+now.Format("20060102-150405")+".tar.gz")
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return "", err
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	add := func(name string, b []byte) {
+		if err == nil {
+			if err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: int64(len(b)), ModTime: now}); err == nil {
+				_, err = tw.Write(b)
+			}
+		}
+	}
+	if l, err2 := journalLines(ctx, v.unitName(), crashLogLines); err2 == nil {
+		add("journal.txt", []byte(strings.Join(l, "\n")+"\n"))
+	} else {
+		add("journal.txt", []byte(err2.Error()+"\n"))
+	}
+	// The coredump itself is too large; the information includes the stack
+	// trace and how to retrieve it with coredumpctl.
+	out, err2 := exec.CommandContext(ctx, "coredumpctl", "info", "--no-pager", "COREDUMP_USER_UNIT="+v.unitName()).CombinedOutput()
+	if err2 != nil {
+		out = append(out, []byte(err2.Error()+"\n")...)
+	}
+	add("coredump.txt", out)
+	if l, err2 := tailFile(gameLogPath(c), crashLogLines); err2 == nil {
+		add("ShooterGame.log", []byte(strings.Join(l, "\n")+"\n"))
+	}
+	logs := filepath.Dir(gameLogPath(c))
+	if entries, err2 := os.ReadDir(logs); err2 == nil {
+		for _, e := range entries {
+			fi, err2 := e.Info()
+			if err2 != nil || !fi.Mode().IsRegular() || !strings.Contains(strings.ToLower(e.Name()), "crash") || now.Sub(fi.ModTime()) > time.Hour || fi.Size() > 16<<20 {
+				continue
+			}
+			if b, err2 := os.ReadFile(filepath.Join(logs, e.Name())); err2 == nil {
+				add("Logs/"+e.Name(), b)
+			}
+		}
+	}
+	if err2 := tw.Close(); err == nil {
+		err = err2
+	}
+	if err2 := gz.Close(); err == nil {
+		err = err2
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(p)
+		return "", err
+	}
+	return p, nil
+}
+
+// collectCrashes writes a crash report when a server crashes or is killed
+// for lack of memory.
+func (s *webServer) collectCrashes(ev event) {
+	if ev.Kind != evCrashed && ev.Kind != evOOMKilled {
+		return
+	}
+	c := s.config()
+	v := c.serverByUnit(ev.Unit)
+	if v == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(s.ctx, time.Minute)
+		defer cancel()
+		if p, err := collectCrash(ctx, c, v); err != nil {
+			log.Printf("crash: %s: %v", v.Name, err)
+		} else {
+			log.Printf("crash: %s: wrote %s", v.Name, p)
+		}
+	}()
+}
+
+var crashesTmpl = template.Must(template.ParseFS(rsc, "rsc/crashes.html.tmpl"))
+
+// serveCrashes lists the crash reports at /crashes/ and serves them at
+// /crashes/<file>.
+func (s *webServer) serveCrashes(w http.ResponseWriter, r *http.Request) {
+	d := crashDir(s.config())
+	if name := path.Base(r.URL.Path); name != "crashes" && name != "/" {
+		if !strings.HasSuffix(name, ".tar.gz") {
+			http.NotFound(w, r)
+			return
+		}
+		extendWriteDeadline(w, 10*time.Minute)
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		http.ServeFile(w, r, filepath.Join(d, name))
+		return
+	}
+	l, err := listArchives(d)
+	if err != nil {
+		replyError(w, err.Error())
+		return
+	}
+	loc := s.config().displayLocation(userFrom(r.Context()))
+	for i := range l {
+		l[i].ID = filepath.Base(l[i].ID)
+		l[i].Time = l[i].Time.In(loc)
+	}
+	w.Header().Add("Content-Type", "text/html")
+	_ = crashesTmpl.Execute(w, map[string]any{"Crashes": l})
+}
@@ -0,0 +1,176 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// Encrypted files are a header followed by chunks of encChunkSize bytes of
+// plaintext sealed with AES-256-GCM. The nonce of each chunk is a random
+// prefix, the chunk index and a flag set on the last chunk, so reordered or
+// truncated files fail to decrypt.
+const (
+	encMagic     = "ARKSENC1"
+	encChunkSize = 64 << 10
+	encPrefix    = 7
+)
+
+// loadKey reads a 32 bytes key encoded in hex, as generated by
+// `openssl rand -hex 32`.
+func loadKey(p string) ([]byte, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	k, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(k) != 32 {
+		return nil, errors.New(p + ": expected 32 bytes encoded in hex")
+	}
+	return k, nil
+}
+
+func encNonce(prefix []byte, i uint32, last bool) []byte {
+	n := make([]byte, 12)
+	copy(n, prefix)
+	binary.BigEndian.PutUint32(n[encPrefix:], i)
+	if last {
+		n[11] = 1
+	}
+	return n
+}
+
+// encWriter encrypts to w. Close must be called to write the last chunk.
+type encWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	i      uint32
+	buf    []byte
+}
+
+func newEncWriter(w io.Writer, key []byte) (*encWriter, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(b)
+	if err != nil {
+		return nil, err
+	}
+	e := &encWriter{w: w, aead: aead, prefix: make([]byte, encPrefix), buf: make([]byte, 0, encChunkSize)}
+	if _, err := rand.Read(e.prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append([]byte(encMagic), e.prefix...)); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *encWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) != 0 {
+		if len(e.buf) == encChunkSize {
+			if err := e.flush(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(e.buf[len(e.buf):encChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (e *encWriter) flush(last bool) error {
+	_, err := e.w.Write(e.aead.Seal(nil, encNonce(e.prefix, e.i, last), e.buf, nil))
+	e.i++
+	e.buf = e.buf[:0]
+	return err
+}
+
+func (e *encWriter) Close() error {
+	return e.flush(true)
+}
+
+// decReader decrypts a file written by encWriter.
+type decReader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	i      uint32
+	done   bool
+	out    []byte
+	in     []byte
+}
+
+func newDecReader(r io.Reader, key []byte) (*decReader, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(b)
+	if err != nil {
+		return nil, err
+	}
+	h := make([]byte, len(encMagic)+encPrefix)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(h, []byte(encMagic)) {
+		return nil, errors.New("not an encrypted backup")
+	}
+	// Read one byte past the chunk to know if it is the last one.
+	return &decReader{r: r, aead: aead, prefix: h[len(encMagic):], in: make([]byte, 0, encChunkSize+aead.Overhead()+1)}, nil
+}
+
+func (d *decReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+func (d *decReader) next() error {
+	full := encChunkSize + d.aead.Overhead()
+	n, err := io.ReadFull(d.r, d.in[len(d.in):full+1])
+	d.in = d.in[:len(d.in)+n]
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	last := len(d.in) <= full
+	c := d.in
+	if !last {
+		c = d.in[:full]
+	}
+	out, err := d.aead.Open(nil, encNonce(d.prefix, d.i, last), c, nil)
+	if err != nil {
+		return errors.New("backup decryption failed: wrong key or corrupted file")
+	}
+	d.i++
+	d.out = out
+	d.done = last
+	// Keep the extra byte for the next chunk.
+	d.in = append(d.in[:0], d.in[len(c):]...)
+	return nil
+}
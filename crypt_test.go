@@ -0,0 +1,141 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// encrypt returns plain encrypted with key.
+func encrypt(t *testing.T, key, plain []byte) []byte {
+	var b bytes.Buffer
+	e, err := newEncWriter(&b, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Written in odd sizes to cross the chunks' boundaries.
+	for p := plain; len(p) != 0; {
+		n := min(len(p), 10007)
+		if _, err := e.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func decrypt(key, enc []byte) ([]byte, error) {
+	d, err := newDecReader(bytes.NewReader(enc), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(d)
+}
+
+func TestEncRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	for _, n := range []int{0, 1, encChunkSize - 1, encChunkSize, encChunkSize + 1, 3 * encChunkSize, 3*encChunkSize + 17} {
+		plain := make([]byte, n)
+		_, _ = rand.Read(plain)
+		enc := encrypt(t, key, plain)
+		chunks := max((n+encChunkSize-1)/encChunkSize, 1)
+		if want := len(encMagic) + encPrefix + n + chunks*16; len(enc) != want {
+			t.Errorf("%d bytes: got %d encrypted bytes, want %d", n, len(enc), want)
+		}
+		got, err := decrypt(key, enc)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("%d bytes: mismatch", n)
+		}
+	}
+}
+
+func TestEncTampered(t *testing.T) {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	other := make([]byte, 32)
+	_, _ = rand.Read(other)
+	plain := make([]byte, 3*encChunkSize+100)
+	_, _ = rand.Read(plain)
+	enc := encrypt(t, key, plain)
+	hdr := len(encMagic) + encPrefix
+	full := encChunkSize + 16
+	chunk := func(i int) []byte {
+		return enc[hdr+i*full : min(hdr+(i+1)*full, len(enc))]
+	}
+	cat := func(l ...[]byte) []byte {
+		return bytes.Join(l, nil)
+	}
+	flip := func(i int) []byte {
+		b := bytes.Clone(enc)
+		b[i] ^= 1
+		return b
+	}
+	data := []struct {
+		name string
+		key  []byte
+		enc  []byte
+		err  string
+	}{
+		{"wrong key", other, enc, "wrong key or corrupted file"},
+		{"magic", key, flip(0), "not an encrypted backup"},
+		{"header", key, enc[:hdr-1], "EOF"},
+		{"prefix", key, flip(hdr - 1), "wrong key or corrupted file"},
+		{"first chunk", key, flip(hdr + 10), "wrong key or corrupted file"},
+		{"last chunk", key, flip(len(enc) - 1), "wrong key or corrupted file"},
+		{"reordered", key, cat(enc[:hdr], chunk(1), chunk(0), chunk(2), chunk(3)), "wrong key or corrupted file"},
+		{"last chunk dropped", key, enc[:hdr+3*full], "wrong key or corrupted file"},
+		{"last chunk truncated", key, enc[:len(enc)-1], "wrong key or corrupted file"},
+		{"chunk duplicated", key, cat(enc[:hdr], chunk(0), chunk(0), chunk(1), chunk(2), chunk(3)), "wrong key or corrupted file"},
+		{"appended", key, cat(enc, []byte("x")), "wrong key or corrupted file"},
+	}
+	for _, l := range data {
+		t.Run(l.name, func(t *testing.T) {
+			_, err := decrypt(l.key, l.enc)
+			if err == nil || !strings.Contains(err.Error(), l.err) {
+				t.Fatalf("got %v, want %q", err, l.err)
+			}
+		})
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	d := t.TempDir()
+	data := []struct {
+		name    string
+		content string
+		ok      bool
+	}{
+		{"valid", strings.Repeat("ab", 32) + "\n", true},
+		{"short", strings.Repeat("ab", 31), false},
+		{"long", strings.Repeat("ab", 33), false},
+		{"not hex", strings.Repeat("zz", 32), false},
+	}
+	for _, l := range data {
+		p := filepath.Join(d, l.name)
+		if err := os.WriteFile(p, []byte(l.content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		k, err := loadKey(p)
+		if (err == nil) != l.ok || (l.ok && len(k) != 32) {
+			t.Errorf("%s: got %d bytes, %v", l.name, len(k), err)
+		}
+	}
+	if _, err := loadKey(filepath.Join(d, "missing")); err == nil {
+		t.Error("missing: expected an error")
+	}
+}
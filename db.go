@@ -0,0 +1,382 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/maruel/subcommands"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets in the database.
+var (
+	bucketMeta    = []byte("meta")
+	bucketEvents  = []byte("events")
+	bucketAudit   = []byte("audit")
+	bucketPlayers = []byte("players")
+	bucketMetrics = []byte("metrics")
+	bucketJobs    = []byte("jobs")
+	// bucketLinks holds the used one-time action links.
+	bucketLinks = []byte("links")
+	// bucketBookmarks holds the map locations, keyed by "<map>/<name>".
+	bucketBookmarks = []byte("bookmarks")
+	// bucketWatchlist holds the flagged players, keyed by Steam ID.
+	bucketWatchlist = []byte("watchlist")
+	// bucketSaveTimes holds the world save durations.
+	bucketSaveTimes = []byte("save_times")
+	// bucketAnnouncements holds the recurring announcements, keyed by name.
+	bucketAnnouncements = []byte("announcements")
+	// bucketRCONHistory holds the web console's commands, keyed by user name.
+	bucketRCONHistory = []byte("rcon_history")
+	// bucketTaskRuns holds the runs of the scheduled tasks.
+	bucketTaskRuns = []byte("task_runs")
+)
+
+// migrations upgrade the schema one version at a time. Never modify an
+// existing entry, append a new one.
+var migrations = []func(tx *bolt.Tx) error{
+	// 1: initial schema.
+	func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketEvents, bucketAudit, bucketPlayers, bucketMetrics, bucketJobs} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 2: one-time action links.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketLinks)
+		return err
+	},
+	// 3: map bookmarks.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketBookmarks)
+		return err
+	},
+	// 4: player watchlist.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketWatchlist)
+		return err
+	},
+	// 5: world save durations.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketSaveTimes)
+		return err
+	},
+	// 6: recurring announcements.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketAnnouncements)
+		return err
+	},
+	// 7: RCON command history and favorites.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketRCONHistory)
+		return err
+	},
+	// 8: scheduled task runs.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketTaskRuns)
+		return err
+	},
+}
+
+// store is the embedded database holding everything that must survive a
+// restart. Values are JSON encoded.
+type store struct {
+	db *bolt.DB
+}
+
+// defaultDataDir returns ~/.local/share/ark-serman.
+func defaultDataDir() string {
+	if d := os.Getenv("XDG_DATA_HOME"); d != "" {
+		return filepath.Join(d, "ark-serman")
+	}
+	h, _ := os.UserHomeDir()
+	return filepath.Join(h, ".local", "share", "ark-serman")
+}
+
+// openStore opens the database in dir and runs the pending migrations.
+func openStore(dir string) (*store, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	p := filepath.Join(dir, "ark-serman.db")
+	db, err := bolt.Open(p, 0o600, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%s is locked; is ark-serman web running?", p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &store{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *store) close() error {
+	return s.db.Close()
+}
+
+func (s *store) migrate() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		m, err := tx.CreateBucketIfNotExists(bucketMeta)
+		if err != nil {
+			return err
+		}
+		v := 0
+		if b := m.Get([]byte("version")); b != nil {
+			v = int(binary.BigEndian.Uint32(b))
+		}
+		if v > len(migrations) {
+			return fmt.Errorf("database schema version %d is newer than supported version %d", v, len(migrations))
+		}
+		for ; v < len(migrations); v++ {
+			if err := migrations[v](tx); err != nil {
+				return fmt.Errorf("migration %d: %w", v+1, err)
+			}
+		}
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(v))
+		return m.Put([]byte("version"), b)
+	})
+}
+
+// timeKey returns a key that sorts chronologically and is unique.
+func timeKey(t time.Time) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint32(b[8:], atomic.AddUint32(&keySeq, 1))
+	return b
+}
+
+var keySeq uint32
+
+// keyTime returns the time encoded in a key created by timeKey.
+func keyTime(k []byte) time.Time {
+	if len(k) < 8 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(k)))
+}
+
+// put stores v as JSON.
+func (s *store) put(bucket, key []byte, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put(key, b)
+	})
+}
+
+// get loads the JSON at key into v. It returns false if the key is absent.
+func (s *store) get(bucket, key []byte, v any) (bool, error) {
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket).Get(key)
+		if b == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(b, v)
+	})
+	return found, err
+}
+
+// del deletes the key.
+func (s *store) del(bucket, key []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete(key)
+	})
+}
+
+// useOnce records the key in the bucket. It returns false if it was already
+// recorded.
+func (s *store) useOnce(bucket, key []byte) (bool, error) {
+	used := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if used = b.Get(key) != nil; used {
+			return nil
+		}
+		return b.Put(key, []byte("true"))
+	})
+	return !used, err
+}
+
+// scanPrefix calls f with the entries whose key starts with prefix, in key
+// order.
+func (s *store) scanPrefix(bucket, prefix []byte, f func(k, v []byte)) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			f(k, v)
+		}
+		return nil
+	})
+}
+
+// appendTime stores v under a chronological key in an append-only bucket.
+func (s *store) appendTime(bucket []byte, t time.Time, v any) error {
+	return s.put(bucket, timeKey(t), v)
+}
+
+// last calls f with the values of a chronological bucket, newest first,
+// until f returns false.
+func (s *store) last(bucket []byte, f func(k, v []byte) bool) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			if !f(k, v) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// addEvent persists an event published on the bus.
+func (s *store) addEvent(ev event) {
+	if err := s.appendTime(bucketEvents, ev.Time, ev); err != nil {
+		log.Printf("db: %v", err)
+	}
+}
+
+// loadEvents loads the most recent events into the in-memory log.
+func (s *store) loadEvents(e *eventLog) error {
+	var evs []event
+	err := s.last(bucketEvents, func(k, v []byte) bool {
+		ev := event{}
+		if err := json.Unmarshal(v, &ev); err == nil {
+			evs = append(evs, ev)
+		}
+		return len(evs) < maxEvents
+	})
+	for i := len(evs) - 1; i >= 0; i-- {
+		e.add(evs[i])
+	}
+	return err
+}
+
+// vacuum compacts the database into a new file, reclaiming the free pages.
+func vacuum(dir string) error {
+	p := filepath.Join(dir, "ark-serman.db")
+	s, err := openStore(dir)
+	if err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	dst, err := bolt.Open(tmp, 0o600, nil)
+	if err != nil {
+		s.close()
+		return err
+	}
+	err = bolt.Compact(dst, s.db, 1<<20)
+	if err2 := dst.Close(); err == nil {
+		err = err2
+	}
+	s.close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// export writes all the buckets as a JSON object of bucket name to list of
+// {key, value} to w.
+func (s *store) export(w io.Writer) error {
+	type kv struct {
+		Key   string          `json:"key"`
+		Value json.RawMessage `json:"value"`
+	}
+	out := map[string][]kv{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			l := []kv{}
+			err := b.ForEach(func(k, v []byte) error {
+				if !json.Valid(v) {
+					v, _ = json.Marshal(v)
+				}
+				key := string(k)
+				if bytes.Equal(name, bucketMeta) || !utf8.ValidString(key) {
+					key = hex.EncodeToString(k)
+				}
+				l = append(l, kv{Key: key, Value: v})
+				return nil
+			})
+			out[string(name)] = l
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(out)
+}
+
+var cmdDB = &subcommands.Command{
+	UsageLine: "db <options> <vacuum|export>",
+	ShortDesc: "Maintains the embedded database",
+	LongDesc:  "Maintains the embedded database.\n\n`vacuum` compacts the database file and `export` dumps its content as JSON to stdout.\nThe web server must be stopped since it holds the database lock.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &dbRun{}
+		c.args.flags()
+		return c
+	},
+}
+
+type dbRun struct {
+	args
+}
+
+func (d *dbRun) Run(a subcommands.Application, args []string, env subcommands.Env) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "%s: Expected one of vacuum or export.\n", a.GetName())
+		return 1
+	}
+	c, err := loadConfig(d.configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	switch args[0] {
+	case "vacuum":
+		err = vacuum(c.dataDir())
+	case "export":
+		var s *store
+		if s, err = openStore(c.dataDir()); err == nil {
+			err = s.export(os.Stdout)
+			s.close()
+		}
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,146 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maruel/ark-serman/internal/metrics"
+)
+
+// Counters exported at /debug/vars on the debug server. The RCON and D-Bus
+// counters are in their packages.
+var (
+	expHTTPRequests  = expvar.NewMap("http_requests")
+	expHTTPLatencyMS = expvar.NewMap("http_latency_ms")
+)
+
+// metHTTPDuration is exported in the Prometheus format at /metrics, with
+// the other internal metrics.
+var metHTTPDuration = metrics.NewHistogram("ark_serman_http_request_duration_seconds", "Duration of the HTTP requests by route and status code class.", metrics.DurationBuckets, "route", "code")
+
+// registerMetrics exports the servers' state last seen by watchUnits at
+// /metrics. Called once.
+func (s *webServer) registerMetrics() {
+	labels := []string{"unit"}
+	gauge := func(name, help string, f func(u *unitStatus) float64) {
+		metrics.NewGaugeFunc(name, help, labels, func(emit func(float64, ...string)) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			for i := range s.lastStates {
+				emit(f(&s.lastStates[i]), s.lastStates[i].Name)
+			}
+		})
+	}
+	gauge("ark_serman_server_running", "1 when the server's unit is running.", func(u *unitStatus) float64 {
+		if u.Running {
+			return 1
+		}
+		return 0
+	})
+	gauge("ark_serman_server_players", "Players connected to the server.", func(u *unitStatus) float64 { return float64(len(u.Players)) })
+	gauge("ark_serman_server_memory_bytes", "Memory used by the server's unit.", func(u *unitStatus) float64 { return u.Memory * 1e6 })
+	metrics.NewGaugeFunc("ark_serman_unit_states_age_seconds", "Time since watchUnits last refreshed the servers' state.", nil, func(emit func(float64, ...string)) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if !s.lastStatesTime.IsZero() {
+			emit(time.Since(s.lastStatesTime).Seconds())
+		}
+	})
+}
+
+// routeName returns the first path element, to bound the cardinality of the
+// HTTP metrics.
+func routeName(p string) string {
+	p = strings.TrimPrefix(p, "/")
+	if i := strings.IndexByte(p, '/'); i != -1 {
+		p = p[:i]
+	}
+	return "/" + p
+}
+
+// measureHTTP records the request count and latency per route. w is the
+// access logger's statusWriter, which knows the status code.
+func measureHTTP(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h.ServeHTTP(w, r)
+		d := time.Since(start)
+		n := routeName(r.URL.Path)
+		expHTTPRequests.Add(n, 1)
+		expHTTPLatencyMS.AddFloat(n, float64(d)/float64(time.Millisecond))
+		code := http.StatusOK
+		if sw, ok := w.(*statusWriter); ok && sw.status != 0 {
+			code = sw.status
+		}
+		metHTTPDuration.Observe(d.Seconds(), n, strconv.Itoa(code/100)+"xx")
+	})
+}
+
+// limitBody rejects request bodies larger than max bytes, except the file
+// uploads which serveFiles limits to maxUploadSize.
+func limitBody(h http.Handler, max int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		max := max
+		if strings.HasPrefix(r.URL.Path, "/rpc/files/") && max < maxUploadSize+maxEditSize {
+			max = maxUploadSize + maxEditSize
+		}
+		if r.ContentLength > max {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// extendWriteDeadline lets a long-running handler write its response for d
+// more, beyond -write-timeout. A zero d removes the deadline, for streaming.
+func extendWriteDeadline(w http.ResponseWriter, d time.Duration) {
+	t := time.Time{}
+	if d != 0 {
+		t = time.Now().Add(d)
+	}
+	if err := http.NewResponseController(w).SetWriteDeadline(t); err != nil {
+		log.Printf("write deadline: %v", err)
+	}
+}
+
+// extendReadDeadline lets a handler read the request's body for d more,
+// beyond -read-timeout, e.g. a large upload.
+func extendReadDeadline(w http.ResponseWriter, d time.Duration) {
+	if err := http.NewResponseController(w).SetReadDeadline(time.Now().Add(d)); err != nil {
+		log.Printf("read deadline: %v", err)
+	}
+}
+
+// serveDebug serves net/http/pprof, expvar at /debug/vars, the Prometheus
+// metrics at /metrics and a full goroutine dump at /debug/goroutines on addr. A missing host means
+// localhost.
+func serveDebug(ctx context.Context, addr string) {
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+		addr = net.JoinHostPort("localhost", port)
+	}
+	// net/http/pprof and expvar register on the default mux.
+	http.Handle("/debug/goroutines", http.RedirectHandler("/debug/pprof/goroutine?debug=2", http.StatusFound))
+	http.Handle("/metrics", metrics.Handler())
+	s := &http.Server{
+		Addr:        addr,
+		Handler:     http.DefaultServeMux,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	log.Printf("Serving debug on %s", addr)
+	if err := s.ListenAndServe(); err != nil {
+		log.Printf("debug: %v", err)
+	}
+}
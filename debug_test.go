@@ -0,0 +1,93 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimitBody(t *testing.T) {
+	h := limitBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		}
+	}), 1<<20)
+	data := []struct {
+		path string
+		size int
+		want int
+	}{
+		{"/rpc/hold", 1 << 10, http.StatusOK},
+		{"/rpc/hold", 2 << 20, http.StatusRequestEntityTooLarge},
+		{"/rpc/files/ark-island.service/saves/", 2 << 20, http.StatusOK},
+		{"/rpc/files/ark-island.service/saves/", maxUploadSize + maxEditSize + 1, http.StatusRequestEntityTooLarge},
+	}
+	for i, l := range data {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", l.path, bytes.NewReader(make([]byte, l.size)))
+		h.ServeHTTP(w, r)
+		if w.Code != l.want {
+			t.Errorf("#%d: %s %d bytes: got %d, want %d", i, l.path, l.size, w.Code, l.want)
+		}
+	}
+	// Without Content-Length, the body is cut while read.
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/rpc/files/ark-island.service/saves/", io.MultiReader(bytes.NewReader(make([]byte, 2<<20))))
+	r.ContentLength = -1
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("chunked upload: got %d", w.Code)
+	}
+}
+
+func TestExtendReadDeadline(t *testing.T) {
+	data := []struct {
+		name   string
+		extend bool
+		want   bool
+	}{
+		{"read timeout", false, false},
+		{"extended", true, true},
+	}
+	for _, l := range data {
+		t.Run(l.name, func(t *testing.T) {
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if l.extend {
+					extendReadDeadline(w, 10*time.Second)
+				}
+				if _, err := io.Copy(io.Discard, r.Body); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+				}
+			}))
+			srv.Config.ReadTimeout = 200 * time.Millisecond
+			srv.Start()
+			defer srv.Close()
+			// A slow upload, taking longer than ReadTimeout.
+			pr, pw := io.Pipe()
+			go func() {
+				for i := 0; i < 5; i++ {
+					time.Sleep(100 * time.Millisecond)
+					if _, err := pw.Write(make([]byte, 1024)); err != nil {
+						return
+					}
+				}
+				pw.Close()
+			}()
+			resp, err := http.Post(srv.URL, "application/octet-stream", pr)
+			ok := err == nil && resp.StatusCode == http.StatusOK
+			if resp != nil {
+				resp.Body.Close()
+			}
+			if ok != l.want {
+				t.Fatalf("got %v, %v", resp, err)
+			}
+		})
+	}
+}
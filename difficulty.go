@@ -0,0 +1,319 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/maruel/subcommands"
+)
+
+// difficulty is the wild dino level setting of a map.
+type difficulty struct {
+	// DifficultyOffset scales the difficulty between its minimum and
+	// OverrideOfficialDifficulty, from 0 to 1.
+	DifficultyOffset float64 `json:"difficulty_offset,omitempty"`
+	// OverrideOfficialDifficulty is the maximum difficulty; the maximum wild
+	// dino level is 30 times it when DifficultyOffset is 1.
+	OverrideOfficialDifficulty float64 `json:"override_official_difficulty,omitempty"`
+}
+
+// maxWildLevel returns the maximum wild dino level.
+func (d difficulty) maxWildLevel() int {
+	return int(math.Round(30 * (d.DifficultyOffset*(d.OverrideOfficialDifficulty-0.5) + 0.5)))
+}
+
+// difficultyConfig manages the difficulty of all the servers. The values are
+// set on every server's command line, overriding GameUserSettings.ini, so the
+// servers of a map share the same levels across the cluster.
+type difficultyConfig struct {
+	// DifficultyOffset defaults to 1.
+	DifficultyOffset float64 `json:"difficulty_offset,omitempty"`
+	// OverrideOfficialDifficulty defaults to the map's max_wild_level divided
+	// by 30.
+	OverrideOfficialDifficulty float64 `json:"override_official_difficulty,omitempty"`
+	// Maps override the values per map ID, e.g. {"Aberration_P":
+	// {"override_official_difficulty": 4}}.
+	Maps map[string]difficulty `json:"maps,omitempty"`
+}
+
+// difficultyKeys are the options managed by difficultyConfig.
+var difficultyKeys = []string{"DifficultyOffset", "OverrideOfficialDifficulty"}
+
+// isDifficultyOption returns true if the Key=Value option is managed by
+// difficultyConfig.
+func isDifficultyOption(o string) bool {
+	k, _, _ := strings.Cut(o, "=")
+	for _, n := range difficultyKeys {
+		if strings.EqualFold(n, k) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *difficultyConfig) validate(c *config) error {
+	check := func(name string, v difficulty) error {
+		if v.DifficultyOffset < 0 || v.DifficultyOffset > 1 {
+			return fmt.Errorf("%s: difficulty_offset must be between 0 and 1, got %g", name, v.DifficultyOffset)
+		}
+		if v.OverrideOfficialDifficulty < 0 {
+			return fmt.Errorf("%s: override_official_difficulty must be positive, got %g", name, v.OverrideOfficialDifficulty)
+		}
+		return nil
+	}
+	if err := check("difficulty", difficulty{d.DifficultyOffset, d.OverrideOfficialDifficulty}); err != nil {
+		return err
+	}
+	known := map[string]bool{}
+	for _, m := range c.maps() {
+		known[m.ID] = true
+	}
+	for id, v := range d.Maps {
+		if !known[id] {
+			return fmt.Errorf("difficulty: unknown map %q", id)
+		}
+		if err := check("difficulty: "+id, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forMap returns the values of the map, with the defaults applied.
+func (d *difficultyConfig) forMap(c *config, id string) difficulty {
+	out := difficulty{DifficultyOffset: d.DifficultyOffset, OverrideOfficialDifficulty: d.OverrideOfficialDifficulty}
+	if v, ok := d.Maps[id]; ok {
+		if v.DifficultyOffset != 0 {
+			out.DifficultyOffset = v.DifficultyOffset
+		}
+		if v.OverrideOfficialDifficulty != 0 {
+			out.OverrideOfficialDifficulty = v.OverrideOfficialDifficulty
+		}
+	}
+	if out.DifficultyOffset == 0 {
+		out.DifficultyOffset = 1
+	}
+	if out.OverrideOfficialDifficulty == 0 {
+		out.OverrideOfficialDifficulty = mapDifficulty(c, id)
+	}
+	return out
+}
+
+// options returns the URL options of a server on the map. Both are always
+// set so no server keeps a different value from the INI.
+func (d *difficultyConfig) options(c *config, id string) []string {
+	v := d.forMap(c, id)
+	return []string{
+		"DifficultyOffset=" + strconv.FormatFloat(v.DifficultyOffset, 'f', -1, 64),
+		"OverrideOfficialDifficulty=" + strconv.FormatFloat(v.OverrideOfficialDifficulty, 'f', -1, 64),
+	}
+}
+
+// mapDifficulty returns the default maximum difficulty of the map.
+func mapDifficulty(c *config, id string) float64 {
+	l := c.mapInfo(id).MaxWildLevel
+	if l == 0 {
+		l = 150
+	}
+	return float64(l) / 30
+}
+
+// serverDifficulty is the difficulty a server runs with.
+type serverDifficulty struct {
+	Server  string
+	Map     string
+	MapName string
+	Cluster string
+	difficulty
+	MaxWildLevel int
+	// Source is "difficulty" when managed, "launch" or "GameUserSettings.ini"
+	// when set there, "default" otherwise.
+	Source string
+	// Mismatch is set when another member of the cluster on the same map has
+	// a different maximum level.
+	Mismatch bool
+}
+
+// serverDifficulties returns the difficulty of the Ark servers.
+func serverDifficulties(c *config) ([]serverDifficulty, error) {
+	var out []serverDifficulty
+	for i := range c.Servers {
+		v := &c.Servers[i]
+		if v.gameInfo().ID != "ark" {
+			continue
+		}
+		d := serverDifficulty{Server: v.Name, Map: v.Map, MapName: c.mapInfo(v.Map).Name, Cluster: v.ClusterID, Source: "difficulty"}
+		if c.Difficulty != nil {
+			d.difficulty = c.Difficulty.forMap(c, v.Map)
+		} else {
+			s, err := serverSettings(c, v)
+			if err != nil {
+				return nil, err
+			}
+			// The game's default offset.
+			d.difficulty = difficulty{DifficultyOffset: 0.2, OverrideOfficialDifficulty: mapDifficulty(c, v.Map)}
+			d.Source = "default"
+			// The launch options override GameUserSettings.ini.
+			for _, f := range []struct {
+				k string
+				p *float64
+			}{{"DifficultyOffset", &d.DifficultyOffset}, {"OverrideOfficialDifficulty", &d.OverrideOfficialDifficulty}} {
+				for _, k := range []string{"launch\x00" + f.k, "GameUserSettings.ini\x00[ServerSettings] " + f.k} {
+					if e, ok := s[strings.ToLower(k)]; ok {
+						if v, err := strconv.ParseFloat(e.Value, 64); err == nil {
+							*f.p, d.Source = v, e.Source
+							break
+						}
+					}
+				}
+			}
+		}
+		d.MaxWildLevel = d.maxWildLevel()
+		out = append(out, d)
+	}
+	for i := range out {
+		for j := range out {
+			if out[i].Cluster != "" && out[i].Cluster == out[j].Cluster && out[i].Map == out[j].Map && out[i].MaxWildLevel != out[j].MaxWildLevel {
+				out[i].Mismatch = true
+			}
+		}
+	}
+	return out, nil
+}
+
+var cmdDifficulty = &subcommands.Command{
+	UsageLine: "difficulty <options> <show|set> <Setting=Value...>",
+	ShortDesc: "Manages the wild dino levels",
+	LongDesc:  "Manages DifficultyOffset and OverrideOfficialDifficulty for all the servers or per map, e.g. `difficulty -map Aberration_P set MaxWildLevel=120`. MaxWildLevel sets OverrideOfficialDifficulty to a level / 30 and DifficultyOffset to 1. A value of 0 removes the setting.\n\nRun `install` afterward to apply them to the servers.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &difficultyRun{}
+		c.args.flags()
+		c.Flags.StringVar(&c.mapID, "map", "", "map ID; all the maps when empty")
+		return c
+	},
+}
+
+type difficultyRun struct {
+	args
+	mapID string
+}
+
+func (r *difficultyRun) Run(a subcommands.Application, args []string, env subcommands.Env) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "%s: Expected one of show or set.\n", a.GetName())
+		return 1
+	}
+	c, err := loadConfig(r.configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	switch args[0] {
+	case "show":
+		var l []serverDifficulty
+		if l, err = serverDifficulties(c); err == nil {
+			for _, d := range l {
+				w := ""
+				if d.Mismatch {
+					w = " differs in cluster " + d.Cluster
+				}
+				fmt.Printf("%-16s %-24s offset %-5g override %-5g max level %4d (%s)%s\n", d.Server, d.MapName, d.DifficultyOffset, d.OverrideOfficialDifficulty, d.MaxWildLevel, d.Source, w)
+			}
+		}
+	case "set":
+		err = r.set(c, args[1:])
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
+
+func (r *difficultyRun) set(c *config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("at least one Setting=Value is required")
+	}
+	if c.Difficulty == nil {
+		c.Difficulty = &difficultyConfig{}
+	}
+	d := difficulty{DifficultyOffset: c.Difficulty.DifficultyOffset, OverrideOfficialDifficulty: c.Difficulty.OverrideOfficialDifficulty}
+	if r.mapID != "" {
+		d = c.Difficulty.Maps[r.mapID]
+	}
+	for _, a := range args {
+		k, val, ok := strings.Cut(a, "=")
+		if !ok {
+			return fmt.Errorf("invalid %q; use Setting=Value", a)
+		}
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return fmt.Errorf("%s: invalid value %q", k, val)
+		}
+		switch strings.ToLower(k) {
+		case "difficultyoffset":
+			d.DifficultyOffset = f
+		case "overrideofficialdifficulty":
+			d.OverrideOfficialDifficulty = f
+		case "maxwildlevel":
+			d.DifficultyOffset, d.OverrideOfficialDifficulty = 1, f/30
+			if f == 0 {
+				d.DifficultyOffset = 0
+			}
+		default:
+			return fmt.Errorf("unknown difficulty setting %q", k)
+		}
+	}
+	if r.mapID == "" {
+		c.Difficulty.DifficultyOffset, c.Difficulty.OverrideOfficialDifficulty = d.DifficultyOffset, d.OverrideOfficialDifficulty
+	} else if d == (difficulty{}) {
+		delete(c.Difficulty.Maps, r.mapID)
+	} else {
+		if c.Difficulty.Maps == nil {
+			c.Difficulty.Maps = map[string]difficulty{}
+		}
+		c.Difficulty.Maps[r.mapID] = d
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+	return c.save(r.configPath)
+}
+
+var difficultyTmpl = template.Must(template.ParseFS(rsc, "rsc/difficulty.html.tmpl"))
+
+// serveDifficulty shows the servers' wild dino levels and a calculator at
+// /difficulty/.
+func (s *webServer) serveDifficulty(w http.ResponseWriter, r *http.Request) {
+	c := s.config()
+	l, err := serverDifficulties(c)
+	data := map[string]any{"Servers": l, "Managed": c.Difficulty != nil}
+	if err != nil {
+		data["Err"] = err.Error()
+	}
+	var maps []mapInfo
+	for _, m := range c.maps() {
+		if m.MaxWildLevel == 0 {
+			m.MaxWildLevel = 150
+		}
+		maps = append(maps, m)
+	}
+	data["Maps"] = maps
+	w.Header().Add("Content-Type", "text/html")
+	if err := difficultyTmpl.Execute(w, data); err != nil {
+		log.Printf("difficulty: %v", err)
+	}
+}
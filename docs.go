@@ -0,0 +1,152 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// rconCommand is an admin command of the Ark server, sent via RCON or typed
+// in the game's console after "admincheat".
+type rconCommand struct {
+	Name string
+	// Args are the arguments, e.g. "<PlayerID> <Message>".
+	Args string
+	Doc  string
+}
+
+// rconCommands is the reference of the common admin commands.
+var rconCommands = []rconCommand{
+	{"AllowPlayerToJoinNoCheck", "<SteamID>", "Adds the player to the whitelist, e.g. for -exclusivejoin."},
+	{"BanPlayer", "<SteamID>", "Bans the player from the server."},
+	{"Broadcast", "<Message>", "Shows the message to all the players in the middle of the screen."},
+	{"ClearPlayerInventory", "<PlayerID> <Inventory> <SlotItems> <Equipped>", "Clears the player's inventory, slots and equipment; each flag is true or false."},
+	{"DestroyAll", "<Class>", "Destroys all the creatures or structures of the class, e.g. Rex_Character_BP_C."},
+	{"DestroyStructures", "", "Destroys all the structures; use with care."},
+	{"DestroyTribeDinos", "", "Destroys the tamed creatures of the tribe of the admin's target."},
+	{"DestroyWildDinos", "", "Destroys all the wild creatures so they respawn, e.g. after changing the difficulty."},
+	{"DisallowPlayerToJoinNoCheck", "<SteamID>", "Removes the player from the whitelist."},
+	{"DoExit", "", "Stops the server without saving; run SaveWorld first."},
+	{"ForceTame", "", "Tames the creature the admin is looking at."},
+	{"GetChat", "", "Returns the chat messages since the last call."},
+	{"GetGameLog", "", "Returns the game log lines since the last call."},
+	{"GetPlayerIDForSteamID", "<SteamID>", "Returns the in-game player ID of a Steam ID, for the commands taking a PlayerID."},
+	{"GetSteamIDForPlayerID", "<PlayerID>", "Returns the Steam ID of an in-game player ID."},
+	{"GetTribeIdPlayerList", "<TribeID>", "Lists the members of the tribe."},
+	{"GiveExpToPlayer", "<PlayerID> <Amount> <FromTribeShare> <PreventSharing>", "Gives experience to the player."},
+	{"GiveItemNum", "<ItemNum> <Quantity> <Quality> <Blueprint>", "Gives the item by its number to the admin."},
+	{"GiveItemToPlayer", "<PlayerID> <BlueprintPath> <Quantity> <Quality> <Blueprint>", "Gives the item to the player; the spawn helper of the console builds it."},
+	{"KickPlayer", "<SteamID>", "Disconnects the player."},
+	{"KillPlayer", "<PlayerID>", "Kills the player's character."},
+	{"ListPlayers", "", "Lists the connected players with their Steam ID."},
+	{"PlayersOnly", "", "Freezes the creatures and the crafting; run it again to resume."},
+	{"RenamePlayer", "\"<Name>\" <NewName>", "Renames the player's character."},
+	{"RenameTribe", "\"<Name>\" <NewName>", "Renames the tribe."},
+	{"SaveWorld", "", "Saves the world; the server replies once the save is done."},
+	{"ScriptCommand", "<Command>", "Runs a mod's command, e.g. for the mods with admin tools."},
+	{"ServerChat", "<Message>", "Sends the message to the chat as SERVER."},
+	{"ServerChatTo", "\"<SteamID>\" <Message>", "Sends a private chat message to the player."},
+	{"ServerChatToPlayer", "\"<Name>\" <Message>", "Sends a private chat message to the player by name."},
+	{"SetMessageOfTheDay", "<Message>", "Sets the message of the day shown to the players joining."},
+	{"SetTimeOfDay", "<HH:MM[:SS]>", "Sets the time of day."},
+	{"ShowMessageOfTheDay", "", "Shows the message of the day to all the players."},
+	{"SpawnDino", "<BlueprintPath> <X> <Y> <Z> <Level>", "Spawns a wild creature at the coordinates; the spawn helper of the console builds it."},
+	{"TeleportPlayerIDToPlayer", "<PlayerID> <ToPlayerID>", "Teleports a player to another one."},
+	{"TeleportToPlayer", "<PlayerID>", "Teleports the admin to the player."},
+	{"UnbanPlayer", "<SteamID>", "Lifts the ban of the player."},
+}
+
+// rconCommandByName returns the command of the reference, case
+// insensitively, or nil.
+func rconCommandByName(name string) *rconCommand {
+	for i := range rconCommands {
+		if strings.EqualFold(rconCommands[i].Name, name) {
+			return &rconCommands[i]
+		}
+	}
+	return nil
+}
+
+// docEntry is an entry of the reference.
+type docEntry struct {
+	// Kind is "command", "setting" or "flag".
+	Kind string
+	Name string
+	Args string
+	// Where is the INI file and section of the settings.
+	Where string
+	Doc   string
+}
+
+// Anchor returns the entry's HTML anchor, e.g. command-SaveWorld.
+func (d *docEntry) Anchor() string {
+	return d.Kind + "-" + d.Name
+}
+
+// docEntries returns the reference sorted by kind and name.
+func docEntries() []docEntry {
+	var out []docEntry
+	for _, c := range rconCommands {
+		out = append(out, docEntry{Kind: "command", Name: c.Name, Args: c.Args, Doc: c.Doc})
+	}
+	where := map[string]string{}
+	for f, sections := range iniKeys {
+		for sec, keys := range sections {
+			for _, k := range keys {
+				w := iniFileNames[f] + " [" + iniSectionNames[sec] + "]"
+				if where[k.Name] != "" && where[k.Name] != w {
+					w = where[k.Name] + ", " + w
+				}
+				where[k.Name] = w
+			}
+		}
+	}
+	for k, v := range settingDocs {
+		w := where[k]
+		if w == "" && overrideKindOf(k) != nil {
+			w = "Game.ini [" + gameModeSection + "]"
+		}
+		out = append(out, docEntry{Kind: "setting", Name: k, Where: w, Doc: v})
+	}
+	for _, f := range launchFlags {
+		a := ""
+		if f.Value {
+			a = "=<Value>"
+		}
+		out = append(out, docEntry{Kind: "flag", Name: f.Name, Args: a, Doc: f.Doc})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Kind != out[j].Kind {
+			return out[i].Kind < out[j].Kind
+		}
+		return strings.ToLower(out[i].Name) < strings.ToLower(out[j].Name)
+	})
+	return out
+}
+
+var docsTmpl = template.Must(template.ParseFS(rsc, "rsc/docs.html.tmpl"))
+
+// serveDocs serves the reference of the admin commands, the settings and
+// the flags at /docs/?q=<words>.
+func (s *webServer) serveDocs(w http.ResponseWriter, r *http.Request) {
+	q := r.FormValue("q")
+	words := strings.Fields(strings.ToLower(q))
+	var l []docEntry
+	for _, d := range docEntries() {
+		t := strings.ToLower(d.Name + " " + d.Args + " " + d.Where + " " + d.Doc)
+		ok := true
+		for _, w := range words {
+			ok = ok && strings.Contains(t, w)
+		}
+		if ok {
+			l = append(l, d)
+		}
+	}
+	w.Header().Add("Content-Type", "text/html")
+	_ = docsTmpl.Execute(w, map[string]any{"Q": q, "Entries": l})
+}
@@ -0,0 +1,238 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/maruel/ark-serman/internal/systemdctl"
+)
+
+// The servers' environment variables, e.g. the WINE settings, are kept in a
+// drop-in next to the generated unit so regenerating the unit keeps them.
+
+// envVar is an environment variable of a unit.
+type envVar struct {
+	Name  string
+	Value string
+}
+
+// Secret returns true if the variable likely holds a secret, which isn't
+// shown in the web UI.
+func (e *envVar) Secret() bool {
+	return reSecretEnv.MatchString(e.Name)
+}
+
+var (
+	reEnvName   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	reSecretEnv = regexp.MustCompile(`(?i)pass|secret|token|key|credential`)
+)
+
+// envDropIn returns the path of the drop-in holding the unit's environment.
+func envDropIn(unit string) (string, error) {
+	d, err := userUnitDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(d, unit+".d", "ark-serman-env.conf"), nil
+}
+
+// envQuote quotes an assignment for use in Environment=.
+func envQuote(e envVar) string {
+	s := e.Name + "=" + e.Value
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "%", "%%")
+	return `"` + s + `"`
+}
+
+// envUnquote undoes envQuote.
+func envUnquote(s string) (envVar, bool) {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return envVar{}, false
+	}
+	b := strings.Builder{}
+	s = s[1 : len(s)-1]
+	for i := 0; i < len(s); i++ {
+		if (s[i] == '\\' || s[i] == '%') && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	n, v, ok := strings.Cut(b.String(), "=")
+	return envVar{Name: n, Value: v}, ok
+}
+
+// readEnv returns the variables of the unit's drop-in, sorted by name.
+func readEnv(unit string) ([]envVar, error) {
+	p, err := envDropIn(unit)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []envVar
+	for _, l := range strings.Split(string(b), "\n") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(l), "Environment="); ok {
+			if e, ok := envUnquote(v); ok {
+				out = append(out, e)
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// validateEnv checks the variables before they are written.
+func validateEnv(l []envVar) error {
+	seen := map[string]bool{}
+	for _, e := range l {
+		if !reEnvName.MatchString(e.Name) {
+			return fmt.Errorf("invalid variable name %q", e.Name)
+		}
+		if seen[e.Name] {
+			return fmt.Errorf("variable %s is set twice", e.Name)
+		}
+		seen[e.Name] = true
+		if strings.ContainsAny(e.Value, "\r\n\x00") {
+			return fmt.Errorf("variable %s: the value must be on one line", e.Name)
+		}
+	}
+	return nil
+}
+
+// writeEnv replaces the variables of the unit's drop-in, removing it when l
+// is empty. The running server only sees them after a restart.
+func writeEnv(unit string, l []envVar) error {
+	if err := validateEnv(l); err != nil {
+		return err
+	}
+	p, err := envDropIn(unit)
+	if err != nil {
+		return err
+	}
+	if len(l) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		// Only succeeds when no other drop-in is left.
+		_ = os.Remove(filepath.Dir(p))
+		return nil
+	}
+	b := bytes.Buffer{}
+	b.WriteString("# Generated by ark-serman. Edit in the web UI, changes will be overwritten.\n[Service]\n")
+	for _, e := range l {
+		b.WriteString("Environment=" + envQuote(e) + "\n")
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	// May contain secrets.
+	return os.WriteFile(p, b.Bytes(), 0o600)
+}
+
+var envTmpl = template.Must(template.ParseFS(rsc, "rsc/env.html.tmpl"))
+
+// serveEnv serves the unit's environment editor at /env/<unit>. The changes
+// are POSTed to /rpc/env/<unit> to be recorded in the audit log. Only admins
+// can see and change the environment since it may hold secrets.
+func (s *webServer) serveEnv(w http.ResponseWriter, r *http.Request) {
+	unit := path.Base(r.URL.Path)
+	if s.config().serverByUnit(unit) == nil {
+		http.Error(w, "unknown server", http.StatusNotFound)
+		return
+	}
+	if !userFrom(r.Context()).hasRole(roleAdmin) {
+		http.Error(w, "only admins can manage the environment", http.StatusForbidden)
+		return
+	}
+	data := map[string]any{"Unit": unit}
+	if r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/rpc/env/") {
+		if err := s.saveEnv(r, unit); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			data["Err"] = err.Error()
+		} else {
+			data["Result"] = "Saved. Restart the server to apply the changes."
+		}
+	}
+	l, err := readEnv(unit)
+	if err != nil {
+		data["Err"] = err.Error()
+	}
+	data["Vars"] = l
+	w.Header().Add("Content-Type", "text/html")
+	_ = envTmpl.Execute(w, data)
+}
+
+// saveEnv writes the submitted variables and reloads systemd. An empty value
+// keeps the current value of a secret, which isn't sent to the browser.
+func (s *webServer) saveEnv(r *http.Request, unit string) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	old, err := readEnv(unit)
+	if err != nil {
+		return err
+	}
+	cur := map[string]string{}
+	for _, e := range old {
+		cur[e.Name] = e.Value
+	}
+	names, values := r.PostForm["name"], r.PostForm["value"]
+	if len(names) != len(values) {
+		return errors.New("malformed form")
+	}
+	var l []envVar
+	var changed []string
+	for i, n := range names {
+		e := envVar{Name: strings.TrimSpace(n), Value: values[i]}
+		if e.Name == "" || r.PostForm.Get("delete_"+e.Name) != "" {
+			continue
+		}
+		if v, ok := cur[e.Name]; ok && e.Secret() && e.Value == "" {
+			e.Value = v
+		}
+		if v, ok := cur[e.Name]; !ok || v != e.Value {
+			changed = append(changed, e.Name)
+		}
+		delete(cur, e.Name)
+		l = append(l, e)
+	}
+	for n := range cur {
+		changed = append(changed, "-"+n)
+	}
+	sort.Strings(changed)
+	// Only the names; the values may be secrets.
+	setAuditDetail(r.Context(), strings.Join(changed, " "))
+	sort.Slice(l, func(i, j int) bool { return l[i].Name < l[j].Name })
+	if err := writeEnv(unit, l); err != nil {
+		return err
+	}
+	conn, err := systemdctl.Dial(r.Context())
+	if err != nil {
+		return fmt.Errorf("saved but systemd wasn't reloaded: %w", err)
+	}
+	defer conn.Close()
+	if err := conn.ReloadContext(r.Context()); err != nil {
+		return fmt.Errorf("saved but systemd wasn't reloaded: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// event is a notable thing that happened to a server, e.g. a restart, an
+// update, a wipe or a backup.
+type event struct {
+	Time time.Time `json:"time"`
+	// Unit is the systemd unit name. It is empty for host wide events.
+	Unit string `json:"unit,omitempty"`
+	// Kind is one of the ev* constants.
+	Kind string `json:"kind"`
+	Msg  string `json:"msg"`
+	// Player is set for player events.
+	Player *player `json:"player,omitempty"`
+	// Stats is set for stats events.
+	Stats *serverStats `json:"stats,omitempty"`
+}
+
+// maxEvents is the number of events kept in memory.
+const maxEvents = 256
+
+// eventLog is a bounded in-memory list of recent events, fed from the bus.
+type eventLog struct {
+	mu     sync.Mutex
+	events []event
+}
+
+var events eventLog
+
+func (e *eventLog) add(ev event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.events) == maxEvents {
+		copy(e.events, e.events[1:])
+		e.events = e.events[:maxEvents-1]
+	}
+	e.events = append(e.events, ev)
+}
+
+// adminEvents are the event kinds only shown to the admins, e.g. the
+// watchlist's notes about a player.
+var adminEvents = map[string]bool{evWatchedJoined: true}
+
+// list returns the events for unit, newest first. If unit is empty, all the
+// events are returned. The adminEvents are only returned when admin is true.
+func (e *eventLog) list(unit string, admin bool) []event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var out []event
+	for i := len(e.events) - 1; i >= 0; i-- {
+		if adminEvents[e.events[i].Kind] && !admin {
+			continue
+		}
+		if unit == "" || e.events[i].Unit == unit {
+			out = append(out, e.events[i])
+		}
+	}
+	return out
+}
+
+// Atom feed.
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Link    []atomLink  `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Updated string   `xml:"updated"`
+	Link    atomLink `xml:"link"`
+	Summary string   `xml:"summary"`
+}
+
+// baseURL returns the URL the client used to reach us, without path.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// serveFeed serves /feed.atom for all servers and /feed/<unit>.atom for a
+// single server.
+func serveFeed(w http.ResponseWriter, r *http.Request) {
+	unit := ""
+	title := "ark-serman events"
+	if strings.HasPrefix(r.URL.Path, "/feed/") {
+		unit = strings.TrimSuffix(path.Base(r.URL.Path), ".atom")
+		title = "ark-serman events for " + unit
+	}
+	base := baseURL(r)
+	self := base + r.URL.Path
+	f := atomFeed{
+		Title:  title,
+		ID:     self,
+		Link:   []atomLink{{Href: self, Rel: "self"}, {Href: base + "/"}},
+		Author: atomAuthor{Name: "ark-serman"},
+	}
+	// The feed is public.
+	evs := events.list(unit, false)
+	updated := time.Now()
+	if len(evs) != 0 {
+		updated = evs[0].Time
+	}
+	f.Updated = updated.UTC().Format(time.RFC3339)
+	for _, ev := range evs {
+		t := ev.Time.UTC().Format(time.RFC3339Nano)
+		name := ev.Unit
+		if name == "" {
+			name = "host"
+		}
+		f.Entries = append(f.Entries, atomEntry{
+			Title:   fmt.Sprintf("%s: %s", name, ev.Kind),
+			ID:      fmt.Sprintf("%s#%s-%s-%s", self, t, name, ev.Kind),
+			Updated: t,
+			Link:    atomLink{Href: base + "/"},
+			Summary: ev.Msg,
+		})
+	}
+	w.Header().Add("Content-Type", "application/atom+xml; charset=utf-8")
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	w.Write([]byte(xml.Header))
+	if err := enc.Encode(&f); err != nil {
+		log.Printf("feed: %v", err)
+	}
+}
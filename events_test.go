@@ -0,0 +1,52 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEventsAdminOnly(t *testing.T) {
+	events.mu.Lock()
+	saved := events.events
+	events.events = nil
+	events.mu.Unlock()
+	defer func() {
+		events.mu.Lock()
+		events.events = saved
+		events.mu.Unlock()
+	}()
+	events.add(event{Unit: "ark-island.service", Kind: evPlayerJoined, Msg: "Bob joined"})
+	events.add(event{Unit: "ark-island.service", Kind: evWatchedJoined, Msg: "76561198000000000 joined: griefed the base"})
+	events.add(event{Unit: "ark-other.service", Kind: evStarted, Msg: "started"})
+	data := []struct {
+		unit  string
+		admin bool
+		want  []string
+	}{
+		{"", false, []string{evStarted, evPlayerJoined}},
+		{"", true, []string{evStarted, evWatchedJoined, evPlayerJoined}},
+		{"ark-island.service", false, []string{evPlayerJoined}},
+		{"ark-island.service", true, []string{evWatchedJoined, evPlayerJoined}},
+	}
+	for i, l := range data {
+		var got []string
+		for _, ev := range events.list(l.unit, l.admin) {
+			got = append(got, ev.Kind)
+		}
+		if strings.Join(got, ",") != strings.Join(l.want, ",") {
+			t.Errorf("#%d: got %q, want %q", i, got, l.want)
+		}
+	}
+	for _, p := range []string{"/feed.atom", "/feed/ark-island.service.atom"} {
+		w := httptest.NewRecorder()
+		serveFeed(w, httptest.NewRequest("GET", p, nil))
+		if b := w.Body.String(); strings.Contains(b, "griefed") || !strings.Contains(b, "Bob joined") {
+			t.Errorf("%s:\n%s", p, b)
+		}
+	}
+}
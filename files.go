@@ -0,0 +1,369 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxEditSize is the largest text file edited in the web UI.
+const maxEditSize = 1 << 20
+
+// maxUploadSize is the largest file uploaded in the web UI.
+const maxUploadSize = 64 << 20
+
+// uploadTimeout bounds an upload, e.g. maxUploadSize over a 1 Mbps uplink.
+const uploadTimeout = 15 * time.Minute
+
+// fileRoot is a directory browsable at /files/<unit>/<name>/.
+type fileRoot struct {
+	Name string
+	Dir  string
+}
+
+// fileRoots returns the directories of the server browsable in the web UI:
+// its saves and, when the game has one, the directory holding the INI files.
+func (s *serverConfig) fileRoots(c *config) []fileRoot {
+	g := s.gameInfo()
+	out := []fileRoot{{Name: "saves", Dir: s.saveDir(c)}}
+	if g.configDir != nil {
+		out = append(out, fileRoot{Name: "config", Dir: g.configDir(c.gameDir(g))})
+	}
+	return out
+}
+
+// resolveFile returns the path of rel inside root. The symlinks are resolved
+// so they can't escape root either. When create is set, the file may not
+// exist yet but its directory must.
+func resolveFile(root, rel string, create bool) (string, error) {
+	if strings.ContainsRune(rel, 0) {
+		return "", errors.New("invalid path")
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	p := filepath.Join(realRoot, filepath.FromSlash(path.Clean("/"+rel)))
+	real, err := filepath.EvalSymlinks(p)
+	if errors.Is(err, os.ErrNotExist) && create {
+		var dir string
+		if dir, err = filepath.EvalSymlinks(filepath.Dir(p)); err == nil {
+			real = filepath.Join(dir, filepath.Base(p))
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if real != realRoot && !strings.HasPrefix(real, realRoot+string(filepath.Separator)) {
+		return "", errors.New("path outside of the directory")
+	}
+	return real, nil
+}
+
+// isText returns true if the content can be edited as text.
+func isText(b []byte) bool {
+	return len(b) <= maxEditSize && utf8.Valid(b) && bytes.IndexByte(b, 0) == -1
+}
+
+// fileEntry is a file or a directory in the listing.
+type fileEntry struct {
+	Name    string
+	Dir     bool
+	Size    int64
+	ModTime time.Time
+}
+
+// listDir returns the entries of the directory, the directories first.
+func listDir(dir string) ([]fileEntry, error) {
+	l, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]fileEntry, 0, len(l))
+	for _, e := range l {
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		out = append(out, fileEntry{Name: e.Name(), Dir: fi.IsDir(), Size: fi.Size(), ModTime: fi.ModTime()})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Dir != out[j].Dir {
+			return out[i].Dir
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out, nil
+}
+
+// writeFileAtomic replaces the file so the server never reads a partial one.
+func writeFileAtomic(p string, r io.Reader, mode os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), mode)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// isIni returns true for the INI files, which are validated before being
+// written.
+func isIni(p string) bool {
+	return strings.EqualFold(filepath.Ext(p), ".ini")
+}
+
+// validateFile returns the syntax errors of the file's new content.
+func validateFile(p, content string) error {
+	if !isIni(p) {
+		return nil
+	}
+	return validateIni(filepath.Base(p), strings.ReplaceAll(content, "\r\n", "\n"))
+}
+
+// fileCrumb is a link of the path shown above the listing.
+type fileCrumb struct {
+	Name string
+	Href string
+}
+
+var filesTmpl = template.Must(template.New("files.html.tmpl").Funcs(template.FuncMap{"size": formatSize}).ParseFS(rsc, "rsc/files.html.tmpl"))
+
+// serveFiles browses the server's directories at /files/<unit>/<root>/<path>.
+// The uploads and the edits are POSTed to /rpc/files/<unit>/<root>/<path> to
+// be recorded in the audit log, and so are the downloads. Only admins can
+// since the INI files hold the passwords.
+func (s *webServer) serveFiles(w http.ResponseWriter, r *http.Request) {
+	rpc := strings.HasPrefix(r.URL.Path, "/rpc/files/")
+	parts := strings.SplitN(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/rpc"), "/files/"), "/", 3)
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+	unit, rootName, rel := parts[0], parts[1], strings.Trim(parts[2], "/")
+	c := s.config()
+	v := c.serverByUnit(unit)
+	if v == nil {
+		http.Error(w, "unknown server", http.StatusNotFound)
+		return
+	}
+	u := userFrom(r.Context())
+	if !u.hasRole(roleAdmin) {
+		http.Error(w, "only admins can manage the files", http.StatusForbidden)
+		return
+	}
+	roots := v.fileRoots(c)
+	data := map[string]any{"Unit": unit, "Roots": roots}
+	w.Header().Add("Content-Type", "text/html")
+	var root *fileRoot
+	for i := range roots {
+		if roots[i].Name == rootName {
+			root = &roots[i]
+		}
+	}
+	if root == nil {
+		if rootName != "" {
+			w.WriteHeader(http.StatusNotFound)
+			data["Err"] = "unknown directory"
+		}
+		_ = filesTmpl.Execute(w, data)
+		return
+	}
+	data["Root"] = root.Name
+	data["Path"] = rel
+	base := "/files/" + unit + "/" + root.Name
+	crumbs := []fileCrumb{{Name: root.Name, Href: base + "/"}}
+	if rel != "" {
+		for i, n := range strings.Split(rel, "/") {
+			crumbs = append(crumbs, fileCrumb{Name: n, Href: crumbs[i].Href + n + "/"})
+		}
+	}
+	data["Crumbs"] = crumbs
+	if rpc {
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+maxEditSize)
+		if r.Method == "POST" {
+			// -read-timeout and -write-timeout cover the whole body.
+			extendReadDeadline(w, uploadTimeout)
+			extendWriteDeadline(w, uploadTimeout+time.Minute)
+		}
+	}
+	p, err := resolveFile(root.Dir, rel, false)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		data["Err"] = err.Error()
+		_ = filesTmpl.Execute(w, data)
+		return
+	}
+	if rpc && r.Method == "POST" {
+		if r.FormValue("op") == "download" {
+			setAuditDetail(r.Context(), "download "+root.Name+"/"+rel)
+			s.downloadFile(w, r, p)
+			return
+		}
+		res, err := s.editFile(r, root, rel, p)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			data["Err"] = err.Error()
+		} else {
+			data["Result"] = res
+		}
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		data["Err"] = err.Error()
+		_ = filesTmpl.Execute(w, data)
+		return
+	}
+	if fi.IsDir() {
+		l, err := listDir(p)
+		if err != nil {
+			data["Err"] = err.Error()
+		}
+		data["Entries"] = l
+		data["Href"] = crumbs[len(crumbs)-1].Href
+	} else {
+		data["File"] = fi
+		if fi.Size() <= maxEditSize {
+			if b, err := os.ReadFile(p); err != nil {
+				data["Err"] = err.Error()
+			} else if isText(b) {
+				data["Text"], data["Content"] = true, string(b)
+			}
+		}
+		// Detects the concurrent edits.
+		data["ModTime"] = strconv.FormatInt(fi.ModTime().UnixNano(), 10)
+		data["Lang"] = strings.TrimPrefix(strings.ToLower(filepath.Ext(p)), ".")
+	}
+	data["Loc"] = c.displayLocation(u)
+	_ = filesTmpl.Execute(w, data)
+}
+
+// downloadFile sends the file as an attachment.
+func (s *webServer) downloadFile(w http.ResponseWriter, r *http.Request, p string) {
+	f, err := os.Open(p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		http.Error(w, "not a file", http.StatusBadRequest)
+		return
+	}
+	extendWriteDeadline(w, 10*time.Minute)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+strings.ReplaceAll(fi.Name(), `"`, "_")+`"`)
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+// editFile saves a text file or uploads a file in a directory.
+func (s *webServer) editFile(r *http.Request, root *fileRoot, rel, p string) (string, error) {
+	switch op := r.FormValue("op"); op {
+	case "save":
+		content := r.FormValue("content")
+		setAuditDetail(r.Context(), fmt.Sprintf("save %s/%s %d bytes", root.Name, rel, len(content)))
+		if len(content) > maxEditSize {
+			return "", errors.New("the file is too large to be edited")
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			return "", err
+		}
+		if fi.IsDir() {
+			return "", errors.New("not a file")
+		}
+		if r.FormValue("mtime") != strconv.FormatInt(fi.ModTime().UnixNano(), 10) {
+			return "", errors.New("the file was modified since it was loaded; reload it")
+		}
+		old, err := os.ReadFile(p)
+		if err != nil {
+			return "", err
+		}
+		if !isText(old) {
+			return "", errors.New("not a text file")
+		}
+		// The browsers send CRLF; keep the file's line endings.
+		if !bytes.Contains(old, []byte("\r\n")) {
+			content = strings.ReplaceAll(content, "\r\n", "\n")
+		}
+		if err := validateFile(p, content); err != nil {
+			return "", err
+		}
+		if err := writeFileAtomic(p, strings.NewReader(content), fi.Mode().Perm()); err != nil {
+			return "", err
+		}
+		return "Saved. Restart the server to apply the changes.", nil
+	case "upload":
+		f, h, err := r.FormFile("file")
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		name := filepath.Base(filepath.Clean(h.Filename))
+		setAuditDetail(r.Context(), fmt.Sprintf("upload %s/%s %d bytes", root.Name, path.Join(rel, name), h.Size))
+		if name == "." || name == ".." || name == string(filepath.Separator) {
+			return "", errors.New("invalid file name")
+		}
+		if fi, err := os.Stat(p); err != nil || !fi.IsDir() {
+			return "", errors.New("upload in a directory")
+		}
+		dst, err := resolveFile(root.Dir, path.Join(rel, name), true)
+		if err != nil {
+			return "", err
+		}
+		mode := os.FileMode(0o644)
+		if fi, err := os.Stat(dst); err == nil {
+			if r.FormValue("overwrite") == "" || fi.IsDir() {
+				return "", fmt.Errorf("%s already exists", name)
+			}
+			mode = fi.Mode().Perm()
+		}
+		var src io.Reader = f
+		if isIni(dst) {
+			// Small enough to be checked in memory.
+			b, err := io.ReadAll(io.LimitReader(f, maxEditSize+1))
+			if err != nil {
+				return "", err
+			}
+			if !isText(b) {
+				return "", errors.New("not a text file")
+			}
+			if err := validateFile(dst, string(b)); err != nil {
+				return "", err
+			}
+			src = bytes.NewReader(b)
+		}
+		if err := writeFileAtomic(dst, src, mode); err != nil {
+			return "", err
+		}
+		return "Uploaded " + name + ".", nil
+	default:
+		return "", fmt.Errorf("unknown operation %q", op)
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// game is the plugin of a Steam dedicated server: how it is installed,
+// launched and queried. The systemd, RCON, backup and scheduling machinery is
+// shared by all the games.
+type game struct {
+	// ID is the value of the servers' game, e.g. "palworld".
+	ID   string
+	Name string
+	// AppID is the Steam app ID of the dedicated server.
+	AppID string
+	// Dir is the installation directory under steamapps/common.
+	Dir string
+	// Binary is the server executable, relative to the installation.
+	Binary string
+	// DefaultMap is the map, or world, of the servers that don't set one.
+	DefaultMap string
+	// RCON is set when the server speaks Source RCON. ListPlayers and
+	// SaveWorld are then the RCON commands listing the players and saving the
+	// world.
+	RCON        bool
+	ListPlayers string
+	SaveWorld   string
+	// QueryPortOffset is set when the query port isn't configurable: it is
+	// the game port plus the offset.
+	QueryPortOffset int
+	// Memory is the estimated memory requirement of a server, in MB.
+	Memory int
+
+	// The functions get the game's installation directory. configDir, when
+	// set, returns the directory holding the INI files.
+	launch       func(c *config, s *serverConfig, dir string) []string
+	saveDir      func(s *serverConfig, dir string) string
+	configDir    func(dir string) string
+	env          func(dir string) []string
+	parsePlayers func(resp string) []player
+}
+
+// games are the supported games. Ark is the default.
+var games = []*game{
+	{
+		ID:           "ark",
+		Name:         "Ark: Survival Evolved",
+		AppID:        "376030",
+		Dir:          "ARK Survival Evolved Dedicated Server",
+		Binary:       filepath.Join("ShooterGame", "Binaries", "Linux", "ShooterGameServer"),
+		RCON:         true,
+		ListPlayers:  "ListPlayers",
+		SaveWorld:    "SaveWorld",
+		Memory:       6144,
+		launch:       func(c *config, s *serverConfig, dir string) []string { return launchArgs(c, s) },
+		saveDir:      arkSaveDir,
+		configDir:    unrealConfigDir("ShooterGame"),
+		parsePlayers: parseListPlayers,
+	},
+	{
+		ID:         "palworld",
+		Name:       "Palworld",
+		AppID:      "2394010",
+		Dir:        "PalServer",
+		Binary:     filepath.Join("Pal", "Binaries", "Linux", "PalServer-Linux-Shipping"),
+		DefaultMap: "Palpagos",
+		// RCONEnabled, RCONPort and AdminPassword are set in
+		// PalWorldSettings.ini.
+		RCON:        true,
+		ListPlayers: "ShowPlayers",
+		SaveWorld:   "Save",
+		Memory:      8192,
+		launch: func(c *config, s *serverConfig, dir string) []string {
+			args := []string{"Pal", "-port=" + strconv.Itoa(s.Port), "-QueryPort=" + strconv.Itoa(s.QueryPort)}
+			if s.MaxPlayers != 0 {
+				args = append(args, "-players="+strconv.Itoa(s.MaxPlayers))
+			}
+			return append(args, s.Flags...)
+		},
+		saveDir: func(s *serverConfig, dir string) string {
+			return filepath.Join(dir, "Pal", "Saved", "SaveGames")
+		},
+		configDir:    unrealConfigDir("Pal"),
+		parsePlayers: parseShowPlayers,
+	},
+	{
+		ID:              "valheim",
+		Name:            "Valheim",
+		AppID:           "896660",
+		Dir:             "Valheim dedicated server",
+		Binary:          "valheim_server.x86_64",
+		DefaultMap:      "Dedicated",
+		QueryPortOffset: 1,
+		Memory:          2048,
+		launch: func(c *config, s *serverConfig, dir string) []string {
+			args := []string{"-nographics", "-batchmode", "-name", s.SessionName, "-port", strconv.Itoa(s.Port), "-world", s.Map, "-savedir", valheimSaveDir(s, dir), "-public", "1"}
+			if c.ServerPassword != "" {
+				args = append(args, "-password", c.ServerPassword)
+			}
+			return append(args, s.Flags...)
+		},
+		saveDir: valheimSaveDir,
+		env: func(dir string) []string {
+			return []string{"SteamAppId=892970", "LD_LIBRARY_PATH=" + filepath.Join(dir, "linux64")}
+		},
+		parsePlayers: func(string) []player { return nil },
+	},
+}
+
+// gameByID returns the game, or nil.
+func gameByID(id string) *game {
+	if id == "" {
+		id = "ark"
+	}
+	for _, g := range games {
+		if g.ID == id {
+			return g
+		}
+	}
+	return nil
+}
+
+// gameInfo returns the server's game. The configuration was validated so it
+// is known.
+func (s *serverConfig) gameInfo() *game {
+	if g := gameByID(s.Game); g != nil {
+		return g
+	}
+	return games[0]
+}
+
+// gameDir returns the installation directory of the game.
+func (c *config) gameDir(g *game) string {
+	if g.ID == "ark" {
+		return c.installDir()
+	}
+	if d := c.GameDirs[g.ID]; d != "" {
+		return d
+	}
+	return filepath.Join(filepath.Dir(defaultInstallDir()), g.Dir)
+}
+
+// binary returns the path to the server's executable.
+func (s *serverConfig) binary(c *config) string {
+	g := s.gameInfo()
+	return filepath.Join(c.gameDir(g), g.Binary)
+}
+
+// gameArgs returns the command line arguments for the server, excluding the
+// executable.
+func (s *serverConfig) gameArgs(c *config) []string {
+	g := s.gameInfo()
+	return g.launch(c, s, c.gameDir(g))
+}
+
+// gameEnv returns the environment variables the server requires.
+func (s *serverConfig) gameEnv(c *config) []string {
+	g := s.gameInfo()
+	if g.env == nil {
+		return nil
+	}
+	return g.env(c.gameDir(g))
+}
+
+// usedGames returns the games of the configured servers, once each.
+func (c *config) usedGames() []*game {
+	var out []*game
+	seen := map[string]bool{}
+	for i := range c.Servers {
+		if g := c.Servers[i].gameInfo(); !seen[g.ID] {
+			seen[g.ID] = true
+			out = append(out, g)
+		}
+	}
+	return out
+}
+
+// arkSaveDir returns the directory holding the server's .ark and profile
+// files.
+func arkSaveDir(s *serverConfig, dir string) string {
+	d := s.SaveDir
+	if d == "" {
+		d = "SavedArks"
+	}
+	return filepath.Join(dir, "ShooterGame", "Saved", d)
+}
+
+// unrealConfigDir returns the configDir of an Unreal Engine game, e.g.
+// ShooterGame/Saved/Config/LinuxServer for Ark.
+func unrealConfigDir(project string) func(dir string) string {
+	return func(dir string) string {
+		return filepath.Join(dir, project, "Saved", "Config", "LinuxServer")
+	}
+}
+
+// valheimSaveDir returns the -savedir of the server; each server has its own
+// by default.
+func valheimSaveDir(s *serverConfig, dir string) string {
+	d := s.SaveDir
+	if d == "" {
+		d = s.Name
+	}
+	return filepath.Join(dir, "saves", d)
+}
+
+// parseShowPlayers parses the response to Palworld's ShowPlayers RCON
+// command:
+//
+//	name,playeruid,steamid
+//	Some Name,1234567890,76561198000000000
+func parseShowPlayers(resp string) []player {
+	var out []player
+	for i, l := range strings.Split(strings.TrimSpace(resp), "\n") {
+		f := strings.Split(strings.TrimSpace(l), ",")
+		if i == 0 || len(f) < 3 {
+			continue
+		}
+		out = append(out, player{Name: strings.Join(f[:len(f)-2], ","), SteamID: f[len(f)-1]})
+	}
+	return out
+}
@@ -4,7 +4,6 @@ go 1.21
 
 require (
 	github.com/gorcon/rcon v1.3.4
-	github.com/maruel/serve-dir v1.0.4
 	github.com/maruel/subcommands v1.1.1
 	github.com/texttheater/golang-levenshtein v1.0.1 // indirect
 )
@@ -12,4 +11,8 @@ require (
 require (
 	github.com/coreos/go-systemd/v22 v22.5.0
 	github.com/godbus/dbus/v5 v5.1.0 // indirect
+	go.etcd.io/bbolt v1.3.10
+	golang.org/x/crypto v0.17.0
+	golang.org/x/sys v0.15.0
+	gopkg.in/yaml.v3 v3.0.1
 )
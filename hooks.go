@@ -0,0 +1,258 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// hookConfig is a scripted reaction to the events.
+//
+// The script is a text/template. It can only call the functions in
+// hookAllowed, none of which builds a longer string than its arguments, and
+// can't loop, so it can't run away with the CPU nor the memory. Its output is
+// discarded.
+type hookConfig struct {
+	// Name identifies the hook in the logs.
+	Name string `json:"name"`
+	// Events are the event kinds running the hook. All the events when empty.
+	Events []string `json:"events,omitempty"`
+	// Script is run for each event, e.g.
+	// `{{if and (eq .Player.Name "X") (lt .Clock "06:00")}}{{broadcast "Y"}}{{end}}`.
+	Script string `json:"script"`
+}
+
+const (
+	// hookTimeout bounds a hook's run, including its RCON commands.
+	hookTimeout = 10 * time.Second
+	// hookMaxActions bounds the number of actions of a hook's run.
+	hookMaxActions = 10
+	// hookMaxOutput bounds the text a hook's run may produce.
+	hookMaxOutput = 4096
+	// hookMaxScript bounds the script's length, thus its run's steps.
+	hookMaxScript = 16 << 10
+	// hookMaxValue bounds the strings passed to the functions.
+	hookMaxValue = 1024
+)
+
+// hookData is the data passed to the scripts.
+type hookData struct {
+	Kind string
+	// Server is the server's name, empty for host wide events.
+	Server string
+	Msg    string
+	// Player is set for player events. It is never nil.
+	Player player
+	Time   time.Time
+	// Clock is the time in the configured time zone as "15:04", to compare
+	// with lt and ge.
+	Clock   string
+	Weekday string
+}
+
+// hookFuncs are the functions of the scripts besides the builtins. The
+// actions are stubs replaced at run time; they are listed here to parse the
+// scripts.
+var hookFuncs = template.FuncMap{
+	"broadcast": func(string) (string, error) { return "", nil },
+	"tell":      func(string) (string, error) { return "", nil },
+	"log":       func(...any) string { return "" },
+	"contains":  strings.Contains,
+	"hasPrefix": strings.HasPrefix,
+	"lower": func(s string) (string, error) {
+		if len(s) > hookMaxValue {
+			return "", fmt.Errorf("more than %d bytes", hookMaxValue)
+		}
+		return strings.ToLower(s), nil
+	},
+}
+
+// hookAllowed are the functions the scripts can call. The builtins building
+// strings, e.g. printf, and call are left out.
+var hookAllowed = map[string]bool{
+	"and": true, "or": true, "not": true, "len": true, "index": true, "slice": true,
+	"eq": true, "ne": true, "lt": true, "le": true, "gt": true, "ge": true,
+	"broadcast": true, "tell": true, "log": true, "contains": true, "hasPrefix": true, "lower": true,
+}
+
+// parseHook parses the hook's script and verifies it only uses bounded
+// constructs: no template definitions, which could recurse, no range and only
+// the functions in hookAllowed. The execution is then linear in the script's
+// length, which is bounded, and the values can't grow.
+func parseHook(script string) (*template.Template, error) {
+	if len(script) > hookMaxScript {
+		return nil, fmt.Errorf("script longer than %d bytes", hookMaxScript)
+	}
+	t, err := template.New("").Option("missingkey=error").Funcs(hookFuncs).Parse(script)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.Templates()) > 1 {
+		return nil, errors.New("define and block aren't allowed")
+	}
+	if t.Tree == nil {
+		return t, nil
+	}
+	var check func(n parse.Node) error
+	check = func(n parse.Node) error {
+		switch n := n.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return nil
+			}
+			for _, c := range n.Nodes {
+				if err := check(c); err != nil {
+					return err
+				}
+			}
+		case *parse.ActionNode:
+			return check(n.Pipe)
+		case *parse.PipeNode:
+			if n == nil {
+				return nil
+			}
+			for _, c := range n.Cmds {
+				for _, a := range c.Args {
+					if err := check(a); err != nil {
+						return err
+					}
+				}
+			}
+		case *parse.ChainNode:
+			return check(n.Node)
+		case *parse.IdentifierNode:
+			if !hookAllowed[n.Ident] {
+				return fmt.Errorf("%s isn't allowed", n.Ident)
+			}
+		case *parse.TemplateNode:
+			return errors.New("template isn't allowed")
+		case *parse.IfNode:
+			return errors.Join(check(n.Pipe), check(n.List), check(n.ElseList))
+		case *parse.WithNode:
+			return errors.Join(check(n.Pipe), check(n.List), check(n.ElseList))
+		case *parse.RangeNode:
+			// The event's data has nothing to loop over, and ranging over an
+			// integer, e.g. {{range len .Msg}}, nests into unbounded loops.
+			return errors.New("range isn't allowed")
+		}
+		return nil
+	}
+	return t, check(t.Root)
+}
+
+// limitWriter fails once more than n bytes were written or ctx is done, which
+// stops the template's execution.
+type limitWriter struct {
+	ctx context.Context
+	n   int
+}
+
+func (l *limitWriter) Write(b []byte) (int, error) {
+	if err := l.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if l.n -= len(b); l.n < 0 {
+		return 0, errors.New("too much output")
+	}
+	return len(b), nil
+}
+
+// runHooks runs the hooks interested in the event. Used as a bus consumer.
+func (s *webServer) runHooks(ev event) {
+	c := s.config()
+	for i := range c.Hooks {
+		h := &c.Hooks[i]
+		if len(h.Events) != 0 && !slices.Contains(h.Events, ev.Kind) {
+			continue
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(s.ctx, hookTimeout)
+			defer cancel()
+			if err := s.runHook(ctx, c, h, ev); err != nil {
+				log.Printf("hook %s: %s: %v", h.Name, ev.Kind, err)
+			}
+		}()
+	}
+}
+
+// runHook runs the hook's script for the event.
+func (s *webServer) runHook(ctx context.Context, c *config, h *hookConfig, ev event) error {
+	t, err := parseHook(h.Script)
+	if err != nil {
+		return err
+	}
+	v := c.serverByUnit(ev.Unit)
+	now := ev.Time.In(c.location())
+	d := hookData{Kind: ev.Kind, Msg: ev.Msg, Time: now, Clock: now.Format("15:04"), Weekday: now.Weekday().String()}
+	if v != nil {
+		d.Server = v.Name
+	}
+	if ev.Player != nil {
+		d.Player = *ev.Player
+	}
+	actions := 0
+	rcon := func(cmd string) (string, error) {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if len(cmd) > hookMaxValue {
+			return "", fmt.Errorf("more than %d bytes", hookMaxValue)
+		}
+		if actions++; actions > hookMaxActions {
+			return "", fmt.Errorf("more than %d actions", hookMaxActions)
+		}
+		if v == nil {
+			return "", errors.New("the event isn't about a server")
+		}
+		p, err := s.rconPoller(c, v)
+		if err != nil {
+			return "", err
+		}
+		_, err = p.Execute(ctx, cmd)
+		return "", err
+	}
+	t.Funcs(template.FuncMap{
+		"broadcast": func(msg string) (string, error) {
+			return rcon("Broadcast " + msg)
+		},
+		"tell": func(msg string) (string, error) {
+			if d.Player.SteamID == "" {
+				return "", errors.New("the event isn't about a player")
+			}
+			return rcon("ServerChatTo \"" + d.Player.SteamID + "\" " + msg)
+		},
+		"log": func(args ...any) string {
+			if actions++; actions <= hookMaxActions && ctx.Err() == nil {
+				msg := strings.TrimSuffix(fmt.Sprintln(args...), "\n")
+				if len(msg) > hookMaxValue {
+					msg = msg[:hookMaxValue] + "..."
+				}
+				log.Printf("hook %s: %s", h.Name, msg)
+			}
+			return ""
+		},
+	})
+	// The execution can't be interrupted in the middle of an action, so it's
+	// abandoned at the deadline; the functions and the writer then fail,
+	// ending it at its next step.
+	done := make(chan error, 1)
+	go func() {
+		done <- t.Execute(&limitWriter{ctx: ctx, n: hookMaxOutput}, d)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
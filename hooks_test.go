@@ -0,0 +1,69 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestParseHook(t *testing.T) {
+	data := []struct {
+		name   string
+		script string
+		err    string
+	}{
+		{"empty", "", ""},
+		{"example", `{{if and (eq .Player.Name "X") (lt .Clock "06:00")}}{{broadcast "Y"}}{{end}}`, ""},
+		{"with", `{{with .Server}}{{log "on" .}}{{else}}{{log "host"}}{{end}}`, ""},
+		{"nested if", `{{if .Msg}}{{if contains .Msg "crash"}}{{tell (lower .Msg)}}{{end}}{{end}}`, ""},
+		{"syntax", `{{if}}`, "missing value for if"},
+		{"unknown func", `{{exec "rm"}}`, `function "exec" not defined`},
+		{"define", `{{define "a"}}{{template "a"}}{{end}}`, "define and block aren't allowed"},
+		{"template", `{{template "x"}}`, "template isn't allowed"},
+		{"range number", `{{range 1000000}}{{end}}`, "range isn't allowed"},
+		{"range len", `{{range len .Msg}}{{range len .Msg}}{{end}}{{end}}`, "range isn't allowed"},
+		{"range in if", `{{if .Msg}}{{range .Msg}}{{end}}{{end}}`, "range isn't allowed"},
+		{"range in else", `{{with .Msg}}{{else}}{{range .Kind}}{{end}}{{end}}`, "range isn't allowed"},
+		{"vars", `{{$x := lower .Msg}}{{if contains $x "a"}}{{log $x (len $x) (slice $x 1)}}{{end}}`, ""},
+		{"printf", `{{$x := printf "%01000000d" 0}}{{$x = printf "%s%s" $x $x}}`, "printf isn't allowed"},
+		{"print in if", `{{if print .Msg .Msg}}{{end}}`, "print isn't allowed"},
+		{"println in arg", `{{log (println .Msg)}}`, "println isn't allowed"},
+		{"call", `{{call .Msg}}`, "call isn't allowed"},
+		{"html in with", `{{with html .Msg}}{{end}}`, "html isn't allowed"},
+		{"too long", strings.Repeat(" ", hookMaxScript+1), "script longer than"},
+	}
+	for _, l := range data {
+		t.Run(l.name, func(t *testing.T) {
+			_, err := parseHook(l.script)
+			if l.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), l.err) {
+				t.Fatalf("got %v, want %q", err, l.err)
+			}
+		})
+	}
+}
+
+func TestLimitWriter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := limitWriter{ctx: ctx, n: 4}
+	if _, err := l.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Write([]byte("de")); err == nil {
+		t.Fatal("expected an error")
+	}
+	l.n = 4
+	cancel()
+	if _, err := l.Write([]byte("a")); err != context.Canceled {
+		t.Fatalf("got %v", err)
+	}
+}
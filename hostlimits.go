@@ -0,0 +1,92 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The host settings the servers need. Missing nofile limits cause corrupted
+// saves under load.
+const (
+	hostMaxMapCount = 262144
+	hostFileMax     = 2097152
+	// hostNoFile is the LimitNOFILE of the server units.
+	hostNoFile = 1000000
+)
+
+// hostFile is a host configuration file written by `install -host-limits`.
+type hostFile struct {
+	Path    string
+	Content string
+}
+
+// hostLimitFiles returns the sysctl, PAM limits and systemd configuration
+// files. The user manager's limit caps the LimitNOFILE of the user units.
+func hostLimitFiles(owner string, fileMax int) []hostFile {
+	const hdr = "# Generated by ark-serman. Do not edit, changes will be overwritten.\n"
+	return []hostFile{
+		{"/etc/sysctl.d/60-ark-serman.conf", fmt.Sprintf("%svm.max_map_count = %d\nfs.file-max = %d\n", hdr, hostMaxMapCount, max(fileMax, hostFileMax))},
+		{"/etc/security/limits.d/60-ark-serman.conf", fmt.Sprintf("%s%s soft nofile %d\n%s hard nofile %d\n", hdr, owner, hostNoFile, owner, hostNoFile)},
+		{"/etc/systemd/system/user@.service.d/60-ark-serman.conf", fmt.Sprintf("%s[Service]\nLimitNOFILE=%d\n", hdr, hostNoFile)},
+	}
+}
+
+// readSysctl returns the value of the sysctl, e.g. "vm/max_map_count", 0 if
+// unknown.
+func readSysctl(name string) int {
+	b, err := os.ReadFile(filepath.Join("/proc/sys", name))
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	return n
+}
+
+// writeHostLimits writes the host configuration files and raises the sysctls
+// right away. It requires root.
+func writeHostLimits(quiet bool) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("-host-limits requires root, run `sudo %s install -host-limits`", filepath.Base(os.Args[0]))
+	}
+	uid, _ := serviceOwner()
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return err
+	}
+	for _, f := range hostLimitFiles(u.Username, readSysctl("fs/file-max")) {
+		if old, err := os.ReadFile(f.Path); err == nil && string(old) == f.Content {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(f.Path), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(f.Path, []byte(f.Content), 0o644); err != nil {
+			return err
+		}
+		if !quiet {
+			log.Printf("Wrote %s", f.Path)
+		}
+	}
+	// Only raise the values; the host may already use larger ones.
+	for name, v := range map[string]int{"vm/max_map_count": hostMaxMapCount, "fs/file-max": hostFileMax} {
+		if readSysctl(name) >= v {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join("/proc/sys", name), []byte(strconv.Itoa(v)), 0o644); err != nil {
+			return err
+		}
+	}
+	if !quiet {
+		log.Printf("Run `sudo systemctl daemon-reload` and log in again as %s for the open files limit to apply, then run install as %s.", u.Username, u.Username)
+	}
+	return nil
+}
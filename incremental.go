@@ -0,0 +1,172 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// incrementalBackend stores each backup as a directory tree in the data
+// directory. Files unchanged since the previous backup are hard links to it,
+// so a backup only costs the size of the files modified since, like rsync's
+// --link-dest rotation. Deleting any backup is safe.
+type incrementalBackend struct{}
+
+func (incrementalBackend) list(c *config, s *serverConfig) ([]backupInfo, error) {
+	d := backupDir(c, s)
+	entries, err := os.ReadDir(d)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var l []backupInfo
+	for _, e := range entries {
+		t, err := time.ParseInLocation(snapshotTimeFormat, e.Name(), time.Local)
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		l = append(l, backupInfo{ID: filepath.Join(d, e.Name()), Time: t})
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Time.After(l[j].Time) })
+	return l, nil
+}
+
+func (b incrementalBackend) create(c *config, s *serverConfig) (backupInfo, error) {
+	prev := ""
+	if l, err := b.list(c, s); err == nil && len(l) != 0 {
+		prev = l[0].ID
+	}
+	d := backupDir(c, s)
+	if err := os.MkdirAll(d, 0o700); err != nil {
+		return backupInfo{}, err
+	}
+	now := time.Now()
+	i := backupInfo{ID: filepath.Join(d, now.Format(snapshotTimeFormat)), Time: now}
+	tmp := i.ID + ".tmp"
+	var err error
+	for _, src := range []string{s.saveDir(c), configDir(c)} {
+		var n int64
+		if n, err = linkTree(savedDir(c), src, tmp, prev); err != nil {
+			break
+		}
+		i.Size += n
+	}
+	if err == nil {
+		err = os.Rename(tmp, i.ID)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return backupInfo{}, err
+	}
+	return i, nil
+}
+
+func (b incrementalBackend) check(c *config, s *serverConfig, id string) error {
+	if filepath.Dir(id) != backupDir(c, s) {
+		return fmt.Errorf("%s is not a backup of %s", id, s.Name)
+	}
+	return nil
+}
+
+func (b incrementalBackend) restore(c *config, s *serverConfig, id string) error {
+	if err := b.check(c, s, id); err != nil {
+		return err
+	}
+	dst := s.saveDir(c)
+	old := dst + ".restore-" + time.Now().Format(snapshotTimeFormat)
+	if err := os.Rename(dst, old); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	// Copy instead of linking, otherwise the server would modify the backup.
+	if _, err := linkTree(id, id, savedDir(c), ""); err != nil {
+		os.RemoveAll(dst)
+		if err2 := os.Rename(old, dst); err2 != nil && !errors.Is(err2, fs.ErrNotExist) {
+			return fmt.Errorf("%w; the previous saves are in %s", err, old)
+		}
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+func (b incrementalBackend) remove(c *config, s *serverConfig, id string) error {
+	if err := b.check(c, s, id); err != nil {
+		return err
+	}
+	return os.RemoveAll(id)
+}
+
+// linkTree copies the files under dir to dst, with names relative to root.
+// Files with the same size and modification time in prev are hard linked from
+// there instead. It returns the number of bytes copied. A missing dir is
+// ignored.
+func linkTree(root, dir, dst, prev string) (int64, error) {
+	var copied int64
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == dir && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		out := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(out, 0o700)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if prev != "" {
+			if pi, err := os.Stat(filepath.Join(prev, rel)); err == nil && pi.Size() == fi.Size() && pi.ModTime().Equal(fi.ModTime()) {
+				if os.Link(filepath.Join(prev, rel), out) == nil {
+					return nil
+				}
+			}
+		}
+		if err := copyFile(p, out, fi); err != nil {
+			return err
+		}
+		copied += fi.Size()
+		return nil
+	})
+	return copied, err
+}
+
+// copyFile copies src to dst, keeping the modification time.
+func copyFile(src, dst string, fi fs.FileInfo) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fi.Mode().Perm()|0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if err2 := w.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
@@ -0,0 +1,354 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The INI files are checked before being written: the engine silently
+// ignores what it can't parse, e.g. the second [ServerSettings] section
+// pasted from a forum post, and the server then starts with the defaults.
+
+// iniType is the type of the value of a known key.
+type iniType int
+
+const (
+	iniString iniType = iota
+	iniBool
+	iniInt
+	iniFloat
+	// iniMods is a comma separated list of workshop IDs.
+	iniMods
+)
+
+func (t iniType) String() string {
+	switch t {
+	case iniBool:
+		return "True or False"
+	case iniInt:
+		return "an integer"
+	case iniFloat:
+		return "a number"
+	case iniMods:
+		return "a comma separated list of mod IDs"
+	}
+	return "a string"
+}
+
+// check returns true if the value has the type.
+func (t iniType) check(v string) bool {
+	switch t {
+	case iniBool:
+		return strings.EqualFold(v, "true") || strings.EqualFold(v, "false")
+	case iniInt:
+		_, err := strconv.ParseInt(v, 10, 64)
+		return err == nil
+	case iniFloat:
+		_, err := strconv.ParseFloat(v, 64)
+		return err == nil
+	case iniMods:
+		if v == "" {
+			return true
+		}
+		for _, m := range strings.Split(v, ",") {
+			if _, err := strconv.ParseUint(strings.TrimSpace(m), 10, 64); err != nil {
+				return false
+			}
+		}
+		return true
+	}
+	return true
+}
+
+// iniKeys are the known keys of Ark's INI files by file, section and key,
+// indexed in lower case since the engine is case insensitive. It is not
+// exhaustive; the other keys are accepted as is.
+var iniKeys = map[string]map[string]map[string]iniKey{
+	"gameusersettings.ini": {
+		"serversettings": lowerKeys(map[string]iniType{
+			"ActiveMods":                              iniMods,
+			"AdminLogging":                            iniBool,
+			"AllowAnyoneBabyImprintCuddle":            iniBool,
+			"AllowCaveBuildingPvE":                    iniBool,
+			"AllowFlyerCarryPvE":                      iniBool,
+			"AllowThirdPersonPlayer":                  iniBool,
+			"AlwaysAllowStructurePickup":              iniBool,
+			"AutoSavePeriodMinutes":                   iniFloat,
+			"DayCycleSpeedScale":                      iniFloat,
+			"DayTimeSpeedScale":                       iniFloat,
+			"DifficultyOffset":                        iniFloat,
+			"DinoCharacterFoodDrainMultiplier":        iniFloat,
+			"DinoCharacterHealthRecoveryMultiplier":   iniFloat,
+			"DinoCharacterStaminaDrainMultiplier":     iniFloat,
+			"DinoCountMultiplier":                     iniFloat,
+			"DinoDamageMultiplier":                    iniFloat,
+			"DinoResistanceMultiplier":                iniFloat,
+			"DisableDinoDecayPvE":                     iniBool,
+			"DisableStructureDecayPvE":                iniBool,
+			"EnablePvPGamma":                          iniBool,
+			"ForceAllStructureLocking":                iniBool,
+			"HarvestAmountMultiplier":                 iniFloat,
+			"HarvestHealthMultiplier":                 iniFloat,
+			"ItemStackSizeMultiplier":                 iniFloat,
+			"KickIdlePlayersPeriod":                   iniFloat,
+			"MaxTamedDinos":                           iniInt,
+			"MaxTributeDinos":                         iniInt,
+			"MaxTributeItems":                         iniInt,
+			"NightTimeSpeedScale":                     iniFloat,
+			"NoTributeDownloads":                      iniBool,
+			"OverrideOfficialDifficulty":              iniFloat,
+			"OxygenSwimSpeedStatMultiplier":           iniFloat,
+			"PerPlatformMaxStructuresMultiplier":      iniFloat,
+			"PlayerCharacterFoodDrainMultiplier":      iniFloat,
+			"PlayerCharacterHealthRecoveryMultiplier": iniFloat,
+			"PlayerCharacterStaminaDrainMultiplier":   iniFloat,
+			"PlayerCharacterWaterDrainMultiplier":     iniFloat,
+			"PlayerDamageMultiplier":                  iniFloat,
+			"PlayerResistanceMultiplier":              iniFloat,
+			"PreventDownloadDinos":                    iniBool,
+			"PreventDownloadItems":                    iniBool,
+			"PreventDownloadSurvivors":                iniBool,
+			"PvEStructureDecayPeriodMultiplier":       iniFloat,
+			"RCONEnabled":                             iniBool,
+			"RCONPort":                                iniInt,
+			"RCONServerGameLogBuffer":                 iniInt,
+			"ResourcesRespawnPeriodMultiplier":        iniFloat,
+			"ServerAdminPassword":                     iniString,
+			"ServerCrosshair":                         iniBool,
+			"ServerForceNoHUD":                        iniBool,
+			"ServerHardcore":                          iniBool,
+			"ServerPassword":                          iniString,
+			"ServerPVE":                               iniBool,
+			"ShowMapPlayerLocation":                   iniBool,
+			"SpectatorPassword":                       iniString,
+			"StructureDamageMultiplier":               iniFloat,
+			"StructureResistanceMultiplier":           iniFloat,
+			"TamingSpeedMultiplier":                   iniFloat,
+			"TheMaxStructuresInRange":                 iniInt,
+			"XPMultiplier":                            iniFloat,
+		}),
+		"sessionsettings": lowerKeys(map[string]iniType{
+			"MultiHome":   iniString,
+			"Port":        iniInt,
+			"QueryPort":   iniInt,
+			"SessionName": iniString,
+		}),
+		"/script/engine.gamesession": lowerKeys(map[string]iniType{
+			"MaxPlayers": iniInt,
+		}),
+		"messageoftheday": lowerKeys(map[string]iniType{
+			"Duration": iniInt,
+			"Message":  iniString,
+		}),
+	},
+	"game.ini": {
+		"/script/shootergame.shootergamemode": lowerKeys(map[string]iniType{
+			"BabyCuddleGracePeriodMultiplier":             iniFloat,
+			"BabyCuddleIntervalMultiplier":                iniFloat,
+			"BabyCuddleLoseImprintQualitySpeedMultiplier": iniFloat,
+			"BabyFoodConsumptionSpeedMultiplier":          iniFloat,
+			"BabyImprintAmountMultiplier":                 iniFloat,
+			"BabyImprintingStatScaleMultiplier":           iniFloat,
+			"BabyMatureSpeedMultiplier":                   iniFloat,
+			"bAllowCustomRecipes":                         iniBool,
+			"bAllowPlatformSaddleMultiFloors":             iniBool,
+			"bAllowUnlimitedRespecs":                      iniBool,
+			"bAutoPvETimer":                               iniBool,
+			"bAutoUnlockAllEngrams":                       iniBool,
+			"bDisableFriendlyFire":                        iniBool,
+			"bDisableLootCrates":                          iniBool,
+			"bDisableStructurePlacementCollision":         iniBool,
+			"bIncreasePvPRespawnInterval":                 iniBool,
+			"bOnlyAllowSpecifiedEngrams":                  iniBool,
+			"bPassiveDefensesDamageRiderlessDinos":        iniBool,
+			"bPvEAllowTribeWar":                           iniBool,
+			"bPvEAllowTribeWarCancel":                     iniBool,
+			"bPvEDisableFriendlyFire":                     iniBool,
+			"bShowCreativeMode":                           iniBool,
+			"bUseCorpseLocator":                           iniBool,
+			"bUseSingleplayerSettings":                    iniBool,
+			"CraftXPMultiplier":                           iniFloat,
+			"CropGrowthSpeedMultiplier":                   iniFloat,
+			"CustomRecipeEffectivenessMultiplier":         iniFloat,
+			"CustomRecipeSkillMultiplier":                 iniFloat,
+			"DinoHarvestingDamageMultiplier":              iniFloat,
+			"EggHatchSpeedMultiplier":                     iniFloat,
+			"FuelConsumptionIntervalMultiplier":           iniFloat,
+			"GenericXPMultiplier":                         iniFloat,
+			"GlobalCorpseDecompositionTimeMultiplier":     iniFloat,
+			"GlobalItemDecompositionTimeMultiplier":       iniFloat,
+			"GlobalSpoilingTimeMultiplier":                iniFloat,
+			"HairGrowthSpeedMultiplier":                   iniFloat,
+			"HarvestXPMultiplier":                         iniFloat,
+			"KillXPMultiplier":                            iniFloat,
+			"LayEggIntervalMultiplier":                    iniFloat,
+			"MatingIntervalMultiplier":                    iniFloat,
+			"MatingSpeedMultiplier":                       iniFloat,
+			"MaxNumberOfPlayersInTribe":                   iniInt,
+			"MaxTribeLogs":                                iniInt,
+			"OverrideMaxExperiencePointsDino":             iniInt,
+			"OverrideMaxExperiencePointsPlayer":           iniInt,
+			"PlayerHarvestingDamageMultiplier":            iniFloat,
+			"PoopIntervalMultiplier":                      iniFloat,
+			"ResourceNoReplenishRadiusPlayers":            iniFloat,
+			"ResourceNoReplenishRadiusStructures":         iniFloat,
+			"SpecialXPMultiplier":                         iniFloat,
+		}),
+	},
+}
+
+// iniKey is a known key.
+type iniKey struct {
+	// Name is the key as documented.
+	Name string
+	Type iniType
+}
+
+func lowerKeys(m map[string]iniType) map[string]iniKey {
+	out := make(map[string]iniKey, len(m))
+	for k, v := range m {
+		out[strings.ToLower(k)] = iniKey{Name: k, Type: v}
+	}
+	return out
+}
+
+// iniKeyType returns the type of the known key and true, or false.
+func iniKeyType(file, section, key string) (iniType, bool) {
+	k, ok := iniKeys[strings.ToLower(file)][strings.ToLower(section)][strings.ToLower(key)]
+	return k.Type, ok
+}
+
+// maxIniErrors is the number of problems reported at once.
+const maxIniErrors = 10
+
+// validateIni returns the problems of the INI file content, by line: the
+// malformed lines, the duplicated sections, the duplicated keys and the
+// values of the known keys that don't have the right type. file is the base
+// name, e.g. "Game.ini".
+func validateIni(file, content string) error {
+	var errs []error
+	add := func(n int, format string, args ...any) {
+		if len(errs) < maxIniErrors {
+			errs = append(errs, fmt.Errorf("%s:%d: %s", file, n, fmt.Sprintf(format, args...)))
+		}
+	}
+	sections := map[string]int{}
+	keys := map[string]int{}
+	section, known := "", map[string]iniKey(nil)
+	for i, l := range strings.Split(content, "\n") {
+		n := i + 1
+		t := strings.TrimSpace(l)
+		if t == "" || t[0] == ';' || t[0] == '#' {
+			continue
+		}
+		if t[0] == '[' {
+			if !strings.HasSuffix(t, "]") || len(t) == 2 {
+				add(n, "malformed section header %q", t)
+				continue
+			}
+			section = t[1 : len(t)-1]
+			lower := strings.ToLower(section)
+			if prev, ok := sections[lower]; ok {
+				add(n, "section [%s] is already at line %d; the game only reads one of them, merge them", section, prev)
+			} else {
+				sections[lower] = n
+			}
+			known = iniKeys[strings.ToLower(file)][lower]
+			clear(keys)
+			continue
+		}
+		// The engine's array operators: +Key=Value appends, -Key=Value
+		// removes, !Key clears and .Key=Value appends a duplicate.
+		op := ""
+		if strings.ContainsRune("+-.!", rune(t[0])) {
+			op, t = t[:1], t[1:]
+		}
+		k, v, ok := strings.Cut(t, "=")
+		k = strings.TrimSpace(k)
+		if op == "!" {
+			if ok || k == "" {
+				add(n, "expected !Key, got %q", l)
+			}
+			continue
+		}
+		if !ok || k == "" {
+			add(n, "expected Key=Value, got %q", t)
+			continue
+		}
+		if section == "" {
+			add(n, "%s is outside of a section", k)
+			continue
+		}
+		if strings.EqualFold(file, "Game.ini") && strings.EqualFold(section, gameModeSection) && overrideKindOf(k) != nil {
+			if _, err := splitStruct(v); err != nil {
+				add(n, "%s: %s", k, err)
+			}
+			continue
+		}
+		if known == nil {
+			continue
+		}
+		lower := strings.ToLower(k)
+		ik, ok := known[lower]
+		if !ok {
+			if s := iniSuggest(known, lower); s != "" {
+				add(n, "unknown key %s in [%s], did you mean %s?", k, section, s)
+			}
+			continue
+		}
+		// The known keys are all single values.
+		if prev, ok := keys[lower]; ok && op == "" {
+			add(n, "%s is already set at line %d", k, prev)
+		}
+		keys[lower] = n
+		if v = strings.TrimSpace(v); !ik.Type.check(v) {
+			add(n, "%s must be %s, got %q", k, ik.Type, v)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// iniSuggest returns the known key one typo away from the unknown key, if
+// any. Only the long keys are considered to not reject the unlisted ones.
+func iniSuggest(known map[string]iniKey, key string) string {
+	if len(key) < 10 {
+		return ""
+	}
+	for k, v := range known {
+		if oneEdit(k, key) {
+			return v.Name
+		}
+	}
+	return ""
+}
+
+// oneEdit returns true if a and b differ by exactly one insertion, deletion,
+// substitution or transposition.
+func oneEdit(a, b string) bool {
+	if a == b {
+		return false
+	}
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	if len(b)-len(a) > 1 {
+		return false
+	}
+	i := 0
+	for i < len(a) && a[i] == b[i] {
+		i++
+	}
+	if len(a) == len(b) {
+		if a[i+1:] == b[i+1:] {
+			return true
+		}
+		return i+1 < len(a) && a[i] == b[i+1] && a[i+1] == b[i] && a[i+2:] == b[i+2:]
+	}
+	return a[i:] == b[i+1:]
+}
@@ -0,0 +1,106 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// Package a2s implements the A2S_INFO Steam server query.
+package a2s
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// Info is the subset of the A2S_INFO reply ark-serman uses.
+type Info struct {
+	Name       string
+	Map        string
+	Players    int
+	MaxPlayers int
+}
+
+// Query sends an A2S_INFO query to the Steam query port and returns the
+// reply and the round trip time. See
+// https://developer.valvesoftware.com/wiki/Server_queries#A2S_INFO
+func Query(ctx context.Context, addr string) (Info, time.Duration, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return Info{}, 0, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	_ = conn.SetDeadline(deadline)
+	req := []byte("\xFF\xFF\xFF\xFFTSource Engine Query\x00")
+	buf := make([]byte, 1400)
+	for try := 0; try < 2; try++ {
+		start := time.Now()
+		if _, err = conn.Write(req); err != nil {
+			return Info{}, 0, err
+		}
+		n, err := conn.Read(buf)
+		if err != nil {
+			return Info{}, 0, err
+		}
+		rtt := time.Since(start)
+		b := buf[:n]
+		if len(b) < 5 || !bytes.Equal(b[:4], []byte{0xFF, 0xFF, 0xFF, 0xFF}) {
+			return Info{}, rtt, errors.New("a2s: invalid reply")
+		}
+		switch b[4] {
+		case 'A':
+			// S2C_CHALLENGE; resend with the challenge appended.
+			if len(b) < 9 {
+				return Info{}, rtt, errors.New("a2s: invalid challenge")
+			}
+			req = append([]byte("\xFF\xFF\xFF\xFFTSource Engine Query\x00"), b[5:9]...)
+		case 'I':
+			i, err := parseInfo(b[5:])
+			return i, rtt, err
+		default:
+			return Info{}, rtt, errors.New("a2s: unexpected reply")
+		}
+	}
+	return Info{}, 0, errors.New("a2s: too many challenges")
+}
+
+// parseInfo parses the A2S_INFO payload after the header byte.
+func parseInfo(b []byte) (Info, error) {
+	r := bytes.NewReader(b)
+	str := func() string {
+		var out []byte
+		for {
+			c, err := r.ReadByte()
+			if err != nil || c == 0 {
+				return string(out)
+			}
+			out = append(out, c)
+		}
+	}
+	var i Info
+	// Protocol version.
+	if _, err := r.ReadByte(); err != nil {
+		return i, errors.New("a2s: truncated reply")
+	}
+	i.Name = str()
+	i.Map = str()
+	_ = str() // Folder.
+	_ = str() // Game.
+	var hdr struct {
+		AppID      uint16
+		Players    uint8
+		MaxPlayers uint8
+	}
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return i, errors.New("a2s: truncated reply")
+	}
+	i.Players = int(hdr.Players)
+	i.MaxPlayers = int(hdr.MaxPlayers)
+	return i, nil
+}
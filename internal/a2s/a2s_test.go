@@ -0,0 +1,77 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package a2s
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// info returns an A2S_INFO payload, after the header byte.
+func info(name, m string, players, max byte) []byte {
+	b := []byte{17}
+	for _, s := range []string{name, m, "ark_survival_evolved", "ARK: Survival Evolved"} {
+		b = append(append(b, s...), 0)
+	}
+	return append(b, 0x5A, 0x06, players, max)
+}
+
+func TestParseInfo(t *testing.T) {
+	data := []struct {
+		name string
+		in   []byte
+		want Info
+		err  bool
+	}{
+		{"ok", info("My Island", "TheIsland", 3, 70), Info{Name: "My Island", Map: "TheIsland", Players: 3, MaxPlayers: 70}, false},
+		{"empty", nil, Info{}, true},
+		{"truncated", info("My Island", "TheIsland", 3, 70)[:20], Info{}, true},
+	}
+	for _, l := range data {
+		t.Run(l.name, func(t *testing.T) {
+			got, err := parseInfo(l.in)
+			if (err != nil) != l.err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !l.err && got != l.want {
+				t.Fatalf("got %+v, want %+v", got, l.want)
+			}
+		})
+	}
+}
+
+func TestQueryChallenge(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 1400)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			reply := append([]byte{0xFF, 0xFF, 0xFF, 0xFF, 'A'}, 1, 2, 3, 4)
+			if bytes.HasSuffix(buf[:n], []byte{1, 2, 3, 4}) {
+				reply = append([]byte{0xFF, 0xFF, 0xFF, 0xFF, 'I'}, info("My Island", "Ragnarok", 1, 10)...)
+			}
+			_, _ = conn.WriteTo(reply, addr)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	got, _, err := Query(ctx, conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Info{Name: "My Island", Map: "Ragnarok", Players: 1, MaxPlayers: 10}); got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// Package lineedit reads lines from a terminal with history and completion.
+//
+// It supports the usual keys: arrows, home/end, backspace/delete, Ctrl-A,
+// Ctrl-E, Ctrl-U, Ctrl-W, Tab for completion, Ctrl-C to discard the line and
+// Ctrl-D to quit. When the input isn't a terminal, lines are read as is.
+package lineedit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrInterrupted is returned when the user pressed Ctrl-C.
+var ErrInterrupted = errors.New("interrupted")
+
+// Editor reads lines.
+type Editor struct {
+	// History is the previous lines, oldest first. ReadLine doesn't append to
+	// it.
+	History []string
+	// Complete returns the candidates replacing the last word of line. May be
+	// nil.
+	Complete func(line string) []string
+
+	in  *os.File
+	out io.Writer
+	r   *bufio.Reader
+	tty bool
+}
+
+// New returns an editor reading from in and echoing to out.
+func New(in *os.File, out io.Writer) *Editor {
+	_, err := unix.IoctlGetTermios(int(in.Fd()), unix.TCGETS)
+	return &Editor{in: in, out: out, r: bufio.NewReader(in), tty: err == nil}
+}
+
+// ReadLine prints the prompt and returns the line entered, without the
+// trailing newline. It returns io.EOF on Ctrl-D on an empty line or at the
+// end of the input.
+func (e *Editor) ReadLine(prompt string) (string, error) {
+	if !e.tty {
+		l, err := e.r.ReadString('\n')
+		if err == io.EOF && l != "" {
+			err = nil
+		}
+		return strings.TrimRight(l, "\r\n"), err
+	}
+	fd := int(e.in.Fd())
+	old, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return "", err
+	}
+	raw := *old
+	raw.Iflag &^= unix.ICRNL | unix.IXON
+	raw.Lflag &^= unix.ECHO | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &raw); err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = unix.IoctlSetTermios(fd, unix.TCSETS, old)
+	}()
+	s := state{e: e, prompt: prompt, hist: len(e.History)}
+	s.redraw()
+	for {
+		ch, _, err := e.r.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch ch {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(s.line), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", ErrInterrupted
+		case 4: // Ctrl-D
+			if len(s.line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			s.del()
+		case 1: // Ctrl-A
+			s.pos = 0
+		case 5: // Ctrl-E
+			s.pos = len(s.line)
+		case 21: // Ctrl-U
+			s.line = append(s.line[:0], s.line[s.pos:]...)
+			s.pos = 0
+		case 23: // Ctrl-W
+			i := s.pos
+			for i > 0 && s.line[i-1] == ' ' {
+				i--
+			}
+			for i > 0 && s.line[i-1] != ' ' {
+				i--
+			}
+			s.line = append(s.line[:i], s.line[s.pos:]...)
+			s.pos = i
+		case 127, 8: // Backspace
+			if s.pos > 0 {
+				s.pos--
+				s.del()
+			}
+		case '\t':
+			s.complete()
+		case 27:
+			s.escape()
+		default:
+			if ch >= ' ' {
+				s.line = append(s.line[:s.pos], append([]rune{ch}, s.line[s.pos:]...)...)
+				s.pos++
+			}
+		}
+		s.redraw()
+	}
+}
+
+// state is the line being edited.
+type state struct {
+	e      *Editor
+	prompt string
+	line   []rune
+	pos    int
+	// hist is the index in History being edited; len(History) for the new
+	// line.
+	hist int
+	// saved is the new line while browsing the history.
+	saved []rune
+}
+
+func (s *state) redraw() {
+	fmt.Fprintf(s.e.out, "\r%s%s\x1b[K", s.prompt, string(s.line))
+	if n := len(s.line) - s.pos; n > 0 {
+		fmt.Fprintf(s.e.out, "\x1b[%dD", n)
+	}
+}
+
+func (s *state) del() {
+	if s.pos < len(s.line) {
+		s.line = append(s.line[:s.pos], s.line[s.pos+1:]...)
+	}
+}
+
+// escape handles the ANSI escape sequences of the arrows, home, end and
+// delete keys.
+func (s *state) escape() {
+	if ch, _, _ := s.e.r.ReadRune(); ch != '[' && ch != 'O' {
+		return
+	}
+	ch, _, _ := s.e.r.ReadRune()
+	switch ch {
+	case 'A':
+		s.browse(-1)
+	case 'B':
+		s.browse(1)
+	case 'C':
+		if s.pos < len(s.line) {
+			s.pos++
+		}
+	case 'D':
+		if s.pos > 0 {
+			s.pos--
+		}
+	case 'H':
+		s.pos = 0
+	case 'F':
+		s.pos = len(s.line)
+	case '3':
+		if ch, _, _ := s.e.r.ReadRune(); ch == '~' {
+			s.del()
+		}
+	}
+}
+
+// browse moves in the history.
+func (s *state) browse(d int) {
+	i := s.hist + d
+	if i < 0 || i > len(s.e.History) {
+		return
+	}
+	if s.hist == len(s.e.History) {
+		s.saved = append(s.saved[:0], s.line...)
+	}
+	s.hist = i
+	if i == len(s.e.History) {
+		s.line = append([]rune(nil), s.saved...)
+	} else {
+		s.line = []rune(s.e.History[i])
+	}
+	s.pos = len(s.line)
+}
+
+// complete replaces the word before the cursor with the single candidate or
+// the candidates' common prefix, and lists them if it didn't progress.
+func (s *state) complete() {
+	if s.e.Complete == nil {
+		return
+	}
+	head := string(s.line[:s.pos])
+	c := s.e.Complete(head)
+	if len(c) == 0 {
+		return
+	}
+	word := head[strings.LastIndexByte(head, ' ')+1:]
+	repl := c[0]
+	for _, v := range c[1:] {
+		for !strings.HasPrefix(v, repl) {
+			repl = repl[:len(repl)-1]
+		}
+	}
+	if len(c) == 1 {
+		repl += " "
+	} else if repl == word {
+		fmt.Fprintf(s.e.out, "\r\n%s\r\n", strings.Join(c, "  "))
+		return
+	}
+	head = head[:len(head)-len(word)] + repl
+	s.line = append([]rune(head), s.line[s.pos:]...)
+	s.pos = len([]rune(head))
+}
@@ -0,0 +1,290 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// Package metrics exports the internal metrics in the Prometheus text
+// exposition format. Like expvar, the metrics are registered globally,
+// usually in package variables.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DurationBuckets are the upper bounds in seconds of the duration
+// histograms, from a fast RCON command to a slow server restart.
+var DurationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// metric is a registered metric family.
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+var (
+	mu       sync.Mutex
+	registry = map[string]metric{}
+)
+
+func register(m metric) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := registry[m.name()]; ok {
+		panic("metrics: duplicate metric " + m.name())
+	}
+	registry[m.name()] = m
+}
+
+// family is the common part of the metrics: the name, the help and the label
+// names.
+type family struct {
+	n      string
+	help   string
+	labels []string
+}
+
+func (f *family) name() string {
+	return f.n
+}
+
+func (f *family) header(w *bufio.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.n, escape(f.help, false), f.n, typ)
+}
+
+// key joins the label values, checking their count.
+func (f *family) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.n, len(f.labels), len(values)))
+	}
+	return strings.Join(values, "\x00")
+}
+
+// labelPairs formats the labels of key, with the extra label if any, e.g.
+// `{route="/api",le="0.1"}`.
+func (f *family) labelPairs(key string, extra ...string) string {
+	var l []string
+	if len(f.labels) != 0 {
+		for i, v := range strings.Split(key, "\x00") {
+			l = append(l, f.labels[i]+`="`+escape(v, true)+`"`)
+		}
+	}
+	if len(extra) == 2 {
+		l = append(l, extra[0]+`="`+extra[1]+`"`)
+	}
+	if len(l) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(l, ",") + "}"
+}
+
+// Counter is a monotonic counter per label values.
+type Counter struct {
+	family
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter registers a counter. By convention the name ends with _total.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{family: family{n: name, help: help, labels: labels}, values: map[string]float64{}}
+	register(c)
+	return c
+}
+
+// Add adds v to the counter of the label values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	k := c.key(labelValues)
+	c.mu.Lock()
+	c.values[k] += v
+	c.mu.Unlock()
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.header(w, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.n, c.labelPairs(k), formatFloat(c.values[k]))
+	}
+}
+
+// Gauge is a value that goes up and down per label values.
+type Gauge struct {
+	family
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewGauge registers a gauge.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{family: family{n: name, help: help, labels: labels}, values: map[string]float64{}}
+	register(g)
+	return g
+}
+
+// Set sets the gauge of the label values.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	k := g.key(labelValues)
+	g.mu.Lock()
+	g.values[k] = v
+	g.mu.Unlock()
+}
+
+// Add adds v, which may be negative, to the gauge of the label values.
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	k := g.key(labelValues)
+	g.mu.Lock()
+	g.values[k] += v
+	g.mu.Unlock()
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.header(w, "gauge")
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, k := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.n, g.labelPairs(k), formatFloat(g.values[k]))
+	}
+}
+
+// GaugeFunc is a gauge computed when the metrics are scraped.
+type GaugeFunc struct {
+	family
+	f func(emit func(v float64, labelValues ...string))
+}
+
+// NewGaugeFunc registers a gauge whose values are emitted by f at each
+// scrape.
+func NewGaugeFunc(name, help string, labels []string, f func(emit func(v float64, labelValues ...string))) *GaugeFunc {
+	g := &GaugeFunc{family: family{n: name, help: help, labels: labels}, f: f}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	values := map[string]float64{}
+	g.f(func(v float64, labelValues ...string) {
+		values[g.key(labelValues)] = v
+	})
+	g.header(w, "gauge")
+	for _, k := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.n, g.labelPairs(k), formatFloat(values[k]))
+	}
+}
+
+// Histogram counts the observations in buckets per label values.
+type Histogram struct {
+	family
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a histogram with the buckets' upper bounds, in
+// increasing order.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{family: family{n: name, help: help, labels: labels}, buckets: buckets, values: map[string]*histogramValue{}}
+	register(h)
+	return h
+}
+
+// Observe records v for the label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	k := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv := h.values[k]
+	if hv == nil {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = hv
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.header(w, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, k := range sortedKeys(h.values) {
+		hv := h.values[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.n, h.labelPairs(k, "le", formatFloat(b)), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.n, h.labelPairs(k, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.n, h.labelPairs(k), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.n, h.labelPairs(k), hv.count)
+	}
+}
+
+// WriteText writes all the metrics, sorted by name.
+func WriteText(w io.Writer) error {
+	mu.Lock()
+	l := make([]metric, 0, len(registry))
+	for _, m := range registry {
+		l = append(l, m)
+	}
+	mu.Unlock()
+	sort.Slice(l, func(i, j int) bool { return l[i].name() < l[j].name() })
+	b := bufio.NewWriter(w)
+	for _, m := range l {
+		m.write(b)
+	}
+	return b.Flush()
+}
+
+// Handler serves the metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = WriteText(w)
+	})
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// escape escapes the help text or, with quote, a label value.
+func escape(s string, quote bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quote {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
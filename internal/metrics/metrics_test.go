@@ -0,0 +1,95 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	c := NewCounter("test_requests_total", "Requests.\nPer route.", "route")
+	c.Add(1, "/api")
+	c.Add(2, "/api")
+	c.Add(1, `/"q"`)
+	g := NewGauge("test_players", "Players.")
+	g.Set(5)
+	g.Add(-2)
+	NewGaugeFunc("test_units", "Units.", []string{"state"}, func(emit func(v float64, labelValues ...string)) {
+		emit(2, "active")
+		emit(1, "failed")
+	})
+	h := NewHistogram("test_seconds", "Durations.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(3)
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	got := w.Body.String()
+	data := []string{
+		"# HELP test_requests_total Requests.\\nPer route.\n# TYPE test_requests_total counter\n" +
+			"test_requests_total{route=\"/\\\"q\\\"\"} 1\ntest_requests_total{route=\"/api\"} 3\n",
+		"# TYPE test_players gauge\ntest_players 3\n",
+		"# TYPE test_units gauge\ntest_units{state=\"active\"} 2\ntest_units{state=\"failed\"} 1\n",
+		"# TYPE test_seconds histogram\n" +
+			"test_seconds_bucket{le=\"0.1\"} 1\ntest_seconds_bucket{le=\"1\"} 2\ntest_seconds_bucket{le=\"+Inf\"} 3\n" +
+			"test_seconds_sum 3.55\ntest_seconds_count 3\n",
+	}
+	for i, l := range data {
+		if !strings.Contains(got, l) {
+			t.Errorf("#%d: missing\n%s\nin\n%s", i, l, got)
+		}
+	}
+	// Sorted by name.
+	if a, b := strings.Index(got, "test_players"), strings.Index(got, "test_units"); a > b {
+		t.Error("not sorted")
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type: %q", ct)
+	}
+}
+
+func TestFormatFloat(t *testing.T) {
+	data := []struct {
+		v    float64
+		want string
+	}{
+		{0, "0"},
+		{0.001, "0.001"},
+		{300, "300"},
+		{1e21, "1e+21"},
+		{math.Inf(1), "+Inf"},
+		{math.Inf(-1), "-Inf"},
+	}
+	for _, l := range data {
+		if got := formatFloat(l.v); got != l.want {
+			t.Errorf("formatFloat(%v) = %q, want %q", l.v, got, l.want)
+		}
+	}
+}
+
+func TestPanics(t *testing.T) {
+	c := NewCounter("test_panics_total", "Panics.", "a")
+	data := []struct {
+		name string
+		f    func()
+	}{
+		{"duplicate", func() { NewGauge("test_panics_total", "Again.") }},
+		{"labels", func() { c.Add(1) }},
+	}
+	for _, l := range data {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: didn't panic", l.name)
+				}
+			}()
+			l.f()
+		}()
+	}
+}
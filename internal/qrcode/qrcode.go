@@ -0,0 +1,416 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// Package qrcode encodes short strings, like URLs, as QR codes.
+//
+// Only the byte mode, the error correction level M and the versions 1 to 10
+// are implemented, which is enough for up to 213 bytes. See ISO/IEC 18004.
+package qrcode
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Code is an encoded QR code.
+type Code struct {
+	// Size is the number of modules per side, excluding the quiet zone.
+	Size    int
+	modules []bool
+}
+
+// Black returns true if the module at column x, row y is dark.
+func (c *Code) Black(x, y int) bool {
+	return c.modules[y*c.Size+x]
+}
+
+// SVG returns the code as a scalable SVG image, including the quiet zone.
+func (c *Code) SVG() string {
+	n := c.Size + 8
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, n, n)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, n, n)
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.Black(x, y) {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x+4, y+4)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.String()
+}
+
+// blocks describes the error correction blocks of a version at level M.
+type blocks struct {
+	// ec is the number of error correction codewords per block.
+	ec int
+	// short is the number of blocks of data codewords; there are long blocks
+	// of data+1 codewords.
+	short, long, data int
+}
+
+var versions = [...]blocks{
+	1:  {ec: 10, short: 1, data: 16},
+	2:  {ec: 16, short: 1, data: 28},
+	3:  {ec: 26, short: 1, data: 44},
+	4:  {ec: 18, short: 2, data: 32},
+	5:  {ec: 24, short: 2, data: 43},
+	6:  {ec: 16, short: 4, data: 27},
+	7:  {ec: 18, short: 4, data: 31},
+	8:  {ec: 22, short: 2, long: 2, data: 38},
+	9:  {ec: 22, short: 3, long: 2, data: 36},
+	10: {ec: 26, short: 4, long: 1, data: 43},
+}
+
+var alignments = [...][]int{
+	2: {6, 18}, 3: {6, 22}, 4: {6, 26}, 5: {6, 30}, 6: {6, 34},
+	7: {6, 22, 38}, 8: {6, 24, 42}, 9: {6, 26, 46}, 10: {6, 28, 50},
+}
+
+func (b *blocks) dataLen() int {
+	return b.short*b.data + b.long*(b.data+1)
+}
+
+// Encode encodes the data in the smallest version that fits.
+func Encode(data []byte) (*Code, error) {
+	for v := 1; v < len(versions); v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		b := &versions[v]
+		if 4+countBits+8*len(data) > 8*b.dataLen() {
+			continue
+		}
+		var w bitWriter
+		w.write(0x4, 4)
+		w.write(len(data), countBits)
+		for _, c := range data {
+			w.write(int(c), 8)
+		}
+		capacity := 8 * b.dataLen()
+		w.write(0, min(4, capacity-w.n))
+		w.write(0, (8-w.n%8)%8)
+		for pad := 0xEC; w.n < capacity; pad ^= 0xEC ^ 0x11 {
+			w.write(pad, 8)
+		}
+		return build(v, interleave(b, w.buf)), nil
+	}
+	return nil, errors.New("qrcode: data too long")
+}
+
+type bitWriter struct {
+	buf []byte
+	n   int
+}
+
+func (w *bitWriter) write(v, bits int) {
+	for i := bits - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if (v>>i)&1 != 0 {
+			w.buf[w.n/8] |= 0x80 >> (w.n % 8)
+		}
+		w.n++
+	}
+}
+
+// interleave splits the data in blocks, appends their error correction
+// codewords and interleaves them.
+func interleave(b *blocks, data []byte) []byte {
+	div := rsDivisor(b.ec)
+	var dataBlocks, ecBlocks [][]byte
+	for i := 0; i < b.short+b.long; i++ {
+		n := b.data
+		if i >= b.short {
+			n++
+		}
+		dataBlocks = append(dataBlocks, data[:n])
+		ecBlocks = append(ecBlocks, rsRemainder(data[:n], div))
+		data = data[n:]
+	}
+	var out []byte
+	for i := 0; i <= b.data; i++ {
+		for _, d := range dataBlocks {
+			if i < len(d) {
+				out = append(out, d[i])
+			}
+		}
+	}
+	for i := 0; i < b.ec; i++ {
+		for _, e := range ecBlocks {
+			out = append(out, e[i])
+		}
+	}
+	return out
+}
+
+// gfMul multiplies in GF(2^8) modulo x^8+x^4+x^3+x^2+1.
+func gfMul(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// rsDivisor returns the Reed-Solomon generator polynomial of the degree,
+// without its leading term.
+func rsDivisor(degree int) []byte {
+	out := make([]byte, degree)
+	out[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range out {
+			out[j] = gfMul(out[j], root)
+			if j+1 < len(out) {
+				out[j] ^= out[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return out
+}
+
+func rsRemainder(data, div []byte) []byte {
+	out := make([]byte, len(div))
+	for _, b := range data {
+		f := b ^ out[0]
+		copy(out, out[1:])
+		out[len(out)-1] = 0
+		for i := range out {
+			out[i] ^= gfMul(div[i], f)
+		}
+	}
+	return out
+}
+
+// grid is a code being built.
+type grid struct {
+	size     int
+	modules  []bool
+	function []bool
+}
+
+func (g *grid) set(x, y int, black bool) {
+	g.modules[y*g.size+x] = black
+	g.function[y*g.size+x] = true
+}
+
+func build(version int, codewords []byte) *Code {
+	size := 17 + 4*version
+	g := &grid{size: size, modules: make([]bool, size*size), function: make([]bool, size*size)}
+	for i := 0; i < size; i++ {
+		g.set(6, i, i%2 == 0)
+		g.set(i, 6, i%2 == 0)
+	}
+	for _, c := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x >= 0 && x < size && y >= 0 && y < size {
+					d := max(abs(dx), abs(dy))
+					g.set(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+	a := alignments[version]
+	for i, cx := range a {
+		for j, cy := range a {
+			// Skip the ones overlapping the finder patterns.
+			if (i == 0 && j == 0) || (i == 0 && j == len(a)-1) || (i == len(a)-1 && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					g.set(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+	// Reserve the format areas; they are drawn once the mask is chosen.
+	g.drawFormat(0)
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			black := (bits>>i)&1 != 0
+			x, y := size-11+i%3, i/3
+			g.set(x, y, black)
+			g.set(y, x, black)
+		}
+	}
+	i := 0
+	for right := size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = size - 1 - vert
+				}
+				if !g.function[y*size+x] && i < len(codewords)*8 {
+					g.modules[y*size+x] = (codewords[i/8]>>(7-i%8))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+	best, bestPenalty := 0, -1
+	for m := 0; m < 8; m++ {
+		g.applyMask(m)
+		g.drawFormat(m)
+		if p := g.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = m, p
+		}
+		g.applyMask(m)
+	}
+	g.applyMask(best)
+	g.drawFormat(best)
+	return &Code{Size: size, modules: g.modules}
+}
+
+// drawFormat draws both copies of the format information of level M with the
+// mask, and the dark module.
+func (g *grid) drawFormat(mask int) {
+	data := mask // Level M is 00.
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 != 0 }
+	for i := 0; i <= 5; i++ {
+		g.set(8, i, bit(i))
+	}
+	g.set(8, 7, bit(6))
+	g.set(8, 8, bit(7))
+	g.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		g.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		g.set(g.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		g.set(8, g.size-15+i, bit(i))
+	}
+	g.set(8, g.size-8, true)
+}
+
+// applyMask XORs the data modules with the mask pattern. Applying it twice
+// reverts it.
+func (g *grid) applyMask(mask int) {
+	for y := 0; y < g.size; y++ {
+		for x := 0; x < g.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !g.function[y*g.size+x] {
+				g.modules[y*g.size+x] = !g.modules[y*g.size+x]
+			}
+		}
+	}
+}
+
+// penalty scores the code per the mask evaluation rules; lower is better.
+func (g *grid) penalty() int {
+	n := g.size
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			x, y = y, x
+		}
+		return g.modules[y*n+x]
+	}
+	p := 0
+	finder := []bool{true, false, true, true, true, false, true}
+	for _, t := range []bool{false, true} {
+		for y := 0; y < n; y++ {
+			run := 0
+			for x := 0; x < n; x++ {
+				if x > 0 && at(x, y, t) == at(x-1, y, t) {
+					run++
+				} else {
+					run = 1
+				}
+				if run == 5 {
+					p += 3
+				} else if run > 5 {
+					p++
+				}
+				// A finder-like pattern with 4 light modules on either side.
+				if x+7 <= n {
+					match := true
+					for k, v := range finder {
+						if at(x+k, y, t) != v {
+							match = false
+							break
+						}
+					}
+					if match && (lightRun(at, x-4, x, y, t, n) || lightRun(at, x+7, x+11, y, t, n)) {
+						p += 40
+					}
+				}
+			}
+		}
+	}
+	dark := 0
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			c := g.modules[y*n+x]
+			if c {
+				dark++
+			}
+			if x+1 < n && y+1 < n && c == g.modules[y*n+x+1] && c == g.modules[(y+1)*n+x] && c == g.modules[(y+1)*n+x+1] {
+				p += 3
+			}
+		}
+	}
+	return p + abs(dark*100/(n*n)-50)/5*10
+}
+
+// lightRun returns true if the modules from start to end on the line are all
+// light. The quiet zone is light.
+func lightRun(at func(x, y int, t bool) bool, start, end, y int, t bool, n int) bool {
+	for x := start; x < end; x++ {
+		if x >= 0 && x < n && at(x, y, t) {
+			return false
+		}
+	}
+	return true
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
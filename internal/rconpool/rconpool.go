@@ -0,0 +1,319 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// Package rconpool multiplexes the RCON commands sent to the game servers over
+// a single connection per server.
+package rconpool
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorcon/rcon"
+
+	"github.com/maruel/ark-serman/internal/metrics"
+	"github.com/maruel/ark-serman/internal/trace"
+)
+
+// Counters exported at /debug/vars.
+var (
+	expCalls  = expvar.NewInt("rcon_calls")
+	expErrors = expvar.NewInt("rcon_errors")
+)
+
+// Metrics exported in the Prometheus format, by server address.
+var (
+	metDuration = metrics.NewHistogram("ark_serman_rcon_duration_seconds", "Duration of the RCON commands, including the connection.", metrics.DurationBuckets, "addr")
+	metErrors   = metrics.NewCounter("ark_serman_rcon_errors_total", "Failed RCON commands.", "addr")
+)
+
+// MinInterval is the minimum delay between two RCON commands sent to the
+// same server.
+const MinInterval = 500 * time.Millisecond
+
+// Result is the response to a RCON command.
+type Result struct {
+	Cmd  string
+	Resp string
+	Err  error
+	Time time.Time
+}
+
+// Poller multiplexes the RCON needs of all the components over a single
+// connection per server at a bounded rate.
+//
+// Periodic commands are registered with Subscribe() and their results fanned
+// out to every subscriber. One-shot commands are sent with Execute().
+type Poller struct {
+	addr   string
+	pwd    string
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	subs      map[string]*sub
+	latest    map[string]Result
+	oneoff    chan request
+	connected bool
+}
+
+type sub struct {
+	interval time.Duration
+	next     time.Time
+	chans    []chan Result
+	// pinned subscriptions are kept even without subscribers, their result
+	// is only available via Last().
+	pinned bool
+}
+
+type request struct {
+	cmd  string
+	resp chan Result
+}
+
+func newPoller(addr, pwd string) *Poller {
+	return &Poller{
+		addr:   addr,
+		pwd:    pwd,
+		subs:   map[string]*sub{},
+		latest: map[string]Result{},
+		oneoff: make(chan request),
+	}
+}
+
+// Subscribe registers cmd to be run at least every interval. The channel
+// always contains the most recent result; older ones are dropped if the
+// subscriber is slow. Call the returned function to unsubscribe.
+func (p *Poller) Subscribe(cmd string, interval time.Duration) (<-chan Result, func()) {
+	ch := make(chan Result, 1)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.subs[cmd]
+	if s == nil {
+		s = &sub{interval: interval}
+		p.subs[cmd] = s
+	} else if interval < s.interval {
+		s.interval = interval
+	}
+	s.chans = append(s.chans, ch)
+	return ch, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for i, c := range s.chans {
+			if c == ch {
+				s.chans = append(s.chans[:i], s.chans[i+1:]...)
+				break
+			}
+		}
+		if len(s.chans) == 0 && !s.pinned {
+			delete(p.subs, cmd)
+		}
+	}
+}
+
+// Pin registers cmd to be run at least every interval for the lifetime of the
+// poller. Use Last() to retrieve the result.
+func (p *Poller) Pin(cmd string, interval time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.subs[cmd]
+	if s == nil {
+		s = &sub{interval: interval}
+		p.subs[cmd] = s
+	} else if interval < s.interval {
+		s.interval = interval
+	}
+	s.pinned = true
+}
+
+// Last returns the last result for a subscribed command.
+func (p *Poller) Last(cmd string) (Result, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r, ok := p.latest[cmd]
+	return r, ok
+}
+
+// Execute runs a one-shot command, sharing the connection and rate limit
+// with the subscriptions.
+func (p *Poller) Execute(ctx context.Context, cmd string) (resp string, err error) {
+	// Only the command's name is recorded, the arguments may be private,
+	// e.g. a chat message.
+	name, _, _ := strings.Cut(cmd, " ")
+	_, span := trace.Start(ctx, "rcon "+name, trace.Client, "rcon.addr", p.addr)
+	defer func() { span.End(err) }()
+	req := request{cmd: cmd, resp: make(chan Result, 1)}
+	select {
+	case p.oneoff <- req:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	select {
+	case r := <-req.resp:
+		return r.Resp, r.Err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// run processes the commands until ctx is canceled.
+func (p *Poller) run(ctx context.Context) {
+	var conn *rcon.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	do := func(cmd string) Result {
+		r := Result{Cmd: cmd, Time: time.Now()}
+		expCalls.Add(1)
+		defer func() {
+			metDuration.Observe(time.Since(r.Time).Seconds(), p.addr)
+			if r.Err != nil {
+				expErrors.Add(1)
+				metErrors.Add(1, p.addr)
+			}
+		}()
+		if conn == nil {
+			if conn, r.Err = rcon.Dial(p.addr, p.pwd, rcon.SetDialTimeout(5*time.Second), rcon.SetDeadline(10*time.Second)); r.Err != nil {
+				conn = nil
+				return r
+			}
+		}
+		if r.Resp, r.Err = conn.Execute(cmd); r.Err != nil {
+			// Reconnect on next command.
+			conn.Close()
+			conn = nil
+		}
+		p.mu.Lock()
+		p.connected = conn != nil
+		p.mu.Unlock()
+		return r
+	}
+	t := time.NewTicker(MinInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		// One-shot commands have priority over polling.
+		select {
+		case req := <-p.oneoff:
+			req.resp <- do(req.cmd)
+			continue
+		default:
+		}
+		cmd := p.due()
+		if cmd == "" {
+			continue
+		}
+		r := do(cmd)
+		p.publish(r)
+	}
+}
+
+// due returns the subscribed command that is the most overdue, if any.
+func (p *Poller) due() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	cmd := ""
+	var oldest time.Time
+	for k, s := range p.subs {
+		if s.next.After(now) {
+			continue
+		}
+		if cmd == "" || s.next.Before(oldest) {
+			cmd = k
+			oldest = s.next
+		}
+	}
+	if cmd != "" {
+		s := p.subs[cmd]
+		s.next = now.Add(s.interval)
+	}
+	return cmd
+}
+
+func (p *Poller) publish(r Result) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.latest[r.Cmd] = r
+	s := p.subs[r.Cmd]
+	if s == nil {
+		return
+	}
+	for _, ch := range s.chans {
+		// Replace the stale result, if any.
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- r
+	}
+}
+
+// Pool holds one poller per server.
+type Pool struct {
+	ctx context.Context
+
+	mu      sync.Mutex
+	pollers map[string]*Poller
+}
+
+// New returns a pool whose pollers run until ctx is canceled.
+func New(ctx context.Context) *Pool {
+	return &Pool{ctx: ctx, pollers: map[string]*Poller{}}
+}
+
+// Get returns the poller for the server name, starting it as needed. The
+// poller is replaced when the address or password changed.
+func (r *Pool) Get(name, addr, pwd string) *Poller {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := r.pollers[name]
+	if p != nil && (p.addr != addr || p.pwd != pwd) {
+		p.cancel()
+		p = nil
+	}
+	if p == nil {
+		p = newPoller(addr, pwd)
+		var ctx context.Context
+		ctx, p.cancel = context.WithCancel(r.ctx)
+		r.pollers[name] = p
+		go p.run(ctx)
+	}
+	return p
+}
+
+// Prune stops the pollers of the servers for which keep returns false.
+func (r *Pool) Prune(keep func(name string) bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, p := range r.pollers {
+		if !keep(name) {
+			p.cancel()
+			delete(r.pollers, name)
+		}
+	}
+}
+
+// Dump logs the state of the pollers.
+func (r *Pool) Dump() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, p := range r.pollers {
+		p.mu.Lock()
+		log.Printf("  rcon %s %s: connected=%t subscriptions=%d", name, p.addr, p.connected, len(p.subs))
+		for cmd, l := range p.latest {
+			log.Printf("    %q at %s: err=%v", cmd, l.Time.Format(time.RFC3339), l.Err)
+		}
+		p.mu.Unlock()
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package rconpool
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorcon/rcon"
+	"github.com/gorcon/rcon/rcontest"
+)
+
+func newServer(t *testing.T, calls *atomic.Int32) *rcontest.Server {
+	s := rcontest.NewServer(
+		rcontest.SetSettings(rcontest.Settings{Password: "pwd"}),
+		rcontest.SetCommandHandler(func(c *rcontest.Context) {
+			calls.Add(1)
+			_, _ = rcon.NewPacket(rcon.SERVERDATA_RESPONSE_VALUE, c.Request().ID, "echo "+c.Request().Body()).WriteTo(c.Conn())
+		}),
+	)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestExecute(t *testing.T) {
+	var calls atomic.Int32
+	s := newServer(t, &calls)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p := New(ctx).Get("island", s.Addr(), "pwd")
+	data := []struct {
+		cmd  string
+		want string
+	}{
+		{"ListPlayers", "echo ListPlayers"},
+		{"Broadcast hi", "echo Broadcast hi"},
+	}
+	for _, l := range data {
+		got, err := p.Execute(ctx, l.cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != l.want {
+			t.Fatalf("%s: got %q, want %q", l.cmd, got, l.want)
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("got %d calls", n)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	var calls atomic.Int32
+	s := newServer(t, &calls)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p := New(ctx).Get("island", s.Addr(), "pwd")
+	// Both subscribers share one command.
+	ch1, unsub1 := p.Subscribe("ListPlayers", time.Hour)
+	defer unsub1()
+	ch2, unsub2 := p.Subscribe("ListPlayers", time.Hour)
+	defer unsub2()
+	for _, ch := range []<-chan Result{ch1, ch2} {
+		select {
+		case r := <-ch:
+			if r.Err != nil || r.Resp != "echo ListPlayers" {
+				t.Fatalf("got %+v", r)
+			}
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("got %d calls, want 1", n)
+	}
+	if r, ok := p.Last("ListPlayers"); !ok || r.Resp != "echo ListPlayers" {
+		t.Fatalf("Last: %+v, %t", r, ok)
+	}
+}
+
+func TestGetReplaces(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool := New(ctx)
+	a := pool.Get("island", "127.0.0.1:1", "pwd")
+	if pool.Get("island", "127.0.0.1:1", "pwd") != a {
+		t.Fatal("expected the same poller")
+	}
+	if pool.Get("island", "127.0.0.1:1", "other") == a {
+		t.Fatal("expected a new poller after a password change")
+	}
+	pool.Prune(func(string) bool { return false })
+	if len(pool.pollers) != 0 {
+		t.Fatal("expected no pollers")
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// Package systemdctl controls the units of the user's systemd instance over
+// D-Bus.
+package systemdctl
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+
+	"github.com/maruel/ark-serman/internal/metrics"
+	"github.com/maruel/ark-serman/internal/trace"
+)
+
+// Counters exported at /debug/vars.
+var (
+	// expCalls counts the D-Bus connections; one is opened per operation.
+	expCalls  = expvar.NewInt("dbus_calls")
+	expErrors = expvar.NewInt("dbus_errors")
+)
+
+// Metrics exported in the Prometheus format.
+var (
+	metDuration = metrics.NewHistogram("ark_serman_dbus_duration_seconds", "Duration of the D-Bus operations, including the systemd jobs.", metrics.DurationBuckets, "op")
+	metErrors   = metrics.NewCounter("ark_serman_dbus_errors_total", "Failed D-Bus operations.", "op")
+)
+
+// observe records the operation's duration and failure.
+func observe(op string, start time.Time, err error) {
+	metDuration.Observe(time.Since(start).Seconds(), op)
+	if err != nil {
+		metErrors.Add(1, op)
+	}
+}
+
+// Dial connects to the user's systemd instance.
+func Dial(ctx context.Context) (*dbus.Conn, error) {
+	start := time.Now()
+	_, span := trace.Start(ctx, "dbus dial", trace.Client)
+	expCalls.Add(1)
+	c, err := dbus.NewUserConnectionContext(ctx)
+	if err != nil {
+		expErrors.Add(1)
+	}
+	observe("dial", start, err)
+	span.End(err)
+	return c, err
+}
+
+// unitOp is a systemd job method, e.g. (*dbus.Conn).StartUnitContext.
+type unitOp func(c *dbus.Conn, ctx context.Context, name, mode string, ch chan<- string) (int, error)
+
+// runUnitJob runs the job on the unit and waits for its completion.
+func runUnitJob(ctx context.Context, name, unit string, op unitOp) (err error) {
+	start := time.Now()
+	ctx, span := trace.Start(ctx, "systemd "+name, trace.Client, "systemd.unit", unit)
+	defer func() {
+		observe(name, start, err)
+		span.End(err)
+	}()
+	conn, err := Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ch := make(chan string, 1)
+	if _, err = op(conn, ctx, unit, "replace", ch); err != nil {
+		return err
+	}
+	select {
+	case r := <-ch:
+		if r != "done" {
+			return fmt.Errorf("%s: job %s", unit, r)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Start starts the unit and waits for the job to complete.
+func Start(ctx context.Context, unit string) error {
+	return runUnitJob(ctx, "start", unit, (*dbus.Conn).StartUnitContext)
+}
+
+// Stop stops the unit and waits for the job to complete.
+func Stop(ctx context.Context, unit string) error {
+	return runUnitJob(ctx, "stop", unit, (*dbus.Conn).StopUnitContext)
+}
+
+// Restart restarts the unit and waits for the job to complete.
+func Restart(ctx context.Context, unit string) error {
+	return runUnitJob(ctx, "restart", unit, (*dbus.Conn).RestartUnitContext)
+}
+
+// Active returns true if the unit is active or transitioning.
+func Active(ctx context.Context, unit string) (_ bool, err error) {
+	start := time.Now()
+	ctx, span := trace.Start(ctx, "systemd active", trace.Client, "systemd.unit", unit)
+	defer func() {
+		observe("active", start, err)
+		span.End(err)
+	}()
+	conn, err := Dial(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	p, err := conn.GetUnitPropertyContext(ctx, unit, "ActiveState")
+	if err != nil {
+		return false, err
+	}
+	s, _ := p.Value.Value().(string)
+	return s != "inactive" && s != "failed", nil
+}
+
+// Kill sends SIGKILL to the unit's processes. Restart=on-failure then
+// restarts it.
+func Kill(ctx context.Context, unit string) error {
+	conn, err := Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.KillUnitContext(ctx, unit, int32(syscall.SIGKILL))
+	return nil
+}
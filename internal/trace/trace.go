@@ -0,0 +1,358 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// Package trace records spans and exports them to an OpenTelemetry collector
+// with OTLP over HTTP, in the JSON encoding.
+//
+// Tracing is disabled until Init is called; Start then returns a nil *Span
+// whose methods do nothing, so the instrumented code doesn't check.
+package trace
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kind is the span kind, as defined by OTLP.
+type Kind int
+
+// The span kinds.
+const (
+	Internal Kind = 1
+	Server   Kind = 2
+	Client   Kind = 3
+)
+
+const (
+	// queueLen is the number of ended spans buffered; more are dropped while
+	// the collector is slow or down.
+	queueLen = 2048
+	// batchLen is the number of spans sent per request.
+	batchLen = 512
+	// flushInterval is the maximum time an ended span waits to be sent.
+	flushInterval = 5 * time.Second
+)
+
+// Span is an operation of a trace.
+type Span struct {
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	kind    Kind
+	start   time.Time
+
+	mu    sync.Mutex
+	attrs []string
+	err   string
+	ended bool
+}
+
+// SetAttr sets the attributes, as key value pairs.
+func (s *Span) SetAttr(kv ...string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, kv...)
+	s.mu.Unlock()
+}
+
+// End ends the span, marking it as failed when err is not nil, and queues it
+// for export.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	end := time.Now()
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	if err != nil {
+		s.err = err.Error()
+	}
+	s.mu.Unlock()
+	if e := exp.Load(); e != nil {
+		e.queue(s, end)
+	}
+}
+
+// TraceParent returns the W3C traceparent header value of the span.
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+type spanKeyType struct{}
+
+var spanKey spanKeyType
+
+// Start starts a span, a child of the span of ctx if any. kv are the
+// attributes as key value pairs.
+func Start(ctx context.Context, name string, kind Kind, kv ...string) (context.Context, *Span) {
+	if exp.Load() == nil {
+		return ctx, nil
+	}
+	s := &Span{name: name, kind: kind, start: time.Now(), attrs: kv}
+	if p, _ := ctx.Value(spanKey).(*Span); p != nil {
+		s.traceID, s.parent = p.traceID, p.spanID
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+	}
+	_, _ = rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey, s), s
+}
+
+// StartRemote starts a span continuing the trace of the W3C traceparent
+// header value, e.g. of an incoming request. A new trace is started when
+// traceparent is empty or invalid.
+func StartRemote(ctx context.Context, name string, kind Kind, traceparent string, kv ...string) (context.Context, *Span) {
+	ctx, s := Start(ctx, name, kind, kv...)
+	if s == nil || s.parent != [8]byte{} {
+		return ctx, s
+	}
+	p := strings.Split(traceparent, "-")
+	if len(p) != 4 || p[0] != "00" || len(p[1]) != 32 || len(p[2]) != 16 {
+		return ctx, s
+	}
+	var t [16]byte
+	var sp [8]byte
+	if _, err := hex.Decode(t[:], []byte(p[1])); err != nil || t == [16]byte{} {
+		return ctx, s
+	}
+	if _, err := hex.Decode(sp[:], []byte(p[2])); err != nil || sp == [8]byte{} {
+		return ctx, s
+	}
+	s.traceID, s.parent = t, sp
+	return ctx, s
+}
+
+// Config is the exporter's configuration.
+type Config struct {
+	// Endpoint is the collector's OTLP/HTTP URL, e.g. http://localhost:4318.
+	// /v1/traces is appended unless the URL already has a path.
+	Endpoint string
+	// Headers are sent with each request, e.g. an API key.
+	Headers map[string]string
+	// Service is the service.name resource attribute.
+	Service string
+}
+
+var exp atomic.Pointer[exporter]
+
+// Init enables tracing. The returned function stops the exporter after
+// sending the ended spans.
+func Init(c Config) (func(), error) {
+	if !strings.HasPrefix(c.Endpoint, "http://") && !strings.HasPrefix(c.Endpoint, "https://") {
+		return nil, fmt.Errorf("trace: invalid endpoint %q", c.Endpoint)
+	}
+	u := strings.TrimSuffix(c.Endpoint, "/")
+	if strings.Count(u, "/") == 2 {
+		u += "/v1/traces"
+	}
+	e := &exporter{
+		url:     u,
+		headers: c.Headers,
+		service: c.Service,
+		ch:      make(chan ended, queueLen),
+		done:    make(chan struct{}),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	if !exp.CompareAndSwap(nil, e) {
+		return nil, errors.New("trace: already initialized")
+	}
+	go e.run()
+	return func() {
+		exp.CompareAndSwap(e, nil)
+		e.mu.Lock()
+		e.closed = true
+		close(e.ch)
+		e.mu.Unlock()
+		<-e.done
+	}, nil
+}
+
+type ended struct {
+	s   *Span
+	end time.Time
+}
+
+type exporter struct {
+	url     string
+	headers map[string]string
+	service string
+	ch      chan ended
+	done    chan struct{}
+	client  *http.Client
+	dropped atomic.Int64
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (e *exporter) queue(s *Span, end time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.ch <- ended{s, end}:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+func (e *exporter) run() {
+	defer close(e.done)
+	t := time.NewTicker(flushInterval)
+	defer t.Stop()
+	var batch []ended
+	for {
+		select {
+		case s, ok := <-e.ch:
+			if !ok {
+				e.send(batch)
+				return
+			}
+			if batch = append(batch, s); len(batch) < batchLen {
+				continue
+			}
+		case <-t.C:
+		}
+		e.send(batch)
+		batch = batch[:0]
+	}
+}
+
+func (e *exporter) send(batch []ended) {
+	if n := e.dropped.Swap(0); n != 0 {
+		log.Printf("trace: dropped %d spans", n)
+	}
+	if len(batch) == 0 {
+		return
+	}
+	b, err := json.Marshal(e.payload(batch))
+	if err != nil {
+		log.Printf("trace: %v", err)
+		return
+	}
+	req, err := http.NewRequest("POST", e.url, bytes.NewReader(b))
+	if err != nil {
+		log.Printf("trace: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		log.Printf("trace: %v", err)
+		return
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("trace: %s: %s", e.url, resp.Status)
+	}
+}
+
+// The OTLP JSON encoding, with the IDs in hex and the 64 bits integers as
+// strings.
+type (
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	otlpAttr struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpSpan struct {
+		TraceID      string     `json:"traceId"`
+		SpanID       string     `json:"spanId"`
+		ParentSpanID string     `json:"parentSpanId,omitempty"`
+		Name         string     `json:"name"`
+		Kind         Kind       `json:"kind"`
+		Start        string     `json:"startTimeUnixNano"`
+		End          string     `json:"endTimeUnixNano"`
+		Attributes   []otlpAttr `json:"attributes,omitempty"`
+		Status       otlpStatus `json:"status"`
+	}
+	otlpScopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpResourceSpans struct {
+		Resource struct {
+			Attributes []otlpAttr `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+)
+
+func (e *exporter) payload(batch []ended) *otlpRequest {
+	ss := otlpScopeSpans{Spans: make([]otlpSpan, 0, len(batch))}
+	ss.Scope.Name = e.service
+	for _, b := range batch {
+		s := b.s
+		o := otlpSpan{
+			TraceID: hex.EncodeToString(s.traceID[:]),
+			SpanID:  hex.EncodeToString(s.spanID[:]),
+			Name:    s.name,
+			Kind:    s.kind,
+			Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+			End:     strconv.FormatInt(b.end.UnixNano(), 10),
+		}
+		if s.parent != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		s.mu.Lock()
+		o.Attributes = attrs(s.attrs)
+		if s.err != "" {
+			// STATUS_CODE_ERROR.
+			o.Status = otlpStatus{Code: 2, Message: s.err}
+		}
+		s.mu.Unlock()
+		ss.Spans = append(ss.Spans, o)
+	}
+	rs := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{ss}}
+	rs.Resource.Attributes = attrs([]string{"service.name", e.service})
+	return &otlpRequest{ResourceSpans: []otlpResourceSpans{rs}}
+}
+
+func attrs(kv []string) []otlpAttr {
+	out := make([]otlpAttr, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		out = append(out, otlpAttr{Key: kv[i], Value: otlpValue{StringValue: kv[i+1]}})
+	}
+	return out
+}
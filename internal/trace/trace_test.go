@@ -0,0 +1,117 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestTrace(t *testing.T) {
+	// Disabled: the nil span does nothing.
+	ctx, s := Start(context.Background(), "disabled", Internal)
+	if s != nil || ctx.Value(spanKey) != nil {
+		t.Fatal("expected no span")
+	}
+	s.SetAttr("a", "b")
+	s.End(nil)
+	if s.TraceParent() != "" {
+		t.Fatal("expected no traceparent")
+	}
+
+	if _, err := Init(Config{Endpoint: "localhost:4318"}); err == nil {
+		t.Fatal("expected invalid endpoint")
+	}
+	var mu sync.Mutex
+	var got []otlpRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("X-Key") != "secret" {
+			t.Errorf("%s %v", r.URL.Path, r.Header)
+		}
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		got = append(got, req)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	stop, err := Init(Config{Endpoint: srv.URL, Headers: map[string]string{"X-Key": "secret"}, Service: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Init(Config{Endpoint: srv.URL}); err == nil {
+		t.Fatal("expected already initialized")
+	}
+
+	const parent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	data := []struct {
+		traceparent string
+		remote      bool
+	}{
+		{parent, true},
+		{"", false},
+		{"01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", false},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331", false},
+		{"00-00000000000000000000000000000000-b7ad6b7169203331-01", false},
+		{"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01", false},
+		{"00-0af7651916cd43dd8448eb211c8031zz-b7ad6b7169203331-01", false},
+	}
+	for i, l := range data {
+		_, s := StartRemote(context.Background(), "remote", Server, l.traceparent)
+		if remote := s.parent != [8]byte{}; remote != l.remote {
+			t.Errorf("#%d: %q: got remote %t", i, l.traceparent, remote)
+		}
+		if l.remote && s.TraceParent()[:36] != parent[:36] {
+			t.Errorf("#%d: got %s", i, s.TraceParent())
+		}
+	}
+
+	ctx, root := StartRemote(context.Background(), "root", Server, parent, "http.route", "/api")
+	_, child := Start(ctx, "child", Client)
+	// A child ignores traceparent, it's already in a trace.
+	_, child2 := StartRemote(ctx, "child2", Internal, "")
+	if child.traceID != root.traceID || child.parent != root.spanID || child2.parent != root.spanID {
+		t.Fatal("expected a child")
+	}
+	child.SetAttr("k", "v")
+	child.End(errors.New("failed"))
+	child.End(nil)
+	root.End(nil)
+	stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 1 {
+		t.Fatalf("got %d requests", len(got))
+	}
+	spans := got[0].ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans", len(spans))
+	}
+	c, r := spans[0], spans[1]
+	if c.Name != "child" || c.Kind != Client || c.Status.Code != 2 || c.Status.Message != "failed" || len(c.Attributes) != 1 {
+		t.Errorf("child: %+v", c)
+	}
+	if r.Name != "root" || r.ParentSpanID != "b7ad6b7169203331" || r.TraceID != "0af7651916cd43dd8448eb211c80319c" || r.Status.Code != 0 {
+		t.Errorf("root: %+v", r)
+	}
+	if c.ParentSpanID != r.SpanID {
+		t.Errorf("child's parent %s != %s", c.ParentSpanID, r.SpanID)
+	}
+	if a := got[0].ResourceSpans[0].Resource.Attributes; len(a) != 1 || a[0].Value.StringValue != "test" {
+		t.Errorf("resource: %+v", a)
+	}
+	// Stopped: disabled again.
+	if _, s := Start(context.Background(), "after", Internal); s != nil {
+		t.Fatal("expected no span")
+	}
+}
@@ -0,0 +1,298 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// Package websocket implements the server side of WebSocket connections and
+// a client for the ark-serman CLI.
+//
+// Only what a browser needs is implemented: no extensions, no subprotocols
+// and the messages are limited in size. See RFC 6455.
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Opcodes of the messages.
+const (
+	Text    = 1
+	Binary  = 2
+	opClose = 8
+	opPing  = 9
+	opPong  = 10
+)
+
+// MaxMessage is the largest message accepted from the peer.
+const MaxMessage = 1 << 20
+
+// magic is appended to the key in the handshake.
+const magic = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Conn is a WebSocket connection.
+type Conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	mu   sync.Mutex
+	// client masks the frames it sends, the server doesn't.
+	client bool
+}
+
+// Upgrade switches the request to the WebSocket protocol. It rejects the
+// cross-origin requests since the browsers send the cookies along.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if !headerHas(r.Header, "Connection", "upgrade") || !headerHas(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket required", http.StatusBadRequest)
+		return nil, errors.New("not a websocket handshake")
+	}
+	if r.Header.Get("Sec-Websocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported websocket version")
+	}
+	if o := r.Header.Get("Origin"); o != "" {
+		if u, err := url.Parse(o); err != nil || u.Host != r.Host {
+			http.Error(w, "cross-origin websocket", http.StatusForbidden)
+			return nil, errors.New("cross-origin websocket")
+		}
+	}
+	key := r.Header.Get("Sec-Websocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// Clear the server's timeouts; the caller handles the idle connections.
+	_ = conn.SetDeadline(time.Time{})
+	h := sha1.Sum([]byte(key + magic))
+	resp := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(h[:]) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Conn{conn: conn, r: rw.Reader}, nil
+}
+
+// Dial opens a WebSocket connection to the http(s):// or ws(s):// URL, with
+// the extra request headers h, e.g. Authorization.
+func Dial(ctx context.Context, rawURL string, h http.Header) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "https" {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	var conn net.Conn
+	if u.Scheme == "https" {
+		d := tls.Dialer{Config: &tls.Config{ServerName: u.Hostname()}}
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(dl)
+	}
+	var k [16]byte
+	_, _ = rand.Read(k[:])
+	key := base64.StdEncoding.EncodeToString(k[:])
+	req := &http.Request{Method: "GET", URL: u, Header: http.Header{}, Host: u.Host}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	sum := sha1.Sum([]byte(key + magic))
+	if resp.Header.Get("Sec-Websocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		conn.Close()
+		return nil, errors.New("invalid Sec-WebSocket-Accept")
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return &Conn{conn: conn, r: r, client: true}, nil
+}
+
+func headerHas(h http.Header, k, v string) bool {
+	for _, l := range h.Values(k) {
+		for _, s := range strings.Split(l, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetReadDeadline sets the deadline of the next ReadMessage.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// ReadMessage returns the next text or binary message. It answers the pings
+// and returns io.EOF once the peer closed the connection.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	var msg []byte
+	op := 0
+	for {
+		var hdr [2]byte
+		if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+			return 0, nil, err
+		}
+		fin, opcode, masked := hdr[0]&0x80 != 0, int(hdr[0]&0xf), hdr[1]&0x80 != 0
+		if masked == c.client {
+			if c.client {
+				return 0, nil, errors.New("masked server frame")
+			}
+			return 0, nil, errors.New("unmasked client frame")
+		}
+		n := uint64(hdr[1] & 0x7f)
+		switch n {
+		case 126:
+			var b [2]byte
+			if _, err := io.ReadFull(c.r, b[:]); err != nil {
+				return 0, nil, err
+			}
+			n = uint64(binary.BigEndian.Uint16(b[:]))
+		case 127:
+			var b [8]byte
+			if _, err := io.ReadFull(c.r, b[:]); err != nil {
+				return 0, nil, err
+			}
+			n = binary.BigEndian.Uint64(b[:])
+		}
+		if n > MaxMessage || uint64(len(msg))+n > MaxMessage {
+			return 0, nil, errors.New("message too large")
+		}
+		var mask [4]byte
+		if masked {
+			if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+				return 0, nil, err
+			}
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return 0, nil, err
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+		}
+		switch opcode {
+		case opClose:
+			_ = c.write(opClose, nil)
+			return 0, nil, io.EOF
+		case opPing:
+			if err := c.write(opPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case 0:
+			// Continuation.
+		default:
+			op = opcode
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return op, msg, nil
+		}
+	}
+}
+
+// WriteMessage sends a text or binary message. It is safe to call
+// concurrently.
+func (c *Conn) WriteMessage(op int, data []byte) error {
+	return c.write(op, data)
+}
+
+func (c *Conn) write(op int, data []byte) error {
+	hdr := []byte{0x80 | byte(op), 0}
+	switch n := len(data); {
+	case n < 126:
+		hdr[1] = byte(n)
+	case n <= 0xffff:
+		hdr[1] = 126
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr[1] = 127
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+	if c.client {
+		var mask [4]byte
+		_, _ = rand.Read(mask[:])
+		hdr[1] |= 0x80
+		hdr = append(hdr, mask[:]...)
+		m := make([]byte, len(data))
+		for i := range data {
+			m[i] = data[i] ^ mask[i%4]
+		}
+		data = m
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	if _, err := c.conn.Write(append(hdr, data...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Close sends a close frame and closes the connection.
+func (c *Conn) Close() error {
+	_ = c.write(opClose, nil)
+	return c.conn.Close()
+}
@@ -0,0 +1,137 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echo serves a WebSocket echoing the messages back.
+func echo(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			op, b, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(op, b); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestEcho(t *testing.T) {
+	srv := echo(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// The lengths cover the 7 bits, 16 bits and 64 bits encodings.
+	data := []struct {
+		op  int
+		len int
+	}{
+		{Text, 0},
+		{Text, 125},
+		{Binary, 126},
+		{Binary, 0xffff},
+		{Binary, 0x10000},
+		{Text, MaxMessage},
+	}
+	for i, l := range data {
+		want := bytes.Repeat([]byte{'a' + byte(i)}, l.len)
+		if err := c.WriteMessage(l.op, want); err != nil {
+			t.Fatal(err)
+		}
+		op, got, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if op != l.op || !bytes.Equal(got, want) {
+			t.Fatalf("#%d: got op %d, %d bytes", i, op, len(got))
+		}
+	}
+	// The server answers the ping before the echo.
+	if err := c.write(opPing, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteMessage(Text, []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	if _, got, err := c.ReadMessage(); err != nil || string(got) != "after" {
+		t.Fatalf("%q, %v", got, err)
+	}
+	// Too large: the server drops the connection.
+	if err := c.WriteMessage(Binary, make([]byte, MaxMessage+1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadMessage(); err != io.EOF {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestUpgradeRejects(t *testing.T) {
+	srv := echo(t)
+	data := []struct {
+		name   string
+		header map[string]string
+		want   int
+	}{
+		{"not websocket", map[string]string{"Connection": "keep-alive"}, http.StatusBadRequest},
+		{"version", map[string]string{"Sec-WebSocket-Version": "8"}, http.StatusUpgradeRequired},
+		{"origin", map[string]string{"Origin": "https://evil.example.com"}, http.StatusForbidden},
+		{"key", map[string]string{"Sec-WebSocket-Key": ""}, http.StatusBadRequest},
+	}
+	for _, l := range data {
+		req, err := http.NewRequest("GET", srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		for k, v := range l.header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != l.want {
+			t.Errorf("%s: got %d, want %d", l.name, resp.StatusCode, l.want)
+		}
+	}
+	// The same origin is accepted.
+	h := http.Header{"Origin": {srv.URL}}
+	c, err := Dial(context.Background(), srv.URL, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if _, err := Dial(context.Background(), "ftp://localhost/", nil); err == nil {
+		t.Fatal("expected unsupported scheme")
+	}
+}
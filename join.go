@@ -0,0 +1,51 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"path"
+
+	"github.com/maruel/ark-serman/internal/qrcode"
+)
+
+var joinTmpl = template.Must(template.ParseFS(rsc, "rsc/join.html.tmpl"))
+
+// serveJoin serves the public join page of a server at /join/<unit>, to hand
+// to new community members. The password is only shown to the web users.
+func (s *webServer) serveJoin(w http.ResponseWriter, r *http.Request) {
+	c := s.config()
+	v := c.serverByUnit(path.Base(r.URL.Path))
+	if v == nil {
+		http.NotFound(w, r)
+		return
+	}
+	name := v.SessionName
+	if name == "" {
+		name = v.Name
+	}
+	ci := newConnectInfo(s.publicIP.get(r.Context()), v)
+	data := map[string]any{
+		"Name":      name,
+		"Map":       c.mapInfo(v.Map).Name,
+		"Connect":   ci,
+		"Crossplay": v.Crossplay,
+		"EpicOnly":  v.EpicOnly,
+	}
+	if userFrom(r.Context()) != nil {
+		data["Password"] = c.ServerPassword
+	}
+	if ci.SteamURL != "" {
+		// html/template rejects the steam: scheme otherwise.
+		data["SteamURL"] = template.URL(ci.SteamURL)
+		if q, err := qrcode.Encode([]byte(ci.SteamURL)); err == nil {
+			// The SVG is generated, not user controlled.
+			data["QR"] = template.HTML(q.SVG())
+		}
+	}
+	w.Header().Add("Content-Type", "text/html")
+	_ = joinTmpl.Execute(w, data)
+}
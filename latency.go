@@ -0,0 +1,161 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/maruel/ark-serman/internal/a2s"
+)
+
+// latencyInterval is how often the query ports are probed.
+const latencyInterval = 30 * time.Second
+
+// latencyStat is the query port responsiveness of a server.
+type latencyStat struct {
+	// Last is the last round trip time, 0 on error.
+	Last time.Duration
+	// Avg is the exponentially weighted moving average of the round trip
+	// times.
+	Avg time.Duration
+	Err error
+	// Slow is set when Last was much slower than the average before it.
+	Slow bool
+	// Failures is the number of consecutive failed probes.
+	Failures int
+	Time     time.Time
+}
+
+// Degraded returns true when the last probe failed or was much slower than
+// usual. A slowing query port usually precedes a stall.
+func (l *latencyStat) Degraded() bool {
+	return l.Err != nil || l.Slow
+}
+
+func (l *latencyStat) String() string {
+	if l.Err != nil {
+		return "no reply (" + strconv.Itoa(l.Failures) + "x)"
+	}
+	return roundDuration(l.Last).String()
+}
+
+// latencyProber measures the latency to each running server's query port.
+type latencyProber struct {
+	mu      sync.Mutex
+	stats   map[string]latencyStat
+	stalled map[string]bool
+}
+
+// setStalled records whether the server is stalled and returns true if it
+// changed.
+func (l *latencyProber) setStalled(name string, stalled bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stalled == nil {
+		l.stalled = map[string]bool{}
+	}
+	old := l.stalled[name]
+	l.stalled[name] = stalled
+	return old != stalled
+}
+
+// isStalled returns true if the server was detected as stalled.
+func (l *latencyProber) isStalled(name string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stalled[name]
+}
+
+// get returns the latest measurement for the server.
+func (l *latencyProber) get(name string) (latencyStat, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	v, ok := l.stats[name]
+	return v, ok
+}
+
+// probe queries the server and records the result.
+func (l *latencyProber) probe(ctx context.Context, s *serverConfig) {
+	_, rtt, err := a2s.Query(ctx, s.localAddr(s.QueryPort))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stats == nil {
+		l.stats = map[string]latencyStat{}
+	}
+	v := l.stats[s.Name]
+	v.Time = time.Now()
+	v.Err = err
+	if err != nil {
+		v.Last = 0
+		v.Failures++
+	} else {
+		v.Last = rtt
+		v.Failures = 0
+		limit := 3 * v.Avg
+		if limit < 250*time.Millisecond {
+			limit = 250 * time.Millisecond
+		}
+		v.Slow = rtt > limit
+		if v.Avg == 0 {
+			v.Avg = rtt
+		} else {
+			v.Avg = (7*v.Avg + rtt) / 8
+		}
+	}
+	l.stats[s.Name] = v
+}
+
+// forget drops the measurements of a server, e.g. when it stopped.
+func (l *latencyProber) forget(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.stats, name)
+}
+
+// probeLatency probes the running servers until ctx is canceled.
+func (s *webServer) probeLatency(ctx context.Context) {
+	t := time.NewTicker(latencyInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		c := s.config()
+		s.mu.Lock()
+		running := map[string]bool{}
+		for _, u := range s.lastStates {
+			running[u.Name] = u.Running
+		}
+		s.mu.Unlock()
+		var wg sync.WaitGroup
+		for i := range c.Servers {
+			v := &c.Servers[i]
+			if !running[v.unitName()] {
+				s.latency.forget(v.Name)
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.latency.probe(ctx, v)
+			}()
+		}
+		wg.Wait()
+		s.checkStalls(ctx, c)
+	}
+}
+
+// servePing is a trivial endpoint for the dashboard to measure the latency
+// between the browser and ark-serman.
+func servePing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusNoContent)
+}
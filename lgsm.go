@@ -0,0 +1,157 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"github.com/maruel/subcommands"
+
+	"github.com/maruel/ark-serman/internal/rconpool"
+	"github.com/maruel/ark-serman/internal/systemdctl"
+)
+
+// lgsmAliases maps LinuxGSM's short commands to the long ones.
+var lgsmAliases = map[string]string{
+	"st": "start",
+	"sp": "stop",
+	"r":  "restart",
+	"dt": "details",
+	"u":  "update",
+	"b":  "backup",
+}
+
+var cmdLGSM = &subcommands.Command{
+	UsageLine: "lgsm <options> <start|stop|restart|details|update|backup> <servers...>",
+	ShortDesc: "LinuxGSM compatible commands",
+	LongDesc:  "Runs the LinuxGSM commands on the servers, all of them when none is listed, so the scripts written for LinuxGSM keep working after `migrate import`.\n\nThe short forms st, sp, r, dt, u and b are accepted. As with LinuxGSM, restart doesn't warn the players and update stops the running servers during the update and then starts them again.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &lgsmRun{}
+		c.args.flags()
+		c.Flags.BoolVar(&c.wait, "wait", false, "wait for the servers busy with another operation instead of failing")
+		return c
+	},
+}
+
+type lgsmRun struct {
+	args
+	wait bool
+}
+
+func (l *lgsmRun) Run(a subcommands.Application, args []string, env subcommands.Env) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "%s: Expected one of start, stop, restart, details, update or backup.\n", a.GetName())
+		return 1
+	}
+	c, err := loadConfig(l.configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	servers, err := c.selectServers(args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	ctx = withCLIOwner(ctx, l.wait)
+	s := &webServer{ctx: ctx, ports: newPortMapper(), publicIP: &publicIP{}, rcon: rconpool.New(ctx)}
+	s.setConfig(c)
+	cmd := args[0]
+	if v, ok := lgsmAliases[cmd]; ok {
+		cmd = v
+	}
+	// The playbook steps implement the native operations, with the
+	// configuration's step_policies.
+	r := &playbookRun{}
+	var steps []playbookStep
+	switch cmd {
+	case "start", "stop", "backup":
+		steps = []playbookStep{{Action: cmd}}
+	case "restart":
+		steps = []playbookStep{{Action: "stop"}, {Action: "start"}}
+	case "details":
+		for _, v := range servers {
+			s.printDetails(ctx, v)
+		}
+		return 0
+	case "update":
+		var running []*serverConfig
+		for _, v := range servers {
+			if ok, err := systemdctl.Active(ctx, v.unitName()); err == nil && ok {
+				running = append(running, v)
+			}
+		}
+		err = s.runStep(ctx, r, &playbookStep{Action: "stop"}, running)
+		if err == nil {
+			err = s.runStep(ctx, r, &playbookStep{Action: "update"}, nil)
+		}
+		// Start the servers again even if the update failed.
+		if err2 := s.runStep(ctx, r, &playbookStep{Action: "start"}, running); err == nil {
+			err = err2
+		}
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+	for i := 0; err == nil && i < len(steps); i++ {
+		err = s.runStep(ctx, r, &steps[i], servers)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
+
+// printDetails prints the server's details in the layout of LinuxGSM's
+// details command.
+func (s *webServer) printDetails(ctx context.Context, v *serverConfig) {
+	c := s.config()
+	status := "STOPPED"
+	active, err := systemdctl.Active(ctx, v.unitName())
+	if err != nil {
+		status = "UNKNOWN: " + err.Error()
+	} else if active {
+		status = "STARTED"
+	}
+	ip := v.MultiHome
+	if ip == "" {
+		ip = "0.0.0.0"
+	}
+	rows := [][2]string{
+		{"Server name", v.SessionName},
+		{"Server IP", ip + ":" + strconv.Itoa(v.Port)},
+		{"Internet IP", c.PublicIP},
+		{"Map", c.mapInfo(v.Map).Name},
+		{"Status", status},
+		{"Unit", v.unitName()},
+		{"Save directory", v.saveDir(c)},
+	}
+	if v.MaxPlayers != 0 {
+		rows = append(rows, [2]string{"Maxplayers", strconv.Itoa(v.MaxPlayers)})
+	}
+	if active {
+		rows = append(rows, [2]string{"Stats", s.getStats(ctx, v).String()})
+	}
+	if len(v.Mods) != 0 {
+		rows = append(rows, [2]string{"Mods", strings.Join(v.Mods, ",")})
+	}
+	fmt.Printf("%s\n", v.Name)
+	for _, r := range rows {
+		fmt.Printf("  %-16s %s\n", r[0]+":", r[1])
+	}
+	fmt.Printf("  Ports:\n")
+	fmt.Printf("    %-8s %-6s %5d udp\n", "Game", "INBOUND", v.Port)
+	fmt.Printf("    %-8s %-6s %5d udp\n", "Raw", "INBOUND", v.Port+1)
+	fmt.Printf("    %-8s %-6s %5d udp\n", "Query", "INBOUND", v.QueryPort)
+	fmt.Printf("    %-8s %-6s %5d tcp\n", "RCON", "INBOUND", v.RCONPort)
+	fmt.Printf("  Command-line parameters:\n    %s %s\n", v.binary(c), redact(strings.Join(v.gameArgs(c), " ")))
+}
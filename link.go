@@ -0,0 +1,171 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// actionLink is the payload of a signed one-time action link, e.g. "restart
+// Ragnarok", that a trusted co-admin without account can use.
+type actionLink struct {
+	Action  string `json:"a"`
+	Unit    string `json:"u"`
+	Creator string `json:"c"`
+	Expires int64  `json:"e"`
+	Nonce   []byte `json:"n"`
+}
+
+// key returns the database key recording the link's use. It sorts by
+// expiration so the used links are purged once expired.
+func (l *actionLink) key() []byte {
+	b := make([]byte, 8, 8+len(l.Nonce))
+	binary.BigEndian.PutUint64(b, uint64(time.Unix(l.Expires, 0).UnixNano()))
+	return append(b, l.Nonce...)
+}
+
+// linkDurations are the choices offered in the web UI.
+var linkDurations = []time.Duration{time.Hour, 6 * time.Hour, 24 * time.Hour}
+
+// newLink returns the signed token for the link. The signed message is
+// prefixed so a session cookie can't be passed as a link and vice versa.
+func (s *webServer) newLink(l *actionLink) (string, error) {
+	l.Nonce = make([]byte, 12)
+	if _, err := rand.Read(l.Nonce); err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(l)
+	if err != nil {
+		return "", err
+	}
+	msg := base64.RawURLEncoding.EncodeToString(b)
+	return msg + "." + s.sign("link:"+msg), nil
+}
+
+// checkLink returns the link if the token is validly signed and not expired.
+func (s *webServer) checkLink(token string) (*actionLink, error) {
+	msg, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(s.sign("link:"+msg))) {
+		return nil, errors.New("invalid link")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(msg)
+	if err != nil {
+		return nil, errors.New("invalid link")
+	}
+	l := &actionLink{}
+	if err := json.Unmarshal(b, l); err != nil {
+		return nil, errors.New("invalid link")
+	}
+	if time.Now().Unix() > l.Expires {
+		return nil, errors.New("this link expired")
+	}
+	return l, nil
+}
+
+var linkTmpl = template.Must(template.ParseFS(rsc, "rsc/link.html.tmpl"))
+
+// rpcLink creates a link for an action on a server. Only admins can delegate
+// actions, since the link bypasses the authentication.
+func (s *webServer) rpcLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	u := userFrom(r.Context())
+	if !u.hasRole(roleAdmin) {
+		http.Error(w, "permission denied", http.StatusForbidden)
+		return
+	}
+	unit := r.FormValue("unit")
+	action := r.FormValue("action")
+	if !isServerUnit(unit) {
+		http.Error(w, "unknown server", http.StatusNotFound)
+		return
+	}
+	switch action {
+	case "start", "stop", "restart", "backup":
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+	d, err := time.ParseDuration(r.FormValue("ttl"))
+	if err != nil || d <= 0 || d > 24*time.Hour {
+		http.Error(w, "ttl: expected a duration up to 24h", http.StatusBadRequest)
+		return
+	}
+	l := &actionLink{Action: action, Unit: unit, Creator: u.Name, Expires: time.Now().Add(d).Unix()}
+	token, err := s.newLink(l)
+	if err != nil {
+		replyError(w, err.Error())
+		return
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	setAuditDetail(r.Context(), action+" "+unit+" for "+d.String())
+	w.Header().Add("Content-Type", "text/html")
+	_ = linkTmpl.Execute(w, map[string]any{
+		"Link":    l,
+		"URL":     scheme + "://" + r.Host + "/link/" + token,
+		"Expires": time.Unix(l.Expires, 0).Format(time.RFC1123),
+	})
+}
+
+// serveLink serves /link/<token>. GET shows a confirmation, so the chat
+// clients' link previews don't run the action; POST runs it once.
+func (s *webServer) serveLink(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	l, err := s.checkLink(strings.TrimPrefix(r.URL.Path, "/link/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	data := map[string]any{
+		"Link":    l,
+		"Confirm": true,
+		"Expires": time.Unix(l.Expires, 0).Format(time.RFC1123),
+	}
+	if r.Method == "POST" {
+		ok, err := s.db.useOnce(bucketLinks, l.key())
+		if err != nil {
+			replyError(w, err.Error())
+			return
+		}
+		if !ok {
+			http.Error(w, "this link was already used", http.StatusForbidden)
+			return
+		}
+		extendWriteDeadline(w, bulkTimeout+10*time.Second)
+		ctx, cancel := context.WithTimeout(withLockOwner(r.Context(), "link:"+l.Creator, false), bulkTimeout)
+		defer cancel()
+		start := time.Now()
+		res, err := s.doAction(ctx, l.Action, l.Unit)
+		status := http.StatusOK
+		if errors.Is(err, context.DeadlineExceeded) {
+			res = "still in progress"
+		} else if err != nil {
+			res = "failed: " + err.Error()
+			status = http.StatusInternalServerError
+		}
+		s.audit(auditEntry{Time: start, User: "link:" + l.Creator, Remote: s.remoteAddr(r.RemoteAddr), Action: l.Action, Target: l.Unit, Status: status, Detail: "one-time link"})
+		log.Printf("link: %s %s by %s's link: %s", l.Action, l.Unit, l.Creator, res)
+		data["Confirm"] = false
+		data["Result"] = res
+	}
+	w.Header().Add("Content-Type", "text/html")
+	_ = linkTmpl.Execute(w, data)
+}
@@ -0,0 +1,114 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckLink(t *testing.T) {
+	s := &webServer{sessionKey: []byte("0123456789abcdef0123456789abcdef")}
+	other := &webServer{sessionKey: []byte("fedcba9876543210fedcba9876543210")}
+	newLink := func(expires time.Time) string {
+		tok, err := s.newLink(&actionLink{Action: "restart", Unit: "ark-island.service", Creator: "admin", Expires: expires.Unix()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+	valid := newLink(time.Now().Add(time.Hour))
+	msg, sig, _ := strings.Cut(valid, ".")
+	signed := func(payload string) string {
+		m := base64.RawURLEncoding.EncodeToString([]byte(payload))
+		return m + "." + s.sign("link:"+m)
+	}
+	otherTok, err := other.newLink(&actionLink{Action: "restart", Unit: "ark-island.service", Expires: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"valid", valid, ""},
+		{"empty", "", "invalid link"},
+		{"no signature", msg, "invalid link"},
+		{"tampered payload", strings.SplitN(signed(`{"a":"restart","u":"ark-other.service","c":"admin"}`), ".", 2)[0] + "." + sig, "invalid link"},
+		{"tampered signature", msg + "." + sig[:len(sig)-1] + "A", "invalid link"},
+		{"other key", otherTok, "invalid link"},
+		// The session cookies are signed with the same key, another prefix.
+		{"session", s.newSession("admin"), "invalid link"},
+		{"not json", signed("restart"), "invalid link"},
+		{"expired", newLink(time.Now().Add(-time.Second)), "this link expired"},
+	}
+	for _, l := range data {
+		t.Run(l.name, func(t *testing.T) {
+			got, err := s.checkLink(l.token)
+			if l.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Action != "restart" || got.Unit != "ark-island.service" || got.Creator != "admin" || len(got.Nonce) != 12 {
+					t.Fatalf("got %+v", got)
+				}
+				return
+			}
+			if err == nil || err.Error() != l.err {
+				t.Fatalf("got %v, want %q", err, l.err)
+			}
+		})
+	}
+	// The page rejects the invalid links before anything else.
+	w := httptest.NewRecorder()
+	s.serveLink(w, httptest.NewRequest("POST", "/link/"+otherTok, nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("got %d", w.Code)
+	}
+}
+
+func TestLinkUsedOnce(t *testing.T) {
+	db, err := openStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	s := &webServer{db: db, sessionKey: []byte("0123456789abcdef0123456789abcdef")}
+	soon := &actionLink{Action: "stop", Unit: "ark-island.service", Expires: time.Now().Add(time.Hour).Unix()}
+	later := &actionLink{Action: "stop", Unit: "ark-island.service", Expires: time.Now().Add(2 * time.Hour).Unix()}
+	for _, l := range []*actionLink{soon, later} {
+		if _, err := s.newLink(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The used links are purged by expiration, in key order.
+	if bytes.Compare(soon.key(), later.key()) >= 0 {
+		t.Fatal("keys not sorted by expiration")
+	}
+	data := []struct {
+		l    *actionLink
+		want bool
+	}{
+		{soon, true},
+		{soon, false},
+		{later, true},
+		{later, false},
+	}
+	for i, l := range data {
+		ok, err := db.useOnce(bucketLinks, l.l.key())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != l.want {
+			t.Errorf("#%d: got %t", i, ok)
+		}
+	}
+}
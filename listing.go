@@ -0,0 +1,116 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// listingGrace is how long a server has to show up on the server list after
+// it started.
+const listingGrace = 5 * time.Minute
+
+// listingChecker checks whether the servers are registered on the Steam master
+// server, which is what the in-game server browser uses.
+//
+// The Epic (crossplay) server list requires EOS client credentials and is not
+// checked.
+type listingChecker struct {
+	mu      sync.Mutex
+	ip      string
+	updated time.Time
+	// ports are the query and game ports registered at ip.
+	ports map[int]bool
+	err   error
+}
+
+// steamServer is an entry from ISteamApps/GetServersAtAddress.
+type steamServer struct {
+	Addr     string `json:"addr"`
+	AppID    int    `json:"appid"`
+	GamePort int    `json:"gameport"`
+}
+
+// refresh queries the Steam Web API at most every 5 minutes.
+func (l *listingChecker) refresh(ctx context.Context, ip string) (map[int]bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ip == ip && time.Since(l.updated) < 5*time.Minute {
+		return l.ports, l.err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	l.ip = ip
+	l.updated = time.Now()
+	l.ports, l.err = getServersAtAddress(ctx, ip)
+	if l.err != nil {
+		log.Printf("listing: %v", l.err)
+	}
+	return l.ports, l.err
+}
+
+func getServersAtAddress(ctx context.Context, ip string) (map[int]bool, error) {
+	u := "https://api.steampowered.com/ISteamApps/GetServersAtAddress/v1/?addr=" + url.QueryEscape(ip)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("steam master server: %s", resp.Status)
+	}
+	data := struct {
+		Response struct {
+			Success bool          `json:"success"`
+			Message string        `json:"message"`
+			Servers []steamServer `json:"servers"`
+		} `json:"response"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	if !data.Response.Success {
+		return nil, fmt.Errorf("steam master server: %s", data.Response.Message)
+	}
+	out := map[int]bool{}
+	for _, s := range data.Response.Servers {
+		out[s.GamePort] = true
+		if _, p, err := net.SplitHostPort(s.Addr); err == nil {
+			if i, err := strconv.Atoi(p); err == nil {
+				out[i] = true
+			}
+		}
+	}
+	return out, nil
+}
+
+// status returns "listed", a "not listed" message with hints, or an empty
+// string when it cannot be determined yet.
+func (l *listingChecker) status(ctx context.Context, ip string, s *serverConfig, since time.Time) string {
+	if ip == "" || time.Since(since) < listingGrace {
+		return ""
+	}
+	ports, err := l.refresh(ctx, ip)
+	if err != nil {
+		return ""
+	}
+	if ports[s.QueryPort] || ports[s.Port] {
+		return "listed"
+	}
+	return fmt.Sprintf("running but not listed: check that UDP ports %d, %d and %d are forwarded to this host and allowed by the firewall", s.Port, s.Port+1, s.QueryPort)
+}
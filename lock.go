@@ -0,0 +1,253 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maruel/ark-serman/internal/metrics"
+)
+
+var metLockQueue = metrics.NewGauge("ark_serman_lock_queue_depth", "Operations queued for a busy server's lock in this process.")
+
+// The operations changing a server, e.g. a backup restore and an update, are
+// serialized with a lock file per server in the data directory so that the
+// web UI, the schedules and the CLI don't step on each other. The lock is
+// released by the kernel if the process dies.
+
+// lockHolder describes the operation holding a server's lock. It is written
+// in the lock file for the other processes to see.
+type lockHolder struct {
+	Op    string    `json:"op"`
+	Owner string    `json:"owner"`
+	PID   int       `json:"pid"`
+	Since time.Time `json:"since"`
+	// Progress is the operation's progress, e.g. the download's throughput.
+	Progress string `json:"progress,omitempty"`
+}
+
+func (h *lockHolder) String() string {
+	s := fmt.Sprintf("%s by %s since %s", h.Op, h.Owner, h.Since.Local().Format(time.Kitchen))
+	if h.Progress != "" {
+		s += ", " + h.Progress
+	}
+	return s
+}
+
+// heldLocks are the lock files held by this process and their holder, to
+// update the progress.
+var heldLocks = struct {
+	sync.Mutex
+	m map[*os.File]*lockHolder
+}{m: map[*os.File]*lockHolder{}}
+
+// writeHolder writes the holder in the lock file.
+func writeHolder(f *os.File, h *lockHolder) {
+	if b, err := json.Marshal(h); err == nil && f.Truncate(0) == nil {
+		_, _ = f.WriteAt(b, 0)
+	}
+}
+
+// setLockProgress sets the progress of the operations of the ctx's owner
+// holding locks, for the other processes and the web UI to see.
+func setLockProgress(ctx context.Context, progress string) {
+	o := ownerFrom(ctx)
+	heldLocks.Lock()
+	defer heldLocks.Unlock()
+	for f, h := range heldLocks.m {
+		if h.Owner == o.Name && h.PID == os.Getpid() {
+			h.Progress = progress
+			writeHolder(f, h)
+		}
+	}
+}
+
+// busyError is returned when a server is locked by another operation and the
+// caller didn't ask to be queued.
+type busyError struct {
+	Server string
+	Holder *lockHolder
+}
+
+func (e *busyError) Error() string {
+	if e.Holder == nil {
+		return e.Server + " is busy with another operation"
+	}
+	return fmt.Sprintf("%s is busy: %s", e.Server, e.Holder)
+}
+
+// lockOwner is who takes the locks and whether they wait for busy servers.
+type lockOwner struct {
+	Name  string
+	Queue bool
+}
+
+// withLockOwner sets who takes the locks with ctx. Queue makes the operations
+// wait for the busy servers instead of failing.
+func withLockOwner(ctx context.Context, name string, queue bool) context.Context {
+	return context.WithValue(ctx, lockKey, lockOwner{Name: name, Queue: queue})
+}
+
+// ownerFrom returns the owner set with withLockOwner. Otherwise web requests
+// are rejected on busy servers and the schedules are queued.
+func ownerFrom(ctx context.Context) lockOwner {
+	if o, ok := ctx.Value(lockKey).(lockOwner); ok {
+		return o
+	}
+	if u := userFrom(ctx); u != nil {
+		return lockOwner{Name: u.Name}
+	}
+	return lockOwner{Name: "schedule", Queue: true}
+}
+
+func lockPath(c *config, v *serverConfig) string {
+	return filepath.Join(c.dataDir(), "locks", v.Name+".lock")
+}
+
+// lockServers takes the lock of the servers for the operation op and returns
+// the function releasing them. The servers are locked in name order to not
+// deadlock with a concurrent operation on an overlapping set of servers.
+func lockServers(ctx context.Context, c *config, op string, servers ...*serverConfig) (func(), error) {
+	o := ownerFrom(ctx)
+	servers = append([]*serverConfig(nil), servers...)
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Name < servers[j].Name })
+	var files []*os.File
+	release := func() {
+		heldLocks.Lock()
+		defer heldLocks.Unlock()
+		for _, f := range files {
+			delete(heldLocks.m, f)
+			// Truncate first so readers don't see a stale holder.
+			_ = f.Truncate(0)
+			_ = f.Close()
+		}
+	}
+	h := &lockHolder{Op: op, Owner: o.Name, PID: os.Getpid(), Since: time.Now().UTC()}
+	for _, v := range servers {
+		f, err := lockServer(ctx, c, v, o.Queue)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		files = append(files, f)
+		heldLocks.Lock()
+		heldLocks.m[f] = h
+		writeHolder(f, h)
+		heldLocks.Unlock()
+	}
+	return release, nil
+}
+
+func lockServer(ctx context.Context, c *config, v *serverConfig, queue bool) (*os.File, error) {
+	p := lockPath(c, v)
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; ; i++ {
+		err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, unix.EWOULDBLOCK) {
+			break
+		}
+		if !queue {
+			err = &busyError{Server: v.Name, Holder: readHolder(f)}
+			break
+		}
+		if i == 0 {
+			log.Printf("%s, queued", &busyError{Server: v.Name, Holder: readHolder(f)})
+			metLockQueue.Add(1)
+			defer metLockQueue.Add(-1)
+		}
+		t := time.NewTimer(time.Second)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			_ = f.Close()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+	_ = f.Close()
+	return nil, err
+}
+
+func readHolder(f *os.File) *lockHolder {
+	b, err := io.ReadAll(io.NewSectionReader(f, 0, 4096))
+	if err != nil || len(b) == 0 {
+		return nil
+	}
+	h := &lockHolder{}
+	if json.Unmarshal(b, h) != nil {
+		return nil
+	}
+	return h
+}
+
+// serverLock returns the operation holding the server's lock, or nil if the
+// server is idle.
+func serverLock(c *config, v *serverConfig) *lockHolder {
+	f, err := os.Open(lockPath(c, v))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_SH|unix.LOCK_NB); err == nil {
+		return nil
+	}
+	if h := readHolder(f); h != nil {
+		return h
+	}
+	return &lockHolder{Op: "unknown operation", Owner: "?"}
+}
+
+// lockUnit locks the server of the unit. Units not in the configuration file
+// aren't locked.
+func (s *webServer) lockUnit(ctx context.Context, op, unit string) (func(), error) {
+	c := s.config()
+	v := c.serverByUnit(unit)
+	if v == nil {
+		return func() {}, nil
+	}
+	return lockServers(ctx, c, op, v)
+}
+
+// withCLIOwner sets the CLI user as the lock owner. With wait, the command
+// waits for the busy servers instead of failing.
+func withCLIOwner(ctx context.Context, wait bool) context.Context {
+	name := "cli"
+	if u := os.Getenv("USER"); u != "" {
+		name += ":" + u
+	}
+	return withLockOwner(ctx, name, wait)
+}
+
+// replyActionError replies 409 Conflict when the server is busy.
+func replyActionError(w http.ResponseWriter, err error) {
+	var b *busyError
+	if errors.As(err, &b) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	replyError(w, err.Error())
+}
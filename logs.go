@@ -0,0 +1,150 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// logSource is one set of log lines shown in the log viewer.
+type logSource struct {
+	Name  string
+	Lines []string
+	Err   string
+}
+
+// knownIssue is a log pattern with a suggested fix.
+type knownIssue struct {
+	re   *regexp.Regexp
+	Hint string
+}
+
+// knownIssues are common failures found in the server logs, including the
+// ones of servers run under Wine or Proton.
+var knownIssues = []knownIssue{
+	{regexp.MustCompile(`(?i)vcruntime140\.dll|msvcp140\.dll|vcrun20`), "The Visual C++ runtime is missing from the Wine prefix; install it with `winetricks vcrun2022`."},
+	{regexp.MustCompile(`(?i)EOS.*(auth|login).*(fail|error)|EOS_InvalidAuth|EOS_InvalidCredentials`), "Epic Online Services authentication failed; check the host clock is synchronized and that the server can reach the EOS endpoints."},
+	{regexp.MustCompile(`(?i)wine: could not load kernel32\.dll|wine: failed to initialize`), "The Wine prefix is corrupted or was created by another Wine version; recreate it."},
+	{regexp.MustCompile(`(?i)too many open files`), "The file descriptor limit is too low; run rsc/increase_limits.sh."},
+	{regexp.MustCompile(`(?i)failed to (bind|listen).*port|address already in use`), "Another server uses the same port; check port, query_port and rcon_port in the configuration."},
+	{regexp.MustCompile(`(?i)Failed to load map|CallStack|Unhandled Exception`), "The server crashed while loading; check the mods are downloaded and compatible with the map."},
+}
+
+// logIssue is a known issue found in the logs.
+type logIssue struct {
+	Line string
+	Hint string
+}
+
+// findIssues returns the known issues found in the sources, once each.
+func findIssues(sources []logSource) []logIssue {
+	var out []logIssue
+	seen := map[int]bool{}
+	for _, s := range sources {
+		for _, l := range s.Lines {
+			for i, k := range knownIssues {
+				if !seen[i] && k.re.MatchString(l) {
+					seen[i] = true
+					out = append(out, logIssue{Line: l, Hint: k.Hint})
+				}
+			}
+		}
+	}
+	return out
+}
+
+// journalLines returns the last n lines logged by the unit, which includes
+// the process' stdout and stderr, e.g. the Wine and Proton messages.
+func journalLines(ctx context.Context, unit string, n int) ([]string, error) {
+	b, err := exec.CommandContext(ctx, "journalctl", "--user", "-u", unit, "-n", strconv.Itoa(n), "-o", "short-iso", "--no-pager").Output()
+	if err != nil {
+		return nil, err
+	}
+	return splitLines(b), nil
+}
+
+// tailFile returns the last n lines of the file.
+func tailFile(p string, n int) ([]string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// Lines are rarely longer than 1KiB.
+	const maxRead = 1 << 20
+	if fi, err := f.Stat(); err == nil && fi.Size() > maxRead {
+		if _, err = f.Seek(-maxRead, io.SeekEnd); err != nil {
+			return nil, err
+		}
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	l := splitLines(b)
+	if len(l) > n {
+		l = l[len(l)-n:]
+	}
+	return l, nil
+}
+
+func splitLines(b []byte) []string {
+	b = bytes.TrimRight(bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n")), "\n")
+	if len(b) == 0 {
+		return nil
+	}
+	return strings.Split(string(b), "\n")
+}
+
+// gameLogPath returns the path of ShooterGame.log. It is shared by all the
+// servers of the installation.
+func gameLogPath(c *config) string {
+	return filepath.Join(savedDir(c), "Logs", "ShooterGame.log")
+}
+
+var logsTmpl = template.Must(template.ParseFS(rsc, "rsc/logs.html.tmpl"))
+
+// serveLogs shows the systemd journal and the game log of a server, with the
+// known issues found in them.
+func (s *webServer) serveLogs(w http.ResponseWriter, r *http.Request) {
+	unit := path.Base(r.URL.Path)
+	if !isServerUnit(unit) {
+		http.Error(w, "unknown server", http.StatusNotFound)
+		return
+	}
+	n := 200
+	if v, err := strconv.Atoi(r.FormValue("n")); err == nil && v > 0 && v <= 10000 {
+		n = v
+	}
+	src := []logSource{{Name: "journal"}}
+	var err error
+	if src[0].Lines, err = journalLines(r.Context(), unit, n); err != nil {
+		src[0].Err = err.Error()
+	}
+	if v := s.config().serverByUnit(unit); v != nil {
+		g := logSource{Name: "ShooterGame.log"}
+		if g.Lines, err = tailFile(gameLogPath(s.config()), n); err != nil {
+			g.Err = err.Error()
+		}
+		src = append(src, g)
+	}
+	w.Header().Add("Content-Type", "text/html")
+	_ = logsTmpl.Execute(w, map[string]any{
+		"Unit":    unit,
+		"Sources": src,
+		"Issues":  findIssues(src),
+	})
+}
@@ -8,7 +8,9 @@ package main
 import (
 	"context"
 	"embed"
+	"flag"
 	"fmt"
+	"html/template"
 	"io"
 	"io/fs"
 	"log"
@@ -19,12 +21,16 @@ import (
 	"os/signal"
 	"path"
 	"sort"
-	"text/template"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coreos/go-systemd/v22/dbus"
 	"github.com/gorcon/rcon"
-	"github.com/maruel/serve-dir/loghttp"
+	"github.com/maruel/ark-serman/internal/metrics"
+	"github.com/maruel/ark-serman/internal/rconpool"
+	"github.com/maruel/ark-serman/internal/systemdctl"
 	"github.com/maruel/subcommands"
 )
 
@@ -35,8 +41,28 @@ var application = &subcommands.DefaultApplication{
 	Name:  "ark-serman",
 	Title: "Ark Dedicated Server Manager.",
 	Commands: []*subcommands.Command{
+		cmdDB,
+		cmdApply,
+		cmdBackup,
+		cmdCheck,
+		cmdCluster,
+		cmdConfig,
+		cmdDifficulty,
 		cmdInstall,
+		cmdLGSM,
+		cmdMigrate,
+		cmdMods,
 		cmdRCon,
+		cmdRun,
+		cmdSaves,
+		cmdSchedule,
+		cmdServer,
+		cmdShell,
+		cmdStatus,
+		cmdSteam,
+		cmdTrigger,
+		cmdToken,
+		cmdUser,
 		cmdWeb,
 		subcommands.CmdHelp,
 	},
@@ -44,11 +70,13 @@ var application = &subcommands.DefaultApplication{
 
 type args struct {
 	subcommands.CommandRunBase
-	quiet bool
+	quiet      bool
+	configPath string
 }
 
 func (a *args) flags() {
 	a.Flags.BoolVar(&a.quiet, "q", false, "don't print log lines")
+	a.Flags.StringVar(&a.configPath, "config", defaultConfigPath(), "configuration file")
 }
 
 //
@@ -56,20 +84,22 @@ func (a *args) flags() {
 var cmdInstall = &subcommands.Command{
 	UsageLine: "install <options>",
 	ShortDesc: "Installs ark-serman and the Ark servers as a systemd service",
-	LongDesc:  "Installs ark-serman and the Ark servers as a systemd service.",
+	LongDesc:  "Installs ark-serman and the Ark servers as a systemd service.\n\nA systemd user unit is generated for each server listed in the configuration file.\n\nWith -host-limits, run as root via sudo, the host configuration the servers need is written instead: vm.max_map_count and fs.file-max in /etc/sysctl.d, the open files limit of the service user in /etc/security/limits.d and the LimitNOFILE of the systemd user managers, which caps the one of the units. Run install again as the service user afterward.",
 	CommandRun: func() subcommands.CommandRun {
 		c := &installRun{}
 		c.args.flags()
 		c.Flags.StringVar(&c.userPwd, "u", "", "user password (optional)")
 		c.Flags.StringVar(&c.adminPwd, "a", "", "rcon (admin) password")
+		c.Flags.BoolVar(&c.hostLimits, "host-limits", false, "write the host's sysctl and open files limits configuration; requires root")
 		return c
 	},
 }
 
 type installRun struct {
 	args
-	userPwd  string
-	adminPwd string
+	userPwd    string
+	adminPwd   string
+	hostLimits bool
 }
 
 func (i *installRun) Run(a subcommands.Application, args []string, env subcommands.Env) int {
@@ -77,10 +107,73 @@ func (i *installRun) Run(a subcommands.Application, args []string, env subcomman
 		fmt.Fprintf(os.Stderr, "%s: Unsupported arguments.\n", a.GetName())
 		return 1
 	}
-	//ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
-	//defer cancel()
-	fmt.Fprintf(os.Stderr, "TODO(maruel): Implement me\n")
-	return 1
+	if i.hostLimits {
+		if err := writeHostLimits(i.quiet); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+			return 1
+		}
+		return 0
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	c, err := loadConfig(i.configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	defer c.startTracing()()
+	if i.adminPwd != "" {
+		c.AdminPassword = i.adminPwd
+	}
+	if i.userPwd != "" {
+		c.ServerPassword = i.userPwd
+	}
+	if len(c.Servers) == 0 {
+		fmt.Fprintf(os.Stderr, "%s: No server configured in %s.\n", a.GetName(), i.configPath)
+		return 1
+	}
+	if err := c.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	for _, s := range c.Servers {
+		if s.Crossplay && s.PublicIPForEpic == "" && c.PublicIP == "" {
+			fmt.Fprintf(os.Stderr, "%s: warning: server %q uses crossplay without public_ip_for_epic; Epic players can't join if the host is behind NAT.\n", a.GetName(), s.Name)
+		}
+	}
+	all, _ := c.selectServers(nil)
+	release, err := lockServers(withCLIOwner(ctx, false), c, "install", all...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	defer release()
+	units, err := writeUnits(c)
+	for _, u := range units {
+		if !i.quiet {
+			log.Printf("Wrote %s", u)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	conn, err := systemdctl.Dial(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	defer conn.Close()
+	if err := conn.ReloadContext(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	// Remove the links of units enabled by a previous version or by hand;
+	// start_on_boot replaces them.
+	if _, err := conn.DisableUnitFilesContext(ctx, units, false); err != nil && !i.quiet {
+		log.Printf("Disabling units: %v", err)
+	}
+	return 0
 }
 
 //
@@ -88,18 +181,22 @@ func (i *installRun) Run(a subcommands.Application, args []string, env subcomman
 var cmdRCon = &subcommands.Command{
 	UsageLine: "rcon <options> <commands>",
 	ShortDesc: "Connects to an Ark server via RCon (admin) port",
-	LongDesc:  "Connects to an Ark server via RCon (admin) port.",
+	LongDesc:  "Connects to an Ark server via RCon (admin) port.\n\nWith -s, the RCON port and password are found in the configuration, the server's unit file or GameUserSettings.ini, e.g. `rcon -s island SaveWorld`.\nWith -attach, the commands are sent via a running `ark-serman web` with its RCON policy and audit log, e.g. `rcon -attach http://localhost:8070 -s island SaveWorld` with $ARK_SERMAN_TOKEN set to a write token.",
 	CommandRun: func() subcommands.CommandRun {
 		c := &rconRun{}
 		c.args.flags()
+		c.Flags.StringVar(&c.server, "s", "", "server name")
 		c.Flags.StringVar(&c.host, "p", "", "rcon host:port")
 		c.Flags.StringVar(&c.adminPwd, "a", "", "rcon (admin) password")
+		c.attachFlags.flags(&c.CommandRunBase)
 		return c
 	},
 }
 
 type rconRun struct {
 	args
+	attachFlags
+	server   string
 	host     string
 	adminPwd string
 }
@@ -109,39 +206,110 @@ func (r *rconRun) Run(a subcommands.Application, args []string, env subcommands.
 		fmt.Fprintf(os.Stderr, "%s: At least one admin command required.\n", a.GetName())
 		return 1
 	}
+	if (r.server == "") == (r.host == "") {
+		fmt.Fprintf(os.Stderr, "%s: Specify one of -s or -p.\n", a.GetName())
+		return 1
+	}
+	if r.attach != "" {
+		return r.runAttached(a, args)
+	}
+	if r.server != "" {
+		c, err := loadConfig(r.configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+			return 1
+		}
+		host, pwd, err := rconTarget(c, r.server)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+			return 1
+		}
+		r.host = host
+		if r.adminPwd == "" {
+			r.adminPwd = pwd
+		}
+	}
 	// Doesn't support context at the moment.
 	conn, err := rcon.Dial(r.host, r.adminPwd)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
 	}
 	defer conn.Close()
-	for _, a := range args {
-		fmt.Printf("Running: %s\n", a)
-		resp, err := conn.Execute(a)
+	for _, cmd := range args {
+		fmt.Printf("Running: %s\n", cmd)
+		resp, err := conn.Execute(cmd)
 		if err != nil {
-			log.Fatal(err)
+			fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+			return 1
 		}
 		fmt.Printf("  Got: %s\n", resp)
 	}
 	return 0
 }
 
+// runAttached sends the commands via the daemon.
+func (r *rconRun) runAttached(a subcommands.Application, args []string) int {
+	if r.server == "" {
+		fmt.Fprintf(os.Stderr, "%s: -attach requires -s.\n", a.GetName())
+		return 1
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	c, err := r.dial(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	defer c.close()
+	for _, cmd := range args {
+		fmt.Printf("Running: %s\n", cmd)
+		resp, err := c.call(attachRequest{Op: "rcon", Server: r.server, Cmd: cmd})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+			return 1
+		}
+		fmt.Printf("  Got: %s\n", resp.Resp)
+	}
+	return 0
+}
+
 //
 
 var cmdWeb = &subcommands.Command{
 	UsageLine: "web <options>",
 	ShortDesc: "Runs the web server",
-	LongDesc:  "Runs the web server to manage the Ark servers.\nSee rcon commands at https://ark.fandom.com/wiki/Console_commands\n",
+	LongDesc:  "Runs the web server to manage the Ark servers.\nThe rcon commands and the settings are listed at /docs/.\n",
 	CommandRun: func() subcommands.CommandRun {
 		c := &webRun{}
 		c.args.flags()
-		c.Flags.StringVar(&c.bind, "p", ":8070", "bind address and port")
+		c.Flags.StringVar(&c.bind, "p", ":8070", "bind addresses and ports, comma separated, e.g. [::1]:8070,100.64.0.1:8070")
 		c.Flags.StringVar(&c.adminPwd, "pwd", "", "rcon (admin) password")
+		c.Flags.StringVar(&c.debugAddr, "debug-addr", "", "serve pprof, expvar and the metrics on this address, e.g. :6060 (localhost)")
+		c.Flags.StringVar(&c.accessLog, "access-log", "", "write the access log to this file instead of stderr")
+		c.Flags.Int64Var(&c.accessLogMaxMB, "access-log-max-mb", 100, "rotate the access log file when it reaches this size")
+		c.Flags.IntVar(&c.accessLogKeep, "access-log-keep", 5, "number of rotated access log files to keep")
+		c.Flags.StringVar(&c.authLog, "auth-log", "", "also write the authentication failures to this file, e.g. for fail2ban; rotated like the access log")
+		c.Flags.BoolVar(&c.tailscale, "tailscale", false, "serve only on the host's Tailscale IPs unless -p is specified, and authenticate the tailnet users via tailscaled")
+		c.Flags.StringVar(&c.tailscaleSocket, "tailscale-socket", "/var/run/tailscale/tailscaled.sock", "tailscaled LocalAPI socket")
+		c.Flags.DurationVar(&c.readTimeout, "read-timeout", 10*time.Second, "maximum duration to read a request")
+		c.Flags.DurationVar(&c.writeTimeout, "write-timeout", 60*time.Second, "maximum duration to write a response; streaming endpoints extend it")
+		c.Flags.DurationVar(&c.idleTimeout, "idle-timeout", 2*time.Minute, "maximum duration to keep an idle keep-alive connection")
+		c.Flags.Int64Var(&c.maxBodyKB, "max-body-kb", 1024, "maximum request body size")
+		c.Flags.BoolVar(&c.readOnly, "read-only", false, "reject every change, e.g. for a public or kiosk dashboard; only the status is shown")
 		return c
 	},
 }
 
-var pageTmpl = template.Must(template.ParseFS(rsc, "rsc/root.html.tmpl"))
+var pageTmpl = template.Must(template.New("root.html.tmpl").Funcs(template.FuncMap{
+	// html/template only trusts the http(s) links.
+	"steamURL": func(u string) template.URL {
+		if !strings.HasPrefix(u, "steam://connect/") {
+			return "#"
+		}
+		return template.URL(u)
+	},
+}).ParseFS(rsc, "rsc/root.html.tmpl"))
 
 func replyError(w http.ResponseWriter, s string) {
 	w.Header().Add("Content-Type", "text/plain")
@@ -154,16 +322,36 @@ type unitStatus struct {
 	Props       map[string]interface{}
 	Running     bool
 	DisplayName string
-	CPU         float64
-	Memory      float64
+	// Map is the map registry entry of the map loaded by the server, if the
+	// server is in the configuration file.
+	Map         mapInfo
+	PortMapping string
+	Connect     connectInfo
+	// StartOnBoot is the server's start_on_boot policy.
+	StartOnBoot bool
+	// Since is when the unit became active.
+	Since   time.Time
+	Listing string
+	// Latency is the query port round trip time, only set for running
+	// servers.
+	Latency  string
+	Degraded bool
+	Stalled  bool
+	// Players is only valid when HasPlayers is set.
+	Players    []player
+	HasPlayers bool
+	CPU        float64
+	Memory     float64
+	// Lock is the operation in progress on the server, if any.
+	Lock string
 }
 
 func round(val float64, precision int) float64 {
 	return math.Round(val*(math.Pow10(precision))) / math.Pow10(precision)
 }
 
-func getUnitStates(ctx context.Context) ([]unitStatus, error) {
-	conn, err := dbus.NewUserConnectionContext(ctx)
+func getUnitStates(ctx context.Context, c *config) ([]unitStatus, error) {
+	conn, err := systemdctl.Dial(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -175,7 +363,8 @@ func getUnitStates(ctx context.Context) ([]unitStatus, error) {
 	unitNames := make([]string, 0, len(unitFiles))
 	for _, v := range unitFiles {
 		b := path.Base(v.Path)
-		if b == "ark-serman.service" {
+		// ark-serman's own units, e.g. the scheduled tasks' timers.
+		if strings.HasPrefix(b, "ark-serman") {
 			continue
 		}
 		unitNames = append(unitNames, b)
@@ -192,6 +381,9 @@ func getUnitStates(ctx context.Context) ([]unitStatus, error) {
 	for i, s := range unitStates {
 		out[i].UnitStatus = s
 		out[i].DisplayName = s.Name[4 : len(s.Name)-8]
+		if v := c.serverByUnit(s.Name); v != nil {
+			out[i].Map = c.mapInfo(v.Map)
+		}
 		out[i].Running = s.ActiveState == "active" || s.ActiveState == "activating" || s.ActiveState == "deactivating"
 		if out[i].Running {
 			// TODO(maruel): Query less, query in parallel.
@@ -204,6 +396,9 @@ func getUnitStates(ctx context.Context) ([]unitStatus, error) {
 			out[i].CPU = round(float64(c)*0.000000001, 1)
 			m := p["MemoryCurrent"].(uint64)
 			out[i].Memory = round(float64(m)*0.000001, 1)
+			if t, ok := p["ActiveEnterTimestamp"].(uint64); ok && t != 0 {
+				out[i].Since = time.UnixMicro(int64(t))
+			}
 		}
 		// TODO(maruel): List save games.
 		//path := "~/.local/share/Steam/steamapps/common/ARK Survival Evolved Dedicated Server/ShooterGame/Saved/SavedArks"
@@ -211,26 +406,153 @@ func getUnitStates(ctx context.Context) ([]unitStatus, error) {
 	return out, nil
 }
 
-func serveRoot(w http.ResponseWriter, r *http.Request) {
+// webServer holds the state of the web server.
+type webServer struct {
+	cfg      atomic.Pointer[config]
+	ports    *portMapper
+	publicIP *publicIP
+	listing  listingChecker
+	workshop workshopCache
+	rcon     *rconpool.Pool
+	latency  latencyProber
+	votes    restartVotes
+	voteRate authFailures
+	plugins  pluginManager
+	capacity footprintCache
+	authFail authFailures
+	totp     totpGuard
+	terms    terminalTickets
+	// tailscale identifies the tailnet users, when enabled.
+	tailscale *tailscaleClient
+	db        *store
+	// sessionKey signs the session cookies.
+	sessionKey []byte
+
+	// configPath is reloaded on SIGHUP or when modified.
+	configPath string
+	// adminPwd overrides the admin password from the configuration file.
+	adminPwd string
+
+	// ctx is canceled when the web server shuts down. Used for background
+	// operations started by requests.
+	ctx context.Context
+	// starting is set while "start all" is in progress.
+	starting atomic.Bool
+	// applying is set while a plan reviewed at /plan/ is being applied.
+	applying atomic.Bool
+	// readOnly rejects every mutating request, per -read-only.
+	readOnly bool
+	// auditQ queues the audit entries forwarded to audit_syslog.
+	auditQ chan auditEntry
+	// authLog is the -auth-log file. The standard log is used when nil.
+	authLog io.Writer
+
+	mu sync.Mutex
+	// lastStates is the last state seen by watchUnits.
+	lastStates     []unitStatus
+	lastStatesTime time.Time
+	// restarting is when the servers being gracefully restarted go down, per
+	// unit.
+	restarting map[string]time.Time
+}
+
+// states returns the state of the units, decorated with the web server's
+// knowledge.
+func (s *webServer) states(ctx context.Context) ([]unitStatus, error) {
+	c := s.config()
+	u, err := getUnitStates(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	ip := s.publicIP.get(ctx)
+	for i := range u {
+		u[i].PortMapping = s.ports.statusOf(u[i].Name)
+		if v := c.serverByUnit(u[i].Name); v != nil {
+			u[i].StartOnBoot = v.StartOnBoot
+			u[i].Connect = newConnectInfo(ip, v)
+			if h := serverLock(c, v); h != nil {
+				u[i].Lock = h.String()
+			}
+			if u[i].Running {
+				u[i].Listing = s.listing.status(ctx, ip, v, u[i].Since)
+				if l, ok := s.latency.get(v.Name); ok {
+					u[i].Latency = l.String()
+					u[i].Degraded = l.Degraded()
+				}
+				u[i].Stalled = s.latency.isStalled(v.Name)
+				if p, err := s.rconPoller(c, v); err == nil {
+					if r, ok := p.Last(v.gameInfo().ListPlayers); ok && r.Err == nil {
+						u[i].Players = v.gameInfo().parsePlayers(r.Resp)
+						u[i].HasPlayers = true
+						if err := s.db.markWatched(u[i].Players); err != nil {
+							log.Printf("watchlist: %v", err)
+						}
+					}
+				}
+			}
+		}
+	}
+	return u, nil
+}
+
+func (s *webServer) serveRoot(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	u, err := getUnitStates(ctx)
+	u, err := s.states(ctx)
 	if err != nil {
 		replyError(w, err.Error())
 		return
 	}
+	loc := s.config().displayLocation(userFrom(ctx))
+	votes := map[string]string{}
+	for unit, at := range s.votes.pendingAt() {
+		votes[unit] = at.In(loc).Format(time.Kitchen)
+	}
+	tasks, err := taskStatuses(ctx, s.config(), s.db)
+	if err != nil {
+		log.Printf("schedule: %v", err)
+	}
+	for i := range tasks {
+		tasks[i].Last, tasks[i].Next = tasks[i].Last.In(loc), tasks[i].Next.In(loc)
+	}
 	w.Header().Add("Content-Type", "text/html")
 	data := map[string]any{
-		"Servers": u,
+		"Starting": s.starting.Load(),
+		"Servers":  u,
+		"User":     userFrom(ctx),
+		"LinkTTLs": linkDurations,
+		"Votes":    votes,
+		"Tasks":    tasks,
+		"Timezone": loc.String(),
+		"Hold":     s.config().HoldUpdates,
+		"ReadOnly": s.readOnly || userFrom(ctx).readOnly,
+		"Terminal": s.terminalAllowed(s.config().user(userFrom(ctx).Name)) == nil,
+		"ModWarns": s.modWarnings(ctx),
+		"MemWarns": s.capacityWarnings(),
 	}
 	if err := pageTmpl.Execute(w, data); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func rpcStart(w http.ResponseWriter, r *http.Request) {
+func (s *webServer) rpcStart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
 	unitName := path.Base(r.URL.Path)
 	ctx := r.Context()
-	conn, err := dbus.NewUserConnectionContext(ctx)
+	release, err := s.lockUnit(ctx, "start", unitName)
+	if err != nil {
+		replyActionError(w, err)
+		return
+	}
+	defer release()
+	if err := preflightUnit(s.config(), unitName); err != nil {
+		replyError(w, err.Error())
+		return
+	}
+	s.warnOvercommit(unitName)
+	conn, err := systemdctl.Dial(ctx)
 	if err != nil {
 		replyError(w, err.Error())
 		return
@@ -240,13 +562,26 @@ func rpcStart(w http.ResponseWriter, r *http.Request) {
 		replyError(w, err.Error())
 		return
 	}
+	if v := s.config().serverByUnit(unitName); v != nil {
+		s.ports.add(v)
+	}
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-func rpcStop(w http.ResponseWriter, r *http.Request) {
+func (s *webServer) rpcStop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
 	unitName := path.Base(r.URL.Path)
 	ctx := r.Context()
-	conn, err := dbus.NewUserConnectionContext(ctx)
+	release, err := s.lockUnit(ctx, "stop", unitName)
+	if err != nil {
+		replyActionError(w, err)
+		return
+	}
+	defer release()
+	conn, err := systemdctl.Dial(ctx)
 	if err != nil {
 		replyError(w, err.Error())
 		return
@@ -256,13 +591,55 @@ func rpcStop(w http.ResponseWriter, r *http.Request) {
 		replyError(w, err.Error())
 		return
 	}
+	if v := s.config().serverByUnit(unitName); v != nil {
+		s.ports.remove(v)
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func (s *webServer) rpcRestart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	unitName := path.Base(r.URL.Path)
+	ctx := r.Context()
+	release, err := s.lockUnit(ctx, "restart", unitName)
+	if err != nil {
+		replyActionError(w, err)
+		return
+	}
+	defer release()
+	if err := preflightUnit(s.config(), unitName); err != nil {
+		replyError(w, err.Error())
+		return
+	}
+	if err := s.restartWithStats(ctx, unitName); err != nil {
+		replyError(w, err.Error())
+		return
+	}
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 type webRun struct {
 	args
-	bind     string
-	adminPwd string
+	bind      string
+	adminPwd  string
+	debugAddr string
+
+	accessLog      string
+	accessLogMaxMB int64
+	accessLogKeep  int
+	authLog        string
+
+	tailscale       bool
+	tailscaleSocket string
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+	maxBodyKB    int64
+	readOnly     bool
 }
 
 func (w *webRun) Run(a subcommands.Application, args []string, env subcommands.Env) int {
@@ -270,35 +647,208 @@ func (w *webRun) Run(a subcommands.Application, args []string, env subcommands.E
 		fmt.Fprintf(os.Stderr, "%s: Unsupported arguments.\n", a.GetName())
 		return 1
 	}
+	c, err := loadConfig(w.configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
+	defer c.startTracing()()
+	ws := &webServer{
+		ctx:        ctx,
+		configPath: w.configPath,
+		adminPwd:   w.adminPwd,
+		ports:      newPortMapper(),
+		publicIP:   &publicIP{},
+		rcon:       rconpool.New(ctx),
+		auditQ:     make(chan auditEntry, 256),
+		readOnly:   w.readOnly,
+	}
+	if w.tailscale {
+		ws.tailscale = newTailscaleClient(w.tailscaleSocket)
+		if !w.bindSet() {
+			ips, err := ws.tailscale.addrs(ctx)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+				return 1
+			}
+			_, port, _ := net.SplitHostPort(w.bind)
+			var addrs []string
+			for _, ip := range ips {
+				addrs = append(addrs, net.JoinHostPort(ip, port))
+			}
+			w.bind = strings.Join(addrs, ",")
+		}
+	}
+	ws.setConfig(c)
+	go ws.handleSignals(ctx)
+	db, err := openStore(c.dataDir())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	defer db.close()
+	ws.db = db
+	if ws.sessionKey, err = loadSessionKey(c.dataDir()); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	if err := db.loadEvents(&events); err != nil {
+		log.Printf("db: %v", err)
+	}
+	go bus.consume(ctx, events.add)
+	go bus.consume(ctx, db.addEvent)
+	go bus.consume(ctx, ws.collectCrashes)
+	go bus.consume(ctx, ws.sendWebhooks)
+	go bus.consume(ctx, ws.notifyPlugins)
+	go bus.consume(ctx, ws.runHooks)
+	go bus.consume(ctx, ws.welcomePlayers)
+	go bus.consume(ctx, ws.watchPlayers)
+	ws.registerMetrics()
+	go ws.watchUnits(ctx)
+	go ws.startOnBoot(ctx)
+	go ws.rollingRestarts(ctx)
+	go ws.runPluginTasks(ctx)
+	go ws.probeLatency(ctx)
+	go ws.purgeOld(ctx)
+	go ws.forwardAudit(ctx)
+	go ws.sampleSaves(ctx)
+	go ws.samplePerf(ctx)
+	go ws.monitorSwap(ctx)
+	go ws.monitorSaves(ctx)
+	go ws.announce(ctx)
+	go ws.countdownRestarts(ctx)
 	mux := &http.ServeMux{}
-	mux.Handle("/rpc/start/", http.HandlerFunc(rpcStart))
-	mux.Handle("/rpc/stop/", http.HandlerFunc(rpcStop))
+	mux.Handle("/login", http.HandlerFunc(ws.serveLogin))
+	mux.Handle("/logout", http.HandlerFunc(serveLogout))
+	mux.Handle("/rpc/start/", http.HandlerFunc(ws.rpcStart))
+	mux.Handle("/rpc/stop/", http.HandlerFunc(ws.rpcStop))
+	mux.Handle("/rpc/restart/", http.HandlerFunc(ws.rpcRestart))
+	mux.Handle("/rpc/bulk", http.HandlerFunc(ws.rpcBulk))
+	mux.Handle("/rpc/startall", http.HandlerFunc(ws.rpcStartAll))
+	mux.Handle("/rpc/boot/", http.HandlerFunc(ws.rpcBoot))
+	mux.Handle("/rpc/hold", http.HandlerFunc(ws.rpcHold))
+	mux.Handle("/rpc/link", http.HandlerFunc(ws.rpcLink))
+	mux.Handle("/link/", http.HandlerFunc(ws.serveLink))
+	mux.Handle("/logs/", http.HandlerFunc(ws.serveLogs))
+	mux.Handle("/console/", http.HandlerFunc(ws.serveConsole))
+	mux.Handle("/rpc/rcon/", http.HandlerFunc(ws.serveConsole))
+	mux.Handle("/rescue/", http.HandlerFunc(ws.serveRescue))
+	mux.Handle("/rpc/rescue/", http.HandlerFunc(ws.serveRescue))
+	mux.Handle("/env/", http.HandlerFunc(ws.serveEnv))
+	mux.Handle("/rpc/env/", http.HandlerFunc(ws.serveEnv))
+	mux.Handle("/files/", http.HandlerFunc(ws.serveFiles))
+	mux.Handle("/rpc/files/", http.HandlerFunc(ws.serveFiles))
+	mux.Handle("/bookmarks/", http.HandlerFunc(ws.serveBookmarks))
+	mux.Handle("/rpc/bookmarks", http.HandlerFunc(ws.serveBookmarks))
+	mux.Handle("/watchlist/", http.HandlerFunc(ws.serveWatchlist))
+	mux.Handle("/rpc/watchlist", http.HandlerFunc(ws.serveWatchlist))
+	mux.Handle("/join/", http.HandlerFunc(ws.serveJoin))
+	mux.Handle("/badge/", http.HandlerFunc(ws.serveBadge))
+	mux.Handle("/population/", http.HandlerFunc(ws.servePopulation))
+	mux.Handle("/countdown/", http.HandlerFunc(ws.serveCountdown))
+	mux.Handle("/vote/", http.HandlerFunc(ws.serveVote))
+	mux.Handle("/rpc/veto/", http.HandlerFunc(ws.rpcVeto))
+	mux.Handle("/crashes/", http.HandlerFunc(ws.serveCrashes))
+	mux.Handle("/plan/", http.HandlerFunc(ws.servePlan))
+	mux.Handle("/tasks/", http.HandlerFunc(ws.serveTask))
+	mux.Handle("/compare/", http.HandlerFunc(ws.serveCompare))
+	mux.Handle("/difficulty/", http.HandlerFunc(ws.serveDifficulty))
+	mux.Handle("/overrides/", http.HandlerFunc(ws.serveOverrides))
+	mux.Handle("/breeding/", http.HandlerFunc(ws.serveBreeding))
+	mux.Handle("/settings/", http.HandlerFunc(ws.serveSettings))
+	mux.Handle("/docs/", http.HandlerFunc(ws.serveDocs))
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/rpc/settings", http.HandlerFunc(ws.serveSettings))
+	mux.Handle("/rpc/breeding", http.HandlerFunc(ws.serveBreeding))
+	mux.Handle("/rpc/overrides", http.HandlerFunc(ws.serveOverrides))
+	mux.Handle("/mods/", http.HandlerFunc(ws.serveMods))
+	mux.Handle("/rpc/mods", http.HandlerFunc(ws.serveMods))
+	mux.Handle("/saves/", http.HandlerFunc(ws.serveSaves))
+	mux.Handle("/cpus/", http.HandlerFunc(ws.serveCPUs))
+	mux.Handle("/plugins/", http.HandlerFunc(ws.servePlugins))
+	mux.Handle("/capacity/", http.HandlerFunc(ws.serveCapacity))
+	mux.Handle("/announcements/", http.HandlerFunc(ws.serveAnnouncements))
+	mux.Handle("/rpc/announcements", http.HandlerFunc(ws.serveAnnouncements))
+	mux.Handle("/rpc/saves", http.HandlerFunc(ws.serveSaves))
+	mux.Handle("/rpc/apply", http.HandlerFunc(ws.rpcApply))
+	mux.Handle("/rpc/timezone", http.HandlerFunc(ws.rpcTimezone))
+	mux.Handle("/2fa/", http.HandlerFunc(ws.serveTwoFactor))
+	mux.Handle("/rpc/2fa", http.HandlerFunc(ws.serveTwoFactor))
+	mux.Handle("/terminal/", http.HandlerFunc(ws.serveTerminal))
+	mux.Handle("/rpc/terminal", http.HandlerFunc(ws.serveTerminal))
+	mux.Handle("/api/v1/", ws.apiRoutes())
+	mux.Handle("/feed.atom", http.HandlerFunc(serveFeed))
+	mux.Handle("/feed/", http.HandlerFunc(serveFeed))
 	static, err := fs.Sub(rsc, "rsc/static")
 	if err != nil {
 		panic(err)
 	}
 	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(static))))
 	mux.Handle("/favicon.ico", http.RedirectHandler("/static/ark.png", http.StatusSeeOther))
-	mux.Handle("/", http.HandlerFunc(serveRoot))
-	var h http.Handler = mux
-	if !w.quiet {
-		h = &loghttp.Handler{Handler: mux}
+	mux.Handle("/", http.HandlerFunc(ws.serveRoot))
+	al := &accessLogger{h: measureHTTP(traceHTTP(ws.requireAuth(mux))), ws: ws, quiet: w.quiet}
+	if w.accessLog != "" {
+		f, err := openRotatingFile(w.accessLog, w.accessLogMaxMB<<20, w.accessLogKeep)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+			return 1
+		}
+		al.out = f
+	}
+	if w.authLog != "" {
+		f, err := openRotatingFile(w.authLog, w.accessLogMaxMB<<20, w.accessLogKeep)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+			return 1
+		}
+		ws.authLog = f
+	}
+	var h http.Handler = limitBody(al, w.maxBodyKB<<10)
+	if w.debugAddr != "" {
+		go serveDebug(ctx, w.debugAddr)
 	}
 	s := &http.Server{
-		Addr:           w.bind,
 		Handler:        h,
-		ReadTimeout:    10. * time.Second,
-		WriteTimeout:   60 * time.Second,
+		ReadTimeout:    w.readTimeout,
+		WriteTimeout:   w.writeTimeout,
+		IdleTimeout:    w.idleTimeout,
 		MaxHeaderBytes: http.DefaultMaxHeaderBytes,
 		BaseContext:    func(net.Listener) context.Context { return ctx },
 	}
-	log.Printf("Serving on %s", w.bind)
-	log.Fatal(s.ListenAndServe())
+	// Listen on all the addresses first so a typo fails immediately.
+	var lns []net.Listener
+	for _, addr := range strings.Split(w.bind, ",") {
+		ln, err := net.Listen("tcp", strings.TrimSpace(addr))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+			return 1
+		}
+		lns = append(lns, ln)
+	}
+	errs := make(chan error, len(lns))
+	for _, ln := range lns {
+		log.Printf("Serving on %s", ln.Addr())
+		go func(ln net.Listener) {
+			errs <- s.Serve(ln)
+		}(ln)
+	}
+	log.Fatal(<-errs)
 	return 0
 }
 
+// bindSet returns true if -p was specified.
+func (w *webRun) bindSet() bool {
+	found := false
+	w.Flags.Visit(func(f *flag.Flag) {
+		if f.Name == "p" {
+			found = true
+		}
+	})
+	return found
+}
+
 func main() {
 	log.SetFlags(log.Lmicroseconds)
 	os.Exit(subcommands.Run(application, nil))
@@ -0,0 +1,73 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+)
+
+func TestPageTmplEscapes(t *testing.T) {
+	evil := "<script>alert(1)</script>"
+	u := unitStatus{
+		UnitStatus:  dbus.UnitStatus{Name: "ark-island.service", ActiveState: "active"},
+		Running:     true,
+		DisplayName: evil,
+		Map:         mapInfo{Name: evil},
+		PortMapping: evil,
+		Connect:     connectInfo{SteamURL: "steam://connect/192.0.2.1:27015"},
+		Listing:     evil,
+		Players:     []player{{Name: evil, SteamID: "1"}},
+		HasPlayers:  true,
+		Lock:        evil,
+	}
+	data := map[string]any{
+		"Servers":  []unitStatus{u, {UnitStatus: dbus.UnitStatus{Name: "ark-other.service"}, Lock: evil}},
+		"User":     anonymous,
+		"LinkTTLs": linkDurations,
+		"Votes":    map[string]string{},
+		"Tasks":    []taskStatus{{Name: "backup", Last: time.Now(), Result: evil}},
+		"Timezone": "UTC",
+		"Hold":     evil,
+		"ModWarns": []string{evil},
+		"MemWarns": []string{evil},
+	}
+	var b bytes.Buffer
+	if err := pageTmpl.Execute(&b, data); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(b.String(), evil) {
+		t.Fatal("unescaped field")
+	}
+	if !strings.Contains(b.String(), `href="steam://connect/192.0.2.1:27015"`) {
+		t.Fatal("missing steam:// link")
+	}
+}
+
+func TestRPCActionsRequirePOST(t *testing.T) {
+	s := &webServer{}
+	data := []struct {
+		path string
+		h    http.HandlerFunc
+	}{
+		{"/rpc/start/ark-island.service", s.rpcStart},
+		{"/rpc/stop/ark-island.service", s.rpcStop},
+		{"/rpc/restart/ark-island.service", s.rpcRestart},
+		{"/rpc/startall", s.rpcStartAll},
+	}
+	for _, l := range data {
+		w := httptest.NewRecorder()
+		l.h(w, httptest.NewRequest("GET", l.path, nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("GET %s: got %d", l.path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import "sort"
+
+// mapInfo describes a map that can be loaded by a server.
+type mapInfo struct {
+	// ID is the map name passed on the command line, e.g. ScorchedEarth_P.
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// WorkshopID is set for maps provided by a workshop mod.
+	WorkshopID string `json:"workshop_id,omitempty"`
+	// TotalConversion is set when WorkshopID must be loaded via
+	// -TotalConversionMod instead of GameModIds.
+	TotalConversion bool `json:"total_conversion,omitempty"`
+	// MaxWildLevel is the default maximum wild dino level.
+	MaxWildLevel int `json:"max_wild_level,omitempty"`
+}
+
+// builtinMaps are the official maps and popular custom ones.
+var builtinMaps = []mapInfo{
+	{ID: "TheIsland", Name: "The Island", MaxWildLevel: 150},
+	{ID: "TheCenter", Name: "The Center", MaxWildLevel: 150},
+	{ID: "ScorchedEarth_P", Name: "Scorched Earth", MaxWildLevel: 150},
+	{ID: "Ragnarok", Name: "Ragnarok", MaxWildLevel: 150},
+	{ID: "Aberration_P", Name: "Aberration", MaxWildLevel: 150},
+	{ID: "Extinction", Name: "Extinction", MaxWildLevel: 150},
+	{ID: "Valguero_P", Name: "Valguero", MaxWildLevel: 150},
+	{ID: "Genesis", Name: "Genesis: Part 1", MaxWildLevel: 150},
+	{ID: "CrystalIsles", Name: "Crystal Isles", MaxWildLevel: 150},
+	{ID: "Gen2", Name: "Genesis: Part 2", MaxWildLevel: 150},
+	{ID: "LostIsland", Name: "Lost Island", MaxWildLevel: 150},
+	{ID: "Fjordur", Name: "Fjordur", MaxWildLevel: 150},
+	{ID: "EbenusAstrum", Name: "Ebenus Astrum", WorkshopID: "916417001", MaxWildLevel: 150},
+}
+
+// maps returns the map registry: the builtin maps extended or overridden by
+// the ones in the configuration file, sorted by display name.
+func (c *config) maps() []mapInfo {
+	m := map[string]mapInfo{}
+	for _, v := range builtinMaps {
+		m[v.ID] = v
+	}
+	for _, v := range c.Maps {
+		m[v.ID] = v
+	}
+	out := make([]mapInfo, 0, len(m))
+	for _, v := range m {
+		out = append(out, v)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// mapInfo returns the registry entry for the map ID. Unknown maps are
+// returned as is, with their ID as display name.
+func (c *config) mapInfo(id string) mapInfo {
+	for _, v := range c.Maps {
+		if v.ID == id {
+			return v
+		}
+	}
+	for _, v := range builtinMaps {
+		if v.ID == id {
+			return v
+		}
+	}
+	return mapInfo{ID: id, Name: id}
+}
@@ -0,0 +1,443 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/maruel/subcommands"
+)
+
+// The servers of the other common managers, ark-server-tools' arkmanager and
+// LinuxGSM's arkserver, are converted from their configuration files, which
+// are shell variable assignments.
+
+// foreignServer is a server managed by another tool.
+type foreignServer struct {
+	// Manager is "arkmanager" or "linuxgsm".
+	Manager string
+	// Config is the instance configuration file.
+	Config string
+	// Root is the dedicated server installation directory.
+	Root           string
+	Server         serverConfig
+	AdminPassword  string
+	ServerPassword string
+	ClusterDir     string
+	// Notes are the settings that couldn't be converted.
+	Notes []string
+}
+
+var reShellAssign = regexp.MustCompile(`^(?:export\s+)?([A-Za-z_][A-Za-z0-9_]*)=(.*)$`)
+
+// shellVars are the variables of the shell configuration files. The values
+// are expanded when read, so a variable overridden in a later file is also
+// overridden where it is referenced, e.g. LinuxGSM's startparameters.
+type shellVars map[string]string
+
+// read reads the variable assignments of the shell script p. The other
+// statements are ignored.
+func (s shellVars) read(p string) error {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		m := reShellAssign.FindStringSubmatch(strings.TrimSpace(l))
+		if m == nil {
+			continue
+		}
+		v := m[2]
+		switch {
+		case strings.HasPrefix(v, "'"):
+			if i := strings.IndexByte(v[1:], '\''); i != -1 {
+				v = v[1 : i+1]
+			}
+			// Not expanded.
+			v = strings.ReplaceAll(v, "$", "$$")
+		case strings.HasPrefix(v, `"`):
+			b := strings.Builder{}
+			for i := 1; i < len(v) && v[i] != '"'; i++ {
+				if v[i] == '\\' && i+1 < len(v) {
+					i++
+					if v[i] == '$' {
+						b.WriteByte('$')
+					}
+				}
+				b.WriteByte(v[i])
+			}
+			v = b.String()
+		default:
+			if i := strings.IndexAny(v, " \t;#"); i != -1 {
+				v = v[:i]
+			}
+		}
+		s[m[1]] = v
+	}
+	return nil
+}
+
+// get returns the expanded value of the variable.
+func (s shellVars) get(k string) string {
+	return s.expand(s[k], 0)
+}
+
+func (s shellVars) expand(v string, depth int) string {
+	return os.Expand(v, func(k string) string {
+		if k == "$" {
+			return "$"
+		}
+		if depth > 10 {
+			// Self reference.
+			return ""
+		}
+		return s.expand(s[k], depth+1)
+	})
+}
+
+// foreignName converts an instance name to a valid server name.
+func foreignName(s string) string {
+	b := []byte(strings.ToLower(s))
+	for i, c := range b {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_' && c != '-' {
+			b[i] = '-'
+		}
+	}
+	return strings.TrimLeft(string(b), "-_")
+}
+
+// setLaunch converts the server's command line: the "?Key=Value" URL options
+// and the "-Flag" arguments.
+func (f *foreignServer) setLaunch(opts, flags []string) {
+	v := &f.Server
+	atoi := func(k, s string) int {
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			f.Notes = append(f.Notes, fmt.Sprintf("invalid %s %q", k, s))
+		}
+		return i
+	}
+	for _, o := range opts {
+		k, s, _ := strings.Cut(o, "=")
+		switch strings.ToLower(k) {
+		case "listen", "rconenabled":
+		case "sessionname":
+			v.SessionName = s
+		case "port":
+			v.Port = atoi(k, s)
+		case "queryport":
+			v.QueryPort = atoi(k, s)
+		case "rconport":
+			v.RCONPort = atoi(k, s)
+		case "maxplayers":
+			v.MaxPlayers = atoi(k, s)
+		case "multihome":
+			if s != "0.0.0.0" {
+				v.MultiHome = s
+			}
+		case "serveradminpassword":
+			f.AdminPassword = s
+		case "serverpassword":
+			f.ServerPassword = s
+		case "altsavedirectoryname":
+			v.SaveDir = s
+		case "gamemodids":
+			for _, m := range strings.Split(s, ",") {
+				if m = strings.TrimSpace(m); m != "" {
+					v.Mods = append(v.Mods, m)
+				}
+			}
+		default:
+			v.Options = append(v.Options, o)
+		}
+	}
+	for _, a := range flags {
+		k, s, _ := strings.Cut(strings.TrimPrefix(a, "-"), "=")
+		switch strings.ToLower(k) {
+		case "server", "log", "automanagedmods", "multihome", "notransferfromfiltering":
+		case "crossplay":
+			v.Crossplay = true
+		case "epiconly":
+			v.EpicOnly = true
+		case "publicipforepic":
+			v.PublicIPForEpic = s
+		case "totalconversionmod":
+			v.TotalConversionMod = s
+		case "clusterid":
+			v.ClusterID = s
+		case "clusterdiroverride":
+			f.ClusterDir = s
+		default:
+			v.Flags = append(v.Flags, a)
+		}
+	}
+	if v.SessionName == "" {
+		// Both managers may leave it to GameUserSettings.ini.
+		v.SessionName, _ = iniValue(filepath.Join(f.Root, "ShooterGame", "Saved", "Config", "LinuxServer", "GameUserSettings.ini"), "SessionSettings", "SessionName")
+	}
+	if v.PublicIPForEpic != "" && !v.Crossplay {
+		f.Notes = append(f.Notes, "PublicIPForEpic is ignored without crossplay")
+		v.PublicIPForEpic = ""
+	}
+}
+
+// detectArkmanager returns the ark-server-tools instances: the global
+// configuration is overridden by each instance's file. Without instance
+// files, the global configuration is the "main" instance.
+func detectArkmanager(home string) ([]foreignServer, error) {
+	global := shellVars{"HOME": home}
+	found := false
+	for _, p := range []string{"/etc/arkmanager/arkmanager.cfg", filepath.Join(home, ".arkmanager.cfg")} {
+		if err := global.read(p); err == nil {
+			found = true
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	var instances []string
+	for _, d := range []string{"/etc/arkmanager/instances", filepath.Join(home, ".config", "arkmanager", "instances")} {
+		m, _ := filepath.Glob(filepath.Join(d, "*.cfg"))
+		instances = append(instances, m...)
+	}
+	if !found && len(instances) == 0 {
+		return nil, nil
+	}
+	if len(instances) == 0 {
+		instances = []string{""}
+	}
+	var out []foreignServer
+	for _, p := range instances {
+		vars := make(shellVars, len(global))
+		for k, v := range global {
+			vars[k] = v
+		}
+		name := "main"
+		cfg := "/etc/arkmanager/arkmanager.cfg"
+		if p != "" {
+			if err := vars.read(p); err != nil {
+				return nil, err
+			}
+			name, cfg = strings.TrimSuffix(filepath.Base(p), ".cfg"), p
+		}
+		f := foreignServer{Manager: "arkmanager", Config: cfg, Root: vars.get("arkserverroot")}
+		f.Server.Name = foreignName(name)
+		f.Server.Map = vars.get("serverMap")
+		if f.Server.Map == "" {
+			f.Server.Map = "TheIsland"
+		}
+		if f.Root == "" {
+			f.Notes = append(f.Notes, "arkserverroot is not set")
+		}
+		var opts, flags []string
+		keys := make([]string, 0, len(vars))
+		for k := range vars {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := vars.get(k)
+			if o, ok := strings.CutPrefix(k, "ark_"); ok {
+				opts = append(opts, o+"="+v)
+			} else if o, ok := strings.CutPrefix(k, "arkflag_"); ok && v == "true" {
+				flags = append(flags, "-"+o)
+			} else if o, ok := strings.CutPrefix(k, "arkopt_"); ok && v != "" {
+				flags = append(flags, "-"+o+"="+v)
+			}
+		}
+		f.setLaunch(opts, flags)
+		if m := vars.get("serverMapModId"); m != "" {
+			// The map is provided by a mod.
+			f.Server.Mods = append([]string{m}, f.Server.Mods...)
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+// detectLinuxGSM returns the LinuxGSM arkserver instances of the installation
+// in the home directory. Each instance's settings are _default.cfg, overridden
+// by common.cfg and then by the instance's file, secrets included.
+func detectLinuxGSM(home string) ([]foreignServer, error) {
+	d := filepath.Join(home, "lgsm", "config-lgsm", "arkserver")
+	m, _ := filepath.Glob(filepath.Join(d, "*.cfg"))
+	var out []foreignServer
+	for _, p := range m {
+		name := strings.TrimSuffix(filepath.Base(p), ".cfg")
+		if strings.HasPrefix(name, "_") || strings.HasPrefix(name, "secrets-") || name == "common" {
+			continue
+		}
+		vars := shellVars{"HOME": home, "rootdir": home, "selfname": name}
+		for _, n := range []string{"_default", "common", "secrets-common", name, "secrets-" + name} {
+			if err := vars.read(filepath.Join(d, n+".cfg")); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+		}
+		root := vars.get("serverfiles")
+		if root == "" {
+			root = filepath.Join(home, "serverfiles")
+		}
+		f := foreignServer{Manager: "linuxgsm", Config: p, Root: root}
+		f.Server.Name = foreignName(name)
+		params := strings.Fields(vars.get("startparameters"))
+		if len(params) == 0 {
+			// The defaults of LinuxGSM's _default.cfg.
+			m := vars.get("defaultmap")
+			if m == "" {
+				m = "TheIsland"
+			}
+			params = []string{m + "?AltSaveDirectoryName=" + m + "?listen?MultiHome=" + vars.get("ip") + "?MaxPlayers=" + vars.get("maxplayers") + "?QueryPort=" + vars.get("queryport") + "?RCONEnabled=True?RCONPort=" + vars.get("rconport") + "?Port=" + vars.get("port"), "-automanagedmods"}
+		}
+		opts := strings.Split(params[0], "?")
+		f.Server.Map = opts[0]
+		f.setLaunch(opts[1:], params[1:])
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+// detectForeign returns the servers of the other managers found for the user
+// whose home directory is home.
+func detectForeign(home string) ([]foreignServer, error) {
+	a, err := detectArkmanager(home)
+	if err != nil {
+		return nil, err
+	}
+	l, err := detectLinuxGSM(home)
+	if err != nil {
+		return nil, err
+	}
+	return append(a, l...), nil
+}
+
+var cmdMigrate = &subcommands.Command{
+	UsageLine: "migrate <options> <detect|import>",
+	ShortDesc: "Imports the servers of arkmanager or LinuxGSM",
+	LongDesc:  "Imports the servers of ark-server-tools (arkmanager) or LinuxGSM (arkserver) by converting their configuration files.\n\n`migrate detect` lists the servers found and how they are converted, `migrate import` adds them to the configuration file. When the configuration has no server yet, the existing installation and its saves are reused as the install_dir.\nStop and disable the other manager, then run `apply` to generate the systemd units.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &migrateRun{}
+		c.args.flags()
+		h, _ := os.UserHomeDir()
+		c.Flags.StringVar(&c.home, "home", h, "home directory of the user running the other manager")
+		return c
+	},
+}
+
+type migrateRun struct {
+	args
+	home string
+}
+
+func (m *migrateRun) Run(a subcommands.Application, args []string, env subcommands.Env) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "%s: Expected one of detect or import.\n", a.GetName())
+		return 1
+	}
+	c, err := loadConfig(m.configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	l, err := detectForeign(m.home)
+	if err == nil && len(l) == 0 {
+		err = fmt.Errorf("no arkmanager or LinuxGSM server found in /etc/arkmanager or %s", m.home)
+	}
+	if err == nil {
+		switch args[0] {
+		case "detect":
+			for i := range l {
+				printForeign(c, &l[i])
+			}
+		case "import":
+			err = m.importServers(c, l)
+		default:
+			err = fmt.Errorf("unknown command %q", args[0])
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
+
+func printForeign(c *config, f *foreignServer) {
+	v := &f.Server
+	fmt.Printf("%s %s (%s)\n", f.Manager, v.Name, f.Config)
+	fmt.Printf("  %-24s %5d %5d %5d %s\n", c.mapInfo(v.Map).Name, v.Port, v.QueryPort, v.RCONPort, v.SessionName)
+	fmt.Printf("  installation: %s\n", f.Root)
+	if len(v.Mods) != 0 {
+		fmt.Printf("  mods: %s\n", strings.Join(v.Mods, ","))
+	}
+	if len(v.Options) != 0 || len(v.Flags) != 0 {
+		fmt.Printf("  extra arguments: %s\n", strings.Join(append(v.Options, v.Flags...), " "))
+	}
+	for _, n := range f.Notes {
+		fmt.Printf("  warning: %s\n", n)
+	}
+}
+
+// importServers adds the servers not already configured. The first import
+// reuses the other manager's installation, so the saves and the INI files are
+// kept as they are.
+func (m *migrateRun) importServers(c *config, l []foreignServer) error {
+	reuse := c.InstallDir == "" && len(c.Servers) == 0
+	added := 0
+	managers := map[string]bool{}
+	for i := range l {
+		f := &l[i]
+		if c.server(f.Server.Name) != nil {
+			fmt.Printf("Skipped %s %s: a server with this name is already configured\n", f.Manager, f.Server.Name)
+			continue
+		}
+		printForeign(c, f)
+		if reuse && f.Root != "" {
+			c.InstallDir = f.Root
+			reuse = false
+		}
+		if f.Root != "" && filepath.Clean(f.Root) != filepath.Clean(c.installDir()) {
+			fmt.Printf("  note: the saves are in another installation; copy %s to %s\n", f.Server.saveDir(&config{InstallDir: f.Root}), f.Server.saveDir(c))
+		}
+		if c.AdminPassword == "" {
+			c.AdminPassword = f.AdminPassword
+		} else if f.AdminPassword != "" && f.AdminPassword != c.AdminPassword {
+			fmt.Printf("  note: its admin password differs; the shared admin_password is used\n")
+		}
+		if c.ServerPassword == "" {
+			c.ServerPassword = f.ServerPassword
+		}
+		if c.ClusterDir == "" {
+			c.ClusterDir = f.ClusterDir
+		}
+		c.Servers = append(c.Servers, f.Server)
+		managers[f.Manager] = true
+		added++
+	}
+	if added == 0 {
+		return errors.New("no new server to import")
+	}
+	c.setDefaults()
+	if err := c.validate(); err != nil {
+		return err
+	}
+	if err := c.save(m.configPath); err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d servers.\n", added)
+	if managers["arkmanager"] {
+		fmt.Printf("Stop the arkmanager servers and disable their service or cron jobs before running `apply`.\n")
+	}
+	if managers["linuxgsm"] {
+		fmt.Printf("Stop the LinuxGSM servers and remove their cron jobs before running `apply`.\n")
+	}
+	return nil
+}
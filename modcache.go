@@ -0,0 +1,285 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With mod_cache, ark-serman downloads the workshop items itself instead of
+// each server with -automanagedmods at startup: a single steamcmd session
+// downloads every item once into data_dir/workshop, then the items are
+// extracted into the shared Mods directory, hard linking the uncompressed
+// files to the cache.
+
+// arkWorkshopApp is the Steam app of Ark's workshop items.
+const arkWorkshopApp = "346110"
+
+// modCacheDir returns where steamcmd downloads the workshop items.
+func modCacheDir(c *config) string {
+	return filepath.Join(c.dataDir(), "workshop")
+}
+
+// cachedModDir returns the item as downloaded by steamcmd.
+func cachedModDir(c *config, id string) string {
+	return filepath.Join(modCacheDir(c), "steamapps", "workshop", "content", arkWorkshopApp, id, "WindowsNoEditor")
+}
+
+// downloadMods downloads or updates the workshop items in the cache, in one
+// steamcmd session, then installs the ones that changed.
+func downloadMods(ctx context.Context, c *config, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := make([]string, 0, 3*len(ids))
+	for _, id := range ids {
+		args = append(args, "+workshop_download_item", arkWorkshopApp, id)
+	}
+	if err := os.MkdirAll(modCacheDir(c), 0o755); err != nil {
+		return err
+	}
+	if err := steamcmdIn(ctx, c, modCacheDir(c), args...); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := installCachedMod(c, id); err != nil {
+			return fmt.Errorf("mod %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// installCachedMod extracts the cached item in the Mods directory unless the
+// installed copy is up to date.
+func installCachedMod(c *config, id string) error {
+	src := cachedModDir(c, id)
+	newest, err := newestMTime(src)
+	if err != nil {
+		return err
+	}
+	dst := modDir(c, id)
+	if fi, err := os.Stat(dst + ".mod"); err == nil && !fi.ModTime().Before(newest) {
+		if _, err := os.Stat(dst); err == nil {
+			return nil
+		}
+	}
+	// Extracted aside then swapped so a failure leaves the previous copy.
+	tmp := dst + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	links := 0
+	err = filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, p)
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(tmp, rel), 0o755)
+		}
+		if strings.HasSuffix(rel, ".z.uncompressed_size") {
+			return nil
+		}
+		if strings.HasSuffix(rel, ".z") {
+			return extractZ(p, filepath.Join(tmp, strings.TrimSuffix(rel, ".z")))
+		}
+		// steamcmd replaces the files it updates, so the links don't change
+		// under a running server.
+		// The cache may be on another filesystem than the installation.
+		if os.Link(p, filepath.Join(tmp, rel)) == nil {
+			links++
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return copyFile(p, filepath.Join(tmp, rel), fi)
+	})
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	b, err := modFile(src, id)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	if err := os.WriteFile(dst+".mod", b, 0o644); err != nil {
+		return err
+	}
+	log.Printf("Installed mod %s from the cache, %d files linked", id, links)
+	return nil
+}
+
+// newestMTime returns the modification time of the newest file in d.
+func newestMTime(d string) (time.Time, error) {
+	var t time.Time
+	err := filepath.WalkDir(d, func(p string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi, err := e.Info(); err == nil && fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+		return nil
+	})
+	return t, err
+}
+
+// zSignature starts the Unreal Engine compressed files of the workshop items.
+const zSignature = 0x9E2A83C1
+
+const (
+	// maxZSize bounds the uncompressed size of a .z file.
+	maxZSize = 4 << 30
+	// maxZChunk bounds the size of a .z file's chunk, usually 128 KiB.
+	maxZChunk = 16 << 20
+)
+
+// extractZ decompresses a .z file: a header, the sizes of the chunks then
+// the zlib compressed chunks. The chunks are streamed to dst.
+func extractZ(src, dst string) (err error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var hdr [32]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil || binary.LittleEndian.Uint64(hdr[:]) != zSignature {
+		return fmt.Errorf("%s: not a compressed file", src)
+	}
+	size := binary.LittleEndian.Uint64(hdr[24:])
+	if size > maxZSize {
+		return fmt.Errorf("%s: too large", src)
+	}
+	var chunks [][2]uint64
+	for total := uint64(0); total < size; {
+		var b [16]byte
+		if _, err := io.ReadFull(br, b[:]); err != nil {
+			return fmt.Errorf("%s: truncated", src)
+		}
+		ch := [2]uint64{binary.LittleEndian.Uint64(b[:]), binary.LittleEndian.Uint64(b[8:])}
+		if ch[0] > maxZChunk || ch[1] == 0 || ch[1] > maxZChunk {
+			return fmt.Errorf("%s: invalid chunk size", src)
+		}
+		chunks = append(chunks, ch)
+		total += ch[1]
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := out.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+	bw := bufio.NewWriter(out)
+	for _, ch := range chunks {
+		lr := &io.LimitedReader{R: br, N: int64(ch[0])}
+		zr, err := zlib.NewReader(lr)
+		if err == nil {
+			// Bounded so a hostile item can't inflate beyond its declared size.
+			var n int64
+			if n, err = io.Copy(bw, io.LimitReader(zr, int64(ch[1])+1)); err == nil && uint64(n) != ch[1] {
+				err = errors.New("corrupted chunk")
+			}
+		}
+		if _, err2 := io.Copy(io.Discard, lr); err2 != nil || lr.N != 0 {
+			return fmt.Errorf("%s: truncated", src)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", src, err)
+		}
+	}
+	return bw.Flush()
+}
+
+// modFile returns the <id>.mod file the server reads for an installed mod,
+// built from the item's mod.info and modmeta.info.
+func modFile(src, id string) ([]byte, error) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.ReadFile(filepath.Join(src, "mod.info"))
+	if err != nil {
+		return nil, err
+	}
+	errBad := errors.New("invalid mod.info")
+	str := func(b []byte) (string, []byte, error) {
+		if len(b) < 4 {
+			return "", nil, errBad
+		}
+		l := int(binary.LittleEndian.Uint32(b))
+		if l < 1 || len(b) < 4+l {
+			return "", nil, errBad
+		}
+		return string(b[4 : 4+l-1]), b[4+l:], nil
+	}
+	name, rest, err := str(info)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < 4 {
+		return nil, errBad
+	}
+	// Each map takes at least its 4 bytes length.
+	count := binary.LittleEndian.Uint32(rest)
+	rest = rest[4:]
+	if uint64(count) > uint64(len(rest)/4) {
+		return nil, errBad
+	}
+	maps := make([]string, count)
+	for i := range maps {
+		if maps[i], rest, err = str(rest); err != nil {
+			return nil, err
+		}
+	}
+	out := binary.LittleEndian.AppendUint64(nil, n)
+	put := func(s string) {
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(s)+1))
+		out = append(append(out, s...), 0)
+	}
+	put(name)
+	put("../../../ShooterGame/Content/Mods/" + id)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(maps)))
+	for _, m := range maps {
+		put(m)
+	}
+	out = append(out, 0x33, 0xFF, 0x22, 0xFF, 0x02, 0x00, 0x00, 0x00, 0x01)
+	meta, err := os.ReadFile(filepath.Join(src, "modmeta.info"))
+	if errors.Is(err, fs.ErrNotExist) {
+		// A regular mod, as opposed to a total conversion.
+		meta = []byte("\x01\x00\x00\x00\x08\x00\x00\x00ModType\x00\x02\x00\x00\x001\x00")
+	} else if err != nil {
+		return nil, err
+	}
+	return append(out, meta...), nil
+}
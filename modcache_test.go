@@ -0,0 +1,218 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// makeZ compresses data in the .z format, in chunks of n bytes.
+func makeZ(t *testing.T, data []byte, n int) []byte {
+	var hdr, chunks []byte
+	var total uint64
+	for i := 0; i < len(data); i += n {
+		end := min(i+n, len(data))
+		var b bytes.Buffer
+		w := zlib.NewWriter(&b)
+		if _, err := w.Write(data[i:end]); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		hdr = binary.LittleEndian.AppendUint64(hdr, uint64(b.Len()))
+		hdr = binary.LittleEndian.AppendUint64(hdr, uint64(end-i))
+		chunks = append(chunks, b.Bytes()...)
+		total += uint64(b.Len())
+	}
+	out := binary.LittleEndian.AppendUint64(nil, zSignature)
+	out = binary.LittleEndian.AppendUint64(out, uint64(n))
+	out = binary.LittleEndian.AppendUint64(out, total)
+	out = binary.LittleEndian.AppendUint64(out, uint64(len(data)))
+	return append(append(out, hdr...), chunks...)
+}
+
+// infoStr encodes s as in mod.info.
+func infoStr(b []byte, s string) []byte {
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(s)+1))
+	return append(append(b, s...), 0)
+}
+
+func TestExtractZ(t *testing.T) {
+	want := []byte(strings.Repeat("ShooterGame ", 20000))
+	valid := makeZ(t, want, 1<<17)
+	// Declares a 10 bytes chunk that inflates to all of want.
+	inflated := makeZ(t, want, len(want))
+	binary.LittleEndian.PutUint64(inflated[24:], 10)
+	binary.LittleEndian.PutUint64(inflated[40:], 10)
+	huge := append([]byte(nil), valid...)
+	binary.LittleEndian.PutUint64(huge[24:], maxZSize+1)
+	zero := append([]byte(nil), valid...)
+	binary.LittleEndian.PutUint64(zero[40:], 0)
+	bigChunk := append([]byte(nil), valid...)
+	binary.LittleEndian.PutUint64(bigChunk[32:], maxZChunk+1)
+	data := []struct {
+		name string
+		in   []byte
+		err  string
+	}{
+		{"valid", valid, ""},
+		{"empty", nil, "not a compressed file"},
+		{"signature", append([]byte{1}, valid[1:]...), "not a compressed file"},
+		{"truncated sizes", valid[:40], "truncated"},
+		{"truncated chunk", valid[:len(valid)-1], "truncated"},
+		{"inflated", inflated, "corrupted chunk"},
+		{"too large", huge, "too large"},
+		{"zero chunk", zero, "invalid chunk size"},
+		{"large chunk", bigChunk, "invalid chunk size"},
+	}
+	d := t.TempDir()
+	for _, l := range data {
+		src := filepath.Join(d, l.name+".z")
+		dst := filepath.Join(d, l.name)
+		if err := os.WriteFile(src, l.in, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		err := extractZ(src, dst)
+		if l.err != "" {
+			if err == nil || !strings.Contains(err.Error(), l.err) {
+				t.Errorf("%s: got %v, want %q", l.name, err, l.err)
+			}
+			if _, err := os.Stat(dst); err == nil {
+				t.Errorf("%s: partial output left", l.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", l.name, err)
+		}
+		if got, _ := os.ReadFile(dst); !bytes.Equal(got, want) {
+			t.Errorf("%s: got %d bytes", l.name, len(got))
+		}
+	}
+}
+
+func TestModFile(t *testing.T) {
+	info := infoStr(nil, "Structures Plus")
+	info = binary.LittleEndian.AppendUint32(info, 2)
+	info = infoStr(info, "TheIsland")
+	info = infoStr(info, "Ragnarok")
+	hostile := binary.LittleEndian.AppendUint32(infoStr(nil, "Evil"), 0xFFFFFFFF)
+	data := []struct {
+		name string
+		id   string
+		info []byte
+		ok   bool
+	}{
+		{"valid", "731604991", info, true},
+		{"id", "abc", info, false},
+		{"empty", "1", nil, false},
+		{"no count", "1", infoStr(nil, "Name"), false},
+		{"hostile count", "1", hostile, false},
+		{"truncated map", "1", info[:len(info)-3], false},
+		{"zero length", "1", make([]byte, 8), false},
+	}
+	for _, l := range data {
+		d := t.TempDir()
+		if err := os.WriteFile(filepath.Join(d, "mod.info"), l.info, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		b, err := modFile(d, l.id)
+		if !l.ok {
+			if err == nil {
+				t.Errorf("%s: expected an error", l.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", l.name, err)
+		}
+		want := binary.LittleEndian.AppendUint64(nil, 731604991)
+		want = infoStr(want, "Structures Plus")
+		want = infoStr(want, "../../../ShooterGame/Content/Mods/731604991")
+		want = binary.LittleEndian.AppendUint32(want, 2)
+		want = infoStr(want, "TheIsland")
+		want = infoStr(want, "Ragnarok")
+		want = append(want, 0x33, 0xFF, 0x22, 0xFF, 0x02, 0x00, 0x00, 0x00, 0x01)
+		if !bytes.HasPrefix(b, want) || !bytes.HasSuffix(b, []byte("ModType\x00\x02\x00\x00\x001\x00")) {
+			t.Errorf("%s: got %q", l.name, b)
+		}
+	}
+}
+
+func TestInstallCachedMod(t *testing.T) {
+	c := &config{DataDir: t.TempDir(), InstallDir: t.TempDir()}
+	const id = "731604991"
+	src := cachedModDir(c, id)
+	content := []byte(strings.Repeat("mesh", 1000))
+	files := map[string][]byte{
+		"mod.info":              binary.LittleEndian.AppendUint32(infoStr(nil, "Test"), 0),
+		"Content/Test.uasset.z": makeZ(t, content, 1<<17),
+		"Content/Test.uasset.z.uncompressed_size": []byte("4000\n"),
+		"Content/Plain.txt":                       []byte("plain"),
+	}
+	for k, v := range files {
+		p := filepath.Join(src, filepath.FromSlash(k))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, v, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := installCachedMod(c, id); err != nil {
+		t.Fatal(err)
+	}
+	dst := modDir(c, id)
+	if got, _ := os.ReadFile(filepath.Join(dst, "Content", "Test.uasset")); !bytes.Equal(got, content) {
+		t.Errorf("uasset: got %d bytes", len(got))
+	}
+	if got, _ := os.ReadFile(filepath.Join(dst, "Content", "Plain.txt")); string(got) != "plain" {
+		t.Errorf("Plain.txt: got %q", got)
+	}
+	for _, p := range []string{"Content/Test.uasset.z", "Content/Test.uasset.z.uncompressed_size"} {
+		if _, err := os.Stat(filepath.Join(dst, p)); err == nil {
+			t.Errorf("%s: unexpected", p)
+		}
+	}
+	if _, err := os.Stat(dst + ".mod"); err != nil {
+		t.Fatal(err)
+	}
+	// Up to date: a new file in the installed copy is kept.
+	extra := filepath.Join(dst, "extra")
+	if err := os.WriteFile(extra, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := installCachedMod(c, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(extra); err != nil {
+		t.Fatal("reinstalled while up to date")
+	}
+	// A corrupted item leaves the previous copy.
+	bad := filepath.Join(src, "Content", "Bad.uasset.z")
+	if err := os.WriteFile(bad, []byte("bad"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(bad, time.Time{}, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := installCachedMod(c, id); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := os.Stat(extra); err != nil {
+		t.Fatal("previous copy removed")
+	}
+	if _, err := os.Stat(dst + ".tmp"); err == nil {
+		t.Fatal("temporary copy left")
+	}
+}
@@ -0,0 +1,348 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maruel/subcommands"
+)
+
+// builtinMods are the directories shipped in ShooterGame/Content/Mods with
+// the dedicated server.
+var builtinMods = map[string]bool{"111111111": true}
+
+// modIssue is a mod that prevents the players from joining or wastes space.
+type modIssue struct {
+	ID    string
+	Title string
+	// Source is where the mod is referenced: "ActiveMods", "config" or
+	// "Mods directory" for the orphaned ones.
+	Source  string
+	Problem string
+	// Fixes are the possible repairs: "download" and "remove".
+	Fixes []string
+}
+
+func (m *modIssue) String() string {
+	s := "mod " + m.ID
+	if m.Title != "" {
+		s += " (" + m.Title + ")"
+	}
+	return s + " in " + m.Source + ": " + m.Problem
+}
+
+// activeMods returns the mod IDs in ActiveMods of GameUserSettings.ini.
+func activeMods(c *config) ([]string, error) {
+	v, err := iniValue(filepath.Join(configDir(c), "GameUserSettings.ini"), "ServerSettings", "ActiveMods")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	var out []string
+	for _, m := range strings.Split(v, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			out = append(out, m)
+		}
+	}
+	return out, nil
+}
+
+// installedMods returns the mod IDs extracted in the Mods directory.
+func installedMods(c *config) (map[string]bool, error) {
+	entries, err := os.ReadDir(filepath.Dir(modDir(c, "x")))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	out := map[string]bool{}
+	for _, e := range entries {
+		if _, err := strconv.ParseUint(e.Name(), 10, 64); e.IsDir() && err == nil && !builtinMods[e.Name()] {
+			out[e.Name()] = true
+		}
+	}
+	return out, nil
+}
+
+// findModIssues checks that every mod referenced by ActiveMods or the
+// configuration is downloaded and still on the Workshop, and that every
+// downloaded mod is referenced. items may be nil when the Workshop can't be
+// queried.
+func findModIssues(c *config, items map[string]workshopItem) ([]modIssue, error) {
+	active, err := activeMods(c)
+	if err != nil {
+		return nil, err
+	}
+	installed, err := installedMods(c)
+	if err != nil {
+		return nil, err
+	}
+	var out []modIssue
+	used := map[string]bool{}
+	check := func(id, source string) {
+		if used[id] {
+			return
+		}
+		used[id] = true
+		it := items[id]
+		m := modIssue{ID: id, Title: it.Title, Source: source}
+		switch {
+		case items != nil && !it.Found:
+			m.Problem, m.Fixes = "removed or delisted from the Workshop", []string{"remove"}
+		case it.Banned:
+			m.Problem, m.Fixes = "banned on the Workshop", []string{"remove"}
+		case !installed[id]:
+			m.Problem, m.Fixes = "not downloaded", []string{"download", "remove"}
+		default:
+			return
+		}
+		out = append(out, m)
+	}
+	for _, id := range active {
+		check(id, "ActiveMods")
+	}
+	for _, id := range c.modIDs() {
+		check(id, "config")
+	}
+	var orphans []string
+	for id := range installed {
+		if !used[id] {
+			orphans = append(orphans, id)
+		}
+	}
+	sort.Strings(orphans)
+	for _, id := range orphans {
+		out = append(out, modIssue{ID: id, Title: items[id].Title, Source: "Mods directory", Problem: "orphaned, not referenced by any server", Fixes: []string{"remove"}})
+	}
+	return out, nil
+}
+
+// checkMods queries the Workshop and returns the mod issues. When the
+// Workshop can't be queried, werr is set and only the local issues are
+// returned.
+func checkMods(ctx context.Context, c *config) (l []modIssue, werr, err error) {
+	var items map[string]workshopItem
+	if ids := c.allModIDs(); len(ids) != 0 {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		items, werr = getWorkshopItems(ctx, ids)
+		cancel()
+	}
+	l, err = findModIssues(c, items)
+	return l, werr, err
+}
+
+// allModIDs returns the mods referenced by ActiveMods, the configuration or
+// present in the Mods directory.
+func (c *config) allModIDs() []string {
+	seen := map[string]bool{}
+	for _, id := range c.modIDs() {
+		seen[id] = true
+	}
+	if l, err := activeMods(c); err == nil {
+		for _, id := range l {
+			seen[id] = true
+		}
+	}
+	if m, err := installedMods(c); err == nil {
+		for id := range m {
+			seen[id] = true
+		}
+	}
+	out := make([]string, 0, len(seen))
+	for id := range seen {
+		out = append(out, id)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// repairMod fixes the issue with fix, one of m.Fixes. Mods removed from the
+// configuration are saved to configPath; the units must then be regenerated
+// with apply.
+func repairMod(ctx context.Context, c *config, configPath string, m *modIssue, fix string) (string, error) {
+	all, _ := c.selectServers(nil)
+	release, err := lockServers(ctx, c, "mod repair", all...)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	if fix == "download" {
+		if err := checkUpdate(ctx, c, log.Printf); err != nil {
+			return "", err
+		}
+		if c.ModCache {
+			return "downloaded and installed", downloadMods(ctx, c, m.ID)
+		}
+		// The servers extract the downloaded mods at startup with
+		// -automanagedmods.
+		return "downloaded, extracted at the next start", steamcmd(ctx, c, "+workshop_download_item", "346110", m.ID)
+	}
+	switch m.Source {
+	case "ActiveMods":
+		active, err := activeMods(c)
+		if err != nil {
+			return "", err
+		}
+		var keep []string
+		for _, id := range active {
+			if id != m.ID {
+				keep = append(keep, id)
+			}
+		}
+		return "removed from ActiveMods", setIniValue(filepath.Join(configDir(c), "GameUserSettings.ini"), "ServerSettings", "ActiveMods", strings.Join(keep, ","))
+	case "config":
+		// Reload from disk to not persist the command line overrides.
+		d, err := loadConfig(configPath)
+		if err != nil {
+			return "", err
+		}
+		for i := range d.Servers {
+			v := &d.Servers[i]
+			var keep []string
+			for _, id := range v.Mods {
+				if id != m.ID {
+					keep = append(keep, id)
+				}
+			}
+			v.Mods = keep
+			if v.TotalConversionMod == m.ID {
+				v.TotalConversionMod = ""
+			}
+		}
+		return "removed from the configuration, run apply to update the units", d.save(configPath)
+	default:
+		p := modDir(c, m.ID)
+		if err := os.Remove(p + ".mod"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		return "deleted " + p, os.RemoveAll(p)
+	}
+}
+
+var modsTmpl = template.Must(template.ParseFS(rsc, "rsc/mods.html.tmpl"))
+
+// serveMods serves the mod issues at /mods/. The repairs are POSTed to
+// /rpc/mods to be recorded in the audit log.
+func (s *webServer) serveMods(w http.ResponseWriter, r *http.Request) {
+	data := map[string]any{}
+	if r.Method == "POST" && r.URL.Path == "/rpc/mods" {
+		// Downloading a mod can take a while.
+		extendWriteDeadline(w, 30*time.Minute)
+		res, err := s.repairMod(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			data["Err"] = err.Error()
+		} else {
+			data["Result"] = res
+		}
+	}
+	c := s.config()
+	l, werr, err := checkMods(r.Context(), c)
+	if err != nil {
+		data["Err"] = err.Error()
+	}
+	if werr != nil {
+		data["Warning"] = "The Workshop wasn't checked: " + werr.Error()
+	}
+	data["Issues"] = l
+	data["Admin"] = userFrom(r.Context()).hasRole(roleAdmin)
+	w.Header().Add("Content-Type", "text/html")
+	_ = modsTmpl.Execute(w, data)
+}
+
+// repairMod repairs the mod issue still present. Only admins can.
+func (s *webServer) repairMod(r *http.Request) (string, error) {
+	if !userFrom(r.Context()).hasRole(roleAdmin) {
+		return "", errors.New("only admins can repair the mods")
+	}
+	id, source, fix := r.FormValue("id"), r.FormValue("source"), r.FormValue("fix")
+	setAuditDetail(r.Context(), fix+" "+id+" in "+source)
+	c := s.config()
+	l, _, err := checkMods(r.Context(), c)
+	if err != nil {
+		return "", err
+	}
+	for i := range l {
+		if l[i].ID != id || l[i].Source != source {
+			continue
+		}
+		for _, f := range l[i].Fixes {
+			if f != fix {
+				continue
+			}
+			res, err := repairMod(r.Context(), c, s.configPath, &l[i], fix)
+			if err == nil && source == "config" {
+				s.reload()
+			}
+			return l[i].ID + ": " + res, err
+		}
+	}
+	return "", errors.New("this issue is no longer present")
+}
+
+var cmdMods = &subcommands.Command{
+	UsageLine: "mods <options> <check|repair>",
+	ShortDesc: "Checks the mods for issues preventing players from joining",
+	LongDesc:  "Checks that every mod in ActiveMods of GameUserSettings.ini and in the configuration is downloaded and still available on the Workshop, and that every mod in the Mods directory is used.\n\nMissing or delisted mods make the joins fail silently. repair downloads the missing mods, removes the delisted ones from ActiveMods or the configuration and deletes the orphaned ones. The web UI lets removing a missing mod instead.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &modsRun{}
+		c.args.flags()
+		c.Flags.BoolVar(&c.wait, "wait", false, "wait for the servers busy with another operation instead of failing")
+		return c
+	},
+}
+
+type modsRun struct {
+	args
+	wait bool
+}
+
+func (r *modsRun) Run(a subcommands.Application, args []string, env subcommands.Env) int {
+	if len(args) != 1 || (args[0] != "check" && args[0] != "repair") {
+		fmt.Fprintf(os.Stderr, "%s: Expected one of check or repair.\n", a.GetName())
+		return 1
+	}
+	ctx := withCLIOwner(context.Background(), r.wait)
+	c, err := loadConfig(r.configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	l, werr, err := checkMods(ctx, c)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	if werr != nil {
+		fmt.Fprintf(os.Stderr, "%s: warning: the Workshop wasn't checked: %s\n", a.GetName(), werr)
+	}
+	ret := 0
+	for i := range l {
+		m := &l[i]
+		if args[0] == "check" {
+			fmt.Println(m.String())
+			ret = 1
+			continue
+		}
+		res, err := repairMod(ctx, c, r.configPath, m, m.Fixes[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s: %s\n", a.GetName(), m, err)
+			ret = 1
+			continue
+		}
+		fmt.Printf("%s: %s\n", m, res)
+	}
+	return ret
+}
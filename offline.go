@@ -0,0 +1,124 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/maruel/subcommands"
+
+	"github.com/maruel/ark-serman/internal/systemdctl"
+)
+
+// The disaster recovery commands, e.g. backup restore and config validate,
+// only operate on files so that they work when the systemd user session is
+// broken, without the daemon. The only question they ask systemd is whether
+// a server is running and that has an offline answer.
+
+type offlineKeyType struct{}
+
+var offlineKey offlineKeyType
+
+// withOffline skips D-Bus in serverActive, e.g. when the user session hangs
+// rather than failing.
+func withOffline(ctx context.Context, offline bool) context.Context {
+	return context.WithValue(ctx, offlineKey, offline)
+}
+
+// serverActive returns true if the server is running. It asks systemd, then
+// falls back to whether the server's game port is in use when D-Bus is
+// unavailable.
+func serverActive(ctx context.Context, v *serverConfig) (bool, error) {
+	if off, _ := ctx.Value(offlineKey).(bool); !off {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		active, err := systemdctl.Active(ctx, v.unitName())
+		if err == nil {
+			return active, nil
+		}
+		log.Printf("%s: D-Bus is unavailable (%v); checking the game port instead", v.Name, err)
+	}
+	return portInUse(v)
+}
+
+// portInUse returns true if a process, presumably the server, listens on the
+// server's UDP game port.
+func portInUse(v *serverConfig) (bool, error) {
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(v.MultiHome, strconv.Itoa(v.Port)))
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("%s: checking the game port: %w", v.Name, err)
+	}
+	conn.Close()
+	return false, nil
+}
+
+//
+
+var cmdConfig = &subcommands.Command{
+	UsageLine: "config <options> <validate|paths> [playbooks...]",
+	ShortDesc: "Validates the configuration and prints its paths",
+	LongDesc:  "Works without the daemon nor D-Bus, only on files, e.g. for disaster recovery when the systemd user session is broken.\n\n`config validate` checks the configuration file and the playbooks passed as arguments. `config paths` prints where the configuration, the database, the backups and the game files are.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &configRun{}
+		c.args.flags()
+		return c
+	},
+}
+
+type configRun struct {
+	args
+}
+
+func (r *configRun) Run(a subcommands.Application, args []string, env subcommands.Env) int {
+	if len(args) == 0 || (args[0] == "paths" && len(args) != 1) {
+		fmt.Fprintf(os.Stderr, "%s: Expected validate [playbooks...] or paths.\n", a.GetName())
+		return 1
+	}
+	c, err := loadConfig(r.configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	switch args[0] {
+	case "validate":
+		for _, p := range args[1:] {
+			if _, err = loadPlaybook(c, p); err != nil {
+				break
+			}
+		}
+		if err == nil && !r.quiet {
+			fmt.Printf("%s: ok, %d servers\n", r.configPath, len(c.Servers))
+		}
+	case "paths":
+		fmt.Printf("config:   %s\n", r.configPath)
+		fmt.Printf("database: %s\n", filepath.Join(c.dataDir(), "ark-serman.db"))
+		fmt.Printf("backups:  %s\n", filepath.Join(c.dataDir(), "backups"))
+		fmt.Printf("install:  %s\n", c.installDir())
+		fmt.Printf("ini:      %s\n", configDir(c))
+		for i := range c.Servers {
+			v := &c.Servers[i]
+			fmt.Printf("saves:    %s: %s\n", v.Name, v.saveDir(c))
+		}
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
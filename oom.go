@@ -0,0 +1,94 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/maruel/ark-serman/internal/systemdctl"
+)
+
+// oomKilled returns true if the unit's last run was killed for lack of
+// memory: systemd reports "oom-kill" when the unit's cgroup ran out of
+// memory, e.g. at its MemoryMax, and the kernel's OOM killer is only logged
+// in the journal.
+func oomKilled(ctx context.Context, unit string) bool {
+	if conn, err := systemdctl.Dial(ctx); err == nil {
+		p, err := conn.GetServicePropertyContext(ctx, unit, "Result")
+		conn.Close()
+		if err == nil {
+			if r, ok := p.Value.Value().(string); ok && r == "oom-kill" {
+				return true
+			}
+		}
+	}
+	l, err := journalLines(ctx, unit, 200)
+	if err != nil {
+		return false
+	}
+	// Only look at the last run.
+	for i := len(l) - 1; i >= 0; i-- {
+		if strings.Contains(l[i], "killed by the OOM killer") || strings.Contains(l[i], "'oom-kill'") {
+			return true
+		}
+		if strings.Contains(l[i], " Started ") {
+			break
+		}
+	}
+	return false
+}
+
+// publishCrash publishes evOOMKilled when the server ran out of memory,
+// with the remediation, and evCrashed otherwise.
+func (s *webServer) publishCrash(ctx context.Context, u *unitStatus) {
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	if !oomKilled(ctx, u.Name) {
+		bus.publish(event{Unit: u.Name, Kind: evCrashed, Msg: u.DisplayName + " crashed"})
+		return
+	}
+	msg := u.DisplayName + " was killed for lack of memory"
+	if v := s.config().serverByUnit(u.Name); v != nil && v.MemoryMax != "" {
+		msg += fmt.Sprintf(" at its memory_max of %s; raise it or remove mods", v.MemoryMax)
+	} else if p := s.planCapacity(); p != nil {
+		msg += fmt.Sprintf("; %.0f MB of the %d MB of RAM and swap are committed, run fewer maps concurrently or set memory_max on the servers to protect the others", p.Committed, p.Total)
+	}
+	bus.publish(event{Unit: u.Name, Kind: evOOMKilled, Msg: msg})
+}
+
+// swapState returns true when the host is deep into swap: more than half the
+// swap is used and less than a tenth of the RAM is available. The servers
+// then lag and their saves take minutes.
+func swapState(mi map[string]int) (deep bool, used int) {
+	used = mi["SwapTotal"] - mi["SwapFree"]
+	return mi["SwapTotal"] != 0 && 2*used > mi["SwapTotal"] && 10*mi["MemAvailable"] < mi["MemTotal"], used
+}
+
+// monitorSwap publishes evSwapping when the host goes deep into swap. It is
+// published again once the host recovered and went deep into swap again.
+func (s *webServer) monitorSwap(ctx context.Context) {
+	swapping := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
+		deep, used := swapState(readMeminfo())
+		if deep && !swapping {
+			msg := fmt.Sprintf("the host is deep into swap with %d MB swapped", used)
+			if p := s.planCapacity(); p != nil && p.Committed > float64(p.RAM) {
+				msg += fmt.Sprintf("; the running servers commit %.0f MB for %d MB of RAM, run fewer maps concurrently", p.Committed, p.RAM)
+			}
+			log.Printf("swap: %s", msg)
+			bus.publish(event{Kind: evSwapping, Msg: msg})
+		}
+		swapping = deep
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiParam is a path or query parameter of an API route.
+type apiParam struct {
+	Name string
+	// In is "path" or "query".
+	In   string
+	Desc string
+	// Type is "string" or "integer".
+	Type string
+	// Enum lists the accepted values, if restricted.
+	Enum []string
+}
+
+// apiRoute describes an API endpoint. The route table is the source of truth
+// for both the routing, the request validation and the OpenAPI document.
+type apiRoute struct {
+	Method string
+	// Path is relative to /api/v1, with {name} path parameters.
+	Path    string
+	Summary string
+	Params  []apiParam
+	// Response is a value of the type of the JSON response, nil for 204.
+	Response any
+	Handler  func(w http.ResponseWriter, r *http.Request, params map[string]string)
+}
+
+// apiRouter routes and validates the requests under /api/v1/.
+type apiRouter struct {
+	routes []apiRoute
+}
+
+// match returns the path parameters if p matches the route's path.
+func (a *apiRoute) match(p string) (map[string]string, bool) {
+	want := strings.Split(strings.Trim(a.Path, "/"), "/")
+	got := strings.Split(strings.Trim(p, "/"), "/")
+	if len(want) != len(got) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, w := range want {
+		if strings.HasPrefix(w, "{") && strings.HasSuffix(w, "}") {
+			params[w[1:len(w)-1]] = got[i]
+		} else if w != got[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// validate checks the parameters against the route definition and returns
+// an error message.
+func (a *apiRoute) validate(r *http.Request, params map[string]string) string {
+	q := r.URL.Query()
+	// The API tokens can be passed in the query by the kiosks.
+	known := map[string]bool{"token": true}
+	for _, p := range a.Params {
+		var v string
+		if p.In == "path" {
+			v = params[p.Name]
+		} else {
+			known[p.Name] = true
+			if len(q[p.Name]) == 0 {
+				continue
+			}
+			v = q.Get(p.Name)
+			params[p.Name] = v
+		}
+		if p.Type == "integer" {
+			if _, err := strconv.Atoi(v); err != nil {
+				return p.Name + ": expected an integer"
+			}
+		}
+		if len(p.Enum) != 0 {
+			ok := false
+			for _, e := range p.Enum {
+				ok = ok || e == v
+			}
+			if !ok {
+				return p.Name + ": expected one of " + strings.Join(p.Enum, ", ")
+			}
+		}
+	}
+	for k := range q {
+		if !known[k] {
+			return "unknown query parameter " + k
+		}
+	}
+	return ""
+}
+
+func (a *apiRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(r.URL.Path, "/api/v1")
+	methods := []string{}
+	for i := range a.routes {
+		rt := &a.routes[i]
+		params, ok := rt.match(p)
+		if !ok {
+			continue
+		}
+		if rt.Method != r.Method && !(rt.Method == "GET" && r.Method == "HEAD") {
+			methods = append(methods, rt.Method)
+			continue
+		}
+		if msg := rt.validate(r, params); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		rt.Handler(w, r, params)
+		return
+	}
+	if len(methods) != 0 {
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// openAPI returns the OpenAPI 3 document describing the routes.
+func (a *apiRouter) openAPI() map[string]any {
+	schemas := map[string]any{}
+	paths := map[string]any{}
+	for _, rt := range a.routes {
+		op := map[string]any{"summary": rt.Summary}
+		var params []any
+		for _, p := range rt.Params {
+			s := map[string]any{"type": p.Type}
+			if len(p.Enum) != 0 {
+				s["enum"] = p.Enum
+			}
+			params = append(params, map[string]any{
+				"name":        p.Name,
+				"in":          p.In,
+				"required":    p.In == "path",
+				"description": p.Desc,
+				"schema":      s,
+			})
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+		if rt.Response == nil {
+			op["responses"] = map[string]any{"204": map[string]any{"description": "No content"}}
+		} else {
+			op["responses"] = map[string]any{"200": map[string]any{
+				"description": "OK",
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": jsonSchema(reflect.TypeOf(rt.Response), schemas)},
+				},
+			}}
+		}
+		item, _ := paths["/api/v1"+rt.Path].(map[string]any)
+		if item == nil {
+			item = map[string]any{}
+			paths["/api/v1"+rt.Path] = item
+		}
+		item[strings.ToLower(rt.Method)] = op
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info":    map[string]any{"title": "ark-serman", "version": "1"},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"basic":  map[string]any{"type": "http", "scheme": "basic"},
+				"cookie": map[string]any{"type": "apiKey", "in": "cookie", "name": sessionCookie},
+			},
+		},
+		"security": []any{map[string]any{"basic": []any{}}, map[string]any{"cookie": []any{}}},
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// jsonSchema returns the JSON schema of the type as encoded by
+// encoding/json. Structs are added to schemas and referenced.
+func jsonSchema(t reflect.Type, schemas map[string]any) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]any{"type": "number"}
+	case t.Kind() == reflect.String:
+		return map[string]any{"type": "string"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return map[string]any{"type": "array", "items": jsonSchema(t.Elem(), schemas)}
+	case t.Kind() == reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": jsonSchema(t.Elem(), schemas)}
+	case t.Kind() == reflect.Struct:
+		name := t.Name()
+		ref := map[string]any{"$ref": "#/components/schemas/" + name}
+		if _, ok := schemas[name]; ok {
+			return ref
+		}
+		// Break recursion.
+		schemas[name] = nil
+		props := map[string]any{}
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if !f.IsExported() || tag == "-" {
+				continue
+			}
+			n, opts, _ := strings.Cut(tag, ",")
+			if n == "" {
+				n = f.Name
+			}
+			props[n] = jsonSchema(f.Type, schemas)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, n)
+			}
+		}
+		s := map[string]any{"type": "object", "properties": props}
+		if required != nil {
+			s["required"] = required
+		}
+		schemas[name] = s
+		return ref
+	default:
+		return map[string]any{}
+	}
+}
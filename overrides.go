@@ -0,0 +1,557 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The Game.ini override arrays repeat a key once per entry, each value being
+// an engine struct on a single line, e.g.
+//
+//	ConfigOverrideItemMaxQuantity=(ItemClassString="PrimalItemResource_Stone_C",Quantity=(MaxItemQuantity=1000,bIgnoreMultiplier=true))
+//
+// One missing parenthesis silently drops the entry, or the rest of the file.
+
+// gameModeSection is the Game.ini section holding the override arrays.
+const gameModeSection = "/script/shootergame.shootergamemode"
+
+// overrideField is a field of an override array entry.
+type overrideField struct {
+	// Name is the field name, "Parent.Name" for the fields of a nested
+	// struct.
+	Name string
+	Type iniType
+	// Quoted fields are written as "value".
+	Quoted   bool
+	Required bool
+	// Raw fields are an engine struct or array kept as text, e.g. ItemSets.
+	Raw bool
+}
+
+// overrideKind is an override array of Game.ini.
+type overrideKind struct {
+	Key    string
+	Title  string
+	Fields []overrideField
+}
+
+// overrideKinds are the override arrays with a structured editor.
+var overrideKinds = []overrideKind{
+	{
+		Key:   "EngramEntryAutoUnlocks",
+		Title: "Engrams unlocked automatically",
+		Fields: []overrideField{
+			{Name: "EngramClassName", Quoted: true, Required: true},
+			{Name: "LevelToAutoUnlock", Type: iniInt},
+		},
+	},
+	{
+		Key:   "OverrideNamedEngramEntries",
+		Title: "Engram overrides",
+		Fields: []overrideField{
+			// Some entries use EngramIndex instead.
+			{Name: "EngramClassName", Quoted: true},
+			{Name: "EngramHidden", Type: iniBool},
+			{Name: "EngramPointsCost", Type: iniInt},
+			{Name: "EngramLevelRequirement", Type: iniInt},
+			{Name: "RemoveEngramPreReq", Type: iniBool},
+		},
+	},
+	{
+		Key:   "ConfigOverrideItemMaxQuantity",
+		Title: "Item stack sizes",
+		Fields: []overrideField{
+			{Name: "ItemClassString", Quoted: true, Required: true},
+			{Name: "Quantity.MaxItemQuantity", Type: iniInt, Required: true},
+			{Name: "Quantity.bIgnoreMultiplier", Type: iniBool},
+		},
+	},
+	{
+		Key:   "ConfigOverrideSupplyCrateItems",
+		Title: "Supply crate contents",
+		Fields: []overrideField{
+			{Name: "SupplyCrateClassString", Quoted: true, Required: true},
+			{Name: "MinItemSets", Type: iniFloat},
+			{Name: "MaxItemSets", Type: iniFloat},
+			{Name: "NumItemSetsPower", Type: iniFloat},
+			{Name: "bSetsRandomWithoutReplacement", Type: iniBool},
+			{Name: "bAppendItemSets", Type: iniBool},
+			{Name: "ItemSets", Raw: true, Required: true},
+		},
+	},
+}
+
+// overrideKindOf returns the override array of the key, or nil.
+func overrideKindOf(key string) *overrideKind {
+	for i := range overrideKinds {
+		if strings.EqualFold(overrideKinds[i].Key, key) {
+			return &overrideKinds[i]
+		}
+	}
+	return nil
+}
+
+// structField is a Key=Value of an engine struct.
+type structField struct {
+	Key, Value string
+}
+
+// checkBalanced returns an error if the parentheses or the quotes of the
+// value aren't balanced.
+func checkBalanced(v string) error {
+	depth, quoted := 0, false
+	for _, r := range v {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case quoted:
+		case r == '(':
+			depth++
+		case r == ')':
+			if depth--; depth < 0 {
+				return errors.New("unbalanced parentheses: too many )")
+			}
+		}
+	}
+	if quoted {
+		return errors.New("unterminated string")
+	}
+	if depth != 0 {
+		return fmt.Errorf("unbalanced parentheses: %d missing )", depth)
+	}
+	return nil
+}
+
+// splitStruct returns the top level fields of an engine struct, e.g.
+// (A=1,B=(C=2)).
+func splitStruct(v string) ([]structField, error) {
+	v = strings.TrimSpace(v)
+	if !strings.HasPrefix(v, "(") || !strings.HasSuffix(v, ")") {
+		return nil, fmt.Errorf("expected (Key=Value,...), got %q", v)
+	}
+	if err := checkBalanced(v); err != nil {
+		return nil, err
+	}
+	var out []structField
+	depth, quoted, start := 0, false, 1
+	for i := 1; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+			continue
+		case quoted:
+			continue
+		case c == '(':
+			depth++
+			continue
+		case c == ')' && depth > 0:
+			depth--
+			continue
+		case depth > 0, c != ',' && c != ')':
+			continue
+		}
+		if c == ')' && i != len(v)-1 {
+			return nil, fmt.Errorf("unexpected ) in %q", v)
+		}
+		part := strings.TrimSpace(v[start:i])
+		start = i + 1
+		if part == "" {
+			if c == ')' && len(out) == 0 {
+				break
+			}
+			return nil, fmt.Errorf("empty field in %q", v)
+		}
+		k, val, ok := strings.Cut(part, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("expected Key=Value, got %q", part)
+		}
+		out = append(out, structField{Key: strings.TrimSpace(k), Value: strings.TrimSpace(val)})
+	}
+	return out, nil
+}
+
+// overrideRow is an entry of an override array.
+type overrideRow struct {
+	// Values are aligned with the kind's Fields.
+	Values []string
+	// Extra are the fields the editor doesn't know, kept as is.
+	Extra string
+	// Line is the line number in Game.ini; 0 for a new entry.
+	Line int
+	// ReadOnly is the reason the entry can't be edited, e.g. it is composed
+	// from a snippet.
+	ReadOnly string
+	// Raw is the line's value.
+	Raw string
+}
+
+// parseRow parses the value of an entry.
+func (k *overrideKind) parseRow(v string) (overrideRow, error) {
+	row := overrideRow{Values: make([]string, len(k.Fields)), Raw: v}
+	fields, err := splitStruct(v)
+	if err != nil {
+		return row, err
+	}
+	var extra []string
+	for _, f := range fields {
+		if i := k.field(f.Key); i != -1 {
+			row.Values[i] = k.Fields[i].display(f.Value)
+			continue
+		}
+		if k.field(f.Key+".") == -1 {
+			extra = append(extra, f.Key+"="+f.Value)
+			continue
+		}
+		sub, err := splitStruct(f.Value)
+		if err != nil {
+			return row, fmt.Errorf("%s: %w", f.Key, err)
+		}
+		for _, s := range sub {
+			i := k.field(f.Key + "." + s.Key)
+			if i == -1 {
+				return row, fmt.Errorf("unknown field %s.%s", f.Key, s.Key)
+			}
+			row.Values[i] = k.Fields[i].display(s.Value)
+		}
+	}
+	row.Extra = strings.Join(extra, ",")
+	return row, nil
+}
+
+// field returns the index of the field named name, or of the first field of
+// the nested struct when name is "Parent.", or -1.
+func (k *overrideKind) field(name string) int {
+	for i, f := range k.Fields {
+		if strings.HasSuffix(name, ".") {
+			if strings.HasPrefix(strings.ToLower(f.Name), strings.ToLower(name)) {
+				return i
+			}
+		} else if strings.EqualFold(f.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Bool returns true for the fields edited with a True/False select.
+func (f overrideField) Bool() bool {
+	return f.Type == iniBool
+}
+
+// display returns the value as shown in the editor.
+func (f *overrideField) display(v string) string {
+	if f.Type == iniBool {
+		if strings.EqualFold(v, "true") {
+			return "True"
+		}
+		if strings.EqualFold(v, "false") {
+			return "False"
+		}
+	}
+	return unquote(v, f.Quoted)
+}
+
+func unquote(v string, quoted bool) string {
+	if quoted && len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		return v[1 : len(v)-1]
+	}
+	return v
+}
+
+// format returns the entry's value after validating it.
+func (k *overrideKind) format(row *overrideRow) (string, error) {
+	var parts []string
+	for i := 0; i < len(k.Fields); i++ {
+		f := k.Fields[i]
+		v := strings.TrimSpace(row.Values[i])
+		parent, _, nested := strings.Cut(f.Name, ".")
+		if nested {
+			// Group the fields of the nested struct.
+			var sub []string
+			for ; i < len(k.Fields) && strings.HasPrefix(k.Fields[i].Name, parent+"."); i++ {
+				s, err := k.formatField(&k.Fields[i], strings.TrimSpace(row.Values[i]))
+				if err != nil {
+					return "", err
+				}
+				if s != "" {
+					sub = append(sub, s[len(parent)+1:])
+				}
+			}
+			i--
+			if len(sub) != 0 {
+				parts = append(parts, parent+"=("+strings.Join(sub, ",")+")")
+			}
+			continue
+		}
+		s, err := k.formatField(&f, v)
+		if err != nil {
+			return "", err
+		}
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	if e := strings.TrimSpace(row.Extra); e != "" {
+		if _, err := splitStruct("(" + e + ")"); err != nil {
+			return "", fmt.Errorf("other fields: %w", err)
+		}
+		parts = append(parts, e)
+	}
+	return "(" + strings.Join(parts, ",") + ")", nil
+}
+
+// formatField returns Name=Value, or "" when the value is empty.
+func (k *overrideKind) formatField(f *overrideField, v string) (string, error) {
+	if v == "" {
+		if f.Required {
+			return "", fmt.Errorf("%s is required", f.Name)
+		}
+		return "", nil
+	}
+	switch {
+	case f.Raw:
+		if err := checkBalanced(v); err != nil {
+			return "", fmt.Errorf("%s: %w", f.Name, err)
+		}
+		if !strings.HasPrefix(v, "(") {
+			return "", fmt.Errorf("%s: expected (...), got %q", f.Name, v)
+		}
+		v = strings.Join(strings.Fields(strings.ReplaceAll(v, "\n", " ")), " ")
+	case f.Quoted:
+		v = unquote(v, true)
+		if strings.ContainsAny(v, "\",()") {
+			return "", fmt.Errorf("%s: invalid class name %q", f.Name, v)
+		}
+		v = `"` + v + `"`
+	case !f.Type.check(v):
+		return "", fmt.Errorf("%s must be %s, got %q", f.Name, f.Type, v)
+	}
+	return f.Name + "=" + v, nil
+}
+
+// gameIniOverrides is Game.ini split to edit the override arrays.
+type gameIniOverrides struct {
+	lines []string
+	// rows are the entries of each kind, by key.
+	rows    map[string][]overrideRow
+	modTime int64
+}
+
+// loadOverrides reads the override arrays of Game.ini.
+func loadOverrides(p string) (*gameIniOverrides, error) {
+	out := &gameIniOverrides{rows: map[string][]overrideRow{}}
+	b, err := os.ReadFile(p)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		out.modTime = fi.ModTime().UnixNano()
+		out.lines = strings.Split(strings.TrimRight(strings.ReplaceAll(string(b), "\r\n", "\n"), "\n"), "\n")
+	}
+	section, snippet := "", ""
+	for i, l := range out.lines {
+		t := strings.TrimSpace(l)
+		switch {
+		case snippet == "" && strings.HasPrefix(t, snippetBegin):
+			snippet = strings.TrimPrefix(t, snippetBegin)
+			continue
+		case snippet != "" && t == strings.TrimSpace(snippetEnd+snippet):
+			snippet = ""
+			continue
+		case strings.HasPrefix(t, "[") && strings.HasSuffix(t, "]"):
+			section = t[1 : len(t)-1]
+			continue
+		}
+		if !strings.EqualFold(section, gameModeSection) || t == "" || t[0] == ';' {
+			continue
+		}
+		op := ""
+		if strings.ContainsRune("+-.!", rune(t[0])) {
+			op, t = t[:1], t[1:]
+		}
+		key, v, _ := strings.Cut(t, "=")
+		k := overrideKindOf(strings.TrimSpace(key))
+		if k == nil {
+			continue
+		}
+		row, err := k.parseRow(strings.TrimSpace(v))
+		row.Line = i + 1
+		switch {
+		case snippet != "":
+			row.ReadOnly = "from the " + snippet + " snippet"
+		case op != "":
+			row.ReadOnly = "uses the " + op + " operator"
+		case err != nil:
+			row.ReadOnly = err.Error()
+		}
+		out.rows[k.Key] = append(out.rows[k.Key], row)
+	}
+	return out, nil
+}
+
+// replace returns Game.ini with the editable entries of the kind replaced by
+// the rows. The new entries take the place of the first one, or go at the end
+// of the section.
+func (g *gameIniOverrides) replace(k *overrideKind, rows []overrideRow) ([]string, error) {
+	var values []string
+	for i := range rows {
+		v, err := k.format(&rows[i])
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i+1, err)
+		}
+		values = append(values, k.Key+"="+v)
+	}
+	drop := map[int]bool{}
+	for _, r := range g.rows[k.Key] {
+		if r.ReadOnly == "" {
+			drop[r.Line-1] = true
+		}
+	}
+	var out []string
+	at, section, end := -1, "", -1
+	for i, l := range g.lines {
+		t := strings.TrimSpace(l)
+		if strings.HasPrefix(t, "[") && strings.HasSuffix(t, "]") {
+			section = t[1 : len(t)-1]
+		}
+		if drop[i] {
+			if at == -1 {
+				at = len(out)
+			}
+			continue
+		}
+		out = append(out, l)
+		if strings.EqualFold(section, gameModeSection) && t != "" {
+			end = len(out)
+		}
+	}
+	if at == -1 {
+		at = end
+	}
+	if at == -1 {
+		if len(values) == 0 {
+			return out, nil
+		}
+		if len(out) != 0 {
+			out = append(out, "")
+		}
+		out = append(out, "["+gameModeSection+"]")
+		return append(out, values...), nil
+	}
+	return append(out[:at], append(values, out[at:]...)...), nil
+}
+
+var overridesTmpl = template.Must(template.ParseFS(rsc, "rsc/overrides.html.tmpl"))
+
+// serveOverrides serves the override arrays editor at /overrides/; the
+// changes are POSTed to /rpc/overrides. Only admins can edit Game.ini.
+func (s *webServer) serveOverrides(w http.ResponseWriter, r *http.Request) {
+	if !userFrom(r.Context()).hasRole(roleAdmin) {
+		http.Error(w, "only admins can edit the overrides", http.StatusForbidden)
+		return
+	}
+	c := s.config()
+	p := filepath.Join(configDir(c), "Game.ini")
+	data := map[string]any{}
+	w.Header().Add("Content-Type", "text/html")
+	if strings.HasPrefix(r.URL.Path, "/rpc/") && r.Method == "POST" {
+		r.Body = http.MaxBytesReader(w, r.Body, maxEditSize)
+		if res, err := s.editOverrides(r, p); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			data["Err"] = err.Error()
+		} else {
+			data["Result"] = res
+		}
+	}
+	g, err := loadOverrides(p)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		data["Err"] = err.Error()
+		g = &gameIniOverrides{}
+	}
+	var views []overrideView
+	for i := range overrideKinds {
+		v := overrideView{overrideKind: &overrideKinds[i]}
+		for _, row := range g.rows[v.Key] {
+			if row.ReadOnly != "" {
+				v.Fixed = append(v.Fixed, row)
+			} else {
+				v.Rows = append(v.Rows, row)
+			}
+		}
+		// An empty row to add an entry.
+		v.Rows = append(v.Rows, overrideRow{Values: make([]string, len(v.Fields))})
+		views = append(views, v)
+	}
+	data["Kinds"], data["ModTime"] = views, strconv.FormatInt(g.modTime, 10)
+	_ = overridesTmpl.Execute(w, data)
+}
+
+// overrideView is the editor of an override array.
+type overrideView struct {
+	*overrideKind
+	Rows []overrideRow
+	// Fixed are the entries that can't be edited.
+	Fixed []overrideRow
+}
+
+// editOverrides replaces the entries of one override array. The form has
+// one value per row for each field, named f0, f1, etc.
+func (s *webServer) editOverrides(r *http.Request, p string) (string, error) {
+	k := overrideKindOf(r.FormValue("kind"))
+	if k == nil {
+		return "", errors.New("unknown override")
+	}
+	g, err := loadOverrides(p)
+	if err != nil {
+		return "", err
+	}
+	if r.FormValue("mtime") != strconv.FormatInt(g.modTime, 10) {
+		return "", errors.New("Game.ini was modified since it was loaded; reload it")
+	}
+	removed := map[string]bool{}
+	for _, v := range r.Form["remove"] {
+		removed[v] = true
+	}
+	extra := r.Form["extra"]
+	var rows []overrideRow
+	for i := range extra {
+		row := overrideRow{Values: make([]string, len(k.Fields)), Extra: extra[i]}
+		empty := strings.TrimSpace(row.Extra) == ""
+		for j := range k.Fields {
+			if l := r.Form["f"+strconv.Itoa(j)]; i < len(l) {
+				row.Values[j] = l[i]
+			}
+			// The booleans' select defaults to empty.
+			empty = empty && strings.TrimSpace(row.Values[j]) == ""
+		}
+		if !removed[strconv.Itoa(i)] && !empty {
+			rows = append(rows, row)
+		}
+	}
+	setAuditDetail(r.Context(), fmt.Sprintf("save %s %d entries", k.Key, len(rows)))
+	lines, err := g.replace(k, rows)
+	if err != nil {
+		return "", err
+	}
+	if err := writeIni(p, lines); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Saved %d %s entries; restart the servers to use them.", len(rows), k.Key), nil
+}
@@ -0,0 +1,420 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maruel/subcommands"
+	"gopkg.in/yaml.v3"
+
+	"github.com/maruel/ark-serman/internal/rconpool"
+	"github.com/maruel/ark-serman/internal/systemdctl"
+)
+
+// playbook is a maintenance runbook: a sequence of steps run on the selected
+// servers.
+type playbook struct {
+	// Servers are the servers the steps apply to. All when empty.
+	Servers []string `yaml:"servers"`
+	// Policy overrides step_policies for all the steps, e.g. on_error.
+	Policy stepPolicy     `yaml:",inline"`
+	Steps  []playbookStep `yaml:"steps"`
+}
+
+// playbookStep is one operation. Per server operations run concurrently on
+// all the servers and the step completes once they all completed.
+type playbookStep struct {
+	// Action is one of:
+	//   - broadcast: sends Message to the players.
+	//   - rcon: sends Command.
+	//   - backup: saves the world and backs up.
+	//   - start, stop: starts or stops the servers.
+	//   - restart: warns the players for Warning, saves the world and
+	//     restarts.
+	//   - healthy: waits up to Timeout for the servers to answer RCON.
+	//   - update: updates the dedicated server installations of the servers'
+	//     games via steamcmd, once for all the servers.
+	//   - wait: sleeps for Duration.
+	Action   string   `yaml:"action"`
+	Message  string   `yaml:"message"`
+	Command  string   `yaml:"command"`
+	Warning  duration `yaml:"warning"`
+	Timeout  duration `yaml:"timeout"`
+	Duration duration `yaml:"duration"`
+	// Servers overrides the playbook's servers for this step.
+	Servers []string `yaml:"servers"`
+	// Policy overrides the playbook's policy for this step.
+	Policy stepPolicy `yaml:",inline"`
+}
+
+// playbookRun is the state of a sequence of steps being run.
+type playbookRun struct {
+	// policy is the playbook's policy, overridden by the steps'.
+	policy *stepPolicy
+
+	mu sync.Mutex
+	// backups are the backup IDs taken by the backup steps, by server name.
+	backups map[string]string
+}
+
+// stepPolicy returns the step's resolved policy.
+func (r *playbookRun) stepPolicy(c *config, st *playbookStep) stepPolicy {
+	return c.stepPolicy(st.Action, r.policy, &st.Policy)
+}
+
+func (r *playbookRun) addBackup(server, id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.backups == nil {
+		r.backups = map[string]string{}
+	}
+	r.backups[server] = id
+}
+
+func (d *duration) UnmarshalYAML(n *yaml.Node) error {
+	v, err := time.ParseDuration(n.Value)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// loadPlaybook reads and validates a playbook against the configuration.
+func loadPlaybook(c *config, p string) (*playbook, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	pb := &playbook{}
+	d := yaml.NewDecoder(bytes.NewReader(b))
+	d.KnownFields(true)
+	if err := d.Decode(pb); err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	if len(pb.Steps) == 0 {
+		return nil, fmt.Errorf("%s: no steps", p)
+	}
+	if _, err := c.selectServers(pb.Servers); err != nil {
+		return nil, err
+	}
+	if err := pb.Policy.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	r := playbookRun{policy: &pb.Policy}
+	backup := false
+	for j := range pb.Steps {
+		s := &pb.Steps[j]
+		i := j + 1
+		if err := s.Policy.validate(); err != nil {
+			return nil, fmt.Errorf("step %d: %w", i, err)
+		}
+		if pol := r.stepPolicy(c, s); pol.OnError == "rollback" && !backup {
+			return nil, fmt.Errorf("step %d: on_error rollback requires an earlier backup step", i)
+		}
+		backup = backup || s.Action == "backup"
+		if _, err := c.selectServers(s.Servers); err != nil {
+			return nil, fmt.Errorf("step %d: %w", i, err)
+		}
+		var missing string
+		switch s.Action {
+		case "broadcast":
+			if s.Message == "" {
+				missing = "message"
+			}
+		case "rcon":
+			if s.Command == "" {
+				missing = "command"
+			}
+		case "wait":
+			if s.Duration <= 0 {
+				missing = "duration"
+			}
+		case "backup", "start", "stop", "restart", "healthy", "update":
+		default:
+			return nil, fmt.Errorf("step %d: unknown action %q", i, s.Action)
+		}
+		if missing != "" {
+			return nil, fmt.Errorf("step %d: %s requires %s", i, s.Action, missing)
+		}
+	}
+	return pb, nil
+}
+
+var cmdRun = &subcommands.Command{
+	UsageLine: "run <options> <playbook.yaml>",
+	ShortDesc: "Runs a maintenance playbook",
+	LongDesc: `Runs the steps of a maintenance playbook in order on the selected servers, e.g.:
+
+  servers: [island, scorched]
+  on_error: stop
+  steps:
+    - {action: broadcast, message: "Maintenance in 10 minutes"}
+    - {action: wait, duration: 10m}
+    - {action: backup}
+    - {action: stop}
+    - {action: update, retries: 2, retry_delay: 5m, step_timeout: 1h}
+    - {action: start, on_error: rollback}
+    - {action: healthy, timeout: 15m, on_error: rollback}
+
+The actions are broadcast, rcon (command), backup, start, stop, restart (warning, default 15m), healthy (timeout, default start_timeout), update and wait (duration). A step's servers override the playbook's.
+
+Each step has a policy: retries (default 0), retry_delay (default 30s), step_timeout per attempt (default none) and on_error, one of stop (the default, or abort), continue, rollback (restores the backups taken by the earlier backup steps and restarts the servers) or notify (publishes a step_failed event, e.g. to the webhooks). The policies are resolved from step_policies in the configuration, "default" then the action's, then the playbook's and the step's values, and printed with each step.`,
+	CommandRun: func() subcommands.CommandRun {
+		c := &runRun{}
+		c.args.flags()
+		c.Flags.BoolVar(&c.dryRun, "n", false, "only print the steps")
+		c.Flags.BoolVar(&c.cont, "continue", false, "continue after failed steps, overriding on_error")
+		c.Flags.BoolVar(&c.wait, "wait", false, "wait for the servers busy with another operation instead of failing")
+		return c
+	},
+}
+
+type runRun struct {
+	args
+	dryRun bool
+	cont   bool
+	wait   bool
+}
+
+func (p *runRun) Run(a subcommands.Application, args []string, env subcommands.Env) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "%s: Expected one playbook.\n", a.GetName())
+		return 1
+	}
+	c, err := loadConfig(p.configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	pb, err := loadPlaybook(c, args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	ctx = withCLIOwner(ctx, p.wait)
+	defer c.startTracing()()
+	s := &webServer{ctx: ctx, ports: newPortMapper(), publicIP: &publicIP{}, rcon: rconpool.New(ctx)}
+	s.setConfig(c)
+	r := &playbookRun{policy: &pb.Policy}
+	failed := false
+	for i := range pb.Steps {
+		st := &pb.Steps[i]
+		names := st.Servers
+		if len(names) == 0 {
+			names = pb.Servers
+		}
+		servers, _ := c.selectServers(names)
+		pol := r.stepPolicy(c, st)
+		fmt.Printf("%d/%d %s (%s)\n", i+1, len(pb.Steps), st.Action, pol.String())
+		if p.dryRun {
+			continue
+		}
+		err := s.runStep(ctx, r, st, servers)
+		if err == nil {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%s: step %d: %s\n", a.GetName(), i+1, err)
+		failed = true
+		if ctx.Err() != nil {
+			return 1
+		}
+		if p.cont || !pol.stops() {
+			continue
+		}
+		switch pol.OnError {
+		case "rollback":
+			fmt.Printf("rolling back\n")
+			if err := s.rollback(ctx, r); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: rollback: %s\n", a.GetName(), err)
+			}
+		case "notify":
+			s.notifyStepFailed(ctx, event{Kind: evStepFailed, Msg: fmt.Sprintf("playbook %s: step %d %s failed: %v", filepath.Base(args[0]), i+1, st.Action, err)})
+		}
+		return 1
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// runStep runs the step on the servers with the step's policy; the per
+// server operations are retried independently.
+func (s *webServer) runStep(ctx context.Context, r *playbookRun, st *playbookStep, servers []*serverConfig) error {
+	c := s.config()
+	pol := r.stepPolicy(c, st)
+	logf := func(format string, a ...any) {
+		fmt.Printf("  "+format+"\n", a...)
+	}
+	switch st.Action {
+	case "wait":
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(st.Duration)):
+			return nil
+		}
+	case "update":
+		// The installation is shared by all the servers.
+		all, _ := c.selectServers(nil)
+		release, err := lockServers(ctx, c, "update", all...)
+		if err != nil {
+			return err
+		}
+		defer release()
+		if err := checkUpdate(ctx, c, log.Printf); err != nil {
+			return err
+		}
+		for _, v := range all {
+			if ok, err := systemdctl.Active(ctx, v.unitName()); err == nil && ok {
+				s.recordStats(ctx, v, "before update")
+			}
+		}
+		return runWithPolicy(ctx, &pol, logf, func(ctx context.Context) error {
+			for _, g := range c.usedGames() {
+				if err := installGame(ctx, c, g); err != nil {
+					return fmt.Errorf("%s: %w", g.Name, err)
+				}
+			}
+			if c.ModCache {
+				return downloadMods(ctx, c, c.modIDs()...)
+			}
+			return nil
+		})
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	for _, v := range servers {
+		v := v
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var res string
+			err := runWithPolicy(ctx, &pol, func(format string, a ...any) { logf(v.Name+": "+format, a...) }, func(ctx context.Context) error {
+				var err error
+				res, err = s.runServerStep(ctx, c, r, st, v)
+				return err
+			})
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", v.Name, err))
+			} else {
+				fmt.Printf("  %s: %s\n", v.Name, res)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// runServerStep runs a per server step.
+func (s *webServer) runServerStep(ctx context.Context, c *config, r *playbookRun, st *playbookStep, v *serverConfig) (string, error) {
+	switch st.Action {
+	case "broadcast", "rcon":
+		cmd := st.Command
+		if st.Action == "broadcast" {
+			cmd = "Broadcast " + st.Message
+		}
+		p, err := s.rconPoller(c, v)
+		if err != nil {
+			return "", err
+		}
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		resp, err := p.Execute(ctx, cmd)
+		return strings.TrimSpace(resp), err
+	case "backup":
+		id, err := s.backup(ctx, v)
+		if err != nil {
+			return "", err
+		}
+		r.addBackup(v.Name, id)
+		return "backed up to " + id, nil
+	case "start":
+		return "started", s.startLocked(ctx, v)
+	case "stop":
+		release, err := lockServers(ctx, c, "stop", v)
+		if err != nil {
+			return "", err
+		}
+		defer release()
+		s.recordStats(ctx, v, "before stop")
+		return "stopped", systemdctl.Stop(ctx, v.unitName())
+	case "restart":
+		w := time.Duration(st.Warning)
+		if w <= 0 {
+			w = 15 * time.Minute
+		}
+		return "restarted", s.gracefulRestart(ctx, v, w)
+	case "healthy":
+		t := time.Duration(st.Timeout)
+		if t <= 0 {
+			t = c.startTimeout()
+		}
+		if ok, err := systemdctl.Active(ctx, v.unitName()); err != nil {
+			return "", err
+		} else if !ok {
+			return "", errors.New("not running")
+		}
+		if !s.waitReady(ctx, v, t) {
+			return "", fmt.Errorf("not answering RCON after %s", t)
+		}
+		return "healthy", nil
+	}
+	return "", fmt.Errorf("unknown action %q", st.Action)
+}
+
+// rollback restores the backups taken by the run's backup steps, then starts
+// the servers again.
+func (s *webServer) rollback(ctx context.Context, r *playbookRun) error {
+	c := s.config()
+	r.mu.Lock()
+	backups := maps.Clone(r.backups)
+	r.mu.Unlock()
+	var errs []error
+	for name, id := range backups {
+		v := c.server(name)
+		if v == nil {
+			continue
+		}
+		err := func() error {
+			release, err := lockServers(ctx, c, "restore", v)
+			if err != nil {
+				return err
+			}
+			defer release()
+			if err := systemdctl.Stop(ctx, v.unitName()); err != nil {
+				return err
+			}
+			return c.backend().restore(c, v, id)
+		}()
+		if err == nil {
+			err = s.startLocked(ctx, v)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		} else {
+			fmt.Printf("  %s: restored %s\n", name, id)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,35 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+)
+
+// player is a player connected to a server.
+type player struct {
+	Name    string `json:"name"`
+	SteamID string `json:"steam_id"`
+	// Watched is set when the player is on the watchlist.
+	Watched bool `json:"watched,omitempty"`
+}
+
+// parseListPlayers parses the response to the ListPlayers RCON command:
+//
+//  0. Some Name, 76561198000000000
+//  1. Other, 76561198000000001
+func parseListPlayers(resp string) []player {
+	var out []player
+	for _, l := range strings.Split(resp, "\n") {
+		l = strings.TrimSpace(l)
+		i := strings.Index(l, ". ")
+		j := strings.LastIndex(l, ", ")
+		if i <= 0 || j <= i {
+			continue
+		}
+		out = append(out, player{Name: l[i+2 : j], SteamID: strings.TrimSpace(l[j+2:])})
+	}
+	return out
+}
@@ -0,0 +1,464 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Plugins are subprocesses extending ark-serman without forking it. They
+// speak JSON-RPC 1.0, as implemented by net/rpc/jsonrpc, on their stdin and
+// stdout and implement the "Plugin" service:
+//
+//   - Plugin.Describe(struct{}) pluginInfo: what the plugin contributes.
+//   - Plugin.Panel(pluginPanelArgs) pluginPanelReply: a dashboard panel.
+//   - Plugin.Notify(webhookPayload) struct{}: a notification channel
+//     receiving the events.
+//   - Plugin.RunTask(pluginTaskArgs) pluginTaskReply: a scheduled task type.
+//
+// The plugin's stderr is ark-serman's log. A plugin must exit when its stdin
+// is closed.
+
+// pluginConfig is a plugin to run.
+type pluginConfig struct {
+	// Name identifies the plugin in the URLs and the task names.
+	Name string `json:"name"`
+	// Command is the plugin's executable and its arguments.
+	Command []string `json:"command"`
+	// Events are the event kinds sent to the plugin when it is a notification
+	// channel. All the events are sent when empty.
+	Events []string `json:"events,omitempty"`
+	// Tasks schedules the task types provided by the plugin.
+	Tasks []pluginTask `json:"tasks,omitempty"`
+}
+
+// pluginTask is a daily run of a plugin's task type.
+type pluginTask struct {
+	// Type is the task type, one of the plugin's pluginInfo.Tasks.
+	Type string `json:"type"`
+	// At is the local time of the daily run, as "HH:MM".
+	At string `json:"at"`
+	// Servers are the servers passed to the task. All when empty.
+	Servers []string `json:"servers,omitempty"`
+	// Policy overrides step_policies' plugin policy.
+	Policy *stepPolicy `json:"policy,omitempty"`
+}
+
+// taskName returns the name of the scheduled task.
+func (t *pluginTask) taskName(p *pluginConfig) string {
+	return "plugin-" + p.Name + "-" + t.Type
+}
+
+// pluginInfo is the reply to Plugin.Describe.
+type pluginInfo struct {
+	// Panels are the dashboard panels, served at /plugins/<name>/<id>.
+	Panels []pluginPanel `json:"panels"`
+	// Notify is set when the plugin is a notification channel.
+	Notify bool `json:"notify"`
+	// Tasks are the task types the plugin runs.
+	Tasks []string `json:"tasks"`
+}
+
+type pluginPanel struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+}
+
+// pluginServer is what the plugins know about a server. The passwords aren't
+// shared.
+type pluginServer struct {
+	Name      string `json:"name"`
+	Game      string `json:"game"`
+	Map       string `json:"map"`
+	Port      int    `json:"port"`
+	QueryPort int    `json:"query_port"`
+	RCONPort  int    `json:"rcon_port,omitempty"`
+}
+
+type pluginPanelArgs struct {
+	Panel   string         `json:"panel"`
+	Servers []pluginServer `json:"servers"`
+}
+
+type pluginPanelReply struct {
+	// HTML is the panel's content. It is trusted, like the plugin.
+	HTML string `json:"html"`
+}
+
+type pluginTaskArgs struct {
+	Type    string         `json:"type"`
+	Servers []pluginServer `json:"servers"`
+}
+
+type pluginTaskReply struct {
+	Result string `json:"result"`
+}
+
+func toPluginServers(l []*serverConfig) []pluginServer {
+	out := make([]pluginServer, 0, len(l))
+	for _, v := range l {
+		p := pluginServer{Name: v.Name, Game: v.gameInfo().ID, Map: v.Map, Port: v.Port, QueryPort: v.QueryPort}
+		if v.gameInfo().RCON {
+			p.RCONPort = v.RCONPort
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// pluginProcess is a running plugin. It is started on the first call and
+// restarted on the next call after it died.
+type pluginProcess struct {
+	cfg pluginConfig
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	client *rpc.Client
+	info   *pluginInfo
+	err    error
+}
+
+// stdio is the plugin's end of the pipes.
+type stdio struct {
+	io.ReadCloser
+	w io.WriteCloser
+}
+
+func (s *stdio) Write(b []byte) (int, error) {
+	return s.w.Write(b)
+}
+
+func (s *stdio) Close() error {
+	return errors.Join(s.w.Close(), s.ReadCloser.Close())
+}
+
+// start starts the plugin and describes it. It must be called with mu held.
+func (p *pluginProcess) start(ctx context.Context) error {
+	// The plugin outlives the call that started it; it exits when its stdin
+	// is closed.
+	cmd := exec.Command(p.cfg.Command[0], p.cfg.Command[1:]...)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	p.cmd = cmd
+	p.client = jsonrpc.NewClient(&stdio{ReadCloser: out, w: in})
+	info := &pluginInfo{}
+	if err := p.callLocked(ctx, "Plugin.Describe", struct{}{}, info); err != nil {
+		return fmt.Errorf("describe: %w", err)
+	}
+	p.info = info
+	return nil
+}
+
+// stop kills the plugin. It must be called with mu held.
+func (p *pluginProcess) stop() {
+	if p.client != nil {
+		_ = p.client.Close()
+		p.client = nil
+	}
+	if p.cmd != nil {
+		_ = p.cmd.Process.Kill()
+		_ = p.cmd.Wait()
+		p.cmd = nil
+	}
+	p.info = nil
+}
+
+// callLocked calls the method. It must be called with mu held.
+func (p *pluginProcess) callLocked(ctx context.Context, method string, args, reply any) error {
+	c := p.client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-ctx.Done():
+		// The reply may never come; don't reuse the connection.
+		p.stop()
+		return ctx.Err()
+	case <-c.Done:
+	}
+	var serr rpc.ServerError
+	if c.Error != nil && !errors.As(c.Error, &serr) {
+		// The plugin died or wrote garbage.
+		p.stop()
+	}
+	return c.Error
+}
+
+// describe returns what the plugin contributes, starting it as needed.
+func (p *pluginProcess) describe(ctx context.Context) (*pluginInfo, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.info == nil {
+		if err := p.start(ctx); err != nil {
+			p.stop()
+			p.err = err
+			return nil, err
+		}
+		p.err = nil
+	}
+	return p.info, nil
+}
+
+// call calls the plugin's method, starting it as needed.
+func (p *pluginProcess) call(ctx context.Context, method string, args, reply any) error {
+	if _, err := p.describe(ctx); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client == nil {
+		return errors.New("the plugin stopped")
+	}
+	err := p.callLocked(ctx, method, args, reply)
+	if err != nil {
+		p.err = err
+	}
+	return err
+}
+
+// pluginManager holds the plugins' processes. The zero value is ready to use.
+type pluginManager struct {
+	mu    sync.Mutex
+	procs map[string]*pluginProcess
+}
+
+// set updates the plugins to the configuration, stopping the plugins removed
+// or changed.
+func (m *pluginManager) set(l []pluginConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old := m.procs
+	m.procs = make(map[string]*pluginProcess, len(l))
+	for _, cfg := range l {
+		if p := old[cfg.Name]; p != nil && slices.Equal(p.cfg.Command, cfg.Command) {
+			p.mu.Lock()
+			p.cfg = cfg
+			p.mu.Unlock()
+			m.procs[cfg.Name] = p
+			delete(old, cfg.Name)
+			continue
+		}
+		m.procs[cfg.Name] = &pluginProcess{cfg: cfg}
+	}
+	for _, p := range old {
+		p.mu.Lock()
+		p.stop()
+		p.mu.Unlock()
+	}
+}
+
+// get returns the plugin, or nil.
+func (m *pluginManager) get(name string) *pluginProcess {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.procs[name]
+}
+
+// notifyPlugins sends the event to the plugins that are notification
+// channels. Used as a bus consumer.
+func (s *webServer) notifyPlugins(ev event) {
+	c := s.config()
+	for i := range c.Plugins {
+		cfg := &c.Plugins[i]
+		if len(cfg.Events) != 0 && !slices.Contains(cfg.Events, ev.Kind) {
+			continue
+		}
+		p := s.plugins.get(cfg.Name)
+		if p == nil {
+			continue
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(s.ctx, 30*time.Second)
+			defer cancel()
+			info, err := p.describe(ctx)
+			if err != nil || !info.Notify {
+				return
+			}
+			pl := webhookPayload{event: ev, Server: strings.TrimSuffix(strings.TrimPrefix(ev.Unit, "ark-"), ".service")}
+			if err := p.call(ctx, "Plugin.Notify", pl, &struct{}{}); err != nil {
+				log.Printf("plugin %s: notify %s: %v", cfg.Name, ev.Kind, err)
+			}
+		}()
+	}
+}
+
+// pluginTaskByName returns the plugin and its task by the task's name.
+func (c *config) pluginTaskByName(name string) (*pluginConfig, *pluginTask) {
+	for i := range c.Plugins {
+		p := &c.Plugins[i]
+		for j := range p.Tasks {
+			if p.Tasks[j].taskName(p) == name {
+				return p, &p.Tasks[j]
+			}
+		}
+	}
+	return nil, nil
+}
+
+// runPluginTask runs the plugin's task once.
+func (s *webServer) runPluginTask(ctx context.Context, cfg *pluginConfig, t *pluginTask) error {
+	c := s.config()
+	p := s.plugins.get(cfg.Name)
+	if p == nil {
+		return fmt.Errorf("unknown plugin %q", cfg.Name)
+	}
+	info, err := p.describe(ctx)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(info.Tasks, t.Type) {
+		return fmt.Errorf("plugin %s doesn't provide the task %q", cfg.Name, t.Type)
+	}
+	servers, err := c.selectServers(t.Servers)
+	if err != nil {
+		return err
+	}
+	pol := c.stepPolicy("plugin", t.Policy)
+	taskLogf(ctx, "plugin %s: %s (%s)", cfg.Name, t.Type, pol.String())
+	logf := func(format string, a ...any) {
+		taskLogf(ctx, "plugin "+cfg.Name+": "+t.Type+": "+format, a...)
+	}
+	r := pluginTaskReply{}
+	err = runWithPolicy(ctx, &pol, logf, func(ctx context.Context) error {
+		return p.call(ctx, "Plugin.RunTask", pluginTaskArgs{Type: t.Type, Servers: toPluginServers(servers)}, &r)
+	})
+	if err != nil {
+		if pol.OnError == "notify" {
+			s.notifyStepFailed(ctx, event{Kind: evStepFailed, Msg: "task " + t.taskName(cfg) + " failed: " + err.Error()})
+		}
+		return err
+	}
+	taskLogf(ctx, "plugin %s: %s: %s", cfg.Name, t.Type, r.Result)
+	return nil
+}
+
+// runPluginTasks runs the plugins' tasks with the internal scheduler, like
+// rollingRestarts.
+func (s *webServer) runPluginTasks(ctx context.Context) {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		c := s.config()
+		if c.Scheduler == "systemd" {
+			continue
+		}
+		now := time.Now().In(c.location())
+		for _, st := range c.scheduledTasks() {
+			cfg, pt := c.pluginTaskByName(st.Name)
+			if cfg == nil {
+				continue
+			}
+			ok, err := s.claimDailyRun(st.Name, st.jobKey, st.at, now)
+			if err != nil {
+				log.Printf("%s: %v", st.Name, err)
+				continue
+			}
+			if !ok {
+				continue
+			}
+			name := st.Name
+			observeSchedulerLag(name, st.at, now)
+			go func() {
+				err := s.recordTaskRun(withLockOwner(ctx, "scheduler", true), name, func(ctx context.Context) error {
+					return s.runPluginTask(ctx, cfg, pt)
+				})
+				if err != nil {
+					log.Printf("%s: %v", name, err)
+				}
+			}()
+		}
+	}
+}
+
+// pluginStatus is a plugin's line on the plugins page.
+type pluginStatus struct {
+	Name string
+	Info *pluginInfo
+	Err  string
+}
+
+var (
+	pluginsTmpl = template.Must(template.ParseFS(rsc, "rsc/plugins.html.tmpl"))
+	panelTmpl   = template.Must(template.ParseFS(rsc, "rsc/panel.html.tmpl"))
+)
+
+// servePlugins lists the plugins and their panels at /plugins/ and serves the
+// panels at /plugins/<name>/<panel>.
+func (s *webServer) servePlugins(w http.ResponseWriter, r *http.Request) {
+	c := s.config()
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	w.Header().Add("Content-Type", "text/html")
+	rest := strings.TrimPrefix(r.URL.Path, "/plugins/")
+	if rest == "" {
+		l := make([]pluginStatus, 0, len(c.Plugins))
+		for i := range c.Plugins {
+			st := pluginStatus{Name: c.Plugins[i].Name}
+			if p := s.plugins.get(st.Name); p != nil {
+				var err error
+				if st.Info, err = p.describe(ctx); err != nil {
+					st.Err = err.Error()
+				}
+			}
+			l = append(l, st)
+		}
+		_ = pluginsTmpl.Execute(w, map[string]any{"Plugins": l})
+		return
+	}
+	name, panel, _ := strings.Cut(rest, "/")
+	p := s.plugins.get(name)
+	if p == nil {
+		http.Error(w, "unknown plugin", http.StatusNotFound)
+		return
+	}
+	data := map[string]any{"Plugin": name, "Title": panel}
+	info, err := p.describe(ctx)
+	if err == nil {
+		i := slices.IndexFunc(info.Panels, func(x pluginPanel) bool { return x.ID == panel })
+		if i == -1 {
+			http.Error(w, "unknown panel", http.StatusNotFound)
+			return
+		}
+		data["Title"] = info.Panels[i].Title
+		servers, _ := c.selectServers(nil)
+		reply := pluginPanelReply{}
+		if err = p.call(ctx, "Plugin.Panel", pluginPanelArgs{Panel: panel, Servers: toPluginServers(servers)}, &reply); err == nil {
+			data["HTML"] = template.HTML(reply.HTML)
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		data["Err"] = err.Error()
+	}
+	_ = panelTmpl.Execute(w, data)
+}
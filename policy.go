@@ -0,0 +1,175 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// stepActions are the actions of the automation steps with a policy: the
+// playbook actions and "plugin" for the plugins' scheduled tasks.
+var stepActions = []string{"broadcast", "rcon", "backup", "start", "stop", "restart", "healthy", "update", "wait", "plugin"}
+
+// stepPolicy is how an automation step is retried and what happens when it
+// still fails. The zero values are inherited.
+type stepPolicy struct {
+	// Retries is the number of retries after a failed attempt. Defaults to 0.
+	Retries *int `json:"retries,omitempty" yaml:"retries"`
+	// RetryDelay is the wait between the attempts. Defaults to 30 seconds.
+	RetryDelay duration `json:"retry_delay,omitempty" yaml:"retry_delay"`
+	// StepTimeout bounds each attempt. None by default.
+	StepTimeout duration `json:"step_timeout,omitempty" yaml:"step_timeout"`
+	// OnError is what happens once the attempts failed:
+	//   - stop or abort (the default): stops the sequence.
+	//   - continue: runs the next step.
+	//   - rollback: restores the servers' backups taken by the earlier backup
+	//     steps of the playbook, restarts them and stops. Only valid in the
+	//     playbooks.
+	//   - notify: publishes a step_failed event, e.g. to the webhooks, and
+	//     stops.
+	OnError string `json:"on_error,omitempty" yaml:"on_error"`
+}
+
+func (p *stepPolicy) String() string {
+	s := "retries=" + strconv.Itoa(p.retries()) + " retry_delay=" + time.Duration(p.RetryDelay).String()
+	if p.StepTimeout > 0 {
+		s += " step_timeout=" + time.Duration(p.StepTimeout).String()
+	}
+	return s + " on_error=" + p.OnError
+}
+
+func (p *stepPolicy) retries() int {
+	if p.Retries == nil {
+		return 0
+	}
+	return *p.Retries
+}
+
+// validate returns an error for the invalid values.
+func (p *stepPolicy) validate() error {
+	switch p.OnError {
+	case "", "stop", "abort", "continue", "rollback", "notify":
+	default:
+		return fmt.Errorf("invalid on_error %q", p.OnError)
+	}
+	if p.retries() < 0 || p.RetryDelay < 0 || p.StepTimeout < 0 {
+		return errors.New("retries, retry_delay and step_timeout can't be negative")
+	}
+	return nil
+}
+
+// stops returns true when the sequence stops after the step failed.
+func (p *stepPolicy) stops() bool {
+	return p.OnError != "continue"
+}
+
+// stepPolicy returns the action's policy: the defaults, overridden by
+// step_policies' "default" then the action's entry, then by each of the
+// overrides, e.g. the playbook's then the step's.
+func (c *config) stepPolicy(action string, overrides ...*stepPolicy) stepPolicy {
+	out := stepPolicy{RetryDelay: duration(30 * time.Second), OnError: "stop"}
+	l := []*stepPolicy{c.StepPolicies["default"], c.StepPolicies[action]}
+	for _, o := range append(l, overrides...) {
+		if o == nil {
+			continue
+		}
+		if o.Retries != nil {
+			out.Retries = o.Retries
+		}
+		if o.RetryDelay != 0 {
+			out.RetryDelay = o.RetryDelay
+		}
+		if o.StepTimeout != 0 {
+			out.StepTimeout = o.StepTimeout
+		}
+		if o.OnError != "" {
+			out.OnError = o.OnError
+		}
+	}
+	if out.OnError == "abort" {
+		out.OnError = "stop"
+	}
+	return out
+}
+
+// validateStepPolicies validates step_policies and the scheduled tasks'
+// policies.
+func (c *config) validateStepPolicies() error {
+	for k, p := range c.StepPolicies {
+		if k != "default" && !slices.Contains(stepActions, k) {
+			return fmt.Errorf("step_policies: unknown action %q", k)
+		}
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("step_policies: %s: %w", k, err)
+		}
+	}
+	if r := c.RollingRestart; r != nil && r.Policy != nil {
+		if err := r.Policy.validate(); err != nil {
+			return fmt.Errorf("rolling_restart: policy: %w", err)
+		}
+		if r.Policy.OnError == "rollback" {
+			return errors.New("rolling_restart: policy: rollback is only valid in the playbooks")
+		}
+	}
+	for _, p := range c.Plugins {
+		for _, t := range p.Tasks {
+			if t.Policy == nil {
+				continue
+			}
+			if err := t.Policy.validate(); err != nil {
+				return fmt.Errorf("plugin %q: task %q: policy: %w", p.Name, t.Type, err)
+			}
+			if t.Policy.OnError == "rollback" {
+				return fmt.Errorf("plugin %q: task %q: policy: rollback is only valid in the playbooks", p.Name, t.Type)
+			}
+		}
+	}
+	return nil
+}
+
+// notifyStepFailed publishes the evStepFailed event. Without a database, in
+// the commands like `schedule run`, nothing consumes the bus so the event is
+// delivered to the webhooks right away.
+func (s *webServer) notifyStepFailed(ctx context.Context, ev event) {
+	if s.db == nil {
+		s.notifyNow(ctx, ev)
+		return
+	}
+	bus.publish(ev)
+}
+
+// runWithPolicy runs f until it succeeds or the policy's retries are
+// exhausted, each attempt bounded by the policy's step timeout. logf logs
+// the failed attempts.
+func runWithPolicy(ctx context.Context, p *stepPolicy, logf func(string, ...any), f func(ctx context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		actx, cancel := ctx, context.CancelFunc(func() {})
+		if p.StepTimeout > 0 {
+			actx, cancel = context.WithTimeout(ctx, time.Duration(p.StepTimeout))
+		}
+		err := f(actx)
+		cancel()
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if errors.Is(err, context.DeadlineExceeded) && p.StepTimeout > 0 {
+			err = fmt.Errorf("timed out after %s: %w", time.Duration(p.StepTimeout), err)
+		}
+		if attempt >= p.retries() {
+			return err
+		}
+		logf("attempt %d/%d failed, retrying in %s: %v", attempt+1, p.retries()+1, time.Duration(p.RetryDelay), err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(p.RetryDelay)):
+		}
+	}
+}
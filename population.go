@@ -0,0 +1,90 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// populationRanges are the time ranges of the population series.
+var populationRanges = map[string]time.Duration{
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+}
+
+// populationPoint is a player count sample.
+type populationPoint struct {
+	Time    time.Time `json:"t"`
+	Players int       `json:"players"`
+}
+
+// population is the public player count series of a server.
+type population struct {
+	Server     string `json:"server"`
+	Range      string `json:"range"`
+	MaxPlayers int    `json:"max_players,omitempty"`
+	// Interval is the sampling interval; the samples are missing while the
+	// server is offline.
+	Interval string            `json:"interval"`
+	Points   []populationPoint `json:"points"`
+}
+
+// servePopulation serves the player count of the server over the last 24
+// hours or 7 days at /population/<unit>.json?range=7d, for the community
+// websites' graphs. It is public and only exposes the counts.
+func (s *webServer) servePopulation(w http.ResponseWriter, r *http.Request) {
+	unit, ok := strings.CutSuffix(path.Base(r.URL.Path), ".json")
+	c := s.config()
+	v := c.serverByUnit(unit)
+	if !ok || v == nil {
+		http.NotFound(w, r)
+		return
+	}
+	rng := r.URL.Query().Get("range")
+	if rng == "" {
+		rng = "24h"
+	}
+	d, ok := populationRanges[rng]
+	if !ok {
+		http.Error(w, "range must be 24h or 7d", http.StatusBadRequest)
+		return
+	}
+	out := population{Server: v.SessionName, Range: rng, MaxPlayers: v.MaxPlayers, Interval: perfSampleInterval.String(), Points: []populationPoint{}}
+	if out.Server == "" {
+		out.Server = v.Name
+	}
+	from := time.Now().Add(-d)
+	err := s.db.last(bucketMetrics, func(k, b []byte) bool {
+		t := keyTime(k)
+		if t.Before(from) {
+			return false
+		}
+		sm := metricsSample{}
+		if json.Unmarshal(b, &sm) != nil {
+			return true
+		}
+		if n, ok := sm.Players[v.Name]; ok {
+			out.Points = append(out.Points, populationPoint{Time: t.Truncate(time.Second), Players: n})
+		}
+		return true
+	})
+	if err != nil {
+		replyError(w, err.Error())
+		return
+	}
+	// Oldest first.
+	for i, j := 0, len(out.Points)-1; i < j; i, j = i+1, j-1 {
+		out.Points[i], out.Points[j] = out.Points[j], out.Points[i]
+	}
+	// Embeddable from any website; a new sample is only taken every
+	// perfSampleInterval.
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	replyJSON(w, out)
+}
@@ -0,0 +1,390 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// portMapper requests the game ports from the router when a server starts and
+// releases them when it stops.
+//
+// It is opt-in via the "port_forwarding" configuration setting: "upnp",
+// "natpmp" or "auto" to try UPnP first then NAT-PMP.
+type portMapper struct {
+	mu     sync.Mutex
+	mode   string
+	status map[string]string
+	cancel map[string]context.CancelFunc
+}
+
+func newPortMapper() *portMapper {
+	return &portMapper{status: map[string]string{}, cancel: map[string]context.CancelFunc{}}
+}
+
+// setMode changes the mapping method. Existing mappings are kept.
+func (p *portMapper) setMode(mode string) {
+	p.mu.Lock()
+	p.mode = mode
+	p.mu.Unlock()
+}
+
+// serverPorts returns the UDP ports players need to reach the server.
+func serverPorts(s *serverConfig) []int {
+	return []int{s.Port, s.Port + 1, s.QueryPort}
+}
+
+// statusOf returns a human readable mapping status for the unit.
+func (p *portMapper) statusOf(unit string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status[unit]
+}
+
+// dump logs the mapping status of each unit.
+func (p *portMapper) dump() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	log.Printf("  port forwarding mode=%q", p.mode)
+	for unit, s := range p.status {
+		log.Printf("    %s: %s", unit, s)
+	}
+}
+
+func (p *portMapper) setStatus(unit, s string) {
+	p.mu.Lock()
+	p.status[unit] = s
+	p.mu.Unlock()
+}
+
+// add maps the server ports in the background and keeps the NAT-PMP leases
+// alive until remove is called.
+func (p *portMapper) add(s *serverConfig) {
+	ctx, cancel := context.WithCancel(context.Background())
+	unit := s.unitName()
+	p.mu.Lock()
+	mode := p.mode
+	if mode == "" {
+		p.mu.Unlock()
+		cancel()
+		return
+	}
+	if c := p.cancel[unit]; c != nil {
+		c()
+	}
+	p.cancel[unit] = cancel
+	p.status[unit] = "mapping"
+	p.mu.Unlock()
+	ports := serverPorts(s)
+	go func() {
+		for {
+			m, err := mapPorts(ctx, mode, ports, natpmpLifetime, unit)
+			if err != nil {
+				log.Printf("portmap: %s: %v", unit, err)
+				p.setStatus(unit, "failed: "+err.Error())
+				return
+			}
+			p.setStatus(unit, fmt.Sprintf("mapped %v via %s", ports, m))
+			if m != "natpmp" {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(natpmpLifetime / 2):
+			}
+		}
+	}()
+}
+
+// remove releases the ports.
+func (p *portMapper) remove(s *serverConfig) {
+	unit := s.unitName()
+	p.mu.Lock()
+	mode := p.mode
+	c := p.cancel[unit]
+	delete(p.cancel, unit)
+	p.mu.Unlock()
+	if c == nil || mode == "" {
+		return
+	}
+	c()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := mapPorts(ctx, mode, serverPorts(s), 0, unit); err != nil {
+		log.Printf("portmap: %s: %v", unit, err)
+		p.setStatus(unit, "release failed: "+err.Error())
+		return
+	}
+	p.setStatus(unit, "released")
+}
+
+// mapPorts adds the mappings, or deletes them when lifetime is 0. It returns
+// the method used.
+func mapPorts(ctx context.Context, mode string, ports []int, lifetime time.Duration, desc string) (string, error) {
+	var errs []error
+	if mode == "upnp" || mode == "auto" {
+		u, err := discoverUPnP(ctx)
+		if err == nil {
+			for _, port := range ports {
+				if lifetime == 0 {
+					err = u.deletePortMapping(ctx, port)
+				} else {
+					err = u.addPortMapping(ctx, port, desc)
+				}
+				if err != nil {
+					break
+				}
+			}
+		}
+		if err == nil {
+			return "upnp", nil
+		}
+		errs = append(errs, fmt.Errorf("upnp: %w", err))
+	}
+	if mode == "natpmp" || mode == "auto" {
+		gw, err := defaultGateway()
+		if err == nil {
+			for _, port := range ports {
+				if err = natpmpMap(ctx, gw, port, lifetime); err != nil {
+					break
+				}
+			}
+		}
+		if err == nil {
+			return "natpmp", nil
+		}
+		errs = append(errs, fmt.Errorf("natpmp: %w", err))
+	}
+	return "", errors.Join(errs...)
+}
+
+// NAT-PMP (RFC 6886).
+
+const natpmpLifetime = time.Hour
+
+// defaultGateway returns the IPv4 default gateway from /proc/net/route.
+func defaultGateway() (net.IP, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+		// Little endian.
+		return net.IPv4(b[3], b[2], b[1], b[0]), nil
+	}
+	return nil, errors.New("no default gateway")
+}
+
+// natpmpMap maps the UDP port to the same external port.
+func natpmpMap(ctx context.Context, gw net.IP, port int, lifetime time.Duration) error {
+	d := net.Dialer{}
+	c, err := d.DialContext(ctx, "udp4", net.JoinHostPort(gw.String(), "5351"))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	req := make([]byte, 12)
+	// Version 0, opcode 1 (UDP).
+	req[1] = 1
+	binary.BigEndian.PutUint16(req[4:], uint16(port))
+	binary.BigEndian.PutUint16(req[6:], uint16(port))
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+	resp := make([]byte, 16)
+	// Retry with exponential backoff as recommended by the RFC.
+	for timeout := 250 * time.Millisecond; timeout < 4*time.Second; timeout *= 2 {
+		if _, err := c.Write(req); err != nil {
+			return err
+		}
+		_ = c.SetReadDeadline(time.Now().Add(timeout))
+		n, err := c.Read(resp)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+		if n < 16 || resp[1] != 128+1 {
+			return errors.New("invalid response")
+		}
+		if r := binary.BigEndian.Uint16(resp[2:]); r != 0 {
+			return fmt.Errorf("result code %d", r)
+		}
+		return nil
+	}
+	return errors.New("no response from gateway")
+}
+
+// UPnP IGD.
+
+type upnpClient struct {
+	controlURL  string
+	serviceType string
+	localIP     string
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+func (d *upnpDevice) find() *upnpService {
+	for i := range d.Services {
+		t := d.Services[i].ServiceType
+		if strings.Contains(t, ":WANIPConnection:") || strings.Contains(t, ":WANPPPConnection:") {
+			return &d.Services[i]
+		}
+	}
+	for i := range d.Devices {
+		if s := d.Devices[i].find(); s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+// discoverUPnP finds the Internet Gateway Device via SSDP.
+func discoverUPnP(ctx context.Context) (*upnpClient, error) {
+	c, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	dst := &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+	req := "M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\nMAN: \"ssdp:discover\"\r\nMX: 2\r\n\r\n"
+	if _, err := c.WriteTo([]byte(req), dst); err != nil {
+		return nil, err
+	}
+	_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := c.ReadFrom(buf)
+		if err != nil {
+			return nil, errors.New("no gateway found")
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		loc := resp.Header.Get("Location")
+		if loc == "" {
+			continue
+		}
+		u, err := newUPnPClient(ctx, loc, from)
+		if err == nil {
+			return u, nil
+		}
+	}
+}
+
+func newUPnPClient(ctx context.Context, loc string, from net.Addr) (*upnpClient, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", loc, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	root := struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}{}
+	if err := xml.NewDecoder(resp.Body).Decode(&root); err != nil {
+		return nil, err
+	}
+	s := root.Device.find()
+	if s == nil {
+		return nil, errors.New("no WAN connection service")
+	}
+	base := loc
+	if root.URLBase != "" {
+		base = root.URLBase
+	}
+	b, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	ctl, err := b.Parse(s.ControlURL)
+	if err != nil {
+		return nil, err
+	}
+	// Find which local IP routes to the gateway.
+	conn, err := net.Dial("udp4", from.String())
+	if err != nil {
+		return nil, err
+	}
+	local := conn.LocalAddr().(*net.UDPAddr).IP.String()
+	conn.Close()
+	return &upnpClient{controlURL: ctl.String(), serviceType: s.ServiceType, localIP: local}, nil
+}
+
+func (u *upnpClient) soap(ctx context.Context, action, args string) error {
+	body := `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` +
+		`<u:` + action + ` xmlns:u="` + u.serviceType + `">` + args + `</u:` + action + `></s:Body></s:Envelope>`
+	req, err := http.NewRequestWithContext(ctx, "POST", u.controlURL, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+u.serviceType+`#`+action+`"`)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s: %s: %s", action, resp.Status, b)
+	}
+	return nil
+}
+
+func (u *upnpClient) addPortMapping(ctx context.Context, port int, desc string) error {
+	d := bytes.Buffer{}
+	_ = xml.EscapeText(&d, []byte("ark-serman "+desc))
+	return u.soap(ctx, "AddPortMapping", fmt.Sprintf(
+		"<NewRemoteHost></NewRemoteHost><NewExternalPort>%d</NewExternalPort><NewProtocol>UDP</NewProtocol>"+
+			"<NewInternalPort>%d</NewInternalPort><NewInternalClient>%s</NewInternalClient><NewEnabled>1</NewEnabled>"+
+			"<NewPortMappingDescription>%s</NewPortMappingDescription><NewLeaseDuration>0</NewLeaseDuration>",
+		port, port, u.localIP, d.String()))
+}
+
+func (u *upnpClient) deletePortMapping(ctx context.Context, port int) error {
+	return u.soap(ctx, "DeletePortMapping", fmt.Sprintf(
+		"<NewRemoteHost></NewRemoteHost><NewExternalPort>%d</NewExternalPort><NewProtocol>UDP</NewProtocol>", port))
+}
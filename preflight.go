@@ -0,0 +1,280 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/maruel/subcommands"
+)
+
+// problem is an issue found by the preflight checks.
+type problem struct {
+	Path string
+	Msg  string
+	// fix repairs the problem, nil if it can't be fixed automatically.
+	fix func() error
+	// warn is set when the server may still start.
+	warn bool
+}
+
+func (p *problem) String() string {
+	return p.Path + ": " + p.Msg
+}
+
+// serviceOwner returns the uid and gid the server runs as. When run via sudo,
+// it is the invoking user.
+func serviceOwner() (int, int) {
+	uid, gid := os.Getuid(), os.Getgid()
+	if v, err := strconv.Atoi(os.Getenv("SUDO_UID")); err == nil {
+		uid = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("SUDO_GID")); err == nil {
+		gid = v
+	}
+	return uid, gid
+}
+
+// checkPath checks that the service user owns p and can write to it.
+func checkPath(p string, fi fs.FileInfo, uid, gid int) []problem {
+	var out []problem
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != uid {
+		out = append(out, problem{Path: p, Msg: fmt.Sprintf("owned by uid %d instead of %d", st.Uid, uid), fix: func() error { return os.Lchown(p, uid, gid) }})
+	}
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		return out
+	}
+	want := fi.Mode().Perm() | 0o600
+	if fi.IsDir() {
+		want |= 0o100
+	}
+	if want != fi.Mode().Perm() {
+		out = append(out, problem{Path: p, Msg: fmt.Sprintf("mode %s is missing user read/write", fi.Mode().Perm()), fix: func() error { return os.Chmod(p, want) }})
+	}
+	return out
+}
+
+// checkWritable returns a problem if the filesystem holding dir is read-only.
+func checkWritable(dir string) []problem {
+	f, err := os.CreateTemp(dir, ".ark-serman-")
+	if err != nil {
+		if errors.Is(err, syscall.EROFS) {
+			return []problem{{Path: dir, Msg: "the filesystem is read-only"}}
+		}
+		// Permission issues are reported by checkPath.
+		return nil
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
+// preflightChecks verifies the install directory and the server's save and
+// configuration directories before starting, restoring or updating a server.
+// Permission drift, e.g. after a manual rsync as another user, is a frequent
+// reason for a server failing to save.
+func preflightChecks(c *config, v *serverConfig) []problem {
+	uid, gid := serviceOwner()
+	var out []problem
+	root := c.installDir()
+	fi, err := os.Stat(root)
+	if err != nil {
+		return []problem{{Path: root, Msg: err.Error()}}
+	}
+	out = append(out, checkPath(root, fi, uid, gid)...)
+	for _, d := range []string{savedDir(c), v.saveDir(c), configDir(c)} {
+		err := filepath.Walk(d, func(p string, fi fs.FileInfo, err error) error {
+			if err != nil {
+				if p == d && errors.Is(err, fs.ErrNotExist) {
+					// Created by the server on first start.
+					return nil
+				}
+				out = append(out, problem{Path: p, Msg: err.Error()})
+				return nil
+			}
+			if p == savedDir(c) && d == savedDir(c) {
+				// Only the directory itself, its content is checked below.
+				out = append(out, checkPath(p, fi, uid, gid)...)
+				out = append(out, checkWritable(p)...)
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			out = append(out, checkPath(p, fi, uid, gid)...)
+			return nil
+		})
+		if err != nil {
+			out = append(out, problem{Path: d, Msg: err.Error()})
+		}
+	}
+	return out
+}
+
+// minNoFile is the open files limit below which the servers fail to load
+// their assets. The units ask for LimitNOFILE=1000000.
+const minNoFile = 100000
+
+// prereqChecks verifies the host's prerequisites for the server: the
+// executable and its loader, the open files limit, vm.max_map_count and the
+// available memory. The servers otherwise crash-loop with obscure errors.
+func prereqChecks(c *config, v *serverConfig) []problem {
+	var out []problem
+	bin := v.binary(c)
+	if f, err := elf.Open(bin); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = errors.New("missing, run `ark-serman apply` to install the server")
+		} else {
+			err = fmt.Errorf("isn't a valid executable, run `ark-serman apply` to reinstall the server: %w", err)
+		}
+		out = append(out, problem{Path: bin, Msg: err.Error()})
+	} else {
+		for _, p := range f.Progs {
+			if p.Type != elf.PT_INTERP {
+				continue
+			}
+			b, err := io.ReadAll(p.Open())
+			if err != nil {
+				break
+			}
+			interp := strings.TrimRight(string(b), "\x00")
+			if _, err := os.Stat(interp); err != nil {
+				msg := "requires the dynamic loader " + interp
+				if f.Class == elf.ELFCLASS32 {
+					msg += "; install the 32-bit libraries, e.g. `sudo apt install lib32gcc-s1 libc6-i386`"
+				}
+				out = append(out, problem{Path: bin, Msg: msg})
+			}
+		}
+		f.Close()
+	}
+	lim := syscall.Rlimit{}
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err == nil && lim.Max < hostNoFile {
+		out = append(out, problem{
+			Path: "ulimit -n",
+			Msg:  fmt.Sprintf("the hard limit of open files is %d; raise it with `sudo ark-serman install -host-limits`", lim.Max),
+			warn: lim.Max >= minNoFile,
+		})
+	}
+	if b, err := os.ReadFile("/proc/sys/vm/max_map_count"); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil && n < hostMaxMapCount {
+			out = append(out, problem{
+				Path: "vm.max_map_count",
+				Msg:  fmt.Sprintf("is %d; raise it with `sudo ark-serman install -host-limits`", n),
+				warn: true,
+			})
+		}
+	}
+	need := v.defaultMemory()
+	if avail := readMeminfo()["MemAvailable"]; avail != 0 && avail < need {
+		out = append(out, problem{
+			Path: "memory",
+			Msg:  fmt.Sprintf("%d MB available but %s needs about %d MB; stop another server or add swap", avail, v.Name, need),
+			warn: true,
+		})
+	}
+	return out
+}
+
+// preflight returns an error summarizing the problems found by
+// preflightChecks and prereqChecks. The warnings are only logged.
+func preflight(c *config, v *serverConfig) error {
+	var p []problem
+	for _, x := range append(preflightChecks(c, v), prereqChecks(c, v)...) {
+		if x.warn {
+			log.Printf("preflight %s: warning: %s", v.Name, x.String())
+		} else {
+			p = append(p, x)
+		}
+	}
+	if len(p) == 0 {
+		return nil
+	}
+	msgs := make([]string, 0, 3)
+	for i := 0; i < len(p) && i < cap(msgs); i++ {
+		msgs = append(msgs, p[i].String())
+	}
+	if len(p) > len(msgs) {
+		msgs = append(msgs, fmt.Sprintf("and %d more", len(p)-len(msgs)))
+	}
+	return fmt.Errorf("preflight failed, run `ark-serman check -fix %s`: %s", v.Name, strings.Join(msgs, "; "))
+}
+
+// preflightUnit runs the preflight checks on the unit if it is a configured
+// server.
+func preflightUnit(c *config, unit string) error {
+	if v := c.serverByUnit(unit); v != nil {
+		return preflight(c, v)
+	}
+	return nil
+}
+
+var cmdCheck = &subcommands.Command{
+	UsageLine: "check <options> <servers...>",
+	ShortDesc: "Checks the servers' prerequisites and files permissions",
+	LongDesc:  "Checks that the service user owns the install and Saved directories with the correct permissions and that the filesystem isn't read-only, then the host's prerequisites: the server executable and its dynamic loader, e.g. the 32-bit libraries of older builds, the open files limit, vm.max_map_count and the available memory versus the server's estimated requirement. The problems include the remediation steps; the warnings don't prevent starting the server.\n\nThe same checks run before starting a server from the web UI. With no server specified, all the servers are checked. Use -fix to chown and chmod the files; chown requires root, e.g. via sudo.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &checkRun{}
+		c.args.flags()
+		c.Flags.BoolVar(&c.fix, "fix", false, "fix the ownership and permissions")
+		return c
+	},
+}
+
+type checkRun struct {
+	args
+	fix bool
+}
+
+func (k *checkRun) Run(a subcommands.Application, args []string, env subcommands.Env) int {
+	c, err := loadConfig(k.configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	servers, err := c.selectServers(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	ret := 0
+	// The servers share the install and Saved directories.
+	seen := map[string]bool{}
+	for _, s := range servers {
+		for _, p := range append(preflightChecks(c, s), prereqChecks(c, s)...) {
+			key := p.String()
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if p.warn {
+				fmt.Printf("warning: %s\n", key)
+				continue
+			}
+			if !k.fix || p.fix == nil {
+				fmt.Printf("%s\n", key)
+				ret = 1
+				continue
+			}
+			if err := p.fix(); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+				ret = 1
+			} else if !k.quiet {
+				fmt.Printf("fixed %s\n", key)
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,158 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// retentionBuckets are the chronological buckets holding player data, purged
+// after the retention period. The other buckets holding player data, keyed by
+// player or user, are purged in purgeOld: bucketPlayers, bucketWatchlist and
+// bucketRCONHistory.
+var retentionBuckets = [][]byte{bucketEvents}
+
+// remoteAddr returns the client IP of the request as recorded in the access
+// and audit logs, anonymized per anonymize_ips.
+func (s *webServer) remoteAddr(remote string) string {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	switch s.config().AnonymizeIPs {
+	case "truncate":
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return host
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+	case "hash":
+		// Keyed so the hashes can't be reversed by enumerating the IPv4 space,
+		// yet the same client can be followed across requests.
+		m := hmac.New(sha256.New, s.sessionKey)
+		m.Write([]byte(host))
+		return "h:" + hex.EncodeToString(m.Sum(nil)[:8])
+	default:
+		return remote
+	}
+}
+
+// purgeBefore deletes the entries of a chronological bucket older than t.
+func (s *store) purgeBefore(bucket []byte, t time.Time) (int, error) {
+	n := 0
+	end := timeKey(t)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		// Deleting while iterating with a cursor skips entries.
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(keys)
+		return nil
+	})
+	return n, err
+}
+
+// purgeIf deletes the entries of a bucket for which old returns true.
+func (s *store) purgeIf(bucket []byte, old func(v []byte) bool) (int, error) {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		var keys [][]byte
+		_ = b.ForEach(func(k, v []byte) error {
+			if old(v) {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(keys)
+		return nil
+	})
+	return n, err
+}
+
+// purgeBefore removes the events older than t.
+func (e *eventLog) purgeBefore(t time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	i := 0
+	for i < len(e.events) && e.events[i].Time.Before(t) {
+		i++
+	}
+	e.events = append(e.events[:0], e.events[i:]...)
+}
+
+// purgeOld deletes the player data and the audit log older than their
+// retention period and the expired links every hour.
+func (s *webServer) purgeOld(ctx context.Context) {
+	for {
+		// The used links are only needed until they expire.
+		if _, err := s.db.purgeBefore(bucketLinks, time.Now()); err != nil {
+			log.Printf("links: %v", err)
+		}
+		if r := time.Duration(s.config().Retention); r > 0 {
+			before := time.Now().Add(-r)
+			events.purgeBefore(before)
+			for _, b := range retentionBuckets {
+				if n, err := s.db.purgeBefore(b, before); err != nil {
+					log.Printf("retention: %s: %v", b, err)
+				} else if n != 0 {
+					log.Printf("retention: purged %d entries from %s", n, b)
+				}
+			}
+			if n, err := s.db.purgePlayers(before); err != nil {
+				log.Printf("retention: players: %v", err)
+			} else if n != 0 {
+				log.Printf("retention: forgot %d players", n)
+			}
+			if n, err := s.db.purgeWatchlist(before); err != nil {
+				log.Printf("retention: watchlist: %v", err)
+			} else if n != 0 {
+				log.Printf("retention: removed %d players from the watchlist", n)
+			}
+			if n, err := s.db.purgeRCONHistory(before); err != nil {
+				log.Printf("retention: rcon history: %v", err)
+			} else if n != 0 {
+				log.Printf("retention: forgot %d console commands", n)
+			}
+		}
+		if r := time.Duration(s.config().AuditRetention); r > 0 {
+			if n, err := s.db.purgeBefore(bucketAudit, time.Now().Add(-r)); err != nil {
+				log.Printf("retention: audit: %v", err)
+			} else if n != 0 {
+				log.Printf("retention: purged %d entries from the audit log", n)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Hour):
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultPublicIPCheck is used when public_ip_check is not configured.
+const defaultPublicIPCheck = "https://api.ipify.org"
+
+// publicIP detects and caches the host's public IP address.
+type publicIP struct {
+	mu sync.Mutex
+	// static is used as is when set.
+	static string
+	// check is either a http(s):// URL returning the IP as plain text or a
+	// stun:host:port STUN server.
+	check   string
+	ip      string
+	updated time.Time
+}
+
+// set updates the settings, flushing the cache when they changed.
+func (p *publicIP) set(static, check string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.static != static || p.check != check {
+		p.static = static
+		p.check = check
+		p.updated = time.Time{}
+	}
+}
+
+// get returns the cached public IP, refreshing it every 10 minutes. It
+// returns an empty string if it cannot be determined.
+func (p *publicIP) get(ctx context.Context) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.static != "" {
+		return p.static
+	}
+	if time.Since(p.updated) < 10*time.Minute {
+		return p.ip
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	check := p.check
+	if check == "" {
+		check = defaultPublicIPCheck
+	}
+	var ip string
+	var err error
+	if strings.HasPrefix(check, "stun:") {
+		ip, err = stunPublicIP(ctx, strings.TrimPrefix(check, "stun:"))
+	} else {
+		ip, err = httpPublicIP(ctx, check)
+	}
+	if err != nil {
+		log.Printf("publicip: %v", err)
+	}
+	p.ip = ip
+	p.updated = time.Now()
+	return ip
+}
+
+func httpPublicIP(ctx context.Context, u string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(b)))
+	if ip == nil {
+		return "", fmt.Errorf("%s: unexpected response %q", u, b)
+	}
+	return ip.String(), nil
+}
+
+// stunPublicIP sends a RFC 5389 binding request and returns the mapped
+// address.
+func stunPublicIP(ctx context.Context, server string) (string, error) {
+	d := net.Dialer{}
+	c, err := d.DialContext(ctx, "udp4", server)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(dl)
+	}
+	req := make([]byte, 20)
+	binary.BigEndian.PutUint16(req[0:], 0x0001)
+	binary.BigEndian.PutUint32(req[4:], 0x2112A442)
+	if _, err := rand.Read(req[8:20]); err != nil {
+		return "", err
+	}
+	if _, err := c.Write(req); err != nil {
+		return "", err
+	}
+	resp := make([]byte, 1024)
+	n, err := c.Read(resp)
+	if err != nil {
+		return "", err
+	}
+	resp = resp[:n]
+	if n < 20 || binary.BigEndian.Uint16(resp) != 0x0101 || string(resp[8:20]) != string(req[8:20]) {
+		return "", errors.New("stun: invalid response")
+	}
+	for a := resp[20:]; len(a) >= 4; {
+		t := binary.BigEndian.Uint16(a)
+		l := int(binary.BigEndian.Uint16(a[2:]))
+		if len(a) < 4+l {
+			break
+		}
+		v := a[4 : 4+l]
+		// XOR-MAPPED-ADDRESS or MAPPED-ADDRESS, IPv4 only.
+		if (t == 0x0020 || t == 0x0001) && l >= 8 && v[1] == 1 {
+			ip := net.IP(append([]byte(nil), v[4:8]...))
+			if t == 0x0020 {
+				for i := range ip {
+					ip[i] ^= req[4+i]
+				}
+			}
+			return ip.String(), nil
+		}
+		a = a[4+(l+3)&^3:]
+	}
+	return "", errors.New("stun: no mapped address")
+}
+
+// connectInfo is the join information handed to players.
+type connectInfo struct {
+	// SteamURL is a steam://connect/ URL.
+	SteamURL string `json:"steam_url"`
+	// Console is the command to type in the in-game console.
+	Console string `json:"console"`
+}
+
+func newConnectInfo(ip string, s *serverConfig) connectInfo {
+	if ip == "" {
+		return connectInfo{}
+	}
+	return connectInfo{
+		SteamURL: "steam://connect/" + net.JoinHostPort(ip, strconv.Itoa(s.QueryPort)),
+		Console:  "open " + net.JoinHostPort(ip, strconv.Itoa(s.Port)),
+	}
+}
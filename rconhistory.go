@@ -0,0 +1,126 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// rconHistoryLen is the number of recent commands kept per user.
+const rconHistoryLen = 50
+
+// rconHistory is a user's web console commands, shared by the servers.
+type rconHistory struct {
+	// Recent are the last commands sent, most recent first, without
+	// duplicates.
+	Recent []string `json:"recent,omitempty"`
+	// Sent are when the Recent commands were sent, for the retention.
+	Sent []time.Time `json:"sent,omitempty"`
+	// Favorites are the starred commands, in the order they were starred.
+	Favorites []string `json:"favorites,omitempty"`
+}
+
+// rconHistory returns the user's commands.
+func (s *store) rconHistory(user string) (rconHistory, error) {
+	h := rconHistory{}
+	_, err := s.get(bucketRCONHistory, []byte(user), &h)
+	return h, err
+}
+
+// updateRCONHistory modifies the user's commands in one transaction, so
+// concurrent sessions don't lose commands.
+func (s *store) updateRCONHistory(user string, f func(h *rconHistory)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketRCONHistory)
+		h := rconHistory{}
+		if v := b.Get([]byte(user)); v != nil {
+			if err := json.Unmarshal(v, &h); err != nil {
+				return err
+			}
+		}
+		f(&h)
+		v, err := json.Marshal(&h)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(user), v)
+	})
+}
+
+// recordRCON adds the command at the top of the user's recent commands.
+func (s *store) recordRCON(user, cmd string) error {
+	return s.updateRCONHistory(user, func(h *rconHistory) {
+		// The commands recorded before Sent existed are considered old.
+		h.Sent = append(h.Sent, make([]time.Time, max(len(h.Recent)-len(h.Sent), 0))...)[:len(h.Recent)]
+		if i := slices.Index(h.Recent, cmd); i != -1 {
+			h.Recent = slices.Delete(h.Recent, i, i+1)
+			h.Sent = slices.Delete(h.Sent, i, i+1)
+		}
+		h.Recent = slices.Insert(h.Recent, 0, cmd)
+		h.Sent = slices.Insert(h.Sent, 0, time.Now().UTC())
+		if len(h.Recent) > rconHistoryLen {
+			h.Recent = h.Recent[:rconHistoryLen]
+			h.Sent = h.Sent[:rconHistoryLen]
+		}
+	})
+}
+
+// purgeRCONHistory forgets the commands sent before t, as they name the
+// players kicked or banned. The favorites are kept.
+func (s *store) purgeRCONHistory(t time.Time) (int, error) {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketRCONHistory)
+		updated := map[string]*rconHistory{}
+		err := b.ForEach(func(k, v []byte) error {
+			h := &rconHistory{}
+			if err := json.Unmarshal(v, h); err != nil {
+				return err
+			}
+			keep := 0
+			for keep < len(h.Recent) && keep < len(h.Sent) && !h.Sent[keep].Before(t) {
+				keep++
+			}
+			if keep != len(h.Recent) {
+				n += len(h.Recent) - keep
+				h.Recent, h.Sent = h.Recent[:keep], h.Sent[:keep]
+				updated[string(k)] = h
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, h := range updated {
+			if len(h.Recent) == 0 && len(h.Favorites) == 0 {
+				err = b.Delete([]byte(k))
+			} else {
+				var v []byte
+				if v, err = json.Marshal(h); err == nil {
+					err = b.Put([]byte(k), v)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+// starRCON adds or removes the command from the user's favorites.
+func (s *store) starRCON(user, cmd string, star bool) error {
+	return s.updateRCONHistory(user, func(h *rconHistory) {
+		h.Favorites = slices.DeleteFunc(h.Favorites, func(c string) bool { return c == cmd })
+		if star {
+			h.Favorites = append(h.Favorites, cmd)
+		}
+	})
+}
@@ -0,0 +1,56 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPurgeRCONHistory(t *testing.T) {
+	s, err := openStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	now := time.Now().UTC()
+	old := now.Add(-100 * 24 * time.Hour)
+	data := map[string]rconHistory{
+		"alice": {Recent: []string{"listplayers", "kickplayer 1", "banplayer 2"}, Sent: []time.Time{now, old, old}},
+		// Recorded before Sent existed.
+		"bob":   {Recent: []string{"saveworld"}},
+		"carol": {Recent: []string{"banplayer 3"}, Sent: []time.Time{old}, Favorites: []string{"saveworld"}},
+		"dave":  {Recent: []string{"destroywilddinos"}, Sent: []time.Time{now}},
+	}
+	for k, v := range data {
+		if err := s.put(bucketRCONHistory, []byte(k), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := s.purgeRCONHistory(now.Add(-30 * 24 * time.Hour))
+	if err != nil || n != 4 {
+		t.Fatalf("purged %d, %v", n, err)
+	}
+	want := map[string]rconHistory{
+		"alice": {Recent: []string{"listplayers"}, Sent: []time.Time{now}},
+		"bob":   {},
+		"carol": {Recent: []string{}, Sent: []time.Time{}, Favorites: []string{"saveworld"}},
+		"dave":  {Recent: []string{"destroywilddinos"}, Sent: []time.Time{now}},
+	}
+	for k, w := range want {
+		h, err := s.rconHistory(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(h.Recent) != len(w.Recent) || (len(w.Recent) != 0 && !reflect.DeepEqual(h.Recent, w.Recent)) || !reflect.DeepEqual(h.Favorites, w.Favorites) {
+			t.Errorf("%s: got %+v, want %+v", k, h, w)
+		}
+	}
+	// The store has no entry left for bob.
+	if ok, err := s.get(bucketRCONHistory, []byte("bob"), &rconHistory{}); ok || err != nil {
+		t.Errorf("bob: %t, %v", ok, err)
+	}
+}
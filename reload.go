@@ -0,0 +1,115 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/maruel/ark-serman/internal/rconpool"
+)
+
+// config returns the current configuration. It must not be modified.
+func (s *webServer) config() *config {
+	return s.cfg.Load()
+}
+
+// rconPoller returns the RCON poller for the server.
+func (s *webServer) rconPoller(c *config, v *serverConfig) (*rconpool.Poller, error) {
+	if c.AdminPassword == "" {
+		return nil, errors.New("admin_password is not configured")
+	}
+	if g := v.gameInfo(); !g.RCON {
+		return nil, fmt.Errorf("%s servers don't support RCON", g.Name)
+	}
+	return s.rcon.Get(v.Name, v.localAddr(v.RCONPort), c.AdminPassword), nil
+}
+
+// setConfig applies a new configuration to all the components without
+// restarting the web server.
+func (s *webServer) setConfig(c *config) {
+	if s.adminPwd != "" {
+		c.AdminPassword = s.adminPwd
+	}
+	s.cfg.Store(c)
+	s.ports.setMode(c.PortForwarding)
+	s.publicIP.set(c.PublicIP, c.PublicIPCheck)
+	s.plugins.set(c.Plugins)
+	s.rcon.Prune(func(name string) bool { return c.server(name) != nil })
+	for i := range c.Servers {
+		v := &c.Servers[i]
+		if p, err := s.rconPoller(c, v); err == nil {
+			p.Pin(v.gameInfo().ListPlayers, 30*time.Second)
+		}
+	}
+}
+
+// reload reloads the configuration file. On error, the current configuration
+// is kept.
+func (s *webServer) reload() {
+	c, err := loadConfig(s.configPath)
+	if err != nil {
+		log.Printf("reload: %v; keeping the current configuration", err)
+		return
+	}
+	s.setConfig(c)
+	log.Printf("reload: loaded %s", s.configPath)
+}
+
+// dumpState logs the internal state to help debug production issues.
+func (s *webServer) dumpState() {
+	c := s.config()
+	log.Printf("state: config %s with %d servers; %d goroutines", s.configPath, len(c.Servers), runtime.NumGoroutine())
+	s.mu.Lock()
+	log.Printf("  units as of %s:", s.lastStatesTime.Format(time.RFC3339))
+	for _, u := range s.lastStates {
+		log.Printf("    %s: %s/%s cpu=%gs mem=%gMiB players=%d", u.Name, u.ActiveState, u.SubState, u.CPU, u.Memory, len(u.Players))
+	}
+	s.mu.Unlock()
+	s.rcon.Dump()
+	s.ports.dump()
+}
+
+// handleSignals reloads the configuration on SIGHUP or when the file is
+// modified, and dumps the internal state on SIGUSR1.
+func (s *webServer) handleSignals(ctx context.Context) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP, syscall.SIGUSR1)
+	defer signal.Stop(sig)
+	mtime := func() time.Time {
+		if fi, err := os.Stat(s.configPath); err == nil {
+			return fi.ModTime()
+		}
+		return time.Time{}
+	}
+	last := mtime()
+	t := time.NewTicker(5 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case v := <-sig:
+			if v == syscall.SIGUSR1 {
+				s.dumpState()
+				continue
+			}
+			last = mtime()
+			s.reload()
+		case <-t.C:
+			if m := mtime(); !m.Equal(last) {
+				last = m
+				s.reload()
+			}
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maruel/ark-serman/internal/rconpool"
+)
+
+// rescueCommands are the RCON command templates of the teleport tools. The
+// stock teleport cheats move the admin calling them, so moving another player
+// over RCON requires a command provided by a server plugin. {player_id},
+// {target_id}, {x}, {y} and {z} are replaced.
+type rescueCommands struct {
+	// Teleport moves {player_id} to {x} {y} {z}.
+	Teleport string `json:"teleport,omitempty"`
+	// TeleportToPlayer moves {player_id} to {target_id}.
+	TeleportToPlayer string `json:"teleport_to_player,omitempty"`
+}
+
+var reNumber = regexp.MustCompile(`\d+`)
+
+// playerID returns the in-game player ID of the connected player, which the
+// admin commands take instead of the Steam ID.
+func playerID(ctx context.Context, p *rconpool.Poller, steamID string) (string, error) {
+	if _, err := strconv.ParseUint(steamID, 10, 64); err != nil {
+		return "", fmt.Errorf("invalid Steam ID %q", steamID)
+	}
+	resp, err := p.Execute(ctx, "GetPlayerIDForSteamID "+steamID)
+	if err != nil {
+		return "", err
+	}
+	if m := reNumber.FindAllString(resp, -1); len(m) != 0 {
+		return m[len(m)-1], nil
+	}
+	return "", fmt.Errorf("player %s not found: %s", steamID, strings.TrimSpace(resp))
+}
+
+// unstickMsg is sent to the player killed by "unstuck".
+const unstickMsg = "An admin killed your character to get it unstuck. Respawn from the menu; your body keeps your items."
+
+var rescueTmpl = template.Must(template.ParseFS(rsc, "rsc/rescue.html.tmpl"))
+
+// serveRescue serves the rescue tools at /rescue/<unit>. The actions are
+// POSTed to /rpc/rescue/<unit> to be recorded in the audit log.
+func (s *webServer) serveRescue(w http.ResponseWriter, r *http.Request) {
+	unit := path.Base(r.URL.Path)
+	c := s.config()
+	v := c.serverByUnit(unit)
+	if v == nil {
+		http.Error(w, "unknown server", http.StatusNotFound)
+		return
+	}
+	w.Header().Add("Content-Type", "text/html")
+	data := map[string]any{"Unit": unit, "Map": c.mapInfo(v.Map).Name, "Rescue": c.rescue()}
+	p, err := s.rconPoller(c, v)
+	if r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/rpc/rescue/") {
+		ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+		defer cancel()
+		var res string
+		if res, err = s.rescue(ctx, c, v, p, r); err == nil {
+			data["Result"] = res
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		data["Err"] = err.Error()
+	}
+	if p != nil {
+		if l, ok := p.Last(v.gameInfo().ListPlayers); ok && l.Err == nil {
+			data["Players"] = v.gameInfo().parsePlayers(l.Resp)
+		}
+	}
+	if data["Bookmarks"], err = s.db.bookmarks(v.Map); err != nil {
+		data["Err"] = err.Error()
+	}
+	_ = rescueTmpl.Execute(w, data)
+}
+
+// coords parses the x, y and z form values.
+func coords(r *http.Request) ([3]float64, error) {
+	var out [3]float64
+	for i, k := range []string{"x", "y", "z"} {
+		var err error
+		if out[i], err = strconv.ParseFloat(r.FormValue(k), 64); err != nil {
+			return out, fmt.Errorf("%s: expected a coordinate", k)
+		}
+	}
+	return out, nil
+}
+
+// rescue runs the action of the form and returns a description of the result.
+func (s *webServer) rescue(ctx context.Context, c *config, v *serverConfig, p *rconpool.Poller, r *http.Request) (string, error) {
+	op := r.FormValue("op")
+	setAuditDetail(ctx, op+" "+r.FormValue("player")+" "+r.FormValue("target")+" "+r.FormValue("bookmark"))
+	if p == nil {
+		return "", errors.New("admin_password is not configured")
+	}
+	id, err := playerID(ctx, p, r.FormValue("player"))
+	if err != nil {
+		return "", err
+	}
+	role := userFrom(ctx).Role
+	rescue := c.rescue()
+	var cmd string
+	switch op {
+	case "teleport":
+		if rescue.Teleport == "" {
+			return "", errors.New("rescue.teleport is not configured")
+		}
+		var xyz [3]float64
+		if name := r.FormValue("bookmark"); name != "" {
+			b := bookmark{Map: v.Map, Name: name}
+			if ok, err := s.db.get(bucketBookmarks, b.key(), &b); err != nil || !ok {
+				return "", fmt.Errorf("unknown bookmark %q", name)
+			}
+			xyz = [3]float64{b.X, b.Y, b.Z}
+		} else if xyz, err = coords(r); err != nil {
+			return "", err
+		}
+		cmd = strings.NewReplacer("{player_id}", id, "{x}", ftoa(xyz[0]), "{y}", ftoa(xyz[1]), "{z}", ftoa(xyz[2])).Replace(rescue.Teleport)
+	case "teleport_to_player":
+		if rescue.TeleportToPlayer == "" {
+			return "", errors.New("rescue.teleport_to_player is not configured")
+		}
+		target, err := playerID(ctx, p, r.FormValue("target"))
+		if err != nil {
+			return "", err
+		}
+		cmd = strings.NewReplacer("{player_id}", id, "{target_id}", target).Replace(rescue.TeleportToPlayer)
+	case "unstuck":
+		kill := "KillPlayer " + id
+		if err := c.rconAllowed(role, kill); err != nil {
+			return "", err
+		}
+		if _, err := p.Execute(ctx, kill); err != nil {
+			return "", err
+		}
+		cmd = "ServerChatTo \"" + r.FormValue("player") + "\" " + unstickMsg
+	default:
+		return "", fmt.Errorf("unknown operation %q", op)
+	}
+	if err := c.rconAllowed(role, cmd); err != nil {
+		return "", err
+	}
+	resp, err := p.Execute(ctx, cmd)
+	if err != nil {
+		return "", err
+	}
+	return op + ": " + strings.TrimSpace(resp), nil
+}
+
+// rescue returns Rescue or its zero value.
+func (c *config) rescue() rescueCommands {
+	if c.Rescue == nil {
+		return rescueCommands{}
+	}
+	return *c.Rescue
+}
+
+func ftoa(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,176 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parseCPUs parses a CPUAffinity= list, e.g. "0-3,6 8". It returns the CPUs
+// sorted; nil for an empty list.
+func parseCPUs(s string) ([]int, error) {
+	seen := map[int]bool{}
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		lo, hi, isRange := strings.Cut(f, "-")
+		a, err := strconv.Atoi(lo)
+		if err != nil || a < 0 {
+			return nil, fmt.Errorf("invalid CPU %q", f)
+		}
+		b := a
+		if isRange {
+			if b, err = strconv.Atoi(hi); err != nil || b < a {
+				return nil, fmt.Errorf("invalid CPU range %q", f)
+			}
+		}
+		for i := a; i <= b; i++ {
+			seen[i] = true
+		}
+	}
+	var out []int
+	for i := range seen {
+		out = append(out, i)
+	}
+	sort.Ints(out)
+	return out, nil
+}
+
+// resourcesDropIn returns the path of the drop-in setting the server's CPU
+// and I/O priorities and its memory limit, relative to the user unit directory.
+func (s *serverConfig) resourcesDropIn() string {
+	return filepath.Join(s.unitName()+".d", "ark-serman-resources.conf")
+}
+
+// generateResources returns the content of the server's resources drop-in,
+// or nil when the server uses the defaults.
+func generateResources(s *serverConfig) []byte {
+	if s.CPUAffinity == "" && s.Nice == 0 && s.IOSchedulingClass == "" && s.MemoryMax == "" && len(s.Tuning) == 0 {
+		return nil
+	}
+	b := bytes.Buffer{}
+	b.WriteString("# Generated by ark-serman. Do not edit, changes will be overwritten.\n[Service]\n")
+	if s.CPUAffinity != "" {
+		b.WriteString("CPUAffinity=" + s.CPUAffinity + "\n")
+	}
+	if s.Nice != 0 {
+		b.WriteString("Nice=" + strconv.Itoa(s.Nice) + "\n")
+	}
+	if s.IOSchedulingClass != "" {
+		b.WriteString("IOSchedulingClass=" + s.IOSchedulingClass + "\n")
+	}
+	if s.MemoryMax != "" {
+		b.WriteString("MemoryMax=" + s.MemoryMax + "\n")
+	}
+	if s.hasTuning("numa") {
+		n := strconv.Itoa(s.NUMANode)
+		b.WriteString("# numa preset: allocate on node " + n + " and run on its CPUs.\nNUMAPolicy=bind\nNUMAMask=" + n + "\nCPUAffinity=numa\n")
+	}
+	if s.hasTuning("hugepages") {
+		// Effective when /sys/kernel/mm/transparent_hugepage/enabled is
+		// "madvise" or "always".
+		b.WriteString("# hugepages preset: back the heap with transparent huge pages.\nEnvironment=GLIBC_TUNABLES=glibc.malloc.hugetlb=1\n")
+	}
+	return b.Bytes()
+}
+
+// writeResources writes or removes the server's resources drop-in in the
+// unit directory d. It returns true if the drop-in was written or removed.
+func writeResources(d string, s *serverConfig) (bool, error) {
+	p := filepath.Join(d, s.resourcesDropIn())
+	b := generateResources(s)
+	if b == nil {
+		err := os.Remove(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		// Only succeeds when no other drop-in is left.
+		_ = os.Remove(filepath.Dir(p))
+		return err == nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return false, err
+	}
+	return true, os.WriteFile(p, b, 0o644)
+}
+
+// cpuRow is a server's line in the CPU pinning grid.
+type cpuRow struct {
+	Server   string
+	Map      string
+	Nice     int
+	IOClass  string
+	Affinity string
+	Tuning   []string
+	// Pinned[i] is set when the server may run on CPU i; all of them when the
+	// server isn't pinned.
+	Pinned []bool
+	// Missing are the CPUs in Affinity this host doesn't have.
+	Missing []int
+}
+
+var cpusTmpl = template.Must(template.ParseFS(rsc, "rsc/cpus.html.tmpl"))
+
+// serveCPUs shows which CPUs each server is pinned to at /cpus/, so the
+// overlaps are visible on hosts running many maps, and how the tuned servers
+// performed before and after their tuning changed.
+func (s *webServer) serveCPUs(w http.ResponseWriter, r *http.Request) {
+	c := s.config()
+	loc := c.displayLocation(userFrom(r.Context()))
+	n := runtime.NumCPU()
+	rows := make([]cpuRow, 0, len(c.Servers))
+	// load is the number of servers pinned to each CPU.
+	load := make([]int, n)
+	var bench []tuningRow
+	hugepages := false
+	for i := range c.Servers {
+		v := &c.Servers[i]
+		row := cpuRow{Server: v.Name, Map: c.mapInfo(v.Map).Name, Nice: v.Nice, IOClass: v.IOSchedulingClass, Affinity: v.CPUAffinity, Tuning: v.Tuning, Pinned: make([]bool, n)}
+		cpus, _ := parseCPUs(v.CPUAffinity)
+		if len(cpus) == 0 {
+			for j := range row.Pinned {
+				row.Pinned[j] = true
+			}
+		}
+		for _, j := range cpus {
+			if j < n {
+				row.Pinned[j] = true
+				load[j]++
+			} else {
+				row.Missing = append(row.Missing, j)
+			}
+		}
+		rows = append(rows, row)
+		if len(v.Tuning) != 0 {
+			b := tuningRow{Server: v.Name, Tuning: v.Tuning}
+			var err error
+			if b.Changed, b.Before, b.After, err = s.tuningBenchmark(v); err != nil {
+				b.Err = err.Error()
+			}
+			b.Changed = b.Changed.In(loc)
+			bench = append(bench, b)
+			hugepages = hugepages || v.hasTuning("hugepages")
+		}
+	}
+	cpus := make([]int, n)
+	for i := range cpus {
+		cpus[i] = i
+	}
+	data := map[string]any{"CPUs": cpus, "Load": load, "Rows": rows, "Bench": bench}
+	if m := thpMode(); hugepages && m == "never" {
+		data["Err"] = "transparent huge pages are disabled on this host, the hugepages preset has no effect"
+	}
+	w.Header().Add("Content-Type", "text/html")
+	_ = cpusTmpl.Execute(w, data)
+}
@@ -0,0 +1,178 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// broadcast sends a message to all the players of the server. Errors are
+// ignored since the server may not be reachable.
+func (s *webServer) broadcast(ctx context.Context, v *serverConfig, msg string) {
+	if p, err := s.rconPoller(s.config(), v); err == nil {
+		_, _ = p.Execute(ctx, "Broadcast "+msg)
+	}
+}
+
+// gracefulRestart warns the players, saves the world and restarts the server.
+func (s *webServer) gracefulRestart(ctx context.Context, v *serverConfig, warning time.Duration) error {
+	release, err := lockServers(ctx, s.config(), "restart", v)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := preflight(s.config(), v); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.restarting == nil {
+		s.restarting = map[string]time.Time{}
+	}
+	s.restarting[v.unitName()] = time.Now().Add(warning)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.restarting, v.unitName())
+		s.mu.Unlock()
+	}()
+	sched := warningSchedule(warning)
+	for i, left := range sched {
+		taskLogf(ctx, "restart %s: warning the players, restart in %s", v.Name, left.Round(time.Second))
+		s.broadcast(ctx, v, fmt.Sprintf("Server restart in %s.", left.Round(time.Second)))
+		next := time.Duration(0)
+		if i+1 < len(sched) {
+			next = sched[i+1]
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(left - next):
+		}
+	}
+	taskLogf(ctx, "restart %s: saving the world", v.Name)
+	if d, err := s.saveWorld(ctx, v); err != nil {
+		taskLogf(ctx, "restart %s: SaveWorld: %v", v.Name, err)
+	} else {
+		taskLogf(ctx, "restart %s: saved in %s", v.Name, d)
+	}
+	taskLogf(ctx, "restart %s: restarting %s", v.Name, v.unitName())
+	return s.restartWithStats(ctx, v.unitName())
+}
+
+// warningSchedule returns the time left at each of the players' warnings
+// before a restart, more often as the restart gets closer.
+func warningSchedule(warning time.Duration) []time.Duration {
+	var out []time.Duration
+	for left := warning; left > 0; {
+		out = append(out, left)
+		next := left / 2
+		if left <= time.Minute {
+			next = 0
+		} else if next < time.Minute {
+			next = time.Minute
+		}
+		left = next
+	}
+	return out
+}
+
+// rollingCandidates returns, for each cluster, the running member using the
+// most memory.
+func rollingCandidates(c *config, states []unitStatus) []*serverConfig {
+	best := map[string]*unitStatus{}
+	for i := range states {
+		u := &states[i]
+		v := c.serverByUnit(u.Name)
+		if v == nil || v.ClusterID == "" || !u.Running {
+			continue
+		}
+		if b := best[v.ClusterID]; b == nil || u.Memory > b.Memory {
+			best[v.ClusterID] = u
+		}
+	}
+	var out []*serverConfig
+	for _, u := range best {
+		out = append(out, c.serverByUnit(u.Name))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// rollingRestarts restarts, once a day at the configured time, the member of
+// each cluster using the most memory. Only one server per cluster is
+// restarted per day so the cluster always stays available.
+func (s *webServer) rollingRestarts(ctx context.Context) {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		r := s.config().RollingRestart
+		if r == nil || s.config().Scheduler == "systemd" {
+			continue
+		}
+		now := time.Now().In(s.config().location())
+		ok, err := s.claimDailyRun("rolling restart", "rolling_restart", r.At, now)
+		if err != nil {
+			log.Printf("rolling restart: %v", err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		observeSchedulerLag("rolling-restart", r.At, now)
+		s.mu.Lock()
+		servers := rollingCandidates(s.config(), s.lastStates)
+		s.mu.Unlock()
+		go s.recordTaskRun(ctx, "rolling-restart", func(ctx context.Context) error {
+			return s.rollingRestart(ctx, servers, r.warning())
+		})
+	}
+}
+
+// rollingRestart gracefully restarts the servers concurrently, each with the
+// restart policy.
+func (s *webServer) rollingRestart(ctx context.Context, servers []*serverConfig, warning time.Duration) error {
+	c := s.config()
+	var over *stepPolicy
+	if r := c.RollingRestart; r != nil {
+		over = r.Policy
+	}
+	pol := c.stepPolicy("restart", over)
+	var wg sync.WaitGroup
+	errs := make([]error, len(servers))
+	for i, v := range servers {
+		i, v := i, v
+		taskLogf(ctx, "rolling restart: restarting %s in %s (%s)", v.Name, warning, pol.String())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logf := func(format string, a ...any) {
+				taskLogf(ctx, "rolling restart: "+v.Name+": "+format, a...)
+			}
+			err := runWithPolicy(ctx, &pol, logf, func(ctx context.Context) error {
+				return s.gracefulRestart(ctx, v, warning)
+			})
+			if err != nil {
+				logf("%v", err)
+				errs[i] = fmt.Errorf("%s: %w", v.Name, err)
+				if pol.OnError == "notify" {
+					s.notifyStepFailed(ctx, event{Unit: v.unitName(), Kind: evStepFailed, Msg: "rolling restart of " + v.Name + " failed: " + err.Error()})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
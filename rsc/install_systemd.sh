@@ -19,6 +19,7 @@ After=syslog.target network.target nss-lookup.target network-online.target
 
 [Service]
 ExecStart=%h/go/bin/ark-serman web
+ExecReload=/bin/kill -s HUP \$MAINPID
 ExecStop=/bin/kill -s INT \$MAINPID
 
 [Install]
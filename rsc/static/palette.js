@@ -0,0 +1,150 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// Command palette: Ctrl+K (or ⌘K) jumps to a page or a server and runs the
+// server actions by typing, e.g. "isl rest" for "island: restart".
+(() => {
+  "use strict";
+  const pages = [
+    ["Dashboard", "/"],
+    ["Crash reports", "/crashes/"],
+    ["Map bookmarks", "/bookmarks/"],
+    ["Watchlist", "/watchlist/"],
+    ["Pending changes", "/plan/"],
+    ["Settings", "/settings/"],
+    ["Reference", "/docs/"],
+    ["Compare configurations", "/compare/"],
+    ["Wild dino levels", "/difficulty/"],
+    ["Game.ini overrides", "/overrides/"],
+    ["Breeding calculator", "/breeding/"],
+    ["Mods", "/mods/"],
+    ["Saves", "/saves/"],
+    ["CPU pinning and tuning", "/cpus/"],
+    ["Capacity", "/capacity/"],
+    ["Plugins", "/plugins/"],
+    ["Announcements", "/announcements/"],
+    ["API", "/api/v1/"],
+  ];
+  const views = ["logs", "console", "rescue", "env", "files", "join"];
+  // The actions go through /rpc/bulk like the dashboard's selection.
+  const actions = ["start", "stop", "restart", "backup"];
+  const confirmed = new Set(["stop", "restart"]);
+
+  let commands = null;
+  const load = async () => {
+    const out = pages.map(([title, href]) => ({title, run: () => { location.href = href; }}));
+    try {
+      const resp = await fetch("/api/v1/servers", {cache: "no-store"});
+      for (const s of await resp.json()) {
+        for (const v of views) {
+          out.push({title: `${s.name}: ${v}`, run: () => { location.href = `/${v}/${s.unit}`; }});
+        }
+        for (const a of actions) {
+          if ((a === "start" && s.running) || ((a === "stop" || a === "restart") && !s.running)) {
+            continue;
+          }
+          out.push({title: `${s.name}: ${a}`, run: () => post(a, s, confirmed.has(a))});
+        }
+      }
+    } catch (e) {
+      console.log("palette:", e);
+    }
+    return out;
+  };
+
+  const post = (action, s, ask) => {
+    if (ask && !confirm(`${action} ${s.name}?`)) {
+      return;
+    }
+    const f = document.createElement("form");
+    f.method = "POST";
+    f.action = "/rpc/bulk";
+    for (const [k, v] of [["action", action], ["unit", s.unit]]) {
+      const i = document.createElement("input");
+      i.type = "hidden";
+      i.name = k;
+      i.value = v;
+      f.appendChild(i);
+    }
+    document.body.appendChild(f);
+    f.submit();
+  };
+
+  // match returns true if every word of the query is a subsequence of the
+  // title.
+  const match = (title, query) => {
+    title = title.toLowerCase();
+    return query.toLowerCase().split(/\s+/).every((w) => {
+      let i = 0;
+      for (const c of w) {
+        i = title.indexOf(c, i);
+        if (i === -1) {
+          return false;
+        }
+        i++;
+      }
+      return true;
+    });
+  };
+
+  const overlay = document.createElement("div");
+  overlay.style.cssText = "display: none; position: fixed; inset: 0; z-index: 1000; background: rgba(0, 0, 0, 0.3);";
+  overlay.innerHTML = `<div style="margin: 10vh auto; width: min(32em, 90vw); background: white; padding: 0.5em; box-shadow: 0 0 12px gray;">
+    <input type="search" placeholder="Go to a page or run an action" style="width: 100%; box-sizing: border-box; font-size: 1.2em;">
+    <ul style="list-style: none; margin: 0.5em 0 0; padding: 0; max-height: 60vh; overflow: auto;"></ul>
+  </div>`;
+  const input = overlay.querySelector("input");
+  const list = overlay.querySelector("ul");
+  let shown = [];
+  let sel = 0;
+
+  const render = () => {
+    shown = commands.filter((c) => match(c.title, input.value.trim())).slice(0, 50);
+    sel = Math.min(sel, Math.max(shown.length - 1, 0));
+    list.replaceChildren(...shown.map((c, i) => {
+      const li = document.createElement("li");
+      li.textContent = c.title;
+      li.style.cssText = "padding: 0.2em 0.4em; cursor: pointer;" + (i === sel ? " background: #dde8f3;" : "");
+      li.onmousedown = (e) => { e.preventDefault(); close(); c.run(); };
+      return li;
+    }));
+    list.children[sel]?.scrollIntoView({block: "nearest"});
+  };
+
+  const open = async () => {
+    overlay.style.display = "block";
+    input.value = "";
+    sel = 0;
+    input.focus();
+    commands = commands || await load();
+    render();
+  };
+  const close = () => { overlay.style.display = "none"; };
+
+  input.addEventListener("input", () => { sel = 0; render(); });
+  input.addEventListener("keydown", (e) => {
+    if (e.key === "ArrowDown" || e.key === "ArrowUp") {
+      e.preventDefault();
+      sel = (sel + (e.key === "ArrowDown" ? 1 : shown.length - 1)) % Math.max(shown.length, 1);
+      render();
+    } else if (e.key === "Enter" && shown[sel]) {
+      e.preventDefault();
+      close();
+      shown[sel].run();
+    } else if (e.key === "Escape") {
+      close();
+    }
+  });
+  input.addEventListener("blur", close);
+  document.addEventListener("keydown", (e) => {
+    if ((e.ctrlKey || e.metaKey) && e.key.toLowerCase() === "k") {
+      e.preventDefault();
+      open();
+    }
+  });
+  document.addEventListener("DOMContentLoaded", () => document.body.appendChild(overlay));
+  if (document.readyState !== "loading") {
+    document.body.appendChild(overlay);
+  }
+})();
@@ -0,0 +1,336 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// Terminal: a small VT100 emulator for the host shell at /terminal/. The keys
+// are sent as binary messages and the size as a text message {cols, rows}.
+(() => {
+  "use strict";
+  const el = document.getElementById("term");
+  const status = document.getElementById("status");
+  let cols = 80, rows = 24;
+  let grid, x, y, top, bottom, attr, saved, wrap, cursor;
+
+  const blank = () => ({c: " ", a: 0});
+  const line = () => Array.from({length: cols}, blank);
+  const reset = () => {
+    grid = Array.from({length: rows}, line);
+    x = 0; y = 0; top = 0; bottom = rows - 1; attr = 0; saved = [0, 0]; wrap = false; cursor = true;
+  };
+  const clamp = (v, lo, hi) => Math.min(Math.max(v, lo), hi);
+  const scrollUp = (n) => {
+    for (let i = 0; i < n; i++) {
+      grid.splice(top, 1);
+      grid.splice(bottom, 0, line());
+    }
+  };
+  const scrollDown = (n) => {
+    for (let i = 0; i < n; i++) {
+      grid.splice(bottom, 1);
+      grid.splice(top, 0, line());
+    }
+  };
+  const lineFeed = () => {
+    if (y === bottom) {
+      scrollUp(1);
+    } else if (y < rows - 1) {
+      y++;
+    }
+  };
+  const put = (ch) => {
+    if (wrap) {
+      x = 0;
+      lineFeed();
+      wrap = false;
+    }
+    grid[y][x] = {c: ch, a: attr};
+    if (x === cols - 1) {
+      wrap = true;
+    } else {
+      x++;
+    }
+  };
+  const erase = (row, from, to) => {
+    for (let i = from; i < to; i++) {
+      grid[row][i] = blank();
+    }
+  };
+
+  const csi = (priv, params, f) => {
+    const p = params.map((v) => parseInt(v, 10) || 0);
+    const n = Math.max(p[0] || 1, 1);
+    wrap = false;
+    switch (f) {
+      case "A": y = clamp(y - n, 0, rows - 1); break;
+      case "B": case "e": y = clamp(y + n, 0, rows - 1); break;
+      case "C": case "a": x = clamp(x + n, 0, cols - 1); break;
+      case "D": x = clamp(x - n, 0, cols - 1); break;
+      case "E": x = 0; y = clamp(y + n, 0, rows - 1); break;
+      case "F": x = 0; y = clamp(y - n, 0, rows - 1); break;
+      case "G": case "`": x = clamp(n - 1, 0, cols - 1); break;
+      case "d": y = clamp(n - 1, 0, rows - 1); break;
+      case "H": case "f":
+        y = clamp((p[0] || 1) - 1, 0, rows - 1);
+        x = clamp((p[1] || 1) - 1, 0, cols - 1);
+        break;
+      case "J":
+        if (p[0] === 0) {
+          erase(y, x, cols);
+          for (let i = y + 1; i < rows; i++) erase(i, 0, cols);
+        } else if (p[0] === 1) {
+          erase(y, 0, x + 1);
+          for (let i = 0; i < y; i++) erase(i, 0, cols);
+        } else {
+          for (let i = 0; i < rows; i++) erase(i, 0, cols);
+        }
+        break;
+      case "K":
+        if (p[0] === 0) erase(y, x, cols);
+        else if (p[0] === 1) erase(y, 0, x + 1);
+        else erase(y, 0, cols);
+        break;
+      case "X": erase(y, x, Math.min(x + n, cols)); break;
+      case "P":
+        grid[y].splice(x, n);
+        while (grid[y].length < cols) grid[y].push(blank());
+        break;
+      case "@":
+        for (let i = 0; i < n; i++) grid[y].splice(x, 0, blank());
+        grid[y].length = cols;
+        break;
+      case "L": case "M":
+        if (y >= top && y <= bottom) {
+          const t = top;
+          top = y;
+          if (f === "L") scrollDown(n); else scrollUp(n);
+          top = t;
+        }
+        break;
+      case "S": scrollUp(n); break;
+      case "T": scrollDown(n); break;
+      case "r":
+        top = clamp((p[0] || 1) - 1, 0, rows - 1);
+        bottom = clamp((p[1] || rows) - 1, top, rows - 1);
+        x = 0; y = 0;
+        break;
+      case "s": saved = [x, y]; break;
+      case "u": [x, y] = saved; break;
+      case "m":
+        if (p.length === 0) p.push(0);
+        for (const v of p) {
+          if (v === 0) attr = 0;
+          else if (v === 1) attr |= 2;
+          else if (v === 7) attr |= 1;
+          else if (v === 22) attr &= ~2;
+          else if (v === 27) attr &= ~1;
+        }
+        break;
+      case "h": case "l":
+        if (priv === "?") {
+          for (const v of p) {
+            if (v === 25) {
+              cursor = f === "h";
+            } else if (v === 1049 || v === 47 || v === 1047) {
+              // No separate alternate screen; start from a clean one.
+              for (let i = 0; i < rows; i++) erase(i, 0, cols);
+            }
+          }
+        }
+        break;
+      case "n":
+        if (p[0] === 6) send(`\x1b[${y + 1};${x + 1}R`);
+        else if (p[0] === 5) send("\x1b[0n");
+        break;
+      case "c":
+        if (priv === "") send("\x1b[?1;2c");
+        break;
+    }
+  };
+
+  // The parser state: text, escape, CSI, OSC or a charset designation.
+  let state = "text", priv = "", params = [""], osc = "";
+  const feed = (s) => {
+    for (const ch of s) {
+      switch (state) {
+        case "text":
+          switch (ch) {
+            case "\x1b": state = "esc"; break;
+            case "\r": x = 0; wrap = false; break;
+            case "\n": case "\v": case "\f": lineFeed(); wrap = false; break;
+            case "\b": x = Math.max(x - 1, 0); wrap = false; break;
+            case "\t": x = Math.min((x >> 3) * 8 + 8, cols - 1); break;
+            case "\x07": break;
+            default:
+              if (ch >= " ") put(ch);
+          }
+          break;
+        case "esc":
+          state = "text";
+          switch (ch) {
+            case "[": state = "csi"; priv = ""; params = [""]; break;
+            case "]": state = "osc"; osc = ""; break;
+            case "(": case ")": case "*": case "+": state = "charset"; break;
+            case "7": saved = [x, y]; break;
+            case "8": [x, y] = saved; break;
+            case "D": lineFeed(); break;
+            case "E": x = 0; lineFeed(); break;
+            case "M":
+              if (y === top) scrollDown(1); else if (y > 0) y--;
+              break;
+            case "c": reset(); break;
+          }
+          break;
+        case "csi":
+          if (ch >= "0" && ch <= "9") {
+            params[params.length - 1] += ch;
+          } else if (ch === ";") {
+            params.push("");
+          } else if (ch === "?" || ch === ">" || ch === "=") {
+            priv = ch;
+          } else if (ch >= "@" && ch <= "~") {
+            csi(priv, params[0] === "" && params.length === 1 ? [] : params, ch);
+            state = "text";
+          }
+          break;
+        case "osc":
+          // The window title and the like are ignored.
+          if (ch === "\x07") {
+            state = "text";
+          } else if (ch === "\x1b") {
+            state = "oscesc";
+          } else if (osc.length < 1024) {
+            osc += ch;
+          }
+          break;
+        case "oscesc":
+          state = "text";
+          break;
+        case "charset":
+          state = "text";
+          break;
+      }
+    }
+    schedule();
+  };
+
+  const esc = (c) => c.replace(/[&<>]/g, (m) => ({"&": "&amp;", "<": "&lt;", ">": "&gt;"}[m]));
+  let pending = false;
+  const render = () => {
+    pending = false;
+    const out = [];
+    for (let r = 0; r < rows; r++) {
+      let s = "", run = "", a = -1;
+      const flush = () => {
+        if (run === "") return;
+        const cls = (a & 1 ? "i" : "") + (a & 2 ? " b" : "");
+        s += cls ? `<span class="${cls.trim()}">${esc(run)}</span>` : esc(run);
+        run = "";
+      };
+      for (let c = 0; c < cols; c++) {
+        let v = grid[r][c].a;
+        if (cursor && r === y && c === x) v ^= 1;
+        if (v !== a) {
+          flush();
+          a = v;
+        }
+        run += grid[r][c].c;
+      }
+      flush();
+      out.push(s);
+    }
+    el.innerHTML = out.join("\n");
+  };
+  const schedule = () => {
+    if (!pending) {
+      pending = true;
+      requestAnimationFrame(render);
+    }
+  };
+
+  const ws = new WebSocket(`${location.protocol === "https:" ? "wss" : "ws"}://${location.host}/terminal/ws?ticket=${encodeURIComponent(el.dataset.ticket)}`);
+  ws.binaryType = "arraybuffer";
+  const encoder = new TextEncoder();
+  const decoder = new TextDecoder();
+  const send = (s) => {
+    if (ws.readyState === WebSocket.OPEN) ws.send(encoder.encode(s));
+  };
+
+  const fit = () => {
+    // Measure one character to derive the grid size from the element.
+    const probe = document.createElement("span");
+    probe.textContent = "0".repeat(10);
+    el.appendChild(probe);
+    const w = probe.getBoundingClientRect().width / 10;
+    const h = probe.getBoundingClientRect().height;
+    probe.remove();
+    const c = Math.max(Math.floor((el.clientWidth - 8) / w), 20);
+    const r = Math.max(Math.floor((el.clientHeight - 8) / h), 5);
+    if (c === cols && r === rows) return;
+    const old = grid;
+    cols = c;
+    rows = r;
+    grid = Array.from({length: rows}, (_, i) => {
+      const l = line();
+      const src = old[i + Math.max(old.length - rows, 0)];
+      if (src) {
+        for (let j = 0; j < Math.min(cols, src.length); j++) l[j] = src[j];
+      }
+      return l;
+    });
+    y = clamp(y - Math.max(old.length - rows, 0), 0, rows - 1);
+    x = clamp(x, 0, cols - 1);
+    top = 0;
+    bottom = rows - 1;
+    if (ws.readyState === WebSocket.OPEN) ws.send(JSON.stringify({cols, rows}));
+    schedule();
+  };
+
+  reset();
+  render();
+  ws.onopen = () => {
+    status.textContent = "Connected.";
+    // Force sending the size.
+    cols = 0;
+    fit();
+    el.focus();
+  };
+  ws.onmessage = (e) => feed(decoder.decode(e.data, {stream: true}));
+  ws.onclose = () => {
+    status.textContent = "Disconnected. Reload the page and enter a new code to reconnect.";
+    cursor = false;
+    schedule();
+  };
+  window.addEventListener("resize", fit);
+
+  const keys = {
+    Enter: "\r", Backspace: "\x7f", Tab: "\t", Escape: "\x1b",
+    ArrowUp: "\x1b[A", ArrowDown: "\x1b[B", ArrowRight: "\x1b[C", ArrowLeft: "\x1b[D",
+    Home: "\x1b[H", End: "\x1b[F", Insert: "\x1b[2~", Delete: "\x1b[3~",
+    PageUp: "\x1b[5~", PageDown: "\x1b[6~",
+    F1: "\x1bOP", F2: "\x1bOQ", F3: "\x1bOR", F4: "\x1bOS",
+  };
+  el.addEventListener("keydown", (e) => {
+    if (e.metaKey) {
+      // Leave ⌘ to the browser.
+      return;
+    }
+    let s = keys[e.key];
+    if (e.ctrlKey && e.key.length === 1) {
+      const c = e.key.toUpperCase().charCodeAt(0);
+      if (c >= 64 && c <= 95) s = String.fromCharCode(c - 64);
+      else if (e.key === " ") s = "\0";
+    } else if (!s && e.key.length === 1) {
+      s = e.key;
+    }
+    if (s === undefined) return;
+    if (e.altKey) s = "\x1b" + s;
+    // Ctrl+K goes to the shell, not to the command palette.
+    e.preventDefault();
+    e.stopPropagation();
+    send(s);
+  });
+  el.addEventListener("paste", (e) => {
+    e.preventDefault();
+    send(e.clipboardData.getData("text").replace(/\r?\n/g, "\r"));
+  });
+})();
@@ -0,0 +1,389 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maruel/subcommands"
+)
+
+// The world saves slow down as the .ark file and the player profiles grow.
+// The sizes are sampled periodically to show the trend, and the profiles of
+// the players who left can be archived like the official servers do.
+
+// saveSizes are the sizes of a server's save files, in bytes.
+type saveSizes struct {
+	Ark      int64 `json:"ark"`
+	Profiles int64 `json:"profiles"`
+	// ProfileCount is the number of .arkprofile files.
+	ProfileCount int   `json:"profile_count"`
+	Tribes       int64 `json:"tribes"`
+}
+
+// metricsSample is an entry of bucketMetrics. The save sizes and the
+// performance are sampled separately so only one of them is set.
+type metricsSample struct {
+	// Saves is keyed by server name.
+	Saves map[string]saveSizes `json:"saves,omitempty"`
+	// Perf is keyed by server name.
+	Perf map[string]perfStat `json:"perf,omitempty"`
+	// Players is the number of players online, keyed by server name.
+	Players map[string]int `json:"players,omitempty"`
+}
+
+const (
+	// saveSampleInterval is how often the save sizes are sampled.
+	saveSampleInterval = 6 * time.Hour
+	// saveSampleKeep is how long the samples are kept.
+	saveSampleKeep = 400 * 24 * time.Hour
+)
+
+// measureSaves returns the sizes of the server's save files.
+func measureSaves(c *config, v *serverConfig) (saveSizes, error) {
+	out := saveSizes{}
+	entries, err := os.ReadDir(v.saveDir(c))
+	if errors.Is(err, fs.ErrNotExist) {
+		return out, nil
+	}
+	if err != nil {
+		return out, err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		switch n := e.Name(); {
+		case n == v.Map+".ark":
+			out.Ark = fi.Size()
+		case strings.HasSuffix(n, ".arkprofile"):
+			out.Profiles += fi.Size()
+			out.ProfileCount++
+		case strings.HasSuffix(n, ".arktribe"):
+			out.Tribes += fi.Size()
+		}
+	}
+	return out, nil
+}
+
+// sampleSaves records the save sizes of all the servers every
+// saveSampleInterval and forgets the samples older than saveSampleKeep.
+func (s *webServer) sampleSaves(ctx context.Context) {
+	for {
+		c := s.config()
+		sm := metricsSample{Saves: map[string]saveSizes{}}
+		for i := range c.Servers {
+			v := &c.Servers[i]
+			z, err := measureSaves(c, v)
+			if err != nil {
+				log.Printf("saves %s: %v", v.Name, err)
+				continue
+			}
+			sm.Saves[v.Name] = z
+		}
+		if err := s.db.appendTime(bucketMetrics, time.Now(), sm); err != nil {
+			log.Printf("saves: %v", err)
+		}
+		if _, err := s.db.purgeBefore(bucketMetrics, time.Now().Add(-saveSampleKeep)); err != nil {
+			log.Printf("saves: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(saveSampleInterval):
+		}
+	}
+}
+
+// saveTrend is the growth of a server's save files.
+type saveTrend struct {
+	Server string
+	Now    saveSizes
+	// Week and Month are the growth of the .ark file and the profiles over
+	// the last 7 and 30 days, or nil when there isn't enough history.
+	Week, Month *saveSizes
+}
+
+// saveTrends returns the current save sizes and, when db isn't nil, their
+// growth from the samples.
+func saveTrends(c *config, db *store) ([]saveTrend, error) {
+	out := make([]saveTrend, 0, len(c.Servers))
+	for i := range c.Servers {
+		v := &c.Servers[i]
+		z, err := measureSaves(c, v)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, saveTrend{Server: v.Name, Now: z})
+	}
+	if db == nil {
+		return out, nil
+	}
+	now := time.Now()
+	week, month := now.AddDate(0, 0, -7), now.AddDate(0, 0, -30)
+	err := db.last(bucketMetrics, func(k, b []byte) bool {
+		t := keyTime(k)
+		sm := metricsSample{}
+		if json.Unmarshal(b, &sm) != nil || sm.Saves == nil {
+			return true
+		}
+		for i := range out {
+			old, ok := sm.Saves[out[i].Server]
+			if !ok {
+				continue
+			}
+			d := out[i].Now.sub(old)
+			// The samples are visited newest first, so the last one visited
+			// before the limit wins.
+			if !t.After(week) && out[i].Week == nil {
+				out[i].Week = &d
+			}
+			if !t.After(month) && out[i].Month == nil {
+				out[i].Month = &d
+			}
+		}
+		return t.After(month)
+	})
+	return out, err
+}
+
+func (z saveSizes) sub(o saveSizes) saveSizes {
+	return saveSizes{Ark: z.Ark - o.Ark, Profiles: z.Profiles - o.Profiles, ProfileCount: z.ProfileCount - o.ProfileCount, Tribes: z.Tribes - o.Tribes}
+}
+
+// staleProfile is the profile of a player not seen in a while.
+type staleProfile struct {
+	Path     string
+	SteamID  string
+	LastSeen time.Time
+	Size     int64
+}
+
+// staleProfiles returns the profiles of the players not seen since before.
+// The last time the game wrote the profile is used, or the last join recorded
+// in db when more recent; db may be nil.
+func staleProfiles(c *config, v *serverConfig, db *store, before time.Time) ([]staleProfile, error) {
+	d := v.saveDir(c)
+	entries, err := os.ReadDir(d)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []staleProfile
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".arkprofile")
+		if !ok || e.IsDir() {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		p := staleProfile{Path: filepath.Join(d, e.Name()), SteamID: id, LastSeen: fi.ModTime(), Size: fi.Size()}
+		if db != nil {
+			r := playerRecord{}
+			if found, err := db.get(bucketPlayers, []byte(id), &r); err == nil && found && r.LastSeen.After(p.LastSeen) {
+				p.LastSeen = r.LastSeen
+			}
+		}
+		if p.LastSeen.Before(before) {
+			out = append(out, p)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LastSeen.Before(out[j].LastSeen) })
+	return out, nil
+}
+
+// profileArchiveDir returns the directory holding the server's archived
+// profiles. It is outside the save directory so it isn't backed up with it.
+func profileArchiveDir(c *config, v *serverConfig) string {
+	return filepath.Join(savedDir(c), ".ark-serman-profiles", v.Name)
+}
+
+// archiveProfiles moves the profiles of the players not seen in days to the
+// archive directory. Moving a profile back restores the player's character.
+func archiveProfiles(ctx context.Context, c *config, v *serverConfig, db *store, days int) ([]staleProfile, error) {
+	if days <= 0 {
+		return nil, errors.New("the number of days must be positive")
+	}
+	// The servers sharing the save directory share the profiles.
+	var shared []*serverConfig
+	for i := range c.Servers {
+		if c.Servers[i].saveDir(c) == v.saveDir(c) {
+			shared = append(shared, &c.Servers[i])
+		}
+	}
+	release, err := lockServers(ctx, c, "profile archive", shared...)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	l, err := staleProfiles(c, v, db, time.Now().AddDate(0, 0, -days))
+	if err != nil || len(l) == 0 {
+		return nil, err
+	}
+	d := filepath.Join(profileArchiveDir(c, v), time.Now().Format(snapshotTimeFormat))
+	if err := os.MkdirAll(d, 0o755); err != nil {
+		return nil, err
+	}
+	for i, p := range l {
+		if err := os.Rename(p.Path, filepath.Join(d, filepath.Base(p.Path))); err != nil {
+			return l[:i], err
+		}
+	}
+	return l, nil
+}
+
+// formatSize formats a size in bytes as MiB, with a sign for the growth.
+func formatSize(b int64, sign bool) string {
+	s := strconv.FormatFloat(round(float64(b)/(1<<20), 1), 'f', -1, 64) + " MiB"
+	if sign && b >= 0 {
+		s = "+" + s
+	}
+	return s
+}
+
+var savesTmpl = template.Must(template.New("saves.html.tmpl").Funcs(template.FuncMap{"size": formatSize}).ParseFS(rsc, "rsc/saves.html.tmpl"))
+
+// serveSaves shows the growth of the save files at /saves/. Archiving the
+// stale profiles is POSTed to /rpc/saves to be recorded in the audit log.
+func (s *webServer) serveSaves(w http.ResponseWriter, r *http.Request) {
+	data := map[string]any{}
+	if r.Method == "POST" && r.URL.Path == "/rpc/saves" {
+		res, err := s.archiveProfiles(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			data["Err"] = err.Error()
+		} else {
+			data["Result"] = res
+		}
+	}
+	l, err := saveTrends(s.config(), s.db)
+	if err != nil {
+		data["Err"] = err.Error()
+	}
+	data["Trends"] = l
+	start := time.Now().AddDate(0, 0, -7)
+	ts, st, err := s.db.saveTimes(start)
+	if err != nil {
+		data["Err"] = err.Error()
+	}
+	if len(st) != 0 {
+		data["SaveChart"] = saveTimeChart(start, ts, st, s.config().saveThreshold())
+	}
+	last := map[string]saveTime{}
+	for _, t := range st {
+		last[t.Server] = t
+	}
+	data["LastSave"] = last
+	data["Monitored"] = s.config().SaveMonitor != nil
+	data["Admin"] = userFrom(r.Context()).hasRole(roleAdmin)
+	w.Header().Add("Content-Type", "text/html")
+	_ = savesTmpl.Execute(w, data)
+}
+
+// archiveProfiles archives the stale profiles of the server. Only admins can.
+func (s *webServer) archiveProfiles(r *http.Request) (string, error) {
+	if !userFrom(r.Context()).hasRole(roleAdmin) {
+		return "", errors.New("only admins can archive the profiles")
+	}
+	name := r.FormValue("server")
+	days, err := strconv.Atoi(r.FormValue("days"))
+	if err != nil {
+		return "", errors.New("invalid number of days")
+	}
+	setAuditDetail(r.Context(), fmt.Sprintf("%s: not seen in %d days", name, days))
+	c := s.config()
+	v := c.server(name)
+	if v == nil {
+		return "", errors.New("unknown server")
+	}
+	l, err := archiveProfiles(r.Context(), c, v, s.db, days)
+	return fmt.Sprintf("%s: archived %d profiles to %s", name, len(l), profileArchiveDir(c, v)), err
+}
+
+var cmdSaves = &subcommands.Command{
+	UsageLine: "saves <options> <trend|stale|archive> <servers...>",
+	ShortDesc: "Shows the save files' growth and archives the stale profiles",
+	LongDesc:  "Large saves slow down the world saves.\n\n`saves trend` prints the size of the .ark file and of the player profiles; ark-serman web samples them every 6 hours and shows their growth.\n\n`saves stale` lists the profiles of the players not seen in -days and `saves archive` moves them out of the save directory, like the official servers do. A player whose profile was archived starts over with a new character unless the file is moved back.\n\nWith no server specified, all the servers are processed.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &savesRun{}
+		c.args.flags()
+		c.Flags.IntVar(&c.days, "days", 90, "profiles of the players not seen in this many days are stale")
+		c.Flags.BoolVar(&c.wait, "wait", false, "wait for the servers busy with another operation instead of failing")
+		return c
+	},
+}
+
+type savesRun struct {
+	args
+	days int
+	wait bool
+}
+
+func (r *savesRun) Run(a subcommands.Application, args []string, env subcommands.Env) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "%s: Expected one of trend, stale or archive.\n", a.GetName())
+		return 1
+	}
+	c, err := loadConfig(r.configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	servers, err := c.selectServers(args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	ctx := withCLIOwner(context.Background(), r.wait)
+	for _, v := range servers {
+		switch args[0] {
+		case "trend":
+			var z saveSizes
+			if z, err = measureSaves(c, v); err == nil {
+				fmt.Printf("%s: ark %s, %d profiles %s, tribes %s\n", v.Name, formatSize(z.Ark, false), z.ProfileCount, formatSize(z.Profiles, false), formatSize(z.Tribes, false))
+			}
+		case "stale":
+			var l []staleProfile
+			l, err = staleProfiles(c, v, nil, time.Now().AddDate(0, 0, -r.days))
+			for _, p := range l {
+				fmt.Printf("%s: %s last seen %s\n", v.Name, p.SteamID, p.LastSeen.Format("2006-01-02"))
+			}
+		case "archive":
+			var l []staleProfile
+			l, err = archiveProfiles(ctx, c, v, nil, r.days)
+			if len(l) != 0 {
+				fmt.Printf("%s: archived %d profiles to %s\n", v.Name, len(l), profileArchiveDir(c, v))
+			}
+		default:
+			err = fmt.Errorf("unknown command %q", args[0])
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+			return 1
+		}
+	}
+	return 0
+}
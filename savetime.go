@@ -0,0 +1,194 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// saveTime is a world save duration, an entry of bucketSaveTimes.
+type saveTime struct {
+	Server string `json:"server"`
+	// Duration is the SaveWorld RCON round trip; the command replies once
+	// the world is written.
+	Duration time.Duration `json:"duration"`
+	// Confirmed is set when the game log reported the save.
+	Confirmed bool `json:"confirmed"`
+}
+
+const (
+	// saveTimeKeep is how long the save durations are kept.
+	saveTimeKeep = 90 * 24 * time.Hour
+	// saveConfirmTimeout is how long the game log is watched for the save.
+	saveConfirmTimeout = 10 * time.Second
+)
+
+// reSaveDone matches the game log line written once the world is saved.
+var reSaveDone = regexp.MustCompile(`(?i)world save(d| complete)`)
+
+// saveWorld saves the world, records how long it took and publishes
+// evSlowSave when it took longer than save_monitor.threshold.
+func (s *webServer) saveWorld(ctx context.Context, v *serverConfig) (time.Duration, error) {
+	c := s.config()
+	p, err := s.rconPoller(c, v)
+	if err != nil {
+		return 0, err
+	}
+	// Only the lines written after the command are considered.
+	var off int64
+	if fi, err := os.Stat(gameLogPath(c)); err == nil {
+		off = fi.Size()
+	}
+	ctx2, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	start := time.Now()
+	_, err = p.Execute(ctx2, v.gameInfo().SaveWorld)
+	cancel()
+	st := saveTime{Server: v.Name, Duration: roundDuration(time.Since(start))}
+	if err != nil {
+		return 0, err
+	}
+	st.Confirmed = waitLogLine(ctx, gameLogPath(c), off, reSaveDone, saveConfirmTimeout)
+	if s.db != nil {
+		if err := s.db.appendTime(bucketSaveTimes, start, st); err != nil {
+			log.Printf("save %s: %v", v.Name, err)
+		}
+	}
+	if t := c.saveThreshold(); st.Duration > t {
+		bus.publish(event{Unit: v.unitName(), Kind: evSlowSave, Msg: fmt.Sprintf("%s took %s to save the world, more than %s", v.Name, st.Duration, t)})
+	}
+	return st.Duration, nil
+}
+
+// waitLogLine returns true once a line matching re is appended to the file
+// after the offset off, or false after timeout.
+func waitLogLine(ctx context.Context, p string, off int64, re *regexp.Regexp, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		if f, err := os.Open(p); err == nil {
+			b, err := io.ReadAll(io.NewSectionReader(f, off, 1<<20))
+			f.Close()
+			if err == nil && re.Match(b) {
+				return true
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+// monitorSaves times SaveWorld on the running idle servers every
+// save_monitor.interval until ctx is canceled.
+func (s *webServer) monitorSaves(ctx context.Context) {
+	for {
+		c := s.config()
+		wait := time.Hour
+		if m := c.SaveMonitor; m != nil {
+			if m.Interval > 0 {
+				wait = time.Duration(m.Interval)
+			}
+			s.mu.Lock()
+			running := map[string]bool{}
+			for _, u := range s.lastStates {
+				running[u.Name] = u.Running
+			}
+			s.mu.Unlock()
+			for i := range c.Servers {
+				v := &c.Servers[i]
+				// Don't interfere with a restart or a backup in progress.
+				if !running[v.unitName()] || serverLock(c, v) != nil {
+					continue
+				}
+				if _, err := s.saveWorld(ctx, v); err != nil {
+					log.Printf("save %s: %v", v.Name, err)
+				}
+			}
+			if _, err := s.db.purgeBefore(bucketSaveTimes, time.Now().Add(-saveTimeKeep)); err != nil {
+				log.Printf("save: %v", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// saveTimes returns the world save durations since t, oldest first.
+func (s *store) saveTimes(t time.Time) ([]time.Time, []saveTime, error) {
+	var ts []time.Time
+	var out []saveTime
+	err := s.last(bucketSaveTimes, func(k, v []byte) bool {
+		kt := keyTime(k)
+		if kt.Before(t) {
+			return false
+		}
+		st := saveTime{}
+		if json.Unmarshal(v, &st) == nil {
+			ts = append(ts, kt)
+			out = append(out, st)
+		}
+		return true
+	})
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		ts[i], ts[j] = ts[j], ts[i]
+		out[i], out[j] = out[j], out[i]
+	}
+	return ts, out, err
+}
+
+// chartColors are the colors of the servers' lines.
+var chartColors = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd", "#8c564b"}
+
+// saveTimeChart renders the save durations since start as a SVG line chart,
+// one line per server, with the threshold as a dashed line.
+func saveTimeChart(start time.Time, ts []time.Time, l []saveTime, threshold time.Duration) template.HTML {
+	const w, h = 600, 150
+	maxD := threshold
+	byServer := map[string][]int{}
+	for i := range l {
+		byServer[l[i].Server] = append(byServer[l[i].Server], i)
+		maxD = max(maxD, l[i].Duration)
+	}
+	maxD = maxD * 11 / 10
+	span := time.Since(start)
+	x := func(t time.Time) float64 { return float64(t.Sub(start)) / float64(span) * w }
+	y := func(d time.Duration) float64 { return h - float64(d)/float64(maxD)*h }
+	names := make([]string, 0, len(byServer))
+	for n := range byServer {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	b := strings.Builder{}
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="%d" height="%d" style="border:1px solid #ccc">`, w, h+20, w, h+20)
+	fmt.Fprintf(&b, `<line x1="0" y1="%.1f" x2="%d" y2="%.1f" stroke="red" stroke-dasharray="4"/>`, y(threshold), w, y(threshold))
+	fmt.Fprintf(&b, `<text x="2" y="%.1f" font-size="10" fill="red">%s</text>`, y(threshold)-2, threshold)
+	for i, n := range names {
+		color := chartColors[i%len(chartColors)]
+		pts := make([]string, 0, len(byServer[n]))
+		for _, j := range byServer[n] {
+			pts = append(pts, fmt.Sprintf("%.1f,%.1f", x(ts[j]), y(l[j].Duration)))
+			fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="2" fill="%s"><title>%s %s</title></circle>`, x(ts[j]), y(l[j].Duration), color, ts[j].Format(time.DateTime), l[j].Duration)
+		}
+		fmt.Fprintf(&b, `<polyline fill="none" stroke="%s" points="%s"/>`, color, strings.Join(pts, " "))
+		fmt.Fprintf(&b, `<text x="%d" y="%d" font-size="10" fill="%s">%s</text>`, 2+i*100, h+15, color, template.HTMLEscapeString(n))
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
@@ -0,0 +1,428 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/maruel/subcommands"
+
+	"github.com/maruel/ark-serman/internal/metrics"
+	"github.com/maruel/ark-serman/internal/rconpool"
+	"github.com/maruel/ark-serman/internal/systemdctl"
+)
+
+// scheduledTask is a periodic task. With "scheduler": "systemd", it runs as
+// a systemd timer calling `ark-serman schedule run <name>` instead of in
+// ark-serman web.
+type scheduledTask struct {
+	// Name identifies the task, e.g. "rolling-restart".
+	Name string
+	// OnCalendar is when the task runs, as a systemd calendar event.
+	OnCalendar string
+	// at is the time of the daily run in the configured time zone, as "HH:MM".
+	at string
+	// jobKey is the bucketJobs key recording the last internal run.
+	jobKey string
+}
+
+func (t *scheduledTask) timerName() string {
+	return "ark-serman-" + t.Name + ".timer"
+}
+
+func (t *scheduledTask) serviceName() string {
+	return "ark-serman-" + t.Name + ".service"
+}
+
+// scheduledTasks returns the periodic tasks enabled in the configuration.
+func (c *config) scheduledTasks() []scheduledTask {
+	var out []scheduledTask
+	if r := c.RollingRestart; r != nil {
+		out = append(out, scheduledTask{Name: "rolling-restart", OnCalendar: c.onCalendar(r.At), at: r.At, jobKey: "rolling_restart"})
+	}
+	for i := range c.Plugins {
+		p := &c.Plugins[i]
+		for j := range p.Tasks {
+			t := &p.Tasks[j]
+			out = append(out, scheduledTask{Name: t.taskName(p), OnCalendar: c.onCalendar(t.At), at: t.At, jobKey: "plugin_" + p.Name + "_" + t.Type})
+		}
+	}
+	return out
+}
+
+// validClock returns an error unless at is a time of the day as a zero
+// padded "HH:MM", e.g. "04:00", so it compares as a string with the clock.
+func validClock(at string) error {
+	if _, err := time.Parse("15:04", at); err != nil || len(at) != 5 {
+		return fmt.Errorf("invalid at %q, expected HH:MM, e.g. 04:00", at)
+	}
+	return nil
+}
+
+// schedulerCatchUp is how late the internal scheduler still starts a daily
+// task, e.g. after ark-serman itself was restarted. Past it, the day's run is
+// skipped rather than restarting the servers with the players online.
+const schedulerCatchUp = 15 * time.Minute
+
+// claimDailyRun returns true when the daily task at "HH:MM" must start at
+// now, in the configured time zone, and records the day's run in bucketJobs
+// under key, so restarting ark-serman doesn't run it twice.
+//
+// A task seen for the first time, e.g. just enabled, only runs at its next
+// time.
+func (s *webServer) claimDailyRun(name, key, at string, now time.Time) (bool, error) {
+	h, m := 0, 0
+	if _, err := fmt.Sscanf(at, "%d:%d", &h, &m); err != nil {
+		return false, err
+	}
+	// A time skipped by DST is normalized to right after; a repeated one
+	// runs once.
+	sched := time.Date(now.Year(), now.Month(), now.Day(), h, m, 0, 0, now.Location())
+	today := now.Format("2006-01-02")
+	var last string
+	ok, err := s.db.get(bucketJobs, []byte(key), &last)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		last = today
+		if now.Before(sched) {
+			last = now.AddDate(0, 0, -1).Format("2006-01-02")
+		}
+		return false, s.db.put(bucketJobs, []byte(key), last)
+	}
+	if now.Before(sched) || last == today {
+		return false, nil
+	}
+	if err := s.db.put(bucketJobs, []byte(key), today); err != nil {
+		return false, err
+	}
+	if late := now.Sub(sched); late >= schedulerCatchUp {
+		log.Printf("%s: skipping today's run at %s, %s late", name, at, late.Round(time.Minute))
+		return false, nil
+	}
+	return true, nil
+}
+
+var metSchedulerLag = metrics.NewGauge("ark_serman_scheduler_lag_seconds", "Delay between the scheduled time of the internal scheduler's last run of the task and its start.", "task")
+
+// observeSchedulerLag records the lag of the task's run starting at now,
+// scheduled at "HH:MM" today in now's time zone.
+func observeSchedulerLag(task, at string, now time.Time) {
+	t, err := time.ParseInLocation("2006-01-02 15:04", now.Format("2006-01-02 ")+at, now.Location())
+	if err == nil {
+		metSchedulerLag.Set(now.Sub(t).Seconds(), task)
+	}
+}
+
+// onCalendar returns the systemd calendar event of a daily task at "HH:MM" in
+// the configured time zone.
+func (c *config) onCalendar(at string) string {
+	if c.Timezone != "" {
+		return "*-*-* " + at + ":00 " + c.Timezone
+	}
+	return "*-*-* " + at + ":00"
+}
+
+// runTask runs the task once.
+func (s *webServer) runTask(ctx context.Context, name string) error {
+	c := s.config()
+	switch name {
+	case "rolling-restart":
+		r := c.RollingRestart
+		if r == nil {
+			return errors.New("rolling_restart isn't configured")
+		}
+		states, err := getUnitStates(ctx, c)
+		if err != nil {
+			return err
+		}
+		return s.rollingRestart(ctx, rollingCandidates(c, states), r.warning())
+	}
+	if p, t := c.pluginTaskByName(name); p != nil {
+		return s.runPluginTask(ctx, p, t)
+	}
+	return fmt.Errorf("unknown task %q", name)
+}
+
+var taskUnitTmpl = template.Must(template.New("").Parse(`# Generated by ark-serman. Do not edit, changes will be overwritten.
+[Unit]
+Description=ark-serman: {{.Task.Name}}
+
+[Service]
+Type=oneshot
+ExecStart={{.ExecStart}}
+# A rolling restart waits for the players' warning.
+TimeoutStartSec=infinity
+`))
+
+var taskTimerTmpl = template.Must(template.New("").Parse(`# Generated by ark-serman. Do not edit, changes will be overwritten.
+[Unit]
+Description=ark-serman: {{.Task.Name}} timer
+
+[Timer]
+OnCalendar={{.Task.OnCalendar}}
+# Catch up on the runs missed while the host was off.
+Persistent=true
+
+[Install]
+WantedBy=timers.target
+`))
+
+// generateTaskUnits returns the service and the timer units of the task.
+func generateTaskUnits(exe, configPath string, t *scheduledTask) ([]byte, []byte, error) {
+	cmd := []string{systemdQuote(exe), "schedule", "-config", systemdQuote(configPath), "run", t.Name}
+	data := map[string]any{"Task": t, "ExecStart": strings.Join(cmd, " ")}
+	var svc, timer bytes.Buffer
+	if err := taskUnitTmpl.Execute(&svc, data); err != nil {
+		return nil, nil, err
+	}
+	err := taskTimerTmpl.Execute(&timer, data)
+	return svc.Bytes(), timer.Bytes(), err
+}
+
+// installTimers writes and enables the timers of the scheduled tasks, and
+// removes the timers of the tasks no longer scheduled. All the timers are
+// removed with the internal scheduler.
+func installTimers(ctx context.Context, c *config, configPath string, logf func(string, ...any)) error {
+	d, err := userUnitDir()
+	if err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if configPath, err = filepath.Abs(configPath); err != nil {
+		return err
+	}
+	var tasks []scheduledTask
+	if c.Scheduler == "systemd" {
+		tasks = c.scheduledTasks()
+	}
+	conn, err := systemdctl.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	keep := map[string]bool{}
+	if len(tasks) != 0 {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			return err
+		}
+	}
+	for i := range tasks {
+		t := &tasks[i]
+		svc, timer, err := generateTaskUnits(exe, configPath, t)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(d, t.serviceName()), svc, 0o644); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(d, t.timerName()), timer, 0o644); err != nil {
+			return err
+		}
+		keep[t.timerName()] = true
+		logf("Wrote %s", t.timerName())
+	}
+	old, _ := filepath.Glob(filepath.Join(d, "ark-serman-*.timer"))
+	for _, p := range old {
+		name := filepath.Base(p)
+		if keep[name] {
+			continue
+		}
+		if err := systemdctl.Stop(ctx, name); err != nil {
+			logf("Stopping %s: %v", name, err)
+		}
+		if _, err := conn.DisableUnitFilesContext(ctx, []string{name}, false); err != nil {
+			logf("Disabling %s: %v", name, err)
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		if err := os.Remove(strings.TrimSuffix(p, ".timer") + ".service"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		logf("Removed %s", name)
+	}
+	if err := conn.ReloadContext(ctx); err != nil {
+		return err
+	}
+	for i := range tasks {
+		name := tasks[i].timerName()
+		if _, _, err := conn.EnableUnitFilesContext(ctx, []string{name}, false, true); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		// Restart to pick up a changed schedule.
+		if err := systemdctl.Restart(ctx, name); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// taskStatus is the state of a scheduled task.
+type taskStatus struct {
+	Name     string
+	Schedule string
+	// Runner is "internal" or the systemd timer unit.
+	Runner string
+	Last   time.Time
+	Next   time.Time
+	// Result is the result of the last run of the timer's service, e.g.
+	// "success" or "exit-code", or the timer's problem, e.g. "not installed".
+	Result string
+}
+
+// taskStatuses returns the state of the scheduled tasks. The last internal
+// runs are read from db, which may be nil.
+func taskStatuses(ctx context.Context, c *config, db *store) ([]taskStatus, error) {
+	tasks := c.scheduledTasks()
+	out := make([]taskStatus, len(tasks))
+	for i := range tasks {
+		out[i] = taskStatus{Name: tasks[i].Name, Schedule: strings.TrimSpace("daily at " + tasks[i].at + " " + c.Timezone), Runner: "internal"}
+	}
+	if len(tasks) == 0 {
+		return out, nil
+	}
+	if c.Scheduler != "systemd" {
+		loc := c.location()
+		now := time.Now().In(loc)
+		for i := range tasks {
+			if db == nil {
+				// The database is owned by ark-serman web.
+				out[i].Result = "see ark-serman web"
+				continue
+			}
+			var last string
+			if _, err := db.get(bucketJobs, []byte(tasks[i].jobKey), &last); err != nil {
+				return nil, err
+			}
+			// Only the day is recorded; the run started at the scheduled time.
+			if t, err := time.ParseInLocation("2006-01-02 15:04", last+" "+tasks[i].at, loc); err == nil {
+				out[i].Last = t
+			}
+			at, _ := time.ParseInLocation("2006-01-02 15:04", now.Format("2006-01-02 ")+tasks[i].at, loc)
+			if last == now.Format("2006-01-02") {
+				at = at.AddDate(0, 0, 1)
+			} else if at.Before(now) {
+				// Catches up within a minute.
+				at = now
+			}
+			out[i].Next = at
+		}
+		return out, nil
+	}
+	conn, err := systemdctl.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	for i := range tasks {
+		t := &tasks[i]
+		out[i].Runner = t.timerName()
+		u, err := conn.ListUnitsByNamesContext(ctx, []string{t.timerName()})
+		if err != nil {
+			return nil, err
+		}
+		if len(u) == 0 || u[0].LoadState != "loaded" {
+			out[i].Result = "not installed, run ark-serman schedule install"
+			continue
+		}
+		if u[0].ActiveState != "active" {
+			out[i].Result = "timer " + u[0].ActiveState
+			continue
+		}
+		p, err := conn.GetUnitTypePropertiesContext(ctx, t.timerName(), "Timer")
+		if err != nil {
+			return nil, err
+		}
+		if v, ok := p["NextElapseUSecRealtime"].(uint64); ok && v != 0 {
+			out[i].Next = time.UnixMicro(int64(v))
+		}
+		if v, ok := p["LastTriggerUSec"].(uint64); ok && v != 0 {
+			out[i].Last = time.UnixMicro(int64(v))
+			if p, err := conn.GetUnitTypePropertiesContext(ctx, t.serviceName(), "Service"); err == nil {
+				out[i].Result, _ = p["Result"].(string)
+			}
+		}
+	}
+	return out, nil
+}
+
+var cmdSchedule = &subcommands.Command{
+	UsageLine: "schedule <options> <list|install|run>",
+	ShortDesc: "Manages the scheduled tasks",
+	LongDesc:  "Manages the periodic tasks, e.g. the rolling restart.\n\nBy default ark-serman web runs them. With \"scheduler\": \"systemd\" in the configuration file, `schedule install` materializes them as systemd user timers calling `ark-serman schedule run <task>`; run it again after changing the tasks. ark-serman web still displays their status.\n\n`schedule list` prints the tasks and their last and next runs.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &scheduleRun{}
+		c.args.flags()
+		return c
+	},
+}
+
+type scheduleRun struct {
+	args
+}
+
+func (r *scheduleRun) Run(a subcommands.Application, args []string, env subcommands.Env) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "%s: Expected one of list, install or run.\n", a.GetName())
+		return 1
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	c, err := loadConfig(r.configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	defer c.startTracing()()
+	logf := log.Printf
+	if r.quiet {
+		logf = func(string, ...any) {}
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		var l []taskStatus
+		if l, err = taskStatuses(ctx, c, nil); err == nil {
+			for _, t := range l {
+				fmt.Printf("%s: %s (%s)\n", t.Name, t.Schedule, t.Runner)
+				if !t.Last.IsZero() {
+					fmt.Printf("  last: %s %s\n", t.Last.Format(time.RFC3339), t.Result)
+				} else if t.Result != "" {
+					fmt.Printf("  %s\n", t.Result)
+				}
+				if !t.Next.IsZero() {
+					fmt.Printf("  next: %s\n", t.Next.Format(time.RFC3339))
+				}
+			}
+		}
+	case args[0] == "install" && len(args) == 1:
+		err = installTimers(ctx, c, r.configPath, logf)
+	case args[0] == "run" && len(args) == 2:
+		s := &webServer{ctx: ctx, ports: newPortMapper(), publicIP: &publicIP{}, rcon: rconpool.New(ctx)}
+		s.setConfig(c)
+		err = s.runTask(withLockOwner(ctx, "timer:"+args[1], true), args[1])
+	default:
+		err = errors.New("expected list, install or run <task>")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,76 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidClock(t *testing.T) {
+	data := []struct {
+		at string
+		ok bool
+	}{
+		{"04:00", true},
+		{"00:00", true},
+		{"23:59", true},
+		{"4:00", false},
+		{"04:0", false},
+		{"24:00", false},
+		{"04:60", false},
+		{" 4:00", false},
+		{"04:00 ", false},
+		{"", false},
+	}
+	for _, l := range data {
+		if err := validClock(l.at); (err == nil) != l.ok {
+			t.Errorf("%q: got %v", l.at, err)
+		}
+	}
+}
+
+func TestClaimDailyRun(t *testing.T) {
+	db, err := openStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	s := &webServer{db: db}
+	day := func(d, h, m int) time.Time {
+		return time.Date(2024, 3, d, h, m, 0, 0, time.UTC)
+	}
+	data := []struct {
+		name string
+		key  string
+		now  time.Time
+		want bool
+	}{
+		// Enabled before its time: runs today.
+		{"early", "a", day(1, 3, 0), false},
+		{"early", "a", day(1, 3, 59), false},
+		{"early", "a", day(1, 4, 0), true},
+		{"early", "a", day(1, 4, 1), false},
+		{"early", "a", day(2, 4, 14), true},
+		// Too late, e.g. ark-serman was down.
+		{"early", "a", day(3, 4, 15), false},
+		{"early", "a", day(3, 4, 16), false},
+		{"early", "a", day(4, 4, 0), true},
+		// Enabled in the middle of the day: waits for the next day.
+		{"midday", "b", day(1, 13, 0), false},
+		{"midday", "b", day(1, 13, 1), false},
+		{"midday", "b", day(2, 3, 59), false},
+		{"midday", "b", day(2, 4, 5), true},
+	}
+	for i, l := range data {
+		got, err := s.claimDailyRun(l.name, l.key, "04:00", l.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != l.want {
+			t.Errorf("#%d: %s at %s: got %t", i, l.name, l.now.Format(time.DateTime), got)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/maruel/subcommands"
+)
+
+var cmdServer = &subcommands.Command{
+	UsageLine: "server <options> <add|list|maps>",
+	ShortDesc: "Manages the servers in the configuration file",
+	LongDesc:  "Manages the servers in the configuration file.\n\n`server -name <name> -map <map> add` adds a server, `server list` lists the configured servers and `server maps` lists the known maps.\nRun `install` afterward to generate the systemd units.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &serverRun{}
+		c.args.flags()
+		c.Flags.StringVar(&c.name, "name", "", "server name for add")
+		c.Flags.StringVar(&c.mapID, "map", "", "map ID for add; see `server maps`")
+		c.Flags.StringVar(&c.game, "game", "ark", "game of the server for add: ark, palworld or valheim")
+		c.Flags.StringVar(&c.session, "session", "", "session name displayed in the server browser")
+		c.Flags.StringVar(&c.cluster, "cluster", "", "cluster ID")
+		c.Flags.IntVar(&c.port, "port", 0, "game port; defaults to the first free one")
+		c.Flags.BoolVar(&c.crossplay, "crossplay", false, "enable Epic crossplay")
+		return c
+	},
+}
+
+type serverRun struct {
+	args
+	name      string
+	mapID     string
+	game      string
+	session   string
+	cluster   string
+	port      int
+	crossplay bool
+}
+
+func (s *serverRun) Run(a subcommands.Application, args []string, env subcommands.Env) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "%s: Expected one of add, list or maps.\n", a.GetName())
+		return 1
+	}
+	c, err := loadConfig(s.configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	switch args[0] {
+	case "add":
+		err = s.add(c)
+	case "list":
+		for _, v := range c.Servers {
+			fmt.Printf("%-16s %-24s %5d %5d %5d %s\n", v.Name, c.mapInfo(v.Map).Name, v.Port, v.QueryPort, v.RCONPort, v.SessionName)
+		}
+	case "maps":
+		for _, m := range c.maps() {
+			w := ""
+			if m.WorkshopID != "" {
+				w = "workshop " + m.WorkshopID
+			}
+			fmt.Printf("%-20s %-20s %s\n", m.ID, m.Name, w)
+		}
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
+
+func (s *serverRun) add(c *config) error {
+	g := gameByID(s.game)
+	if g == nil {
+		return fmt.Errorf("unknown game %q", s.game)
+	}
+	if s.name == "" || (s.mapID == "" && g.DefaultMap == "") {
+		return fmt.Errorf("-name and -map are required")
+	}
+	m := c.mapInfo(s.mapID)
+	v := serverConfig{
+		Name:        s.name,
+		Map:         m.ID,
+		SessionName: s.session,
+		ClusterID:   s.cluster,
+		Port:        s.port,
+		Crossplay:   s.crossplay,
+	}
+	if g.ID != "ark" {
+		v.Game = g.ID
+	} else if m.WorkshopID != "" {
+		if m.TotalConversion {
+			v.TotalConversionMod = m.WorkshopID
+		} else {
+			v.Mods = []string{m.WorkshopID}
+		}
+	}
+	used := map[int]bool{}
+	for _, o := range c.Servers {
+		used[o.Port] = true
+		used[o.Port+1] = true
+		used[o.QueryPort] = true
+		used[o.RCONPort] = true
+	}
+	if v.Port == 0 {
+		v.Port = freePort(used, 7777, 2)
+	}
+	used[v.Port] = true
+	used[v.Port+1] = true
+	if g.QueryPortOffset == 0 {
+		v.QueryPort = freePort(used, 27015, 1)
+		used[v.QueryPort] = true
+	}
+	if g.RCON {
+		v.RCONPort = freePort(used, 32330, 1)
+	}
+	c.Servers = append(c.Servers, v)
+	c.setDefaults()
+	v = c.Servers[len(c.Servers)-1]
+	if err := c.validate(); err != nil {
+		return err
+	}
+	if err := c.save(s.configPath); err != nil {
+		return err
+	}
+	fmt.Printf("Added %s (%s) on port %d, query port %d, rcon port %d\n", v.Name, c.mapInfo(v.Map).Name, v.Port, v.QueryPort, v.RCONPort)
+	return nil
+}
+
+// freePort returns the first port starting at base, by increments of step,
+// that is not used.
+func freePort(used map[int]bool, base, step int) int {
+	for p := base; ; p += step {
+		if !used[p] {
+			return p
+		}
+	}
+}
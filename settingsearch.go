@@ -0,0 +1,278 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// iniFileNames are the INI file names by lower case name.
+var iniFileNames = map[string]string{
+	"gameusersettings.ini": "GameUserSettings.ini",
+	"game.ini":             "Game.ini",
+}
+
+// iniSectionNames are the section names as the game writes them, by lower
+// case name.
+var iniSectionNames = map[string]string{
+	"serversettings":             "ServerSettings",
+	"sessionsettings":            "SessionSettings",
+	"/script/engine.gamesession": "/Script/Engine.GameSession",
+	"messageoftheday":            "MessageOfTheDay",
+	gameModeSection:              gameModeSection,
+}
+
+// settingHit is a setting found by the search.
+type settingHit struct {
+	// File is the INI file name or "launch".
+	File    string
+	Section string
+	Key     string
+	// Type is empty for the unknown keys.
+	Type string
+	Doc  string
+	// Value is the server's current value; Set is false when it has none.
+	Value string
+	Set   bool
+	// Managed is set when the configuration maintains the value, with the
+	// value it maintains.
+	Managed    bool
+	ManagedVal string
+	Secret     bool
+	// Flag is set for the command line flags; Editable is false for the
+	// launch options generated from the configuration.
+	Flag     bool
+	Editable bool
+	rank     int
+}
+
+// searchSettings returns the settings matching all the words of q, in their
+// name or description, with the server's values. It returns every known
+// setting when q is empty.
+func searchSettings(c *config, v *serverConfig, q string) ([]settingHit, error) {
+	hits := map[string]*settingHit{}
+	add := func(file, section, key string) *settingHit {
+		k := strings.ToLower(file + "\x00" + section + "\x00" + key)
+		h := hits[k]
+		if h == nil {
+			h = &settingHit{File: file, Section: section, Key: key, Doc: settingDocs[key], Editable: true}
+			hits[k] = h
+		}
+		return h
+	}
+	for f, sections := range iniKeys {
+		for sec, keys := range sections {
+			for _, k := range keys {
+				h := add(iniFileNames[f], iniSectionNames[sec], k.Name)
+				h.Type = k.Type.String()
+			}
+		}
+	}
+	for _, f := range launchFlags {
+		h := add("launch", "", f.Name)
+		h.Doc, h.Flag = f.Doc, true
+		if f.Value {
+			h.Type = "a value"
+		} else {
+			h.Type = "present or not"
+		}
+	}
+	if v != nil {
+		cur, err := serverSettings(c, v)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range cur {
+			var h *settingHit
+			if e.Source == "launch" {
+				_, known := hits[strings.ToLower("launch\x00\x00"+e.Name)]
+				h = add("launch", "", e.Name)
+				h.Flag = strings.HasPrefix(e.Name, "-")
+				if !known {
+					// Generated from the configuration, e.g. the ports.
+					h.Editable = false
+					if h.Doc == "" {
+						h.Doc = "Set on the command line from the configuration."
+					}
+				}
+			} else {
+				sec, key, _ := strings.Cut(strings.TrimPrefix(e.Name, "["), "] ")
+				h = add(e.Source, sec, key)
+				if h.Doc == "" {
+					h.Doc = settingDocs[key]
+				}
+			}
+			h.Value, h.Set = e.Value, true
+		}
+		for _, f := range v.Flags {
+			k, val, _ := strings.Cut(f, "=")
+			h := add("launch", "", k)
+			h.Managed, h.ManagedVal, h.Flag, h.Editable = true, val, true, true
+		}
+	}
+	for _, s := range c.Settings {
+		h := add(s.File, s.Section, s.Key)
+		h.Managed, h.ManagedVal = true, s.Value
+	}
+	words := strings.Fields(strings.ToLower(q))
+	var out []settingHit
+	for _, h := range hits {
+		name := strings.ToLower(h.Key + " " + h.Section + " " + h.File)
+		doc := strings.ToLower(h.Doc)
+		h.rank = 0
+		for _, w := range words {
+			switch {
+			case strings.Contains(name, w):
+			case strings.Contains(doc, w):
+				h.rank = 1
+			default:
+				h.rank = -1
+			}
+			if h.rank == -1 {
+				break
+			}
+		}
+		if h.rank == -1 {
+			continue
+		}
+		if reSecretEnv.MatchString(h.Key) {
+			h.Secret = true
+			h.Value, h.ManagedVal = maskSecret(h.Value), maskSecret(h.ManagedVal)
+		}
+		out = append(out, *h)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].rank != out[j].rank {
+			return out[i].rank < out[j].rank
+		}
+		if a, b := strings.ToLower(out[i].Key), strings.ToLower(out[j].Key); a != b {
+			return a < b
+		}
+		return out[i].File < out[j].File
+	})
+	return out, nil
+}
+
+// setSetting sets the value the configuration maintains in the INI files.
+func (c *config) setSetting(v iniSetting) {
+	for i := range c.Settings {
+		o := &c.Settings[i]
+		if strings.EqualFold(o.File, v.File) && strings.EqualFold(o.Section, v.Section) && strings.EqualFold(o.Key, v.Key) {
+			o.Value = v.Value
+			return
+		}
+	}
+	c.Settings = append(c.Settings, v)
+}
+
+// unsetSetting stops maintaining the value; the INI file is left as is.
+func (c *config) unsetSetting(v iniSetting) {
+	c.Settings = slices.DeleteFunc(c.Settings, func(o iniSetting) bool {
+		return strings.EqualFold(o.File, v.File) && strings.EqualFold(o.Section, v.Section) && strings.EqualFold(o.Key, v.Key)
+	})
+}
+
+var settingsTmpl = template.Must(template.ParseFS(rsc, "rsc/settings.html.tmpl"))
+
+// serveSettings serves the settings search at /settings/?q=<words>&server=<unit>.
+// The values are edited by POSTing to /rpc/settings; the INI values are saved
+// in the configuration for `apply`, the flags in the server's flags. Only
+// admins can since it shows the INI files.
+func (s *webServer) serveSettings(w http.ResponseWriter, r *http.Request) {
+	if !userFrom(r.Context()).hasRole(roleAdmin) {
+		http.Error(w, "only admins can search the settings", http.StatusForbidden)
+		return
+	}
+	c := s.config()
+	unit := r.FormValue("server")
+	if unit == "" && len(c.Servers) != 0 {
+		unit = c.Servers[0].unitName()
+	}
+	data := map[string]any{"Q": r.FormValue("q"), "Server": unit}
+	w.Header().Add("Content-Type", "text/html")
+	if strings.HasPrefix(r.URL.Path, "/rpc/") && r.Method == "POST" {
+		if res, err := s.editSetting(r, unit); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			data["Err"] = err.Error()
+		} else {
+			data["Result"] = res
+		}
+		c = s.config()
+	}
+	var servers []string
+	for i := range c.Servers {
+		if c.Servers[i].gameInfo().ID == "ark" {
+			servers = append(servers, c.Servers[i].unitName())
+		}
+	}
+	data["Servers"] = servers
+	hits, err := searchSettings(c, c.serverByUnit(unit), r.FormValue("q"))
+	if err != nil {
+		data["Err"] = err.Error()
+	}
+	data["Hits"] = hits
+	_ = settingsTmpl.Execute(w, data)
+}
+
+// editSetting sets or unsets one value.
+func (s *webServer) editSetting(r *http.Request, unit string) (string, error) {
+	op, file, key, value := r.FormValue("op"), r.FormValue("file"), r.FormValue("key"), strings.TrimSpace(r.FormValue("value"))
+	v := iniSetting{File: file, Section: r.FormValue("section"), Key: key, Value: value}
+	setAuditDetail(r.Context(), fmt.Sprintf("%s %s [%s] %s", op, file, v.Section, key))
+	if key == "" || (op != "set" && op != "unset") {
+		return "", errors.New("invalid request")
+	}
+	if file == "launch" {
+		if !strings.HasPrefix(key, "-") || strings.ContainsAny(key, "= ") {
+			return "", errors.New("only the flags can be edited")
+		}
+		err := s.editConfig(func(c *config) error {
+			sv := c.serverByUnit(unit)
+			if sv == nil {
+				return errors.New("unknown server")
+			}
+			sv.Flags = slices.DeleteFunc(sv.Flags, func(f string) bool {
+				k, _, _ := strings.Cut(f, "=")
+				return strings.EqualFold(k, key)
+			})
+			if op == "set" {
+				f := key
+				if value != "" {
+					f += "=" + value
+				}
+				sv.Flags = append(sv.Flags, f)
+			}
+			return c.validate()
+		})
+		if err != nil {
+			return "", err
+		}
+		return "Saved the flags of " + unit + "; install to update the unit and restart the server.", nil
+	}
+	if iniFileNames[strings.ToLower(file)] == "" || v.Section == "" {
+		return "", errors.New("unknown INI file or section")
+	}
+	err := s.editConfig(func(c *config) error {
+		if op == "set" {
+			c.setSetting(v)
+		} else {
+			c.unsetSetting(v)
+		}
+		return c.validate()
+	})
+	if err != nil {
+		return "", err
+	}
+	if op == "unset" {
+		return key + " is no longer maintained; the INI file keeps its value.", nil
+	}
+	return "Saved " + key + "; review it in the pending changes and apply it.", nil
+}
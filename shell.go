@@ -0,0 +1,224 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/maruel/subcommands"
+
+	"github.com/maruel/ark-serman/internal/lineedit"
+)
+
+var cmdShell = &subcommands.Command{
+	UsageLine: "shell <options>",
+	ShortDesc: "Runs the subcommands from an interactive prompt",
+	LongDesc:  "Runs the subcommands from an interactive prompt, e.g. `rcon -s island SaveWorld`, with history and Tab completion of the commands, flags and server names.\n\nThe commands use the shell's -config unless specified. `history` lists the previous commands and `exit` or Ctrl-D quits.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &shellRun{}
+		c.args.flags()
+		return c
+	},
+}
+
+type shellRun struct {
+	args
+}
+
+// shellHistoryMax is the number of commands kept in the history file.
+const shellHistoryMax = 500
+
+func (s *shellRun) Run(a subcommands.Application, args []string, env subcommands.Env) int {
+	if len(args) != 0 {
+		fmt.Fprintf(os.Stderr, "%s: Unexpected arguments.\n", a.GetName())
+		return 1
+	}
+	histPath := filepath.Join(defaultDataDir(), "shell_history")
+	e := lineedit.New(os.Stdin, os.Stdout)
+	e.History = loadHistory(histPath)
+	e.Complete = s.complete
+	for {
+		l, err := e.ReadLine("ark-serman> ")
+		if errors.Is(err, lineedit.ErrInterrupted) {
+			continue
+		}
+		if err == io.EOF {
+			return 0
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+			return 1
+		}
+		if l = strings.TrimSpace(l); l == "" {
+			continue
+		}
+		if len(e.History) == 0 || e.History[len(e.History)-1] != l {
+			e.History = append(e.History, l)
+			if err := saveHistory(histPath, e.History); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+			}
+		}
+		argv, err := splitLine(l)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+			continue
+		}
+		switch argv[0] {
+		case "exit", "quit":
+			return 0
+		case "history":
+			for i, h := range e.History {
+				fmt.Printf("%4d  %s\n", i+1, h)
+			}
+			continue
+		case "shell":
+			fmt.Fprintf(os.Stderr, "%s: Already in the shell.\n", a.GetName())
+			continue
+		}
+		if c := findCommand(argv[0]); c != nil && hasFlag(c, "config") {
+			// Flags are parsed in order, so an explicit -config wins.
+			argv = append([]string{argv[0], "-config", s.configPath}, argv[1:]...)
+		}
+		if rc := subcommands.Run(application, argv); rc != 0 {
+			fmt.Printf("exit status %d\n", rc)
+		}
+	}
+}
+
+// complete returns the commands, flags and server names starting with the
+// last word of line.
+func (s *shellRun) complete(line string) []string {
+	f := strings.Fields(line)
+	if strings.HasSuffix(line, " ") || len(f) == 0 {
+		f = append(f, "")
+	}
+	word := f[len(f)-1]
+	var candidates []string
+	if len(f) == 1 {
+		candidates = []string{"exit", "history"}
+		for _, c := range application.Commands {
+			candidates = append(candidates, c.Name())
+		}
+	} else if c := findCommand(f[0]); c != nil {
+		c.CommandRun().GetFlags().VisitAll(func(fl *flag.Flag) {
+			candidates = append(candidates, "-"+fl.Name)
+		})
+		candidates = append(candidates, usageVerbs(c.UsageLine)...)
+		if cfg, err := loadConfig(s.configPath); err == nil {
+			for _, v := range cfg.Servers {
+				candidates = append(candidates, v.Name)
+			}
+		}
+	}
+	var out []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, word) && c != "shell" {
+			out = append(out, c)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// usageVerbs returns the verbs listed in the usage line, e.g. add, list and
+// maps for "server <options> <add|list|maps>".
+func usageVerbs(usage string) []string {
+	var out []string
+	for _, w := range strings.Fields(usage) {
+		if w = strings.Trim(w, "<>[]"); strings.Contains(w, "|") {
+			out = append(out, strings.Split(w, "|")...)
+		}
+	}
+	return out
+}
+
+func findCommand(name string) *subcommands.Command {
+	for _, c := range application.Commands {
+		if c.Name() == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func hasFlag(c *subcommands.Command, name string) bool {
+	return c.CommandRun().GetFlags().Lookup(name) != nil
+}
+
+// splitLine splits a command line into arguments. Arguments can be quoted
+// with ' or ", and \ escapes the next character outside of single quotes.
+func splitLine(l string) ([]string, error) {
+	var out []string
+	var cur strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, ch := range l {
+		switch {
+		case escaped:
+			cur.WriteRune(ch)
+			escaped = false
+		case ch == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(ch)
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+			inArg = true
+		case ch == ' ' || ch == '\t':
+			if inArg {
+				out = append(out, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(ch)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote")
+	}
+	if inArg {
+		out = append(out, cur.String())
+	}
+	return out, nil
+}
+
+func loadHistory(p string) []string {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var out []string
+	for s := bufio.NewScanner(f); s.Scan(); {
+		out = append(out, s.Text())
+	}
+	return out
+}
+
+func saveHistory(p string, h []string) error {
+	if len(h) > shellHistoryMax {
+		h = h[len(h)-shellHistoryMax:]
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(p, []byte(strings.Join(h, "\n")+"\n"), 0o600)
+}
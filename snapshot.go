@@ -0,0 +1,204 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snapshotTimeFormat is the time format used in the snapshot names.
+const snapshotTimeFormat = "20060102-150405"
+
+// run runs the command and returns its stdout. stderr is included in the
+// error.
+func run(name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// zfsBackend snapshots the ZFS dataset holding the server's save directory.
+//
+// Rolling back destroys the snapshots more recent than the one restored.
+type zfsBackend struct{}
+
+// dataset returns the dataset mounted at the longest prefix of p.
+func (zfsBackend) dataset(p string) (string, error) {
+	out, err := run("zfs", "list", "-H", "-o", "name,mountpoint")
+	if err != nil {
+		return "", err
+	}
+	best, bestMnt := "", ""
+	for _, l := range strings.Split(strings.TrimSpace(out), "\n") {
+		f := strings.Split(l, "\t")
+		if len(f) != 2 || !strings.HasPrefix(f[1], "/") {
+			continue
+		}
+		if (p == f[1] || strings.HasPrefix(p, strings.TrimSuffix(f[1], "/")+"/")) && len(f[1]) > len(bestMnt) {
+			best, bestMnt = f[0], f[1]
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("%s is not on a ZFS dataset", p)
+	}
+	return best, nil
+}
+
+func (z zfsBackend) list(c *config, s *serverConfig) ([]backupInfo, error) {
+	ds, err := z.dataset(s.saveDir(c))
+	if err != nil {
+		return nil, err
+	}
+	out, err := run("zfs", "list", "-H", "-p", "-t", "snapshot", "-o", "name,creation,used", ds)
+	if err != nil {
+		return nil, err
+	}
+	prefix := ds + "@ark-serman-" + s.Name + "-"
+	var l []backupInfo
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		f := strings.Split(line, "\t")
+		if len(f) != 3 || !strings.HasPrefix(f[0], prefix) {
+			continue
+		}
+		b := backupInfo{ID: f[0]}
+		if v, err := strconv.ParseInt(f[1], 10, 64); err == nil {
+			b.Time = time.Unix(v, 0)
+		}
+		b.Size, _ = strconv.ParseInt(f[2], 10, 64)
+		l = append(l, b)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Time.After(l[j].Time) })
+	return l, nil
+}
+
+func (z zfsBackend) create(c *config, s *serverConfig) (backupInfo, error) {
+	ds, err := z.dataset(s.saveDir(c))
+	if err != nil {
+		return backupInfo{}, err
+	}
+	now := time.Now()
+	b := backupInfo{ID: ds + "@ark-serman-" + s.Name + "-" + now.Format(snapshotTimeFormat), Time: now}
+	_, err = run("zfs", "snapshot", b.ID)
+	return b, err
+}
+
+// check verifies id is a snapshot of the server.
+func (z zfsBackend) check(c *config, s *serverConfig, id string) error {
+	ds, err := z.dataset(s.saveDir(c))
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(id, ds+"@ark-serman-"+s.Name+"-") {
+		return fmt.Errorf("%s is not a snapshot of %s", id, s.Name)
+	}
+	return nil
+}
+
+func (z zfsBackend) restore(c *config, s *serverConfig, id string) error {
+	if err := z.check(c, s, id); err != nil {
+		return err
+	}
+	_, err := run("zfs", "rollback", "-r", id)
+	return err
+}
+
+func (z zfsBackend) remove(c *config, s *serverConfig, id string) error {
+	if err := z.check(c, s, id); err != nil {
+		return err
+	}
+	_, err := run("zfs", "destroy", id)
+	return err
+}
+
+// btrfsBackend snapshots the server's save directory, which must be a btrfs
+// subvolume. The read-only snapshots are kept next to it since snapshots
+// can't cross filesystems.
+type btrfsBackend struct{}
+
+// snapshotDir returns the directory holding the server's snapshots.
+func (btrfsBackend) snapshotDir(c *config, s *serverConfig) string {
+	return filepath.Join(savedDir(c), ".ark-serman-snapshots", s.Name)
+}
+
+func (b btrfsBackend) list(c *config, s *serverConfig) ([]backupInfo, error) {
+	entries, err := os.ReadDir(b.snapshotDir(c, s))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var l []backupInfo
+	for _, e := range entries {
+		t, err := time.ParseInLocation(snapshotTimeFormat, e.Name(), time.Local)
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		l = append(l, backupInfo{ID: filepath.Join(b.snapshotDir(c, s), e.Name()), Time: t})
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Time.After(l[j].Time) })
+	return l, nil
+}
+
+func (b btrfsBackend) create(c *config, s *serverConfig) (backupInfo, error) {
+	if _, err := run("btrfs", "subvolume", "show", s.saveDir(c)); err != nil {
+		return backupInfo{}, fmt.Errorf("%s must be a btrfs subvolume: %w", s.saveDir(c), err)
+	}
+	if err := os.MkdirAll(b.snapshotDir(c, s), 0o700); err != nil {
+		return backupInfo{}, err
+	}
+	now := time.Now()
+	i := backupInfo{ID: filepath.Join(b.snapshotDir(c, s), now.Format(snapshotTimeFormat)), Time: now}
+	_, err := run("btrfs", "subvolume", "snapshot", "-r", s.saveDir(c), i.ID)
+	return i, err
+}
+
+func (b btrfsBackend) check(c *config, s *serverConfig, id string) error {
+	if filepath.Dir(id) != b.snapshotDir(c, s) {
+		return fmt.Errorf("%s is not a snapshot of %s", id, s.Name)
+	}
+	return nil
+}
+
+func (b btrfsBackend) restore(c *config, s *serverConfig, id string) error {
+	if err := b.check(c, s, id); err != nil {
+		return err
+	}
+	dst := s.saveDir(c)
+	old := dst + ".restore-" + time.Now().Format(snapshotTimeFormat)
+	if err := os.Rename(dst, old); err != nil {
+		return err
+	}
+	if _, err := run("btrfs", "subvolume", "snapshot", id, dst); err != nil {
+		if err2 := os.Rename(old, dst); err2 != nil {
+			return fmt.Errorf("%w; the previous saves are in %s", err, old)
+		}
+		return err
+	}
+	_, err := run("btrfs", "subvolume", "delete", old)
+	return err
+}
+
+func (b btrfsBackend) remove(c *config, s *serverConfig, id string) error {
+	if err := b.check(c, s, id); err != nil {
+		return err
+	}
+	_, err := run("btrfs", "subvolume", "delete", id)
+	return err
+}
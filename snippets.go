@@ -0,0 +1,189 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// The mods' Game.ini blocks are kept as snippets, one file each, and `apply`
+// composes them into Game.ini. Each block is delimited by markers so the
+// next composition replaces it and removing a mod removes its block, while
+// the rest of the file is kept as edited.
+
+const (
+	snippetBegin = "; ark-serman: begin "
+	snippetEnd   = "; ark-serman: end "
+)
+
+// snippetDir returns the directory holding the Game.ini snippets.
+func snippetDir(c *config) string {
+	return filepath.Join(c.dataDir(), "snippets")
+}
+
+// snippet is a block of Game.ini.
+type snippet struct {
+	// Name is the file name without .ini. A workshop ID, e.g. 731604991, ties
+	// the snippet to the mod: it is only used while a server uses the mod.
+	Name    string
+	Content string
+}
+
+// isModID returns true if the name is a workshop ID.
+func isModID(name string) bool {
+	return name != "" && strings.Trim(name, "0123456789") == ""
+}
+
+// loadSnippets returns the snippets in use, sorted by name.
+func loadSnippets(c *config) ([]snippet, error) {
+	l, err := filepath.Glob(filepath.Join(snippetDir(c), "*.ini"))
+	if err != nil {
+		return nil, err
+	}
+	mods := c.modIDs()
+	var out []snippet
+	for _, p := range l {
+		name := strings.TrimSuffix(filepath.Base(p), ".ini")
+		if isModID(name) && !slices.Contains(mods, name) {
+			continue
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateIni(filepath.Base(p), string(b)); err != nil {
+			return nil, err
+		}
+		out = append(out, snippet{Name: name, Content: string(b)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// iniSection is a section of an INI file as its lines, the header first.
+type iniSection struct {
+	name  string
+	lines []string
+}
+
+// splitSections returns the lines before the first section and the
+// sections.
+func splitSections(lines []string) ([]string, []iniSection) {
+	var pre []string
+	var out []iniSection
+	for _, l := range lines {
+		t := strings.TrimSpace(l)
+		if strings.HasPrefix(t, "[") && strings.HasSuffix(t, "]") {
+			out = append(out, iniSection{name: t[1 : len(t)-1], lines: []string{l}})
+		} else if len(out) == 0 {
+			pre = append(pre, l)
+		} else {
+			out[len(out)-1].lines = append(out[len(out)-1].lines, l)
+		}
+	}
+	return pre, out
+}
+
+// stripSnippets removes the blocks composed previously.
+func stripSnippets(lines []string) ([]string, error) {
+	var out []string
+	in := ""
+	for _, l := range lines {
+		t := strings.TrimSpace(l)
+		switch {
+		case in == "" && strings.HasPrefix(t, snippetBegin):
+			in = strings.TrimPrefix(t, snippetBegin)
+		case in != "" && t == strings.TrimSpace(snippetEnd+in):
+			in = ""
+		case in == "":
+			out = append(out, l)
+		}
+	}
+	if in != "" {
+		// Don't drop the rest of the file.
+		return nil, errors.New("Game.ini: the end marker of the " + in + " snippet was removed; restore it")
+	}
+	return out, nil
+}
+
+// composeGameIni returns Game.ini with the snippets' blocks appended to
+// their sections. The sections missing from the file are added at the end,
+// with their header in a block of their own so they go away with the last
+// snippet using them.
+func composeGameIni(cur string, l []snippet) (string, error) {
+	if len(l) == 0 && !strings.Contains(cur, snippetBegin) {
+		return cur, nil
+	}
+	lines := strings.Split(strings.TrimRight(cur, "\n"), "\n")
+	if cur == "" {
+		lines = nil
+	}
+	lines, err := stripSnippets(lines)
+	if err != nil {
+		return "", err
+	}
+	pre, sections := splitSections(lines)
+	for _, sn := range l {
+		_, blocks := splitSections(strings.Split(strings.TrimRight(strings.ReplaceAll(sn.Content, "\r\n", "\n"), "\n"), "\n"))
+		for _, b := range blocks {
+			i := slices.IndexFunc(sections, func(s iniSection) bool { return strings.EqualFold(s.name, b.name) })
+			if i == -1 {
+				sections = append(sections, iniSection{name: b.name, lines: []string{snippetBegin + "[" + b.name + "]", b.lines[0], snippetEnd + "[" + b.name + "]"}})
+				i = len(sections) - 1
+			}
+			body := b.lines[1:]
+			for len(body) != 0 && strings.TrimSpace(body[len(body)-1]) == "" {
+				body = body[:len(body)-1]
+			}
+			// Insert before the section's trailing empty lines.
+			s := &sections[i]
+			n := len(s.lines)
+			for n > 1 && strings.TrimSpace(s.lines[n-1]) == "" {
+				n--
+			}
+			block := append(append([]string{snippetBegin + sn.Name}, body...), snippetEnd+sn.Name)
+			s.lines = append(s.lines[:n], append(block, s.lines[n:]...)...)
+		}
+	}
+	out := pre
+	for _, s := range sections {
+		out = append(out, s.lines...)
+	}
+	if len(out) == 0 {
+		return "", nil
+	}
+	return strings.Join(out, "\n") + "\n", nil
+}
+
+// planSnippets returns the change composing the snippets into Game.ini, if
+// any.
+func planSnippets(c *config) (*change, error) {
+	l, err := loadSnippets(c)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(filepath.Join(configDir(c), "Game.ini"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	to, err := composeGameIni(string(b), l)
+	if err != nil {
+		return nil, err
+	}
+	if to == string(b) {
+		return nil, nil
+	}
+	ch := &change{Kind: "ini", Op: "update", Target: "Game.ini", From: string(b), To: to}
+	if len(b) == 0 {
+		ch.Op = "create"
+	}
+	return ch, nil
+}
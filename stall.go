@@ -0,0 +1,53 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/maruel/ark-serman/internal/systemdctl"
+)
+
+// checkStalls detects the servers whose unit is active but that stopped
+// answering both the query port and RCON, which happens when the server
+// deadlocks. A stalled server is reported once and, with stall_restart,
+// killed so systemd restarts it.
+func (s *webServer) checkStalls(ctx context.Context, c *config) {
+	since := map[string]time.Time{}
+	s.mu.Lock()
+	for _, u := range s.lastStates {
+		if u.Running {
+			since[u.Name] = u.Since
+		}
+	}
+	s.mu.Unlock()
+	for i := range c.Servers {
+		v := &c.Servers[i]
+		t, running := since[v.unitName()]
+		l, ok := s.latency.get(v.Name)
+		// The query port doesn't answer while the map loads.
+		stalled := running && ok && l.Failures >= c.stallAfter() && time.Since(t) > c.startTimeout()
+		if stalled {
+			if p, err := s.rconPoller(c, v); err == nil {
+				if r, ok := p.Last(v.gameInfo().ListPlayers); ok && r.Err == nil && time.Since(r.Time) < 2*time.Minute {
+					// RCON still works, the query port is likely firewalled.
+					stalled = false
+				}
+			}
+		}
+		if !s.latency.setStalled(v.Name, stalled) || !stalled {
+			continue
+		}
+		bus.publish(event{Unit: v.unitName(), Kind: evStalled, Msg: v.Name + " stopped responding"})
+		if c.StallRestart {
+			log.Printf("stall: killing %s", v.Name)
+			if err := systemdctl.Kill(ctx, v.unitName()); err != nil {
+				log.Printf("stall: %s: %v", v.Name, err)
+			}
+		}
+	}
+}
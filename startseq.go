@@ -0,0 +1,115 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/maruel/ark-serman/internal/systemdctl"
+)
+
+// startOrder returns the servers sorted by StartOrder then name.
+func startOrder(servers []*serverConfig) []*serverConfig {
+	out := append([]*serverConfig(nil), servers...)
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].StartOrder != out[j].StartOrder {
+			return out[i].StartOrder < out[j].StartOrder
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// waitReady waits until the server answers RCON, which happens once the
+// server finished loading the map, or until timeout.
+func (s *webServer) waitReady(ctx context.Context, v *serverConfig, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		p, err := s.rconPoller(s.config(), v)
+		if err != nil {
+			// RCON is not configured, can't know.
+			return false
+		}
+		if _, err = p.Execute(ctx, v.gameInfo().ListPlayers); err == nil {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// startAll starts the servers one at a time, waiting for each to report
+// startup complete or for start_timeout before starting the next one, so the
+// host isn't overwhelmed by multiple maps loading concurrently. Servers
+// already running are skipped.
+func (s *webServer) startAll(ctx context.Context, servers []*serverConfig) {
+	if !s.starting.CompareAndSwap(false, true) {
+		log.Printf("start all: already in progress")
+		return
+	}
+	defer s.starting.Store(false)
+	running := map[string]bool{}
+	if u, err := getUnitStates(ctx, s.config()); err == nil {
+		for _, v := range u {
+			running[v.Name] = v.Running
+		}
+	}
+	for _, v := range startOrder(servers) {
+		if running[v.unitName()] {
+			continue
+		}
+		log.Printf("start all: starting %s", v.Name)
+		if err := s.startLocked(ctx, v); err != nil {
+			log.Printf("start all: %s: %v", v.Name, err)
+			continue
+		}
+		s.ports.add(v)
+		if !s.waitReady(ctx, v, s.config().startTimeout()) {
+			log.Printf("start all: %s didn't report ready, continuing", v.Name)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+	log.Printf("start all: done")
+}
+
+// startLocked starts the server while holding its lock.
+func (s *webServer) startLocked(ctx context.Context, v *serverConfig) error {
+	release, err := lockServers(ctx, s.config(), "start", v)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := preflight(s.config(), v); err != nil {
+		return err
+	}
+	s.warnOvercommit(v.unitName())
+	if err := systemdctl.Start(ctx, v.unitName()); err != nil {
+		return err
+	}
+	s.recordStatsWhenReady(v, "after start")
+	return nil
+}
+
+// rpcStartAll starts all the servers in the background with the stagger
+// logic.
+func (s *webServer) rpcStartAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	servers, _ := s.config().selectServers(nil)
+	go s.startAll(s.ctx, servers)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
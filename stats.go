@@ -0,0 +1,115 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maruel/ark-serman/internal/systemdctl"
+)
+
+// serverStats is a snapshot of a server's key metrics, recorded before and
+// after the restarts so the regressions caused by a patch are visible in the
+// event history. The zero values are unknown.
+type serverStats struct {
+	Players int     `json:"players"`
+	Memory  float64 `json:"memory_mib,omitempty"`
+	// SaveSize is the size of the map's .ark file in bytes.
+	SaveSize int64 `json:"save_size,omitempty"`
+	// Day is the in-game day, from the tribe log lines.
+	Day int `json:"day,omitempty"`
+}
+
+func (s *serverStats) String() string {
+	out := []string{fmt.Sprintf("players=%d", s.Players)}
+	if s.Memory != 0 {
+		out = append(out, fmt.Sprintf("memory=%gMiB", s.Memory))
+	}
+	if s.SaveSize != 0 {
+		out = append(out, fmt.Sprintf("save=%gMiB", round(float64(s.SaveSize)/(1<<20), 1)))
+	}
+	if s.Day != 0 {
+		out = append(out, fmt.Sprintf("day=%d", s.Day))
+	}
+	return strings.Join(out, " ")
+}
+
+// reDay matches the in-game time of the game log lines, e.g.
+// "2023.08.01_12.00.00: Day 532, 10:32:02: Tribe ...".
+var reDay = regexp.MustCompile(`Day (\d+), \d+:\d+:\d+`)
+
+// getStats collects the server's stats. Every metric is best effort.
+func (s *webServer) getStats(ctx context.Context, v *serverConfig) *serverStats {
+	c := s.config()
+	st := &serverStats{}
+	if conn, err := systemdctl.Dial(ctx); err == nil {
+		if p, err := conn.GetServicePropertyContext(ctx, v.unitName(), "MemoryCurrent"); err == nil {
+			// MaxUint64 means not running or not accounted.
+			if m, ok := p.Value.Value().(uint64); ok && m != math.MaxUint64 {
+				st.Memory = round(float64(m)*0.000001, 1)
+			}
+		}
+		conn.Close()
+	}
+	if fi, err := os.Stat(filepath.Join(v.saveDir(c), v.Map+".ark")); err == nil {
+		st.SaveSize = fi.Size()
+	}
+	if p, err := s.rconPoller(c, v); err == nil {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		if resp, err := p.Execute(ctx, v.gameInfo().ListPlayers); err == nil {
+			st.Players = len(v.gameInfo().parsePlayers(resp))
+		}
+		if resp, err := p.Execute(ctx, "GetGameLog"); err == nil {
+			if m := reDay.FindAllStringSubmatch(resp, -1); len(m) != 0 {
+				st.Day, _ = strconv.Atoi(m[len(m)-1][1])
+			}
+		}
+	}
+	return st
+}
+
+// recordStats publishes the server's stats as an evStats event. when
+// describes the moment, e.g. "before restart".
+func (s *webServer) recordStats(ctx context.Context, v *serverConfig, when string) {
+	st := s.getStats(ctx, v)
+	bus.publish(event{Unit: v.unitName(), Kind: evStats, Msg: when + ": " + st.String(), Stats: st})
+}
+
+// recordStatsWhenReady records the server's stats in the background once it
+// answers RCON, without holding up the caller while the map loads.
+func (s *webServer) recordStatsWhenReady(v *serverConfig, when string) {
+	go func() {
+		if !s.waitReady(s.ctx, v, s.config().startTimeout()) {
+			log.Printf("stats %s: not ready %s", v.Name, when)
+			return
+		}
+		s.recordStats(s.ctx, v, when)
+	}()
+}
+
+// restartWithStats restarts the unit, recording the server's stats right
+// before and, once the server is ready again, after the restart.
+func (s *webServer) restartWithStats(ctx context.Context, unit string) error {
+	v := s.config().serverByUnit(unit)
+	if v == nil {
+		return systemdctl.Restart(ctx, unit)
+	}
+	s.recordStats(ctx, v, "before restart")
+	if err := systemdctl.Restart(ctx, unit); err != nil {
+		return err
+	}
+	s.recordStatsWhenReady(v, "after restart")
+	return nil
+}
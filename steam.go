@@ -0,0 +1,377 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maruel/subcommands"
+
+	"github.com/maruel/ark-serman/internal/trace"
+)
+
+// steamConfig is the Steam account steamcmd logs in with, for the private
+// branches and the workshop items that can't be downloaded anonymously.
+//
+// ark-serman doesn't store the account's password: `ark-serman steam login`
+// runs steamcmd interactively once, for the password and the Steam Guard
+// code, and steamcmd caches the credentials in the service user's home.
+type steamConfig struct {
+	// Username is the Steam account. Anonymous when empty.
+	Username string `json:"username,omitempty"`
+	// Branch is the beta branch of the dedicated servers, e.g. "preaquatica".
+	Branch string `json:"branch,omitempty"`
+	// BranchPasswordFile holds the password of a private branch. It must only
+	// be readable by the service user.
+	BranchPasswordFile string `json:"branch_password_file,omitempty"`
+}
+
+func (s *steamConfig) validate() error {
+	if strings.ContainsAny(s.Username, " \t\"") || strings.ContainsAny(s.Branch, " \t\"") {
+		return errors.New("steam: invalid username or branch")
+	}
+	if s.BranchPasswordFile != "" && s.Branch == "" {
+		return errors.New("steam: branch_password_file requires a branch")
+	}
+	return nil
+}
+
+// steamUser returns the account steamcmd logs in with.
+func (c *config) steamUser() string {
+	if c.Steam == nil || c.Steam.Username == "" {
+		return "anonymous"
+	}
+	return c.Steam.Username
+}
+
+// branchArgs returns the +app_update arguments selecting the beta branch.
+func (c *config) branchArgs() ([]string, error) {
+	if c.Steam == nil || c.Steam.Branch == "" {
+		return nil, nil
+	}
+	out := []string{"-beta", c.Steam.Branch}
+	if p := c.Steam.BranchPasswordFile; p != "" {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if fi.Mode().Perm()&0o077 != 0 {
+			return nil, fmt.Errorf("%s is readable by other users; run chmod 600 %s", p, p)
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		pw := strings.TrimSpace(string(b))
+		if strings.ContainsAny(pw, "\"\r\n") {
+			return nil, fmt.Errorf("%s: the password can't contain quotes", p)
+		}
+		out = append(out, "-betapassword", pw)
+	}
+	return out, nil
+}
+
+// steamLoginError is steamcmd failing on the login or on an item that needs
+// one, instead of the download itself.
+type steamLoginError struct {
+	User   string
+	Reason string
+}
+
+func (e *steamLoginError) Error() string {
+	if e.User == "anonymous" {
+		return "steamcmd: " + e.Reason + "; the item likely requires a Steam account: set steam.username in the configuration, then run `ark-serman steam login`"
+	}
+	return "steamcmd: " + e.Reason + "; run `ark-serman steam login` as the service user to cache the credentials of " + e.User
+}
+
+// steamLoginProblems are the steamcmd messages about the login, in lower
+// case, and what they mean.
+var steamLoginProblems = []struct{ msg, reason string }{
+	{"steam guard code", "Steam Guard asked for a code"},
+	{"two-factor code", "Steam Guard asked for a code"},
+	{"invalid login auth code", "the Steam Guard code was rejected"},
+	{"cached credentials not found", "no cached credentials"},
+	{"password:", "steamcmd asked for the password, the cached credentials are missing or expired"},
+	{"invalid password", "the login was rejected"},
+	{"login failure", "the login was rejected"},
+	{"rate limit exceeded", "too many login attempts, wait before retrying"},
+	{"invalid beta password", "the branch's password was rejected"},
+	{"no subscription", "the account doesn't own the app, branch or item"},
+}
+
+// steamLoginProblem returns the login problem in the steamcmd output, if
+// any.
+func steamLoginProblem(user string, out []byte) error {
+	l := bytes.ToLower(out)
+	for _, p := range steamLoginProblems {
+		if bytes.Contains(l, []byte(p.msg)) {
+			return &steamLoginError{User: user, Reason: p.reason}
+		}
+	}
+	return nil
+}
+
+// tailBuffer keeps the last bytes written.
+type tailBuffer struct {
+	mu  sync.Mutex
+	max int
+	b   []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.b = append(t.b, p...)
+	if len(t.b) > t.max {
+		t.b = append(t.b[:0], t.b[len(t.b)-t.max:]...)
+	}
+	return len(p), nil
+}
+
+// progressRe matches the progress lines of steamcmd, e.g.
+// " Update state (0x61) downloading, progress: 45.12 (1234567 / 2736123)".
+var progressRe = regexp.MustCompile(`state \(0x[0-9a-f]+\) ([a-z ]+), progress: ([0-9.]+) \(([0-9]+) / ([0-9]+)\)`)
+
+// steamProgress reports the progress and the throughput of steamcmd's
+// downloads in the locks held by the ctx's owner.
+type steamProgress struct {
+	ctx   context.Context
+	line  []byte
+	bytes int64
+	last  time.Time
+}
+
+func (p *steamProgress) Write(b []byte) (int, error) {
+	p.line = append(p.line, b...)
+	for {
+		i := bytes.IndexAny(p.line, "\r\n")
+		if i == -1 {
+			break
+		}
+		p.parse(string(p.line[:i]))
+		p.line = p.line[i+1:]
+	}
+	if len(p.line) > 4096 {
+		p.line = p.line[:0]
+	}
+	return len(b), nil
+}
+
+func (p *steamProgress) parse(l string) {
+	m := progressRe.FindStringSubmatch(l)
+	if m == nil {
+		return
+	}
+	done, _ := strconv.ParseInt(m[3], 10, 64)
+	total, _ := strconv.ParseInt(m[4], 10, 64)
+	now := time.Now()
+	if p.last.IsZero() || done < p.bytes {
+		p.bytes, p.last = done, now
+		return
+	}
+	dt := now.Sub(p.last)
+	if dt < 2*time.Second {
+		return
+	}
+	rate := float64(done-p.bytes) / dt.Seconds()
+	p.bytes, p.last = done, now
+	setLockProgress(p.ctx, fmt.Sprintf("%s %s%% of %s at %s/s", m[1], m[2], formatSize(total, false), formatSize(int64(rate), false)))
+}
+
+// redactArgs returns the steamcmd arguments without the branch password, to
+// be logged or traced. steamcmdIn passes them in a runscript, not on the
+// command line.
+func redactArgs(args []string) []string {
+	out := append([]string(nil), args...)
+	for i := 0; i+1 < len(out); i++ {
+		if out[i] == "-betapassword" {
+			out[i+1] = "<redacted>"
+		}
+	}
+	return out
+}
+
+// writeSteamScript writes the steamcmd commands args, e.g. "+login", "bob",
+// in a runscript only the service user can read, in a new temporary
+// directory. The command line is visible to all the users, e.g. with ps, so
+// the branch password must not be on it.
+func writeSteamScript(args []string) (string, error) {
+	var b strings.Builder
+	for i, a := range args {
+		if strings.ContainsAny(a, "\"\r\n") {
+			return "", errors.New("steamcmd: invalid character in the arguments")
+		}
+		switch {
+		case strings.HasPrefix(a, "+"):
+			if i != 0 {
+				b.WriteByte('\n')
+			}
+			b.WriteString(a[1:])
+		case a == "" || strings.ContainsAny(a, " \t"):
+			b.WriteString(" \"" + a + "\"")
+		default:
+			b.WriteString(" " + a)
+		}
+	}
+	b.WriteByte('\n')
+	d, err := os.MkdirTemp("", "ark-serman-steamcmd")
+	if err != nil {
+		return "", err
+	}
+	p := filepath.Join(d, "script.txt")
+	if err := os.WriteFile(p, []byte(b.String()), 0o600); err != nil {
+		os.RemoveAll(d)
+		return "", err
+	}
+	return p, nil
+}
+
+// steamcmdIn runs steamcmd on the installation directory dir, within
+// download_limit_kbps. steamcmd can't prompt: a login it needs is reported
+// as a steamLoginError rather than a hang or an opaque failure.
+func steamcmdIn(ctx context.Context, c *config, dir string, args ...string) error {
+	_, span := trace.Start(ctx, "steamcmd", trace.Client, "steamcmd.dir", dir, "steamcmd.args", strings.Join(redactArgs(args), " "))
+	user := c.steamUser()
+	pre := []string{"+force_install_dir", dir}
+	if c.DownloadLimitKbps > 0 {
+		pre = append(pre, "+set_download_throttle", strconv.Itoa(c.DownloadLimitKbps))
+	}
+	args = append(append(pre, "+login", user), append(args, "+quit")...)
+	script, err := writeSteamScript(args)
+	if err != nil {
+		span.End(err)
+		return err
+	}
+	defer os.RemoveAll(filepath.Dir(script))
+	cmd := exec.CommandContext(ctx, "/usr/games/steamcmd", "+runscript", script)
+	out := &tailBuffer{max: 64 << 10}
+	prog := &steamProgress{ctx: ctx}
+	cmd.Stdout = io.MultiWriter(os.Stdout, out, prog)
+	cmd.Stderr = io.MultiWriter(os.Stderr, out)
+	err = cmd.Run()
+	setLockProgress(ctx, "")
+	// steamcmd sometimes exits with 0 after a failed login.
+	if err2 := steamLoginProblem(user, out.b); err2 != nil {
+		err = err2
+	}
+	span.End(err)
+	return err
+}
+
+// checkSteamLogin verifies that steamcmd can log in without prompting, so an
+// update fails before stopping the servers rather than midway.
+func checkSteamLogin(ctx context.Context, c *config) error {
+	user := c.steamUser()
+	if user == "anonymous" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "/usr/games/steamcmd", "+login", user, "+quit").CombinedOutput()
+	if err2 := steamLoginProblem(user, out); err2 != nil {
+		return err2
+	}
+	if err != nil {
+		return fmt.Errorf("steamcmd login: %w", err)
+	}
+	return nil
+}
+
+// steamDirs are the directories where steamcmd may cache the credentials,
+// relative to the home directory.
+var steamDirs = []string{"Steam", ".steam", ".local/share/Steam"}
+
+// protectSteamDirs makes steamcmd's credentials cache only readable by the
+// service user.
+func protectSteamDirs() error {
+	h, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	for _, d := range steamDirs {
+		p := filepath.Join(h, d)
+		fi, err := os.Stat(p)
+		if err != nil || fi.Mode().Perm()&0o077 == 0 {
+			continue
+		}
+		if err := os.Chmod(p, fi.Mode().Perm()&0o700); err != nil {
+			return err
+		}
+		log.Printf("Restricted %s to the service user", p)
+	}
+	return nil
+}
+
+//
+
+var cmdSteam = &subcommands.Command{
+	UsageLine: "steam <options> <login|check>",
+	ShortDesc: "Caches the Steam credentials of steamcmd",
+	LongDesc:  "Caches the credentials of the Steam account set as steam.username, for the private branches and the workshop items requiring a login.\n\n`steam login` runs steamcmd interactively to type the password and the Steam Guard code once; steamcmd then caches the credentials in the service user's home, which is restricted to the user. Run it as the service user. ark-serman never stores the password.\n`steam check` verifies that steamcmd logs in without prompting, like before each update.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &steamRun{}
+		c.args.flags()
+		return c
+	},
+}
+
+type steamRun struct {
+	args
+}
+
+func (s *steamRun) Run(a subcommands.Application, args []string, env subcommands.Env) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "%s: Expected one of login or check.\n", a.GetName())
+		return 1
+	}
+	c, err := loadConfig(s.configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	ctx := context.Background()
+	switch args[0] {
+	case "login":
+		if c.steamUser() == "anonymous" {
+			err = errors.New("set steam.username in the configuration first")
+			break
+		}
+		cmd := exec.CommandContext(ctx, "/usr/games/steamcmd", "+login", c.steamUser(), "+quit")
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err = cmd.Run(); err == nil {
+			if err = protectSteamDirs(); err == nil {
+				err = checkSteamLogin(ctx, c)
+			}
+		}
+	case "check":
+		err = checkSteamLogin(ctx, c)
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	if !s.quiet {
+		fmt.Printf("steamcmd logs in as %s without prompting\n", c.steamUser())
+	}
+	return 0
+}
@@ -0,0 +1,174 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSteamLoginProblem(t *testing.T) {
+	data := []struct {
+		user string
+		out  string
+		want string
+	}{
+		{"anonymous", "Success! App '376030' fully installed.", ""},
+		{"anonymous", "ERROR! Failed to install app '376030' (No subscription)", "the account doesn't own the app, branch or item"},
+		{"bob", "Logging in user 'bob' to Steam Public...\nPassword:", "steamcmd asked for the password, the cached credentials are missing or expired"},
+		{"bob", "Please check your email for the message from Steam, and enter the Steam Guard code", "Steam Guard asked for a code"},
+		{"bob", "FAILED (Rate Limit Exceeded)", "too many login attempts, wait before retrying"},
+		{"bob", "Invalid beta password", "the branch's password was rejected"},
+	}
+	for i, l := range data {
+		err := steamLoginProblem(l.user, []byte(l.out))
+		if l.want == "" {
+			if err != nil {
+				t.Errorf("#%d: %v", i, err)
+			}
+			continue
+		}
+		var e *steamLoginError
+		if !errors.As(err, &e) || e.Reason != l.want || e.User != l.user {
+			t.Errorf("#%d: got %v, want %q", i, err, l.want)
+			continue
+		}
+		// The fix differs for anonymous, which has no account.
+		if hint := strings.Contains(err.Error(), "set steam.username"); hint != (l.user == "anonymous") {
+			t.Errorf("#%d: %v", i, err)
+		}
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	data := []struct {
+		args []string
+		want []string
+	}{
+		{nil, nil},
+		{[]string{"+app_update", "376030", "validate"}, []string{"+app_update", "376030", "validate"}},
+		{
+			[]string{"+app_update", "376030", "-beta", "preaquatica", "-betapassword", "hunter2"},
+			[]string{"+app_update", "376030", "-beta", "preaquatica", "-betapassword", "<redacted>"},
+		},
+		{[]string{"-betapassword"}, []string{"-betapassword"}},
+	}
+	for i, l := range data {
+		orig := append([]string(nil), l.args...)
+		if got := redactArgs(l.args); !reflect.DeepEqual(got, l.want) {
+			t.Errorf("#%d: got %q, want %q", i, got, l.want)
+		}
+		// The actual command line is left intact.
+		if !reflect.DeepEqual(l.args, orig) {
+			t.Errorf("#%d: modified %q", i, l.args)
+		}
+	}
+}
+
+func TestWriteSteamScript(t *testing.T) {
+	data := []struct {
+		args []string
+		want string
+		err  bool
+	}{
+		{
+			[]string{"+force_install_dir", "/srv/ark/My Game", "+login", "bob", "+app_update", "376030", "-beta", "b", "-betapassword", "hunter2", "validate", "+quit"},
+			"force_install_dir \"/srv/ark/My Game\"\nlogin bob\napp_update 376030 -beta b -betapassword hunter2 validate\nquit\n",
+			false,
+		},
+		{[]string{"+login", "anonymous", "+workshop_download_item", "346110", "1", "+quit"}, "login anonymous\nworkshop_download_item 346110 1\nquit\n", false},
+		{[]string{"+login", "a\"b"}, "", true},
+		{[]string{"+login", "a\nquit"}, "", true},
+	}
+	for i, l := range data {
+		p, err := writeSteamScript(l.args)
+		if l.err {
+			if err == nil {
+				t.Errorf("#%d: expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := os.ReadFile(p)
+		fi, _ := os.Stat(p)
+		os.RemoveAll(filepath.Dir(p))
+		if string(b) != l.want {
+			t.Errorf("#%d: got %q, want %q", i, b, l.want)
+		}
+		if fi.Mode().Perm() != 0o600 {
+			t.Errorf("#%d: mode %s", i, fi.Mode())
+		}
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	b := tailBuffer{max: 8}
+	for _, s := range []string{"0123", "4567", "89ab"} {
+		if n, err := b.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatal(n, err)
+		}
+	}
+	if got := string(b.b); got != "456789ab" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestProgressRe(t *testing.T) {
+	data := []struct {
+		line string
+		want []string
+	}{
+		{" Update state (0x61) downloading, progress: 45.12 (1234567 / 2736123)", []string{"downloading", "45.12", "1234567", "2736123"}},
+		{" Update state (0x81) verifying update, progress: 0.00 (0 / 18446744)", []string{"verifying update", "0.00", "0", "18446744"}},
+		{"Success! App '376030' fully installed.", nil},
+		{" Update state (0x61) downloading, progress: 45.12", nil},
+	}
+	for i, l := range data {
+		m := progressRe.FindStringSubmatch(l.line)
+		if m != nil {
+			m = m[1:]
+		}
+		if !reflect.DeepEqual(m, l.want) {
+			t.Errorf("#%d: got %q, want %q", i, m, l.want)
+		}
+	}
+}
+
+func TestSteamProgressWrite(t *testing.T) {
+	p := &steamProgress{ctx: context.Background()}
+	// steamcmd rewrites the line with \r; the writes are cut anywhere.
+	for _, s := range []string{"Loading Steam API...OK\n Update state (0x61) downloading, progr", "ess: 1.00 (100 / 10000)\r", " Update state (0x61) down"} {
+		if n, err := p.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatal(n, err)
+		}
+	}
+	if p.bytes != 100 || p.last.IsZero() {
+		t.Fatalf("got %d bytes", p.bytes)
+	}
+	if got := string(p.line); got != " Update state (0x61) down" {
+		t.Fatalf("pending %q", got)
+	}
+	// A restarted download resets the count.
+	if _, err := p.Write([]byte(" Update state (0x61) downloading, progress: 0.50 (50 / 10000)\n")); err != nil {
+		t.Fatal(err)
+	}
+	if p.bytes != 50 || len(p.line) != 0 {
+		t.Fatalf("got %d bytes, pending %q", p.bytes, p.line)
+	}
+	// A line without an end doesn't grow forever.
+	if _, err := p.Write(make([]byte, 5000)); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.line) != 0 {
+		t.Fatalf("pending %d bytes", len(p.line))
+	}
+}
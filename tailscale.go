@@ -0,0 +1,118 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// tailscaleClient talks to the local tailscaled via its LocalAPI, to identify
+// the tailnet users making requests without embedding a Tailscale node.
+type tailscaleClient struct {
+	c *http.Client
+
+	mu    sync.Mutex
+	cache map[string]tailscaleWhois
+}
+
+type tailscaleWhois struct {
+	login string
+	err   error
+	t     time.Time
+}
+
+func newTailscaleClient(socket string) *tailscaleClient {
+	return &tailscaleClient{
+		c: &http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+		cache: map[string]tailscaleWhois{},
+	}
+}
+
+// get calls the LocalAPI and decodes the JSON reply.
+func (t *tailscaleClient) get(ctx context.Context, p string, v any) error {
+	// The host must be this one for tailscaled to accept the request.
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://local-tailscaled.sock/localapi/v0/"+p, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("tailscale: %s: %s", p, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// addrs returns the host's Tailscale IPs.
+func (t *tailscaleClient) addrs(ctx context.Context) ([]string, error) {
+	var st struct {
+		Self struct {
+			TailscaleIPs []string
+		}
+	}
+	if err := t.get(ctx, "status", &st); err != nil {
+		return nil, err
+	}
+	if len(st.Self.TailscaleIPs) == 0 {
+		return nil, fmt.Errorf("tailscale: no IP; is the node logged in?")
+	}
+	return st.Self.TailscaleIPs, nil
+}
+
+// whois returns the login name of the tailnet user at the remote address.
+// Results are cached for a minute.
+func (t *tailscaleClient) whois(ctx context.Context, remote string) (string, error) {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return "", err
+	}
+	t.mu.Lock()
+	w, ok := t.cache[host]
+	t.mu.Unlock()
+	if ok && time.Since(w.t) < time.Minute {
+		return w.login, w.err
+	}
+	var r struct {
+		UserProfile struct {
+			LoginName string
+		}
+	}
+	w = tailscaleWhois{t: time.Now()}
+	if w.err = t.get(ctx, "whois?addr="+url.QueryEscape(remote), &r); w.err == nil {
+		w.login = r.UserProfile.LoginName
+	}
+	t.mu.Lock()
+	t.cache[host] = w
+	t.mu.Unlock()
+	return w.login, w.err
+}
+
+// tailscaleUser returns the configured user mapped to the tailnet login.
+func (c *config) tailscaleUser(login string) *userConfig {
+	for i := range c.Users {
+		if c.Users[i].TailscaleLogin != "" && c.Users[i].TailscaleLogin == login {
+			return &c.Users[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// taskRunsShown is the number of runs shown per task.
+	taskRunsShown = 10
+	// taskRunKeep is how long the runs are kept.
+	taskRunKeep = 90 * 24 * time.Hour
+)
+
+// taskLogLine is a step logged by a task run.
+type taskLogLine struct {
+	Time time.Time `json:"time"`
+	Msg  string    `json:"msg"`
+}
+
+// taskRun is a run of a scheduled task by the internal scheduler, an entry
+// of bucketTaskRuns.
+type taskRun struct {
+	Task  string        `json:"task"`
+	Start time.Time     `json:"start"`
+	End   time.Time     `json:"end"`
+	Err   string        `json:"err,omitempty"`
+	Steps []taskLogLine `json:"steps,omitempty"`
+
+	mu sync.Mutex
+}
+
+type taskRunKeyType struct{}
+
+var taskRunKey taskRunKeyType
+
+// taskLogf logs the step and records it in the task run of the context, if
+// any.
+func taskLogf(ctx context.Context, format string, a ...any) {
+	msg := fmt.Sprintf(format, a...)
+	log.Print(msg)
+	if t, _ := ctx.Value(taskRunKey).(*taskRun); t != nil {
+		t.mu.Lock()
+		t.Steps = append(t.Steps, taskLogLine{Time: time.Now().UTC(), Msg: msg})
+		t.mu.Unlock()
+	}
+}
+
+// recordTaskRun runs the task with f and records the run with the steps
+// logged by taskLogf.
+func (s *webServer) recordTaskRun(ctx context.Context, name string, f func(ctx context.Context) error) error {
+	t := &taskRun{Task: name, Start: time.Now().UTC()}
+	err := f(context.WithValue(ctx, taskRunKey, t))
+	t.End = time.Now().UTC()
+	if err != nil {
+		t.Err = err.Error()
+	}
+	if s.db != nil {
+		if err := s.db.appendTime(bucketTaskRuns, t.Start, t); err != nil {
+			log.Printf("%s: %v", name, err)
+		}
+		if _, err := s.db.purgeBefore(bucketTaskRuns, time.Now().Add(-taskRunKeep)); err != nil {
+			log.Printf("%s: %v", name, err)
+		}
+	}
+	return err
+}
+
+// taskRuns returns the last runs of the task, most recent first.
+func (s *store) taskRuns(name string, n int) ([]*taskRun, error) {
+	var out []*taskRun
+	err := s.last(bucketTaskRuns, func(k, v []byte) bool {
+		t := &taskRun{}
+		if json.Unmarshal(v, t) == nil && t.Task == name {
+			out = append(out, t)
+		}
+		return len(out) < n
+	})
+	return out, err
+}
+
+// taskStep is a step a task would do, as simulated.
+type taskStep struct {
+	Server string
+	// At is the time since the start of the task; the countdown broadcasts
+	// are before it.
+	At      time.Duration
+	Action  string
+	Command string
+	// Duration is the expected duration of the step; zero when unknown.
+	Duration time.Duration
+}
+
+// simulateTask returns what the task would do now, without doing it, and the
+// expected duration of the whole task.
+func (s *webServer) simulateTask(ctx context.Context, name string) ([]taskStep, time.Duration, error) {
+	c := s.config()
+	if name == "rolling-restart" {
+		r := c.RollingRestart
+		if r == nil {
+			return nil, 0, errors.New("rolling_restart isn't configured")
+		}
+		s.mu.Lock()
+		servers := rollingCandidates(c, s.lastStates)
+		s.mu.Unlock()
+		if len(servers) == 0 {
+			return []taskStep{{Action: "nothing to restart, no cluster member is running"}}, 0, nil
+		}
+		var saves map[string][]time.Duration
+		if s.db != nil {
+			_, l, err := s.db.saveTimes(time.Now().Add(-7 * 24 * time.Hour))
+			if err != nil {
+				return nil, 0, err
+			}
+			saves = map[string][]time.Duration{}
+			for _, st := range l {
+				saves[st.Server] = append(saves[st.Server], st.Duration)
+			}
+		}
+		var out []taskStep
+		var total time.Duration
+		warning := r.warning()
+		for _, v := range servers {
+			for _, m := range r.countdown() {
+				out = append(out, taskStep{Server: v.Name, At: warning - m, Action: "countdown broadcast", Command: fmt.Sprintf("Broadcast Server restart in %s.", m)})
+			}
+			check := "ok"
+			if err := preflight(c, v); err != nil {
+				check = "would fail: " + err.Error()
+			} else if h := serverLock(c, v); h != nil {
+				check = "would wait for " + h.String()
+			}
+			out = append(out, taskStep{Server: v.Name, Action: "lock and preflight checks: " + check})
+			pol := c.stepPolicy("restart", r.Policy)
+			out = append(out, taskStep{Server: v.Name, Action: "restart policy: " + pol.String()})
+			sched := warningSchedule(warning)
+			for _, left := range sched {
+				out = append(out, taskStep{Server: v.Name, At: warning - left, Action: "warn the players", Command: fmt.Sprintf("Broadcast Server restart in %s.", left.Round(time.Second))})
+			}
+			// The median of the last week, a slow save delays the restart.
+			save := time.Duration(0)
+			if l := saves[v.Name]; len(l) != 0 {
+				slices.Sort(l)
+				save = l[len(l)/2]
+			}
+			out = append(out, taskStep{Server: v.Name, At: warning, Action: "save the world", Command: v.gameInfo().SaveWorld, Duration: save})
+			out = append(out, taskStep{Server: v.Name, At: warning + save, Action: "restart, then wait for the server to answer RCON", Command: "systemctl --user restart " + v.unitName(), Duration: c.startTimeout()})
+			// The servers restart concurrently.
+			total = max(total, warning+save+c.startTimeout())
+		}
+		sort.SliceStable(out, func(i, j int) bool { return out[i].At < out[j].At })
+		return out, total, nil
+	}
+	cfg, t := c.pluginTaskByName(name)
+	if cfg == nil {
+		return nil, 0, fmt.Errorf("unknown task %q", name)
+	}
+	p := s.plugins.get(cfg.Name)
+	if p == nil {
+		return nil, 0, fmt.Errorf("unknown plugin %q", cfg.Name)
+	}
+	info, err := p.describe(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !slices.Contains(info.Tasks, t.Type) {
+		return nil, 0, fmt.Errorf("plugin %s doesn't provide the task %q", cfg.Name, t.Type)
+	}
+	servers, err := c.selectServers(t.Servers)
+	if err != nil {
+		return nil, 0, err
+	}
+	names := make([]string, len(servers))
+	for i, v := range servers {
+		names[i] = v.Name
+	}
+	pol := c.stepPolicy("plugin", t.Policy)
+	return []taskStep{{Server: strings.Join(names, ", "), Action: "the plugin " + cfg.Name + " runs the task; its actions are up to the plugin; policy: " + pol.String(), Command: "Plugin.RunTask " + t.Type}}, 0, nil
+}
+
+var taskTmpl = template.Must(template.ParseFS(rsc, "rsc/task.html.tmpl"))
+
+// serveTask serves a scheduled task's last runs at /tasks/<name>, and what
+// it would do with ?simulate=1.
+func (s *webServer) serveTask(w http.ResponseWriter, r *http.Request) {
+	c := s.config()
+	name := strings.TrimPrefix(r.URL.Path, "/tasks/")
+	i := slices.IndexFunc(c.scheduledTasks(), func(t scheduledTask) bool { return t.Name == name })
+	if i == -1 {
+		http.Error(w, "unknown task", http.StatusNotFound)
+		return
+	}
+	t := c.scheduledTasks()[i]
+	w.Header().Add("Content-Type", "text/html")
+	data := map[string]any{"Task": t.Name, "Schedule": strings.TrimSpace("daily at " + t.at + " " + c.Timezone)}
+	if c.Scheduler == "systemd" {
+		data["Service"] = t.serviceName()
+	}
+	if r.FormValue("simulate") != "" {
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+		steps, total, err := s.simulateTask(ctx, name)
+		if err != nil {
+			data["Err"] = err.Error()
+		}
+		data["Simulated"] = true
+		data["Steps"] = steps
+		data["Total"] = total
+	}
+	runs, err := s.db.taskRuns(name, taskRunsShown)
+	if err != nil {
+		data["Err"] = err.Error()
+	}
+	loc := c.displayLocation(userFrom(r.Context()))
+	for _, t := range runs {
+		t.Start, t.End = t.Start.In(loc), t.End.In(loc)
+		for i := range t.Steps {
+			t.Steps[i].Time = t.Steps[i].Time.In(loc)
+		}
+	}
+	data["Runs"] = runs
+	_ = taskTmpl.Execute(w, data)
+}
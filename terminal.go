@@ -0,0 +1,288 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/maruel/ark-serman/internal/websocket"
+	"golang.org/x/sys/unix"
+)
+
+// terminalTicketTTL is how long the ticket issued after the 2FA check can be
+// used to open the terminal.
+const terminalTicketTTL = time.Minute
+
+// terminalIdle closes the terminal after this long without input.
+const terminalIdle = 15 * time.Minute
+
+// terminalTickets are the one-time tickets opening a terminal. They are kept
+// in memory.
+type terminalTickets struct {
+	mu sync.Mutex
+	m  map[string]terminalTicket
+}
+
+type terminalTicket struct {
+	user    string
+	expires time.Time
+}
+
+// issue returns a new ticket for the user.
+func (t *terminalTickets) issue(name string) string {
+	b := make([]byte, 18)
+	_, _ = rand.Read(b)
+	id := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.m == nil {
+		t.m = map[string]terminalTicket{}
+	}
+	for k, v := range t.m {
+		if now.After(v.expires) {
+			delete(t.m, k)
+		}
+	}
+	t.m[id] = terminalTicket{user: name, expires: now.Add(terminalTicketTTL)}
+	return id
+}
+
+// use consumes the ticket and returns true if it was issued to the user and
+// didn't expire.
+func (t *terminalTickets) use(id, name string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v, ok := t.m[id]
+	delete(t.m, id)
+	return ok && v.user == name && time.Now().Before(v.expires)
+}
+
+// terminalAllowed returns why the user can't open the terminal, or nil.
+func (s *webServer) terminalAllowed(u *userConfig) error {
+	switch {
+	case !s.config().WebTerminal:
+		return errors.New("the web terminal is disabled; set web_terminal in the configuration")
+	case s.readOnly:
+		return errors.New("the web server is read-only")
+	case os.Geteuid() == 0:
+		return errors.New("refusing to open a root shell; run the web server as the service user")
+	case u == nil || !u.hasRole(roleAdmin) || u.readOnly:
+		return errors.New("the web terminal requires the admin role")
+	case u.TOTPSecret == "":
+		return errors.New("enroll two-factor authentication at /2fa/ to use the web terminal")
+	}
+	return nil
+}
+
+var terminalTmpl = template.Must(template.ParseFS(rsc, "rsc/terminal.html.tmpl"))
+
+// serveTerminal serves the host shell at /terminal/. The 2FA code is POSTed
+// to /rpc/terminal to be recorded in the audit log, which returns the page
+// opening the websocket at /terminal/ws with a one-time ticket.
+func (s *webServer) serveTerminal(w http.ResponseWriter, r *http.Request) {
+	u := s.config().user(userFrom(r.Context()).Name)
+	if r.URL.Path == "/terminal/ws" {
+		s.serveTerminalWS(w, r, u)
+		return
+	}
+	w.Header().Add("Content-Type", "text/html")
+	data := map[string]any{}
+	if err := s.terminalAllowed(u); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		data["Err"] = err.Error()
+		_ = terminalTmpl.Execute(w, data)
+		return
+	}
+	if r.Method == "POST" && r.URL.Path == "/rpc/terminal" {
+		setAuditDetail(r.Context(), "open")
+		if !s.checkSecondFactor(u, r.FormValue("code")) {
+			s.authFailed(r, u.Name, "totp")
+			w.WriteHeader(http.StatusForbidden)
+			data["Err"] = "invalid code"
+		} else {
+			data["Ticket"] = s.terms.issue(u.Name)
+		}
+	}
+	_ = terminalTmpl.Execute(w, data)
+}
+
+// terminalResize is the text message sent by the page when the terminal is
+// resized. The keys are sent as binary messages.
+type terminalResize struct {
+	Cols uint16 `json:"cols"`
+	Rows uint16 `json:"rows"`
+}
+
+func (s *webServer) serveTerminalWS(w http.ResponseWriter, r *http.Request, u *userConfig) {
+	if err := s.terminalAllowed(u); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if !s.terms.use(r.FormValue("ticket"), u.Name) {
+		http.Error(w, "invalid or expired ticket", http.StatusForbidden)
+		return
+	}
+	ptm, cmd, err := startShell()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		ptm.Close()
+		return
+	}
+	start := time.Now()
+	log.Printf("terminal: %s opened a shell from %s, pid %d", u.Name, s.remoteAddr(r.RemoteAddr), cmd.Process.Pid)
+	done := make(chan struct{})
+	go func() {
+		// Shell to browser.
+		defer close(done)
+		b := make([]byte, 16*1024)
+		for {
+			n, err := ptm.Read(b)
+			if n > 0 {
+				if conn.WriteMessage(websocket.Binary, b[:n]) != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		// The shell exited or the connection broke.
+		<-done
+		conn.Close()
+	}()
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(terminalIdle))
+		op, msg, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if op == websocket.Text {
+			var sz terminalResize
+			if json.Unmarshal(msg, &sz) == nil && sz.Cols != 0 && sz.Rows != 0 {
+				_ = setWinsize(ptm, sz.Rows, sz.Cols)
+			}
+			continue
+		}
+		if _, err := ptm.Write(msg); err != nil {
+			break
+		}
+	}
+	conn.Close()
+	// Kill the whole session, including the background jobs.
+	_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGHUP)
+	_ = cmd.Process.Kill()
+	_ = cmd.Wait()
+	ptm.Close()
+	<-done
+	d := time.Since(start).Round(time.Second)
+	log.Printf("terminal: %s closed the shell, pid %d, after %s", u.Name, cmd.Process.Pid, d)
+	// The opening is audited by /rpc/terminal; record how long it lasted.
+	s.audit(auditEntry{Time: start, User: u.Name, Remote: s.remoteAddr(r.RemoteAddr), Action: "terminal", Status: http.StatusSwitchingProtocols, Detail: "session of " + d.String()})
+}
+
+// startShell starts the login shell of the service user in a new
+// pseudo-terminal and returns its controlling side.
+func startShell() (*os.File, *exec.Cmd, error) {
+	ptm, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	n := 0
+	err = ptyControl(ptm, func(fd int) error {
+		if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+			return fmt.Errorf("unlocking the pty: %w", err)
+		}
+		var err error
+		n, err = unix.IoctlGetInt(fd, unix.TIOCGPTN)
+		return err
+	})
+	if err != nil {
+		ptm.Close()
+		return nil, nil, err
+	}
+	pts, err := os.OpenFile("/dev/pts/"+strconv.Itoa(n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		ptm.Close()
+		return nil, nil, err
+	}
+	defer pts.Close()
+	_ = setWinsize(ptm, 24, 80)
+	me, err := user.Current()
+	if err != nil {
+		ptm.Close()
+		return nil, nil, err
+	}
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/bash"
+		if _, err := os.Stat(shell); err != nil {
+			shell = "/bin/sh"
+		}
+	}
+	cmd := exec.Command(shell, "-l")
+	if _, err := os.Stat(me.HomeDir); err == nil {
+		cmd.Dir = me.HomeDir
+	}
+	cmd.Env = []string{
+		"TERM=vt100",
+		"HOME=" + me.HomeDir,
+		"USER=" + me.Username,
+		"LOGNAME=" + me.Username,
+		"SHELL=" + shell,
+		"PATH=/usr/local/bin:/usr/bin:/bin",
+		"LANG=C.UTF-8",
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = pts, pts, pts
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	if err := cmd.Start(); err != nil {
+		ptm.Close()
+		return nil, nil, err
+	}
+	return ptm, cmd, nil
+}
+
+// ptyControl runs f on the file descriptor. f.Fd() would switch the file to
+// blocking mode and then Close wouldn't interrupt the pending Read.
+func ptyControl(f *os.File, fn func(fd int) error) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var err2 error
+	if err := rc.Control(func(fd uintptr) { err2 = fn(int(fd)) }); err != nil {
+		return err
+	}
+	return err2
+}
+
+// setWinsize sets the size of the pseudo-terminal; the shell gets SIGWINCH.
+func setWinsize(f *os.File, rows, cols uint16) error {
+	return ptyControl(f, func(fd int) error {
+		return unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, &unix.Winsize{Row: rows, Col: cols})
+	})
+}
@@ -0,0 +1,144 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/maruel/subcommands"
+)
+
+// apiToken authenticates a program or a kiosk instead of a user, e.g. a
+// lobby screen showing the dashboard.
+type apiToken struct {
+	Name string `json:"name"`
+	// Scope is "read", the default, to only view, or "write" to also run
+	// the actions of an operator.
+	Scope string `json:"scope,omitempty"`
+	// TokenHash is the SHA-256 of the token in hex. Use `ark-serman token`
+	// to generate it.
+	TokenHash string `json:"token_hash"`
+}
+
+// tokenUser returns the pseudo user authenticated by the token in the
+// Authorization: Bearer header or the token query parameter, or nil.
+func (c *config) tokenUser(r *http.Request) *userConfig {
+	token := triggerToken(r)
+	if token == "" {
+		return nil
+	}
+	for i := range c.Tokens {
+		t := &c.Tokens[i]
+		if !tokenMatches(t.TokenHash, token) {
+			continue
+		}
+		if t.Scope == "write" {
+			return &userConfig{Name: "token:" + t.Name, Role: roleOperator}
+		}
+		return &userConfig{Name: "token:" + t.Name, Role: roleViewer, readOnly: true}
+	}
+	return nil
+}
+
+// readOnlyPath returns true for the requests allowed in read-only mode.
+func readOnlyPath(r *http.Request) bool {
+	return r.Method == "GET" || r.Method == "HEAD" || r.URL.Path == "/login" || r.URL.Path == "/logout"
+}
+
+var cmdToken = &subcommands.Command{
+	UsageLine: "token <options> <set|remove|list>",
+	ShortDesc: "Manages the API tokens",
+	LongDesc:  "Manages the tokens authenticating programs and kiosks instead of users.\n\n`token -name <name> -scope read set` adds or updates a token and prints it; the previous token stops working. The token is sent as `Authorization: Bearer <token>` or, for a kiosk browser, as `?token=<token>` in the URL.\nScopes are read, which only views and rejects every change, and write, which runs the actions of an operator.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &tokenRun{}
+		c.args.flags()
+		c.Flags.StringVar(&c.name, "name", "", "token name")
+		c.Flags.StringVar(&c.scope, "scope", "read", "scope: read or write")
+		return c
+	},
+}
+
+type tokenRun struct {
+	args
+	name  string
+	scope string
+}
+
+func (t *tokenRun) Run(a subcommands.Application, args []string, env subcommands.Env) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "%s: Expected one of set, remove or list.\n", a.GetName())
+		return 1
+	}
+	c, err := loadConfig(t.configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	switch args[0] {
+	case "set":
+		err = t.set(c)
+	case "remove":
+		err = errors.New("unknown token")
+		for i := range c.Tokens {
+			if c.Tokens[i].Name == t.name {
+				c.Tokens = append(c.Tokens[:i], c.Tokens[i+1:]...)
+				err = c.save(t.configPath)
+				break
+			}
+		}
+	case "list":
+		for _, v := range c.Tokens {
+			scope := v.Scope
+			if scope == "" {
+				scope = "read"
+			}
+			fmt.Printf("%-16s %s\n", v.Name, scope)
+		}
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
+
+func (t *tokenRun) set(c *config) error {
+	if t.name == "" {
+		return errors.New("-name is required")
+	}
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	h := sha256.Sum256([]byte(token))
+	v := apiToken{Name: t.name, Scope: t.scope, TokenHash: hex.EncodeToString(h[:])}
+	found := false
+	for i := range c.Tokens {
+		if c.Tokens[i].Name == t.name {
+			c.Tokens[i], found = v, true
+		}
+	}
+	if !found {
+		c.Tokens = append(c.Tokens, v)
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+	if err := c.save(t.configPath); err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
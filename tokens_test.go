@@ -0,0 +1,106 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTokenUser(t *testing.T) {
+	hash := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+	c := &config{Tokens: []apiToken{
+		{Name: "kiosk", TokenHash: hash("r3ad")},
+		{Name: "ci", Scope: "write", TokenHash: hash("wr1te")},
+	}}
+	data := []struct {
+		name     string
+		header   string
+		query    string
+		want     string
+		role     string
+		readOnly bool
+	}{
+		{"none", "", "", "", "", false},
+		{"read header", "Bearer r3ad", "", "token:kiosk", roleViewer, true},
+		{"read query", "", "r3ad", "token:kiosk", roleViewer, true},
+		{"write", "Bearer wr1te", "", "token:ci", roleOperator, false},
+		{"wrong", "Bearer nope", "", "", "", false},
+		{"basic", "Basic cjNhZA==", "", "", "", false},
+	}
+	for _, l := range data {
+		t.Run(l.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/?token="+l.query, nil)
+			if l.header != "" {
+				r.Header.Set("Authorization", l.header)
+			}
+			u := c.tokenUser(r)
+			if u == nil {
+				if l.want != "" {
+					t.Fatalf("want %s", l.want)
+				}
+				return
+			}
+			if u.Name != l.want || u.Role != l.role || u.readOnly != l.readOnly {
+				t.Fatalf("got %+v", u)
+			}
+		})
+	}
+}
+
+func TestReadOnlyPath(t *testing.T) {
+	data := []struct {
+		method, path string
+		want         bool
+	}{
+		{"GET", "/", true},
+		{"HEAD", "/api/v1/servers", true},
+		{"GET", "/rpc/stop/ark-island.service", true},
+		{"POST", "/rpc/stop/ark-island.service", false},
+		{"POST", "/rpc/veto/ark-island.service", false},
+		{"POST", "/login", true},
+		{"POST", "/logout", true},
+		{"DELETE", "/api/v1/bookmarks/x", false},
+	}
+	for _, l := range data {
+		if got := readOnlyPath(httptest.NewRequest(l.method, l.path, nil)); got != l.want {
+			t.Errorf("%s %s: got %t, want %t", l.method, l.path, got, l.want)
+		}
+	}
+}
+
+func TestRPCVetoRequiresOperator(t *testing.T) {
+	data := []struct {
+		name   string
+		method string
+		user   *userConfig
+		want   int
+	}{
+		{"get", "GET", anonymous, http.StatusMethodNotAllowed},
+		{"viewer", "POST", &userConfig{Name: "v", Role: roleViewer}, http.StatusForbidden},
+		{"read token", "POST", &userConfig{Name: "token:kiosk", Role: roleOperator, readOnly: true}, http.StatusForbidden},
+		// No vote is pending.
+		{"operator", "POST", &userConfig{Name: "o", Role: roleOperator}, http.StatusNotFound},
+	}
+	s := &webServer{}
+	for _, l := range data {
+		t.Run(l.name, func(t *testing.T) {
+			r := httptest.NewRequest(l.method, "/rpc/veto/ark-island.service", nil)
+			r = r.WithContext(context.WithValue(r.Context(), userKey, l.user))
+			w := httptest.NewRecorder()
+			s.rpcVeto(w, r)
+			if w.Code != l.want {
+				t.Fatalf("got %d, want %d", w.Code, l.want)
+			}
+		})
+	}
+}
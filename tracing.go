@@ -0,0 +1,77 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/maruel/ark-serman/internal/trace"
+)
+
+// tracingConfig is the export of the traces to an OpenTelemetry collector.
+type tracingConfig struct {
+	// Endpoint is the collector's OTLP/HTTP URL, e.g. http://localhost:4318.
+	Endpoint string `json:"endpoint"`
+	// Headers are sent to the collector, e.g. {"Authorization": "Bearer x"}.
+	Headers map[string]string `json:"headers,omitempty"`
+	// ServiceName is the traces' service.name. Defaults to ark-serman.
+	ServiceName string `json:"service_name,omitempty"`
+}
+
+func (t *tracingConfig) validate() error {
+	if !strings.HasPrefix(t.Endpoint, "http://") && !strings.HasPrefix(t.Endpoint, "https://") {
+		return errors.New("tracing: endpoint must be a http(s):// URL")
+	}
+	return nil
+}
+
+// startTracing starts the export of the traces when configured. The returned
+// function sends the pending spans; call it before exiting.
+func (c *config) startTracing() func() {
+	if c.Tracing == nil {
+		return func() {}
+	}
+	n := c.Tracing.ServiceName
+	if n == "" {
+		n = "ark-serman"
+	}
+	stop, err := trace.Init(trace.Config{Endpoint: c.Tracing.Endpoint, Headers: c.Tracing.Headers, Service: n})
+	if err != nil {
+		log.Printf("tracing: %v", err)
+		return func() {}
+	}
+	return stop
+}
+
+// traceHTTP records a span per request, continuing the caller's trace when
+// the request has a traceparent header. w is the access logger's
+// statusWriter, which knows the status code.
+func traceHTTP(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeName(r.URL.Path)
+		// The query isn't recorded, it may hold a token.
+		ctx, span := trace.StartRemote(r.Context(), r.Method+" "+route, trace.Server, r.Header.Get("traceparent"),
+			"http.request.method", r.Method, "http.route", route, "url.path", r.URL.Path)
+		if span == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(ctx))
+		code := http.StatusOK
+		if sw, ok := w.(*statusWriter); ok && sw.status != 0 {
+			code = sw.status
+		}
+		span.SetAttr("http.response.status_code", strconv.Itoa(code))
+		var err error
+		if code >= 500 {
+			err = errors.New(http.StatusText(code))
+		}
+		span.End(err)
+	})
+}
@@ -0,0 +1,198 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/maruel/subcommands"
+)
+
+// clusterConfig holds the settings shared by all the members of a cluster.
+type clusterConfig struct {
+	ID        string         `json:"id"`
+	Transfers transferPolicy `json:"transfers"`
+}
+
+// transferPolicy are the cross-server transfer settings. Mismatched values
+// between the members silently lose the players' uploads, so they are set on
+// every member's command line, overriding GameUserSettings.ini.
+type transferPolicy struct {
+	NoTributeDownloads       bool `json:"no_tribute_downloads,omitempty"`
+	PreventDownloadSurvivors bool `json:"prevent_download_survivors,omitempty"`
+	PreventDownloadItems     bool `json:"prevent_download_items,omitempty"`
+	PreventDownloadDinos     bool `json:"prevent_download_dinos,omitempty"`
+	PreventUploadSurvivors   bool `json:"prevent_upload_survivors,omitempty"`
+	PreventUploadItems       bool `json:"prevent_upload_items,omitempty"`
+	PreventUploadDinos       bool `json:"prevent_upload_dinos,omitempty"`
+	// Expirations are in seconds; the game default is used when 0.
+	TributeItemExpirationSeconds      int `json:"tribute_item_expiration_seconds,omitempty"`
+	TributeDinoExpirationSeconds      int `json:"tribute_dino_expiration_seconds,omitempty"`
+	TributeCharacterExpirationSeconds int `json:"tribute_character_expiration_seconds,omitempty"`
+}
+
+// transferField is one setting of transferPolicy, named as the game option.
+type transferField struct {
+	name string
+	b    *bool
+	i    *int
+}
+
+func (t *transferPolicy) fields() []transferField {
+	return []transferField{
+		{name: "NoTributeDownloads", b: &t.NoTributeDownloads},
+		{name: "PreventDownloadSurvivors", b: &t.PreventDownloadSurvivors},
+		{name: "PreventDownloadItems", b: &t.PreventDownloadItems},
+		{name: "PreventDownloadDinos", b: &t.PreventDownloadDinos},
+		{name: "PreventUploadSurvivors", b: &t.PreventUploadSurvivors},
+		{name: "PreventUploadItems", b: &t.PreventUploadItems},
+		{name: "PreventUploadDinos", b: &t.PreventUploadDinos},
+		{name: "TributeItemExpirationSeconds", i: &t.TributeItemExpirationSeconds},
+		{name: "TributeDinoExpirationSeconds", i: &t.TributeDinoExpirationSeconds},
+		{name: "TributeCharacterExpirationSeconds", i: &t.TributeCharacterExpirationSeconds},
+	}
+}
+
+// options returns the URL options. The booleans are always set so no member
+// keeps a different value from its INI.
+func (t *transferPolicy) options() []string {
+	var out []string
+	for _, f := range t.fields() {
+		if f.b != nil {
+			v := "False"
+			if *f.b {
+				v = "True"
+			}
+			out = append(out, f.name+"="+v)
+		} else if *f.i != 0 {
+			out = append(out, f.name+"="+strconv.Itoa(*f.i))
+		}
+	}
+	return out
+}
+
+// set sets the setting named as the game option.
+func (t *transferPolicy) set(name, value string) error {
+	for _, f := range t.fields() {
+		if !strings.EqualFold(f.name, name) {
+			continue
+		}
+		var err error
+		if f.b != nil {
+			*f.b, err = strconv.ParseBool(value)
+		} else {
+			*f.i, err = strconv.Atoi(value)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: invalid value %q", f.name, value)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown transfer setting %q", name)
+}
+
+// isTransferOption returns true if the Key=Value option is managed by
+// transferPolicy.
+func isTransferOption(o string) bool {
+	k, _, _ := strings.Cut(o, "=")
+	for _, f := range (&transferPolicy{}).fields() {
+		if strings.EqualFold(f.name, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// cluster returns the cluster settings, or nil.
+func (c *config) cluster(id string) *clusterConfig {
+	for i := range c.Clusters {
+		if c.Clusters[i].ID == id {
+			return &c.Clusters[i]
+		}
+	}
+	return nil
+}
+
+var cmdCluster = &subcommands.Command{
+	UsageLine: "cluster <options> <show|set> <Setting=Value...>",
+	ShortDesc: "Manages the cluster transfer settings",
+	LongDesc:  "Manages the cross-server transfer settings shared by all the members of a cluster, e.g. `cluster -id c1 set PreventDownloadDinos=true`.\n\nRun `install` afterward to apply them to the members.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &clusterRun{}
+		c.args.flags()
+		c.Flags.StringVar(&c.id, "id", "", "cluster ID; all the clusters for show")
+		return c
+	},
+}
+
+type clusterRun struct {
+	args
+	id string
+}
+
+func (r *clusterRun) Run(a subcommands.Application, args []string, env subcommands.Env) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "%s: Expected one of show or set.\n", a.GetName())
+		return 1
+	}
+	c, err := loadConfig(r.configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	switch args[0] {
+	case "show":
+		ids := map[string]bool{}
+		for _, s := range c.Servers {
+			if s.ClusterID != "" && (r.id == "" || r.id == s.ClusterID) && !ids[s.ClusterID] {
+				ids[s.ClusterID] = true
+				p := transferPolicy{}
+				if v := c.cluster(s.ClusterID); v != nil {
+					p = v.Transfers
+				}
+				fmt.Printf("%s: %s\n", s.ClusterID, strings.Join(p.options(), " "))
+			}
+		}
+	case "set":
+		err = r.set(c, args[1:])
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
+
+func (r *clusterRun) set(c *config, args []string) error {
+	if r.id == "" || len(args) == 0 {
+		return fmt.Errorf("-id and at least one Setting=Value are required")
+	}
+	if len(c.clusterMembers(r.id)) == 0 {
+		return fmt.Errorf("cluster %q has no member", r.id)
+	}
+	v := c.cluster(r.id)
+	if v == nil {
+		c.Clusters = append(c.Clusters, clusterConfig{ID: r.id})
+		v = &c.Clusters[len(c.Clusters)-1]
+	}
+	for _, a := range args {
+		k, val, ok := strings.Cut(a, "=")
+		if !ok {
+			return fmt.Errorf("invalid %q; use Setting=Value", a)
+		}
+		if err := v.Transfers.set(k, val); err != nil {
+			return err
+		}
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+	return c.save(r.configPath)
+}
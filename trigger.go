@@ -0,0 +1,236 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/maruel/subcommands"
+)
+
+// triggerConfig is a predefined action external systems can run with a
+// token, e.g. a Steam update watcher restarting the servers.
+type triggerConfig struct {
+	// Name is used in the URL: POST /api/v1/triggers/<name>.
+	Name string `json:"name"`
+	// Action is "start", "stop", "restart", "backup" or "start_all", which
+	// starts the servers one at a time like the "Start all" button.
+	Action string `json:"action"`
+	// Servers are the servers the action applies to. All when empty.
+	Servers []string `json:"servers,omitempty"`
+	// TokenHash is the SHA-256 of the token in hex. Use `ark-serman trigger`
+	// to generate it. The trigger is disabled when empty.
+	TokenHash string `json:"token_hash,omitempty"`
+	// Once clears the token after the first use.
+	Once bool `json:"once,omitempty"`
+}
+
+// trigger returns the trigger by name, or nil.
+func (c *config) trigger(name string) *triggerConfig {
+	for i := range c.Triggers {
+		if c.Triggers[i].Name == name {
+			return &c.Triggers[i]
+		}
+	}
+	return nil
+}
+
+// checkToken returns true if the token matches.
+func (t *triggerConfig) checkToken(token string) bool {
+	return tokenMatches(t.TokenHash, token)
+}
+
+// tokenMatches returns true if the token's SHA-256 is hash.
+func tokenMatches(hash, token string) bool {
+	if hash == "" || token == "" {
+		return false
+	}
+	h := sha256.Sum256([]byte(token))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(h[:])), []byte(hash)) == 1
+}
+
+// triggerToken returns the token from the Authorization: Bearer header or the
+// token query parameter, for callers that can only configure a URL.
+func triggerToken(r *http.Request) string {
+	if t, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return t
+	}
+	return r.URL.Query().Get("token")
+}
+
+// consumeTrigger clears the token of a one-time trigger in the configuration
+// file. It returns false if it was already used.
+func (s *webServer) consumeTrigger(name, token string) (bool, error) {
+	// Serialized with the other edits, which also consumes each one-time token
+	// once.
+	configMu.Lock()
+	defer configMu.Unlock()
+	// Reload from disk to not persist the command line overrides.
+	c, err := loadConfig(s.configPath)
+	if err != nil {
+		return false, err
+	}
+	t := c.trigger(name)
+	if t == nil || !t.checkToken(token) {
+		return false, nil
+	}
+	t.TokenHash = ""
+	if err := c.save(s.configPath); err != nil {
+		return false, err
+	}
+	s.reload()
+	return true, nil
+}
+
+// apiTrigger serves POST /api/v1/triggers/{name}. The token replaces the user
+// authentication. The action runs in the background.
+func (s *webServer) apiTrigger(w http.ResponseWriter, r *http.Request, p map[string]string) {
+	c := s.config()
+	t := c.trigger(p["name"])
+	if s.lockedOut(w, r, "") {
+		return
+	}
+	token := triggerToken(r)
+	if t == nil || !t.checkToken(token) {
+		s.authFailed(r, "", "trigger")
+		http.Error(w, "invalid trigger or token", http.StatusForbidden)
+		return
+	}
+	setAuditUser(r.Context(), &userConfig{Name: "trigger:" + t.Name, Role: roleOperator})
+	setAuditDetail(r.Context(), t.Action+" "+strings.Join(t.Servers, ","))
+	if t.Once {
+		ok, err := s.consumeTrigger(t.Name, token)
+		if err != nil {
+			replyError(w, err.Error())
+			return
+		}
+		if !ok {
+			s.authFailed(r, "", "trigger")
+			http.Error(w, "invalid trigger or token", http.StatusForbidden)
+			return
+		}
+	}
+	servers, err := c.selectServers(t.Servers)
+	if err != nil {
+		replyError(w, err.Error())
+		return
+	}
+	if t.Action == "start_all" {
+		go s.startAll(s.ctx, servers)
+	} else {
+		ctx := withLockOwner(s.ctx, "trigger:"+t.Name, true)
+		for _, v := range servers {
+			go func(action, unit string) {
+				if _, err := s.doAction(ctx, action, unit); err != nil {
+					log.Printf("trigger %s: %s: %v", t.Name, unit, err)
+				}
+			}(t.Action, v.unitName())
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+	replyJSON(w, apiActionResult{Result: t.Action + " started"})
+}
+
+var cmdTrigger = &subcommands.Command{
+	UsageLine: "trigger <options> <set|remove|list>",
+	ShortDesc: "Manages the inbound triggers",
+	LongDesc:  "Manages the triggers external systems can call to run a predefined action.\n\n`trigger -name <name> -action <action> -servers a,b set` adds or updates a trigger and prints a new token; the previous token stops working. The trigger is called with `curl -X POST -H \"Authorization: Bearer <token>\" http://<host>/api/v1/triggers/<name>`.\nActions are start, stop, restart, backup and start_all.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &triggerRun{}
+		c.args.flags()
+		c.Flags.StringVar(&c.name, "name", "", "trigger name")
+		c.Flags.StringVar(&c.action, "action", "", "action: start, stop, restart, backup or start_all")
+		c.Flags.StringVar(&c.servers, "servers", "", "comma separated servers; all when empty")
+		c.Flags.BoolVar(&c.once, "once", false, "the token only works once")
+		return c
+	},
+}
+
+type triggerRun struct {
+	args
+	name    string
+	action  string
+	servers string
+	once    bool
+}
+
+func (t *triggerRun) Run(a subcommands.Application, args []string, env subcommands.Env) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "%s: Expected one of set, remove or list.\n", a.GetName())
+		return 1
+	}
+	c, err := loadConfig(t.configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	switch args[0] {
+	case "set":
+		err = t.set(c)
+	case "remove":
+		err = errors.New("unknown trigger")
+		for i := range c.Triggers {
+			if c.Triggers[i].Name == t.name {
+				c.Triggers = append(c.Triggers[:i], c.Triggers[i+1:]...)
+				err = c.save(t.configPath)
+				break
+			}
+		}
+	case "list":
+		for _, v := range c.Triggers {
+			state := "enabled"
+			if v.TokenHash == "" {
+				state = "disabled"
+			}
+			fmt.Printf("%-16s %-10s %-8s %s\n", v.Name, v.Action, state, strings.Join(v.Servers, ","))
+		}
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
+
+func (t *triggerRun) set(c *config) error {
+	if t.name == "" {
+		return errors.New("-name is required")
+	}
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	h := sha256.Sum256([]byte(token))
+	v := triggerConfig{Name: t.name, Action: t.action, TokenHash: hex.EncodeToString(h[:]), Once: t.once}
+	if t.servers != "" {
+		v.Servers = strings.Split(t.servers, ",")
+	}
+	if p := c.trigger(t.name); p != nil {
+		*p = v
+	} else {
+		c.Triggers = append(c.Triggers, v)
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+	if err := c.save(t.configPath); err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
@@ -0,0 +1,217 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// hasTuning returns true if the server uses the tuning preset.
+func (s *serverConfig) hasTuning(preset string) bool {
+	return slices.Contains(s.Tuning, preset)
+}
+
+// perfStat is a server's performance over a sampling interval.
+type perfStat struct {
+	// CPU is the average CPU usage, in cores.
+	CPU float64 `json:"cpu"`
+	// Memory is in MB.
+	Memory float64 `json:"memory_mb"`
+	// QueryRTT is the average query port round trip time.
+	QueryRTT time.Duration `json:"query_rtt,omitempty"`
+}
+
+// perfSampleInterval is how often the servers' performance is sampled.
+const perfSampleInterval = 15 * time.Minute
+
+// samplePerf records the performance of the running servers every
+// perfSampleInterval, to compare it before and after a tuning change, and
+// their player count for the population graphs.
+func (s *webServer) samplePerf(ctx context.Context) {
+	// The CPU usage is cumulative, so the previous sample is needed.
+	type cpuTime struct {
+		t, cpu float64
+		since  time.Time
+	}
+	prev := map[string]cpuTime{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(perfSampleInterval):
+		}
+		c := s.config()
+		s.mu.Lock()
+		states := s.lastStates
+		now := float64(s.lastStatesTime.UnixNano()) / 1e9
+		s.mu.Unlock()
+		sm := metricsSample{Perf: map[string]perfStat{}, Players: map[string]int{}}
+		for i := range states {
+			u := &states[i]
+			v := c.serverByUnit(u.Name)
+			if v == nil || !u.Running {
+				delete(prev, u.Name)
+				continue
+			}
+			if u.HasPlayers {
+				sm.Players[v.Name] = len(u.Players)
+			}
+			cur := cpuTime{t: now, cpu: u.CPU, since: u.Since}
+			p, ok := prev[u.Name]
+			prev[u.Name] = cur
+			// Skip the first sample after a (re)start; the counter was reset.
+			if !ok || !p.since.Equal(cur.since) || cur.t <= p.t {
+				continue
+			}
+			st := perfStat{CPU: round((cur.cpu-p.cpu)/(cur.t-p.t), 2), Memory: u.Memory}
+			if l, ok := s.latency.get(v.Name); ok {
+				st.QueryRTT = l.Avg
+			}
+			sm.Perf[v.Name] = st
+		}
+		if len(sm.Perf) == 0 && len(sm.Players) == 0 {
+			continue
+		}
+		if err := s.db.appendTime(bucketMetrics, time.Now(), sm); err != nil {
+			log.Printf("perf: %v", err)
+		}
+	}
+}
+
+// tuningWindow is how long before and after a tuning change the performance
+// is compared.
+const tuningWindow = 3 * 24 * time.Hour
+
+// benchmark is the average performance of a server over a period.
+type benchmark struct {
+	Samples  int
+	CPU      float64
+	Memory   float64
+	QueryRTT time.Duration
+	// Saves is the number of timed world saves.
+	Saves    int
+	SaveTime time.Duration
+}
+
+// tuningRow is a tuned server's line on the CPU pinning page.
+type tuningRow struct {
+	Server        string
+	Tuning        []string
+	Changed       time.Time
+	Before, After benchmark
+	Err           string
+}
+
+// tuningBenchmark compares the server's performance in the tuningWindow
+// before and after its resources drop-in last changed. The new settings
+// apply once the server restarted, so the "after" period starts at the first
+// start since the change. changed is zero when the server has no drop-in.
+func (s *webServer) tuningBenchmark(v *serverConfig) (changed time.Time, before, after benchmark, err error) {
+	d, err := userUnitDir()
+	if err != nil {
+		return
+	}
+	fi, err := os.Stat(filepath.Join(d, v.resourcesDropIn()))
+	if err != nil {
+		return changed, before, after, nil
+	}
+	changed = fi.ModTime()
+	// Only the samples of the current run count as after the change.
+	start := changed
+	s.mu.Lock()
+	for _, u := range s.lastStates {
+		if u.Name == v.unitName() && u.Running && u.Since.After(start) {
+			start = u.Since
+		}
+	}
+	s.mu.Unlock()
+	if start.Equal(changed) {
+		// Not restarted since; there's no "after".
+		start = time.Now()
+	}
+	add := func(b *benchmark, p perfStat) {
+		b.Samples++
+		b.CPU += p.CPU
+		b.Memory += p.Memory
+		b.QueryRTT += p.QueryRTT
+	}
+	from := changed.Add(-tuningWindow)
+	err = s.db.last(bucketMetrics, func(k, b []byte) bool {
+		t := keyTime(k)
+		if t.Before(from) {
+			return false
+		}
+		sm := metricsSample{}
+		if json.Unmarshal(b, &sm) != nil {
+			return true
+		}
+		p, ok := sm.Perf[v.Name]
+		switch {
+		case !ok:
+		case t.Before(changed):
+			add(&before, p)
+		case !t.Before(start) && t.Before(start.Add(tuningWindow)):
+			add(&after, p)
+		}
+		return true
+	})
+	if err != nil {
+		return
+	}
+	ts, l, err := s.db.saveTimes(from)
+	if err != nil {
+		return
+	}
+	for i := range l {
+		switch t := ts[i]; {
+		case l[i].Server != v.Name:
+		case t.Before(changed):
+			before.Saves++
+			before.SaveTime += l[i].Duration
+		case !t.Before(start) && t.Before(start.Add(tuningWindow)):
+			after.Saves++
+			after.SaveTime += l[i].Duration
+		}
+	}
+	before.average()
+	after.average()
+	return changed, before, after, nil
+}
+
+func (b *benchmark) average() {
+	if b.Samples != 0 {
+		n := float64(b.Samples)
+		b.CPU = round(b.CPU/n, 2)
+		b.Memory = round(b.Memory/n, 1)
+		b.QueryRTT = roundDuration(b.QueryRTT / time.Duration(b.Samples))
+	}
+	if b.Saves != 0 {
+		b.SaveTime = roundDuration(b.SaveTime / time.Duration(b.Saves))
+	}
+}
+
+// thpMode returns the transparent huge pages mode of the kernel, e.g.
+// "madvise", or "" if unknown.
+func thpMode() string {
+	b, err := os.ReadFile("/sys/kernel/mm/transparent_hugepage/enabled")
+	if err != nil {
+		return ""
+	}
+	// The current mode is in brackets: "always [madvise] never".
+	s := string(b)
+	if i := strings.IndexByte(s, '['); i != -1 {
+		if j := strings.IndexByte(s[i:], ']'); j != -1 {
+			return s[i+1 : i+j]
+		}
+	}
+	return ""
+}
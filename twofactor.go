@@ -0,0 +1,266 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maruel/ark-serman/internal/qrcode"
+)
+
+// totpStep is the TOTP time step per RFC 6238.
+const totpStep = 30 * time.Second
+
+// recoveryCodes is the number of recovery codes generated at enrollment.
+const recoveryCodes = 10
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random base32 secret.
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	_, _ = rand.Read(b)
+	return b32.EncodeToString(b)
+}
+
+// totpCode returns the 6 digit code of the secret for the time step counter.
+func totpCode(secret string, counter int64) (string, error) {
+	key, err := b32.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	m := hmac.New(sha1.New, key)
+	_ = binary.Write(m, binary.BigEndian, counter)
+	h := m.Sum(nil)
+	o := h[len(h)-1] & 0xf
+	v := binary.BigEndian.Uint32(h[o:o+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", v%1000000), nil
+}
+
+// totpCounter returns the time step counter matching the code, accepting one
+// step of clock drift each way, or -1.
+func totpCounter(secret, code string, now time.Time) int64 {
+	c := now.Unix() / int64(totpStep/time.Second)
+	for _, n := range []int64{c, c - 1, c + 1} {
+		if v, err := totpCode(secret, n); err == nil && hmac.Equal([]byte(v), []byte(code)) {
+			return n
+		}
+	}
+	return -1
+}
+
+// hashRecoveryCode returns how a recovery code is stored. The codes are
+// random so a plain hash is enough.
+func hashRecoveryCode(code string) string {
+	h := sha256.Sum256([]byte(strings.ToLower(strings.ReplaceAll(code, "-", ""))))
+	return hex.EncodeToString(h[:])
+}
+
+// newRecoveryCodes returns the codes to show once and their hashes to store.
+func newRecoveryCodes() ([]string, []string) {
+	codes := make([]string, recoveryCodes)
+	hashes := make([]string, recoveryCodes)
+	for i := range codes {
+		b := make([]byte, 6)
+		_, _ = rand.Read(b)
+		s := strings.ToLower(b32.EncodeToString(b))[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes
+}
+
+// totpGuard rejects the replay of a code already used. It is kept in memory.
+type totpGuard struct {
+	mu   sync.Mutex
+	last map[string]int64
+}
+
+// use returns false if a code of this time step or a later one was already
+// used by the user.
+func (g *totpGuard) use(user string, counter int64) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.last == nil {
+		g.last = map[string]int64{}
+	}
+	if l, ok := g.last[user]; ok && counter <= l {
+		return false
+	}
+	g.last[user] = counter
+	return true
+}
+
+// needsEnrollment returns true if the user must enroll 2FA before using the
+// web UI. It only applies to password logins; the tailnet identities are
+// already authenticated by the tailnet.
+func (c *config) needsEnrollment(u *userConfig) bool {
+	return u != nil && u.PasswordHash != "" && u.TOTPSecret == "" && slices.Contains(c.TwoFactorRoles, u.Role)
+}
+
+// twoFactorPath returns true for the paths usable before enrolling 2FA.
+func twoFactorPath(p string) bool {
+	return p == "/2fa/" || p == "/rpc/2fa" || p == "/logout" || p == "/favicon.ico" || strings.HasPrefix(p, "/static/")
+}
+
+// checkSecondFactor returns true if the code is a valid TOTP code or an
+// unused recovery code of the user. A recovery code is consumed.
+func (s *webServer) checkSecondFactor(u *userConfig, code string) bool {
+	code = strings.TrimSpace(code)
+	if len(code) == 6 {
+		n := totpCounter(u.TOTPSecret, code, time.Now())
+		return n != -1 && s.totp.use(u.Name, n)
+	}
+	h := hashRecoveryCode(code)
+	if code == "" {
+		return false
+	}
+	// Checked in the edit so two logins can't use the same code.
+	err := s.editUser(u.Name, func(v *userConfig) error {
+		if !slices.Contains(v.RecoveryCodes, h) {
+			return errors.New("invalid recovery code")
+		}
+		v.RecoveryCodes = slices.DeleteFunc(v.RecoveryCodes, func(x string) bool { return x == h })
+		return nil
+	})
+	return err == nil
+}
+
+// editUser modifies the user in the configuration file and reloads it.
+func (s *webServer) editUser(name string, f func(u *userConfig) error) error {
+	return s.editConfig(func(c *config) error {
+		u := c.user(name)
+		if u == nil {
+			return errors.New("no user is configured")
+		}
+		return f(u)
+	})
+}
+
+// configMu serializes the web server's edits of the configuration file, so
+// concurrent requests don't lose each other's changes.
+var configMu sync.Mutex
+
+// editConfig modifies the configuration file and reloads it.
+func (s *webServer) editConfig(f func(c *config) error) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+	// Reload from disk to not persist the command line overrides.
+	c, err := loadConfig(s.configPath)
+	if err != nil {
+		return err
+	}
+	if err := f(c); err != nil {
+		return err
+	}
+	if err := c.save(s.configPath); err != nil {
+		return err
+	}
+	s.reload()
+	return nil
+}
+
+var twoFactorTmpl = template.Must(template.ParseFS(rsc, "rsc/twofactor.html.tmpl"))
+
+// serveTwoFactor serves the 2FA enrollment at /2fa/. The changes are POSTed
+// to /rpc/2fa to be recorded in the audit log; every user can manage their
+// own.
+func (s *webServer) serveTwoFactor(w http.ResponseWriter, r *http.Request) {
+	u := s.config().user(userFrom(r.Context()).Name)
+	w.Header().Add("Content-Type", "text/html")
+	data := map[string]any{"User": u}
+	if u == nil {
+		data["Err"] = "No user is configured."
+		_ = twoFactorTmpl.Execute(w, data)
+		return
+	}
+	secret := newTOTPSecret()
+	if r.Method == "POST" && r.URL.Path == "/rpc/2fa" {
+		codes, err := s.editTwoFactor(r, u)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			data["Err"] = err.Error()
+			// Keep the scanned secret.
+			if v := r.FormValue("secret"); v != "" {
+				secret = v
+			}
+		}
+		data["Codes"] = codes
+		u = s.config().user(u.Name)
+		data["User"] = u
+	}
+	data["Required"] = slices.Contains(s.config().TwoFactorRoles, u.Role)
+	if u.TOTPSecret == "" {
+		uri := "otpauth://totp/" + url.PathEscape("ark-serman:"+u.Name) + "?" + url.Values{"secret": {secret}, "issuer": {"ark-serman"}}.Encode()
+		data["Secret"] = secret
+		if q, err := qrcode.Encode([]byte(uri)); err == nil {
+			// The SVG is generated, not user controlled.
+			data["QR"] = template.HTML(q.SVG())
+		}
+	}
+	_ = twoFactorTmpl.Execute(w, data)
+}
+
+// editTwoFactor enables or disables 2FA or regenerates the recovery codes.
+// It returns the new recovery codes to show once.
+func (s *webServer) editTwoFactor(r *http.Request, u *userConfig) ([]string, error) {
+	op := r.FormValue("op")
+	setAuditDetail(r.Context(), op)
+	code := strings.TrimSpace(r.FormValue("code"))
+	switch op {
+	case "enable":
+		secret := r.FormValue("secret")
+		if _, err := b32.DecodeString(secret); err != nil || len(secret) < 16 {
+			return nil, errors.New("invalid secret")
+		}
+		n := totpCounter(secret, code, time.Now())
+		if n == -1 || !s.totp.use(u.Name, n) {
+			return nil, errors.New("invalid code; check the authenticator app's clock")
+		}
+		codes, hashes := newRecoveryCodes()
+		return codes, s.editUser(u.Name, func(v *userConfig) error {
+			v.TOTPSecret, v.RecoveryCodes = secret, hashes
+			return nil
+		})
+	case "recovery", "disable":
+		if u.TOTPSecret == "" {
+			return nil, errors.New("two-factor authentication isn't enabled")
+		}
+		if !s.checkSecondFactor(u, code) {
+			s.authFailed(r, u.Name, "totp")
+			return nil, errors.New("invalid code")
+		}
+		if op == "disable" {
+			if slices.Contains(s.config().TwoFactorRoles, u.Role) {
+				return nil, fmt.Errorf("two-factor authentication is required for the %s role", u.Role)
+			}
+			return nil, s.editUser(u.Name, func(v *userConfig) error {
+				v.TOTPSecret, v.RecoveryCodes = "", nil
+				return nil
+			})
+		}
+		codes, hashes := newRecoveryCodes()
+		return codes, s.editUser(u.Name, func(v *userConfig) error {
+			v.RecoveryCodes = hashes
+			return nil
+		})
+	}
+	return nil, fmt.Errorf("unknown operation %q", op)
+}
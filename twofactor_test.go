@@ -0,0 +1,133 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maruel/ark-serman/internal/rconpool"
+)
+
+// rfc6238Secret is the SHA-1 secret of the RFC 6238 test vectors,
+// "12345678901234567890", in base32.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, truncated to 6 digits.
+	data := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, l := range data {
+		got, err := totpCode(rfc6238Secret, l.unix/30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != l.want {
+			t.Errorf("%d: got %s, want %s", l.unix, got, l.want)
+		}
+	}
+	if _, err := totpCode("not base32!", 1); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestTOTPCounter(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	c := now.Unix() / 30
+	data := []struct {
+		name    string
+		counter int64
+		want    int64
+	}{
+		{"now", c, c},
+		{"previous step", c - 1, c - 1},
+		{"next step", c + 1, c + 1},
+		{"too old", c - 2, -1},
+	}
+	for _, l := range data {
+		code, _ := totpCode(rfc6238Secret, l.counter)
+		if got := totpCounter(rfc6238Secret, code, now); got != l.want {
+			t.Errorf("%s: got %d, want %d", l.name, got, l.want)
+		}
+	}
+}
+
+func TestTOTPGuard(t *testing.T) {
+	g := totpGuard{}
+	data := []struct {
+		user    string
+		counter int64
+		want    bool
+	}{
+		{"a", 10, true},
+		{"a", 10, false},
+		{"a", 9, false},
+		{"b", 10, true},
+		{"a", 11, true},
+	}
+	for i, l := range data {
+		if got := g.use(l.user, l.counter); got != l.want {
+			t.Errorf("#%d: got %t, want %t", i, got, l.want)
+		}
+	}
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+	codes, hashes := newRecoveryCodes()
+	if len(codes) != recoveryCodes || len(hashes) != recoveryCodes {
+		t.Fatalf("got %d codes", len(codes))
+	}
+	// The users may retype the codes without the dash or in upper case.
+	if hashRecoveryCode(codes[0]) != hashes[0] || hashRecoveryCode("ABCDEFGHIJ") != hashRecoveryCode("abcde-fghij") {
+		t.Fatal("unexpected hash")
+	}
+}
+
+func TestRecoveryCodeUsedOnce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	codes, hashes := newRecoveryCodes()
+	c := &config{Users: []userConfig{{Name: "admin", TailscaleLogin: "admin@example.com", Role: roleAdmin, TOTPSecret: rfc6238Secret, RecoveryCodes: hashes}}}
+	p := filepath.Join(t.TempDir(), "config.json")
+	if err := c.save(p); err != nil {
+		t.Fatal(err)
+	}
+	s := &webServer{ctx: ctx, configPath: p, ports: newPortMapper(), publicIP: &publicIP{}, rcon: rconpool.New(ctx)}
+	c, err := loadConfig(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.setConfig(c)
+	var ok atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s.checkSecondFactor(s.config().user("admin"), codes[0]) {
+				ok.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := ok.Load(); n != 1 {
+		t.Fatalf("the recovery code was accepted %d times", n)
+	}
+	if n := len(s.config().user("admin").RecoveryCodes); n != recoveryCodes-1 {
+		t.Fatalf("got %d recovery codes left", n)
+	}
+}
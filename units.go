@@ -0,0 +1,300 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// launchArgs returns the command line arguments for the Ark server, excluding
+// the executable.
+func launchArgs(c *config, s *serverConfig) []string {
+	opts := []string{
+		s.Map,
+		"listen",
+		"SessionName=" + s.SessionName,
+		"Port=" + strconv.Itoa(s.Port),
+		"QueryPort=" + strconv.Itoa(s.QueryPort),
+		"RCONEnabled=True",
+		"RCONPort=" + strconv.Itoa(s.RCONPort),
+	}
+	if s.MultiHome != "" {
+		opts = append(opts, "MultiHome="+s.MultiHome)
+	}
+	if s.MaxPlayers != 0 {
+		opts = append(opts, "MaxPlayers="+strconv.Itoa(s.MaxPlayers))
+	}
+	if c.AdminPassword != "" {
+		opts = append(opts, "ServerAdminPassword="+c.AdminPassword)
+	}
+	if c.ServerPassword != "" {
+		opts = append(opts, "ServerPassword="+c.ServerPassword)
+	}
+	if s.SaveDir != "" {
+		opts = append(opts, "AltSaveDirectoryName="+s.SaveDir)
+	}
+	if len(s.Mods) != 0 {
+		opts = append(opts, "GameModIds="+strings.Join(s.Mods, ","))
+	}
+	if v := c.cluster(s.ClusterID); v != nil {
+		opts = append(opts, v.Transfers.options()...)
+	}
+	if c.Difficulty != nil {
+		opts = append(opts, c.Difficulty.options(c, s.Map)...)
+	}
+	opts = append(opts, s.Options...)
+	args := []string{strings.Join(opts, "?"), "-server", "-log"}
+	if s.MultiHome != "" {
+		// The URL option alone doesn't bind the query port.
+		args = append(args, "-MULTIHOME="+s.MultiHome)
+	}
+	if s.TotalConversionMod != "" {
+		args = append(args, "-TotalConversionMod="+s.TotalConversionMod)
+	}
+	if (s.TotalConversionMod != "" || len(s.Mods) != 0) && !c.ModCache {
+		// Let the server download workshop content itself.
+		args = append(args, "-automanagedmods")
+	}
+	if s.Crossplay {
+		args = append(args, "-crossplay")
+		if s.EpicOnly {
+			args = append(args, "-epiconly")
+		}
+		ip := s.PublicIPForEpic
+		if ip == "" {
+			ip = c.PublicIP
+		}
+		if ip != "" {
+			args = append(args, "-PublicIPForEpic="+ip)
+		}
+	}
+	if s.ClusterID != "" {
+		args = append(args, "-clusterid="+s.ClusterID, "-NoTransferFromFiltering")
+		if c.ClusterDir != "" {
+			args = append(args, "-ClusterDirOverride="+c.ClusterDir)
+		}
+	}
+	return append(args, s.Flags...)
+}
+
+// systemdQuote quotes an argument for use in ExecStart=.
+func systemdQuote(s string) string {
+	s = strings.ReplaceAll(s, "%", "%%")
+	s = strings.ReplaceAll(s, "$", "$$")
+	if !strings.ContainsAny(s, " \t\"'\\;") {
+		return s
+	}
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+var unitTmpl = template.Must(template.New("").Parse(`# Generated by ark-serman. Do not edit, changes will be overwritten.
+[Unit]
+Description=ark-serman: {{.Server.SessionName}} ({{.Server.Map}})
+Wants=network-online.target
+After=network.target nss-lookup.target network-online.target
+
+[Service]
+{{range .Env}}Environment={{.}}
+{{end}}ExecStart={{.ExecStart}}
+ExecStop=/bin/kill -s INT $MAINPID
+Restart=on-failure
+LimitNOFILE=1000000
+TimeoutStopSec=300
+
+# No [Install] section: enabling the unit would start all the servers
+# concurrently at boot. ark-serman web starts the servers with start_on_boot
+# one at a time instead.
+`))
+
+// generateUnit returns the content of the systemd unit file for the server.
+func generateUnit(c *config, s *serverConfig) ([]byte, error) {
+	cmd := []string{systemdQuote(s.binary(c))}
+	for _, a := range s.gameArgs(c) {
+		cmd = append(cmd, systemdQuote(a))
+	}
+	var env []string
+	for _, e := range s.gameEnv(c) {
+		n, v, _ := strings.Cut(e, "=")
+		env = append(env, envQuote(envVar{Name: n, Value: v}))
+	}
+	b := bytes.Buffer{}
+	err := unitTmpl.Execute(&b, map[string]any{
+		"Server":    s,
+		"Env":       env,
+		"ExecStart": strings.Join(cmd, " "),
+	})
+	return b.Bytes(), err
+}
+
+// userUnitDir returns ~/.config/systemd/user.
+func userUnitDir() (string, error) {
+	d, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(d, "systemd", "user"), nil
+}
+
+// writeUnits writes the systemd unit file of every configured server and its
+// resources drop-in. It returns the unit files that were written.
+func writeUnits(c *config) ([]string, error) {
+	d, err := userUnitDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(d, 0o755); err != nil {
+		return nil, err
+	}
+	var out []string
+	for i := range c.Servers {
+		s := &c.Servers[i]
+		b, err := generateUnit(c, s)
+		if err != nil {
+			return out, err
+		}
+		// Contains the admin password.
+		if err := os.WriteFile(filepath.Join(d, s.unitName()), b, 0o600); err != nil {
+			return out, fmt.Errorf("%s: %w", s.Name, err)
+		}
+		out = append(out, s.unitName())
+		if ok, err := writeResources(d, s); err != nil {
+			return out, fmt.Errorf("%s: %w", s.Name, err)
+		} else if ok {
+			out = append(out, s.resourcesDropIn())
+		}
+	}
+	return out, nil
+}
+
+// splitExecStart splits an ExecStart= value into arguments, undoing
+// systemdQuote.
+func splitExecStart(s string) []string {
+	var out []string
+	var cur strings.Builder
+	inArg, quoted := false, false
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case quoted && ch == '\\' && i+1 < len(s):
+			i++
+			cur.WriteByte(s[i])
+		case ch == '"':
+			quoted = !quoted
+			inArg = true
+		case !quoted && (ch == ' ' || ch == '\t'):
+			if inArg {
+				out = append(out, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		case (ch == '%' || ch == '$') && i+1 < len(s) && s[i+1] == ch:
+			i++
+			cur.WriteByte(ch)
+			inArg = true
+		default:
+			cur.WriteByte(ch)
+			inArg = true
+		}
+	}
+	if inArg {
+		out = append(out, cur.String())
+	}
+	return out
+}
+
+// unitOptions returns the "?Key=Value" URL options on the ExecStart= line of
+// the server's unit file, e.g. for a server no longer in the configuration.
+func unitOptions(name string) (map[string]string, error) {
+	d, err := userUnitDir()
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(filepath.Join(d, (&serverConfig{Name: name}).unitName()))
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		v, ok := strings.CutPrefix(strings.TrimSpace(l), "ExecStart=")
+		if !ok {
+			continue
+		}
+		args := splitExecStart(v)
+		if len(args) < 2 {
+			break
+		}
+		out := map[string]string{}
+		for _, o := range strings.Split(args[1], "?")[1:] {
+			if k, v, ok := strings.Cut(o, "="); ok {
+				out[k] = v
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("%s: no ExecStart", name)
+}
+
+// iniValue returns the value of key in the section of the INI file, or "".
+// Keys are case insensitive like in the engine.
+func iniValue(p, section, key string) (string, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return "", err
+	}
+	cur := ""
+	for _, l := range strings.Split(string(b), "\n") {
+		l = strings.TrimSpace(l)
+		if strings.HasPrefix(l, "[") && strings.HasSuffix(l, "]") {
+			cur = l[1 : len(l)-1]
+			continue
+		}
+		if k, v, ok := strings.Cut(l, "="); ok && cur == section && strings.EqualFold(k, key) {
+			return v, nil
+		}
+	}
+	return "", nil
+}
+
+// rconTarget returns the RCON address and password of the server by name. It
+// uses the configuration, then the unit file and finally GameUserSettings.ini,
+// which is shared by the servers of an installation.
+func rconTarget(c *config, name string) (string, string, error) {
+	if v := c.server(name); v != nil {
+		return v.localAddr(v.RCONPort), c.AdminPassword, nil
+	}
+	port, host, pwd := "", "127.0.0.1", ""
+	if opts, err := unitOptions(name); err == nil {
+		port = opts["RCONPort"]
+		pwd = opts["ServerAdminPassword"]
+		if h := opts["MultiHome"]; h != "" {
+			host = h
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", "", err
+	}
+	ini := filepath.Join(configDir(c), "GameUserSettings.ini")
+	if port == "" {
+		port, _ = iniValue(ini, "ServerSettings", "RCONPort")
+	}
+	if pwd == "" {
+		pwd, _ = iniValue(ini, "ServerSettings", "ServerAdminPassword")
+	}
+	if port == "" {
+		return "", "", fmt.Errorf("server %q: RCON port not found in the configuration, its unit file or %s", name, ini)
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return "", "", fmt.Errorf("server %q: invalid RCON port %q", name, port)
+	}
+	return net.JoinHostPort(host, port), pwd, nil
+}
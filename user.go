@@ -0,0 +1,121 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/maruel/subcommands"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var cmdUser = &subcommands.Command{
+	UsageLine: "user <options> <set|remove|reset-2fa|list>",
+	ShortDesc: "Manages the web users",
+	LongDesc:  "Manages the web users in the configuration file.\n\n`user -name <name> -role <role> set` adds or updates a user, reading the password from stdin. With -tailscale-login, no password is read and the tailnet user is authenticated by ark-serman web -tailscale.\n`user -name <name> reset-2fa` disables the user's two-factor authentication, e.g. after losing both the phone and the recovery codes.\nRoles are viewer, operator and admin. When no user is configured, the web server doesn't require authentication.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &userRun{}
+		c.args.flags()
+		c.Flags.StringVar(&c.name, "name", "", "user name")
+		c.Flags.StringVar(&c.role, "role", roleOperator, "role: viewer, operator or admin")
+		c.Flags.StringVar(&c.tailscaleLogin, "tailscale-login", "", "tailnet login name, e.g. user@example.com")
+		return c
+	},
+}
+
+type userRun struct {
+	args
+	name           string
+	role           string
+	tailscaleLogin string
+}
+
+func (u *userRun) Run(a subcommands.Application, args []string, env subcommands.Env) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "%s: Expected one of set, remove, reset-2fa or list.\n", a.GetName())
+		return 1
+	}
+	c, err := loadConfig(u.configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	switch args[0] {
+	case "set":
+		err = u.set(c)
+	case "remove":
+		err = errors.New("unknown user")
+		for i := range c.Users {
+			if c.Users[i].Name == u.name {
+				c.Users = append(c.Users[:i], c.Users[i+1:]...)
+				err = c.save(u.configPath)
+				break
+			}
+		}
+	case "reset-2fa":
+		err = errors.New("unknown user")
+		if v := c.user(u.name); v != nil {
+			v.TOTPSecret, v.RecoveryCodes = "", nil
+			err = c.save(u.configPath)
+		}
+	case "list":
+		for _, v := range c.Users {
+			tfa := ""
+			if v.TOTPSecret != "" {
+				tfa = " 2fa"
+			}
+			fmt.Printf("%-16s %s%s\n", v.Name, v.Role, tfa)
+		}
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
+
+func (u *userRun) set(c *config) error {
+	if u.name == "" {
+		return errors.New("-name is required")
+	}
+	if roleLevel(u.role) == 0 {
+		return fmt.Errorf("invalid role %q", u.role)
+	}
+	if u.tailscaleLogin != "" {
+		if v := c.user(u.name); v != nil {
+			v.TailscaleLogin = u.tailscaleLogin
+			v.Role = u.role
+		} else {
+			c.Users = append(c.Users, userConfig{Name: u.name, TailscaleLogin: u.tailscaleLogin, Role: u.role})
+		}
+		return c.save(u.configPath)
+	}
+	fmt.Fprintf(os.Stderr, "Password for %s: ", u.name)
+	pwd, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && pwd == "" {
+		return err
+	}
+	pwd = strings.TrimRight(pwd, "\r\n")
+	if len(pwd) < 8 {
+		return errors.New("password must be at least 8 characters")
+	}
+	h, err := bcrypt.GenerateFromPassword([]byte(pwd), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	if v := c.user(u.name); v != nil {
+		v.PasswordHash = string(h)
+		v.Role = u.role
+	} else {
+		c.Users = append(c.Users, userConfig{Name: u.name, PasswordHash: string(h), Role: u.role})
+	}
+	return c.save(u.configPath)
+}
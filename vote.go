@@ -0,0 +1,353 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// restartVote lets the connected players request a restart of their server
+// at /vote/<unit>.
+type restartVote struct {
+	// Quorum is the number of distinct players who must vote within Window.
+	// Defaults to 3.
+	Quorum int `json:"quorum,omitempty"`
+	// Window defaults to 10 minutes.
+	Window duration `json:"window,omitempty"`
+	// Veto is how long the operators have to veto a passed vote before the
+	// restart starts. Defaults to 5 minutes.
+	Veto duration `json:"veto,omitempty"`
+	// Warning is how long the players are warned before the restart. Defaults
+	// to 5 minutes.
+	Warning duration `json:"warning,omitempty"`
+}
+
+func (r *restartVote) quorum() int {
+	if r.Quorum <= 0 {
+		return 3
+	}
+	return r.Quorum
+}
+
+func (r *restartVote) window() time.Duration {
+	if r.Window <= 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(r.Window)
+}
+
+func (r *restartVote) veto() time.Duration {
+	if r.Veto <= 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(r.Veto)
+}
+
+func (r *restartVote) warning() time.Duration {
+	if r.Warning <= 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(r.Warning)
+}
+
+const (
+	// voteCodeTTL is how long the code whispered to a voter is valid.
+	voteCodeTTL = 5 * time.Minute
+)
+
+// votePolicy bounds the POSTs to the vote pages per client IP, each asking
+// for a code over RCON or trying one.
+var votePolicy = authLockout{MaxFailures: 10, Window: duration(10 * time.Minute), Duration: duration(10 * time.Minute)}
+
+// voteCode is the code whispered in-game to confirm a vote.
+type voteCode struct {
+	code    string
+	expires time.Time
+}
+
+// restartVotes tracks the votes per unit. It is kept in memory; a restart of
+// ark-serman resets the votes.
+type restartVotes struct {
+	mu sync.Mutex
+	// votes is the last vote time per Steam ID, per unit.
+	votes map[string]map[string]time.Time
+	// codes are the confirmation codes sent, per unit and Steam ID.
+	codes map[string]voteCode
+	// pending is when the server restarts after a passed vote, per unit.
+	pending map[string]time.Time
+	vetoes  map[string]chan struct{}
+}
+
+// newCode returns a new confirmation code for the player's vote, replacing
+// the previous one.
+func (r *restartVotes) newCode(unit, steamID string, now time.Time) string {
+	n, _ := rand.Int(rand.Reader, big.NewInt(1000000))
+	code := fmt.Sprintf("%06d", n)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.codes == nil {
+		r.codes = map[string]voteCode{}
+	}
+	for k, c := range r.codes {
+		if now.After(c.expires) {
+			delete(r.codes, k)
+		}
+	}
+	r.codes[unit+"\x00"+steamID] = voteCode{code: code, expires: now.Add(voteCodeTTL)}
+	return code
+}
+
+// checkCode returns true if code is the player's unexpired code. A code is
+// only tried once.
+func (r *restartVotes) checkCode(unit, steamID, code string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k := unit + "\x00" + steamID
+	c, ok := r.codes[k]
+	delete(r.codes, k)
+	return ok && now.Before(c.expires) && subtle.ConstantTimeCompare([]byte(c.code), []byte(code)) == 1
+}
+
+// add records the vote and returns the number of distinct votes within the
+// window. It returns 0 if a restart is already pending.
+func (r *restartVotes) add(unit, steamID string, window time.Duration) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.pending[unit]; ok {
+		return 0
+	}
+	if r.votes == nil {
+		r.votes = map[string]map[string]time.Time{}
+	}
+	m := r.votes[unit]
+	if m == nil {
+		m = map[string]time.Time{}
+		r.votes[unit] = m
+	}
+	now := time.Now()
+	m[steamID] = now
+	for k, t := range m {
+		if now.Sub(t) > window {
+			delete(m, k)
+		}
+	}
+	return len(m)
+}
+
+// pass clears the votes and marks the restart as pending until at. The
+// returned channel is closed on veto.
+func (r *restartVotes) pass(unit string, at time.Time) chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.votes, unit)
+	if r.pending == nil {
+		r.pending = map[string]time.Time{}
+		r.vetoes = map[string]chan struct{}{}
+	}
+	ch := make(chan struct{})
+	r.pending[unit] = at
+	r.vetoes[unit] = ch
+	return ch
+}
+
+// veto cancels the pending restart. It returns false if there was none.
+func (r *restartVotes) veto(unit string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ch, ok := r.vetoes[unit]
+	if !ok {
+		return false
+	}
+	close(ch)
+	delete(r.pending, unit)
+	delete(r.vetoes, unit)
+	return true
+}
+
+// finish clears the pending restart once the veto period is over. It returns
+// false if it was vetoed in the meantime.
+func (r *restartVotes) finish(unit string, ch chan struct{}) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.vetoes[unit] != ch {
+		return false
+	}
+	delete(r.pending, unit)
+	delete(r.vetoes, unit)
+	return true
+}
+
+// pendingAt returns when the servers restart after a passed vote, per unit.
+func (r *restartVotes) pendingAt() map[string]time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make(map[string]time.Time, len(r.pending))
+	for k, v := range r.pending {
+		out[k] = v
+	}
+	return out
+}
+
+var voteTmpl = template.Must(template.ParseFS(rsc, "rsc/vote.html.tmpl"))
+
+// serveVote serves the public restart vote at /vote/<unit>. Only the players
+// connected to the server can vote: the vote is confirmed with a code
+// whispered to the player in-game, as anyone may know a player's Steam ID.
+func (s *webServer) serveVote(w http.ResponseWriter, r *http.Request) {
+	unit := path.Base(r.URL.Path)
+	c := s.config()
+	v := c.serverByUnit(unit)
+	if c.RestartVote == nil || v == nil {
+		http.NotFound(w, r)
+		return
+	}
+	rv := c.RestartVote
+	w.Header().Add("Content-Type", "text/html")
+	data := map[string]any{"Server": v.SessionName, "Quorum": rv.quorum(), "Window": rv.window()}
+	if r.Method == "POST" {
+		steamID := strings.TrimSpace(r.FormValue("steam_id"))
+		code := strings.TrimSpace(r.FormValue("code"))
+		now := time.Now()
+		key := "vote:" + clientIP(r)
+		var msg string
+		var err error
+		if !s.voteRate.lockedUntil(now, key).IsZero() {
+			w.WriteHeader(http.StatusTooManyRequests)
+			err = errors.New("too many attempts, try again later")
+		} else {
+			s.voteRate.add(now, votePolicy, key)
+			if code == "" {
+				if msg, err = s.sendVoteCode(c, v, steamID, now); err == nil {
+					data["SteamID"] = steamID
+				}
+			} else {
+				msg, err = s.vote(c, v, steamID, code, now)
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusForbidden)
+			}
+		}
+		if err != nil {
+			data["Err"] = err.Error()
+		}
+		data["Result"] = msg
+	}
+	if at, ok := s.votes.pendingAt()[unit]; ok {
+		data["Pending"] = at.In(c.location()).Format(time.Kitchen)
+	}
+	_ = voteTmpl.Execute(w, data)
+}
+
+// connectedPlayer returns the name of the player connected to the server, as
+// of the last poll.
+func (s *webServer) connectedPlayer(c *config, v *serverConfig, steamID string) (string, error) {
+	p, err := s.rconPoller(c, v)
+	if err != nil {
+		return "", err
+	}
+	l, ok := p.Last(v.gameInfo().ListPlayers)
+	if !ok || l.Err != nil {
+		return "", errors.New("the connected players are unknown, try again later")
+	}
+	for _, pl := range v.gameInfo().parsePlayers(l.Resp) {
+		if steamID != "" && pl.SteamID == steamID {
+			return pl.Name, nil
+		}
+	}
+	return "", errors.New("only the players connected to the server can vote")
+}
+
+// sendVoteCode whispers a confirmation code to the connected player.
+func (s *webServer) sendVoteCode(c *config, v *serverConfig, steamID string, now time.Time) (string, error) {
+	if _, err := s.connectedPlayer(c, v, steamID); err != nil {
+		return "", err
+	}
+	p, err := s.rconPoller(c, v)
+	if err != nil {
+		return "", err
+	}
+	code := s.votes.newCode(v.unitName(), steamID, now)
+	ctx, cancel := context.WithTimeout(s.ctx, 15*time.Second)
+	defer cancel()
+	if _, err := p.Execute(ctx, "ServerChatTo \""+steamID+"\" Your restart vote code is "+code); err != nil {
+		return "", errors.New("the code couldn't be sent, try again later")
+	}
+	return fmt.Sprintf("A code was sent to you in the game's chat; enter it within %s to confirm your vote.", voteCodeTTL), nil
+}
+
+// vote records the vote confirmed with the code and starts the veto period
+// once the quorum is reached.
+func (s *webServer) vote(c *config, v *serverConfig, steamID, code string, now time.Time) (string, error) {
+	name, err := s.connectedPlayer(c, v, steamID)
+	if err != nil {
+		return "", err
+	}
+	if !s.votes.checkCode(v.unitName(), steamID, code, now) {
+		return "", errors.New("invalid or expired code, ask for a new one")
+	}
+	rv := c.RestartVote
+	unit := v.unitName()
+	n := s.votes.add(unit, steamID, rv.window())
+	if n == 0 {
+		return "A restart is already scheduled.", nil
+	}
+	log.Printf("vote: %s voted to restart %s (%d/%d)", name, v.Name, n, rv.quorum())
+	if n < rv.quorum() {
+		s.broadcast(s.ctx, v, fmt.Sprintf("%s voted to restart the server (%d/%d).", name, n, rv.quorum()))
+		return fmt.Sprintf("Vote recorded, %d/%d.", n, rv.quorum()), nil
+	}
+	veto := s.votes.pass(unit, time.Now().Add(rv.veto()+rv.warning()))
+	bus.publish(event{Unit: unit, Kind: evRestartVote, Msg: fmt.Sprintf("%d players voted to restart %s; it restarts in %s unless vetoed", n, v.SessionName, rv.veto()+rv.warning())})
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-veto:
+			s.broadcast(s.ctx, v, "The restart vote was vetoed by an admin.")
+			return
+		case <-time.After(rv.veto()):
+		}
+		if !s.votes.finish(unit, veto) {
+			return
+		}
+		s.audit(auditEntry{Time: time.Now(), User: "vote", Action: "restart", Target: unit, Status: http.StatusOK, Detail: fmt.Sprintf("%d votes", n)})
+		if err := s.gracefulRestart(withLockOwner(s.ctx, "vote", true), v, rv.warning()); err != nil {
+			log.Printf("vote: %s: %v", v.Name, err)
+		}
+	}()
+	return "The vote passed, the server restarts soon.", nil
+}
+
+// rpcVeto cancels the pending restart of a passed vote.
+func (s *webServer) rpcVeto(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	u := userFrom(r.Context())
+	if s.readOnly || u.readOnly || !u.hasRole(roleOperator) {
+		http.Error(w, "permission denied", http.StatusForbidden)
+		return
+	}
+	unit := path.Base(r.URL.Path)
+	if !s.votes.veto(unit) {
+		http.Error(w, "no pending restart vote", http.StatusNotFound)
+		return
+	}
+	bus.publish(event{Unit: unit, Kind: evRestartVote, Msg: "the restart vote was vetoed by " + u.Name})
+	http.Redirect(w, r, "/", http.StatusFound)
+}
@@ -0,0 +1,78 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maruel/ark-serman/internal/rconpool"
+)
+
+func TestVoteCode(t *testing.T) {
+	now := time.Now()
+	data := []struct {
+		name    string
+		unit    string
+		steamID string
+		code    func(code string) string
+		at      time.Time
+		want    bool
+	}{
+		{"valid", "a", "1", func(c string) string { return c }, now, true},
+		{"other player", "a", "2", func(c string) string { return c }, now, false},
+		{"other server", "b", "1", func(c string) string { return c }, now, false},
+		{"wrong", "a", "1", func(c string) string { return c + "0" }, now, false},
+		{"expired", "a", "1", func(c string) string { return c }, now.Add(voteCodeTTL + time.Second), false},
+	}
+	for _, l := range data {
+		t.Run(l.name, func(t *testing.T) {
+			r := restartVotes{}
+			code := r.newCode("a", "1", now)
+			if len(code) != 6 {
+				t.Fatalf("code %q", code)
+			}
+			if got := r.checkCode(l.unit, l.steamID, l.code(code), l.at); got != l.want {
+				t.Fatalf("got %t", got)
+			}
+			// A code is tried once; the other players' tries don't consume it.
+			if got := r.checkCode("a", "1", code, now); got != (l.unit != "a" || l.steamID != "1") {
+				t.Fatalf("second try: got %t", got)
+			}
+		})
+	}
+}
+
+func TestVoteRateLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &config{
+		Servers:     []serverConfig{{Name: "island", SessionName: "The Island"}},
+		RestartVote: &restartVote{},
+	}
+	s := &webServer{ctx: ctx, ports: newPortMapper(), publicIP: &publicIP{}, rcon: rconpool.New(ctx)}
+	s.setConfig(c)
+	unit := c.Servers[0].unitName()
+	for i := 0; i < 12; i++ {
+		r := httptest.NewRequest("POST", "/vote/"+unit, strings.NewReader(url.Values{"steam_id": {"76561198000000000"}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = "203.0.113.7:1234"
+		w := httptest.NewRecorder()
+		s.serveVote(w, r)
+		// The server isn't reachable over RCON.
+		want := http.StatusForbidden
+		if i >= votePolicy.MaxFailures {
+			want = http.StatusTooManyRequests
+		}
+		if w.Code != want {
+			t.Fatalf("#%d: got %d, want %d", i, w.Code, want)
+		}
+	}
+}
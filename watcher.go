@@ -0,0 +1,76 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// watchInterval is how often the unit states are polled for changes.
+const watchInterval = 15 * time.Second
+
+// watchUnits publishes lifecycle events when the units change state, including
+// changes done outside of ark-serman, and player join/leave events from the
+// ListPlayers polling.
+func (s *webServer) watchUnits(ctx context.Context) {
+	prev := map[string]string{}
+	players := map[string]map[string]player{}
+	first := true
+	for {
+		if u, err := s.states(ctx); err != nil {
+			log.Printf("watch: %v", err)
+		} else {
+			s.mu.Lock()
+			s.lastStates = u
+			s.lastStatesTime = time.Now()
+			s.mu.Unlock()
+			for _, v := range u {
+				old, ok := prev[v.Name]
+				prev[v.Name] = v.ActiveState
+				if !first && ok && old != v.ActiveState {
+					switch {
+					case v.ActiveState == "active":
+						bus.publish(event{Unit: v.Name, Kind: evStarted, Msg: v.DisplayName + " is running"})
+					case v.ActiveState == "failed", v.SubState == "auto-restart":
+						// Restart=on-failure restarts the crashed servers.
+						s.publishCrash(ctx, &v)
+					case v.ActiveState == "inactive":
+						bus.publish(event{Unit: v.Name, Kind: evStopped, Msg: v.DisplayName + " stopped"})
+					}
+				}
+				if !v.HasPlayers {
+					continue
+				}
+				cur := map[string]player{}
+				for _, p := range v.Players {
+					cur[p.SteamID] = p
+				}
+				if old, ok := players[v.Name]; ok {
+					for id, p := range cur {
+						if _, ok := old[id]; !ok {
+							p := p
+							bus.publish(event{Unit: v.Name, Kind: evPlayerJoined, Msg: p.Name + " joined " + v.DisplayName, Player: &p})
+						}
+					}
+					for id, p := range old {
+						if _, ok := cur[id]; !ok {
+							p := p
+							bus.publish(event{Unit: v.Name, Kind: evPlayerLeft, Msg: p.Name + " left " + v.DisplayName, Player: &p})
+						}
+					}
+				}
+				players[v.Name] = cur
+			}
+			first = false
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchInterval):
+		}
+	}
+}
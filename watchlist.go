@@ -0,0 +1,166 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// watchEntry is a flagged player, e.g. a suspected cheater.
+type watchEntry struct {
+	SteamID string `json:"steam_id"`
+	// Name is the name the player was known as when flagged.
+	Name   string `json:"name,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Author is the admin who flagged the player.
+	Author string    `json:"author,omitempty"`
+	Added  time.Time `json:"added"`
+	// LastSeen is when the player last joined a managed server.
+	LastSeen time.Time `json:"last_seen,omitempty"`
+}
+
+// watchlist returns the flagged players, sorted by Steam ID.
+func (s *store) watchlist() ([]watchEntry, error) {
+	out := []watchEntry{}
+	err := s.scanPrefix(bucketWatchlist, nil, func(k, v []byte) {
+		e := watchEntry{}
+		if json.Unmarshal(v, &e) == nil {
+			out = append(out, e)
+		}
+	})
+	return out, err
+}
+
+// purgeWatchlist removes the players flagged and last seen before t, along
+// with the admins' notes about them. A flagged player who keeps joining stays.
+func (s *store) purgeWatchlist(t time.Time) (int, error) {
+	return s.purgeIf(bucketWatchlist, func(v []byte) bool {
+		e := watchEntry{}
+		return json.Unmarshal(v, &e) == nil && e.Added.Before(t) && e.LastSeen.Before(t)
+	})
+}
+
+// seenWatched records that the flagged player joined at t. It returns the
+// entry, or false if the player isn't flagged.
+func (s *store) seenWatched(steamID string, t time.Time) (watchEntry, bool, error) {
+	e := watchEntry{}
+	found := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketWatchlist)
+		v := b.Get([]byte(steamID))
+		if v == nil {
+			return nil
+		}
+		if err := json.Unmarshal(v, &e); err != nil {
+			return err
+		}
+		found = true
+		e.LastSeen = t.UTC()
+		v, err := json.Marshal(&e)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(steamID), v)
+	})
+	return e, found, err
+}
+
+// markWatched sets Watched on the flagged players.
+func (s *store) markWatched(players []player) error {
+	l, err := s.watchlist()
+	if err != nil {
+		return err
+	}
+	m := make(map[string]bool, len(l))
+	for _, e := range l {
+		m[e.SteamID] = true
+	}
+	for i := range players {
+		players[i].Watched = m[players[i].SteamID]
+	}
+	return nil
+}
+
+// watchPlayers publishes evWatchedJoined when a flagged player joins a
+// managed server. Used as a bus consumer.
+func (s *webServer) watchPlayers(ev event) {
+	if ev.Kind != evPlayerJoined || ev.Player == nil {
+		return
+	}
+	e, ok, err := s.db.seenWatched(ev.Player.SteamID, ev.Time)
+	if err != nil {
+		log.Printf("watchlist: %v", err)
+		return
+	}
+	if !ok {
+		return
+	}
+	p := *ev.Player
+	p.Watched = true
+	msg := "watched player " + p.Name + " (" + p.SteamID + ") joined"
+	if v := s.config().serverByUnit(ev.Unit); v != nil {
+		msg += " " + v.SessionName
+	}
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	bus.publish(event{Unit: ev.Unit, Kind: evWatchedJoined, Msg: msg, Player: &p})
+}
+
+var watchlistTmpl = template.Must(template.ParseFS(rsc, "rsc/watchlist.html.tmpl"))
+
+// serveWatchlist serves the flagged players at /watchlist/. The changes are
+// POSTed to /rpc/watchlist to be recorded in the audit log.
+func (s *webServer) serveWatchlist(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "text/html")
+	data := map[string]any{}
+	if r.Method == "POST" && r.URL.Path == "/rpc/watchlist" {
+		if err := s.editWatchlist(r); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			data["Err"] = err.Error()
+		}
+	}
+	l, err := s.db.watchlist()
+	if err != nil {
+		data["Err"] = err.Error()
+	}
+	loc := s.config().displayLocation(userFrom(r.Context()))
+	for i := range l {
+		l[i].Added = l[i].Added.In(loc)
+		l[i].LastSeen = l[i].LastSeen.In(loc)
+	}
+	data["Watchlist"] = l
+	_ = watchlistTmpl.Execute(w, data)
+}
+
+// editWatchlist flags or unflags a player. Only admins can.
+func (s *webServer) editWatchlist(r *http.Request) error {
+	u := userFrom(r.Context())
+	if !u.hasRole(roleAdmin) {
+		return errors.New("only admins can edit the watchlist")
+	}
+	e := watchEntry{SteamID: strings.TrimSpace(r.FormValue("steam_id"))}
+	setAuditDetail(r.Context(), r.FormValue("op")+" "+e.SteamID)
+	if _, err := strconv.ParseUint(e.SteamID, 10, 64); err != nil {
+		return errors.New("steam_id: expected a Steam ID")
+	}
+	if r.FormValue("op") == "remove" {
+		return s.db.del(bucketWatchlist, []byte(e.SteamID))
+	}
+	e.Name = strings.TrimSpace(r.FormValue("name"))
+	e.Reason = strings.TrimSpace(r.FormValue("reason"))
+	e.Author = u.Name
+	e.Added = time.Now().UTC()
+	return s.db.put(bucketWatchlist, []byte(e.SteamID), e)
+}
@@ -0,0 +1,48 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPurgeWatchlist(t *testing.T) {
+	s, err := openStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	now := time.Now().UTC()
+	for i, d := range []time.Duration{0, 10 * 24 * time.Hour, 100 * 24 * time.Hour} {
+		e := watchEntry{SteamID: "7656119800000000" + strconv.Itoa(i), Reason: "griefing", Added: now.Add(-d)}
+		if err := s.put(bucketWatchlist, []byte(e.SteamID), e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Flagged long ago but still joining.
+	e := watchEntry{SteamID: "76561198000000003", Added: now.Add(-200 * 24 * time.Hour)}
+	if err := s.put(bucketWatchlist, []byte(e.SteamID), e); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := s.seenWatched(e.SteamID, now.Add(-24*time.Hour)); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if _, ok, err := s.seenWatched("76561198000000009", now); ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	n, err := s.purgeWatchlist(now.Add(-30 * 24 * time.Hour))
+	if err != nil || n != 1 {
+		t.Fatalf("purged %d, %v", n, err)
+	}
+	l, err := s.watchlist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l) != 3 || l[0].SteamID != "76561198000000000" || l[1].SteamID != "76561198000000001" || l[2].SteamID != "76561198000000003" {
+		t.Fatalf("got %+v", l)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webhookConfig is an outgoing webhook receiving the events as JSON.
+type webhookConfig struct {
+	// URL is the http(s):// URL the events are POSTed to.
+	URL string `json:"url"`
+	// Secret, when set, signs the body with HMAC-SHA256. The signature is sent
+	// as "X-Ark-Serman-Signature: sha256=<hex>".
+	Secret string `json:"secret,omitempty"`
+	// Events are the event kinds to send, e.g. "started", "stopped",
+	// "crashed". All the events are sent when empty.
+	Events []string `json:"events,omitempty"`
+}
+
+// eventKinds are the valid values for webhookConfig.Events.
+var eventKinds = []string{evStarted, evStopped, evCrashed, evStalled, evPlayerJoined, evPlayerLeft, evFirstJoin, evWatchedJoined, evRestartVote, evBackupDone, evUpdateAvailable, evStats, evSlowSave, evOOMKilled, evSwapping, evStepFailed}
+
+// wants returns true if the webhook subscribed to the event kind.
+func (h *webhookConfig) wants(kind string) bool {
+	return len(h.Events) == 0 || slices.Contains(h.Events, kind)
+}
+
+// webhookPayload is the JSON body of a webhook delivery.
+type webhookPayload struct {
+	event
+	// Server is the server name, when the event is about a server.
+	Server string `json:"server,omitempty"`
+}
+
+// webhookAttempts is the number of delivery attempts, 5s apart then doubling.
+const webhookAttempts = 5
+
+// sendWebhooks delivers the event to the subscribed webhooks. Used as a bus
+// consumer.
+func (s *webServer) sendWebhooks(ev event) {
+	c := s.config()
+	if len(c.Webhooks) == 0 {
+		return
+	}
+	p := webhookPayload{event: ev, Server: strings.TrimSuffix(strings.TrimPrefix(ev.Unit, "ark-"), ".service")}
+	b, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("webhook: %v", err)
+		return
+	}
+	for i := range c.Webhooks {
+		h := c.Webhooks[i]
+		if h.wants(ev.Kind) {
+			go s.deliverWebhook(s.ctx, &h, ev.Kind, b)
+		}
+	}
+}
+
+// notifyNow delivers the event to the subscribed webhooks and returns once
+// delivered, for the commands exiting right after, which have no bus
+// consumer.
+func (s *webServer) notifyNow(ctx context.Context, ev event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	c := s.config()
+	p := webhookPayload{event: ev, Server: strings.TrimSuffix(strings.TrimPrefix(ev.Unit, "ark-"), ".service")}
+	b, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("webhook: %v", err)
+		return
+	}
+	var wg sync.WaitGroup
+	for i := range c.Webhooks {
+		h := c.Webhooks[i]
+		if h.wants(ev.Kind) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.deliverWebhook(ctx, &h, ev.Kind, b)
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// deliverWebhook POSTs the body, retrying on network errors and 5xx or 429
+// responses.
+func (s *webServer) deliverWebhook(ctx context.Context, h *webhookConfig, kind string, b []byte) {
+	delay := 5 * time.Second
+	for i := 0; ; i++ {
+		retry, err := postWebhook(ctx, h, kind, b)
+		if err == nil {
+			return
+		}
+		if !retry || i == webhookAttempts-1 {
+			log.Printf("webhook %s: giving up on %s event: %v", h.URL, kind, err)
+			return
+		}
+		log.Printf("webhook %s: %v; retrying in %s", h.URL, err, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// postWebhook sends one delivery attempt. It returns true if the error is
+// worth retrying.
+func postWebhook(ctx context.Context, h *webhookConfig, kind string, b []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", h.URL, bytes.NewReader(b))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ark-serman")
+	req.Header.Set("X-Ark-Serman-Event", kind)
+	if h.Secret != "" {
+		m := hmac.New(sha256.New, []byte(h.Secret))
+		m.Write(b)
+		req.Header.Set("X-Ark-Serman-Signature", "sha256="+hex.EncodeToString(m.Sum(nil)))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("status %s", resp.Status)
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
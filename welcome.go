@@ -0,0 +1,153 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// playerRecord is what is known about a player who ever joined a managed
+// server, keyed by Steam ID in bucketPlayers.
+type playerRecord struct {
+	Name      string    `json:"name"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// welcomeDelay lets the player finish loading before the message is sent,
+// otherwise it is lost.
+const welcomeDelay = 30 * time.Second
+
+// seePlayer records that the player joined and returns true the first time.
+func (s *store) seePlayer(p *player, t time.Time) (bool, error) {
+	first := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketPlayers)
+		r := playerRecord{Name: p.Name, FirstSeen: t}
+		if v := b.Get([]byte(p.SteamID)); v != nil {
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			r.Name = p.Name
+		} else {
+			first = true
+		}
+		r.LastSeen = t
+		v, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(p.SteamID), v)
+	})
+	return first, err
+}
+
+// parseWelcome parses a welcome message template.
+func parseWelcome(w string) (*template.Template, error) {
+	return template.New("").Option("missingkey=error").Parse(w)
+}
+
+// purgePlayers forgets the players not seen since t.
+func (s *store) purgePlayers(t time.Time) (int, error) {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketPlayers)
+		var keys [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			r := playerRecord{}
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			if r.LastSeen.Before(t) {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(keys)
+		return nil
+	})
+	return n, err
+}
+
+// welcomeMsg renders the server's welcome message, if any.
+func (c *config) welcomeMsg(v *serverConfig, p *player) (string, error) {
+	w := v.Welcome
+	if w == "" {
+		w = c.Welcome
+	}
+	if w == "" {
+		return "", nil
+	}
+	t, err := parseWelcome(w)
+	if err != nil {
+		return "", err
+	}
+	b := strings.Builder{}
+	err = t.Execute(&b, map[string]string{"Name": p.Name, "Server": v.SessionName})
+	return b.String(), err
+}
+
+// welcomePlayers publishes evFirstJoin the first time a player joins any
+// managed server and sends them the welcome message. Used as a bus consumer.
+func (s *webServer) welcomePlayers(ev event) {
+	if ev.Kind != evPlayerJoined || ev.Player == nil {
+		return
+	}
+	first, err := s.db.seePlayer(ev.Player, ev.Time)
+	if err != nil {
+		log.Printf("welcome: %v", err)
+		return
+	}
+	if !first {
+		return
+	}
+	c := s.config()
+	v := c.serverByUnit(ev.Unit)
+	if v == nil {
+		return
+	}
+	p := *ev.Player
+	bus.publish(event{Unit: ev.Unit, Kind: evFirstJoin, Msg: p.Name + " joined " + v.SessionName + " for the first time", Player: &p})
+	msg, err := c.welcomeMsg(v, &p)
+	if err != nil {
+		log.Printf("welcome: %s: %v", v.Name, err)
+		return
+	}
+	if msg == "" {
+		return
+	}
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(welcomeDelay):
+		}
+		r, err := s.rconPoller(s.config(), v)
+		if err != nil {
+			log.Printf("welcome: %s: %v", v.Name, err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(s.ctx, 15*time.Second)
+		defer cancel()
+		if _, err := r.Execute(ctx, "ServerChatTo \""+p.SteamID+"\" "+msg); err != nil {
+			log.Printf("welcome: %s: %v", v.Name, err)
+		}
+	}()
+}
@@ -0,0 +1,221 @@
+// Copyright 2023 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// breakingUpdate is a game update known to break the mods not updated since.
+type breakingUpdate struct {
+	Version string `json:"version"`
+	// Released is the day of the update, as "YYYY-MM-DD".
+	Released string `json:"released"`
+}
+
+// workshopItem is the metadata of a Steam Workshop item.
+type workshopItem struct {
+	ID    string
+	Title string
+	// Found is false for the items that don't exist or were removed.
+	Found   bool
+	Banned  bool
+	Updated time.Time
+}
+
+// getWorkshopItems queries the Steam Web API for the items' metadata.
+func getWorkshopItems(ctx context.Context, ids []string) (map[string]workshopItem, error) {
+	f := url.Values{"itemcount": {strconv.Itoa(len(ids))}}
+	for i, id := range ids {
+		f.Set("publishedfileids["+strconv.Itoa(i)+"]", id)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://api.steampowered.com/ISteamRemoteStorage/GetPublishedFileDetails/v1/", strings.NewReader(f.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("steam workshop: %s", resp.Status)
+	}
+	data := struct {
+		Response struct {
+			Details []struct {
+				ID          string `json:"publishedfileid"`
+				Result      int    `json:"result"`
+				Title       string `json:"title"`
+				Banned      int    `json:"banned"`
+				TimeUpdated int64  `json:"time_updated"`
+			} `json:"publishedfiledetails"`
+		} `json:"response"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	out := map[string]workshopItem{}
+	for _, d := range data.Response.Details {
+		// Result 1 is k_EResultOK; 9 (not found) for removed items.
+		out[d.ID] = workshopItem{ID: d.ID, Title: d.Title, Found: d.Result == 1, Banned: d.Banned != 0, Updated: time.Unix(d.TimeUpdated, 0)}
+	}
+	return out, nil
+}
+
+// modIDs returns the workshop IDs used by the servers, sorted.
+func (c *config) modIDs() []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, s := range c.Servers {
+		for _, m := range append(append([]string(nil), s.Mods...), s.TotalConversionMod) {
+			if m != "" && !seen[m] {
+				seen[m] = true
+				out = append(out, m)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// latestBreakingUpdate returns the most recent breaking update, if any.
+func (c *config) latestBreakingUpdate() (*breakingUpdate, time.Time) {
+	var best *breakingUpdate
+	var bestT time.Time
+	for i := range c.BreakingUpdates {
+		t, err := time.Parse("2006-01-02", c.BreakingUpdates[i].Released)
+		if err == nil && t.After(bestT) {
+			best, bestT = &c.BreakingUpdates[i], t
+		}
+	}
+	return best, bestT
+}
+
+// modWarnings returns the mods not updated on the Workshop since the latest
+// breaking game update.
+func modWarnings(c *config, items map[string]workshopItem) []string {
+	b, released := c.latestBreakingUpdate()
+	if b == nil {
+		return nil
+	}
+	var out []string
+	for _, id := range c.modIDs() {
+		it, ok := items[id]
+		if !ok || !it.Found || !it.Updated.Before(released) {
+			continue
+		}
+		out = append(out, fmt.Sprintf("mod %s (%s) was last updated on %s, before the breaking game update %s of %s", id, it.Title, it.Updated.UTC().Format("2006-01-02"), b.Version, b.Released))
+	}
+	return out
+}
+
+// checkUpdate is called before updating the game or the mods. It fails when
+// the updates are held or steamcmd can't log in without prompting, and logs
+// the mods likely broken by a game update so the admins can hold the updates
+// with hold_updates.
+func checkUpdate(ctx context.Context, c *config, logf func(string, ...any)) error {
+	if c.HoldUpdates != "" {
+		return fmt.Errorf("updates are held: %s", c.HoldUpdates)
+	}
+	if err := checkSteamLogin(ctx, c); err != nil {
+		return err
+	}
+	if len(c.BreakingUpdates) == 0 {
+		return nil
+	}
+	ids := c.modIDs()
+	if len(ids) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	items, err := getWorkshopItems(ctx, ids)
+	if err != nil {
+		// Best effort; don't block the update when Steam is down.
+		logf("mod compatibility: %v", err)
+		return nil
+	}
+	for _, w := range modWarnings(c, items) {
+		logf("warning: %s", w)
+	}
+	return nil
+}
+
+// workshopCache caches the metadata of the configured mods for the web UI.
+type workshopCache struct {
+	mu      sync.Mutex
+	key     string
+	updated time.Time
+	items   map[string]workshopItem
+	err     error
+}
+
+// get queries the Steam Web API at most every hour or when the mods change.
+func (w *workshopCache) get(ctx context.Context, ids []string) (map[string]workshopItem, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	key := strings.Join(ids, ",")
+	if w.key == key && time.Since(w.updated) < time.Hour {
+		return w.items, w.err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	w.key = key
+	w.updated = time.Now()
+	w.items, w.err = getWorkshopItems(ctx, ids)
+	if w.err != nil {
+		log.Printf("workshop: %v", w.err)
+	}
+	return w.items, w.err
+}
+
+// modWarnings returns the configured mods likely broken by the latest
+// breaking game update, for the web UI.
+func (s *webServer) modWarnings(ctx context.Context) []string {
+	c := s.config()
+	ids := c.modIDs()
+	if len(c.BreakingUpdates) == 0 || len(ids) == 0 {
+		return nil
+	}
+	items, err := s.workshop.get(ctx, ids)
+	if err != nil {
+		return nil
+	}
+	return modWarnings(c, items)
+}
+
+// rpcHold sets or clears the hold_updates maintenance flag and saves the
+// configuration file.
+func (s *webServer) rpcHold(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	err := s.editConfig(func(c *config) error {
+		c.HoldUpdates = strings.TrimSpace(r.FormValue("reason"))
+		if r.FormValue("hold") == "1" && c.HoldUpdates == "" {
+			c.HoldUpdates = "held by " + userFrom(r.Context()).Name
+		}
+		setAuditDetail(r.Context(), c.HoldUpdates)
+		return nil
+	})
+	if err != nil {
+		replyError(w, err.Error())
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}